@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/oreonproject/defense/internal/tray"
@@ -15,15 +16,23 @@ import (
 
 var version = "0.1.0-dev"
 
+const socketPath = "/run/oreon/defense.sock"
+
 func main() {
 	fmt.Printf("Oreon Defense v%s\n", version)
 
+	// defense-ui --scan PATH... queues a custom scan and exits, for file
+	// manager actions
+	if len(os.Args) > 1 && os.Args[1] == "--scan" {
+		os.Exit(scanPaths(os.Args[2:]))
+	}
+
 	// Create a channel to listen for interrupt signals
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
 	// Initialize the IPC client (connects lazily on first call)
-	client := ipc.NewClient("/run/oreon/defense.sock")
+	client := ipc.NewClient(socketPath)
 
 	// Create and run the system tray
 	trayApp := tray.New(client)
@@ -47,3 +56,29 @@ func main() {
 	// Cleanup
 	client.Close()
 }
+
+// scanPaths asks the daemon to scan paths and returns the exit status.
+func scanPaths(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: defense-ui --scan PATH...")
+		return 2
+	}
+	for i, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", p, err)
+			return 1
+		}
+		paths[i] = abs
+	}
+
+	client := ipc.NewClient(socketPath)
+	defer client.Close()
+	resp, err := client.StartCustomScan(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "scan failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Scan started (%s)\n", resp.JobID)
+	return 0
+}
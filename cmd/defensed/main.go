@@ -9,10 +9,14 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/oreonproject/defense/internal/daemon"
+	"github.com/oreonproject/defense/internal/quarantine"
+	"github.com/oreonproject/defense/internal/scanner"
 	"github.com/oreonproject/defense/pkg/config"
+	"github.com/oreonproject/defense/pkg/logging"
 )
 
 var version = "0.1.0-dev"
@@ -46,6 +50,48 @@ func run(ctx context.Context, configPath, socketPath string) error {
 
 	slog.Info("config loaded", "path", configPath)
 
-	d := daemon.New(cfg, slog.Default())
+	opts := []daemon.Option{
+		daemon.WithConfigPath(configPath),
+		daemon.WithStatePath(config.FirewallStatePath),
+	}
+
+	store, err := openLogStore(cfg.Events.DatabasePath)
+	if err != nil {
+		// the daemon still works, it just can't keep a history
+		slog.Warn("event store unavailable", "path", cfg.Events.DatabasePath, "error", err)
+	} else {
+		defer store.Close()
+		opts = append(opts, daemon.WithLogStore(store))
+	}
+
+	vault, err := quarantine.Open(config.QuarantinePath)
+	if err != nil {
+		// threats are still found and reported, just left where they are
+		slog.Warn("quarantine unavailable", "path", config.QuarantinePath, "error", err)
+	} else {
+		defer vault.Close()
+		opts = append(opts, daemon.WithQuarantine(vault))
+	}
+
+	if cfg.Scanning.Cache {
+		cache, err := scanner.OpenVerdictCache(config.ScanCachePath)
+		if err != nil {
+			// scans just go through every file
+			slog.Warn("scan cache unavailable", "path", config.ScanCachePath, "error", err)
+		} else {
+			defer cache.Close()
+			opts = append(opts, daemon.WithScanCache(cache))
+		}
+	}
+
+	d := daemon.New(cfg, slog.Default(), opts...)
 	return d.Run(ctx, socketPath)
 }
+
+// openLogStore opens the SQLite event store, creating its directory.
+func openLogStore(path string) (*logging.LogStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return logging.NewLogStore(path)
+}
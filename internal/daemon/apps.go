@@ -0,0 +1,230 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/config"
+	"github.com/oreonproject/defense/pkg/events"
+)
+
+// appRefresh is how often blocked apps are matched against running
+// cgroups. Scopes come and go as apps start and stop, and a rule only
+// holds for the cgroup it was built for.
+const appRefresh = 5 * time.Second
+
+// AppInfo is a configured app block and the cgroups it currently covers.
+type AppInfo struct {
+	config.FirewallApp
+	Cgroups []string
+}
+
+// parseFirewallApp validates a configured app block and returns it in
+// canonical form.
+func parseFirewallApp(a config.FirewallApp) (config.FirewallApp, error) {
+	a.Cgroup = strings.Trim(strings.TrimSpace(a.Cgroup), "/")
+	a.Exe = strings.TrimSpace(a.Exe)
+
+	switch {
+	case a.Cgroup == "" && a.Exe == "":
+		return a, errors.New("app needs a cgroup or an exe")
+	case a.Cgroup != "" && a.Exe != "":
+		return a, errors.New("app takes a cgroup or an exe, not both")
+	case a.Exe != "":
+		if !filepath.IsAbs(a.Exe) {
+			return a, fmt.Errorf("exe %q is not an absolute path", a.Exe)
+		}
+		a.Exe = filepath.Clean(a.Exe)
+	default:
+		if _, err := filepath.Match(a.Cgroup, ""); err != nil {
+			return a, fmt.Errorf("invalid cgroup pattern %q", a.Cgroup)
+		}
+		for _, elem := range strings.Split(a.Cgroup, "/") {
+			if elem == "" || elem == "." || elem == ".." {
+				return a, fmt.Errorf("invalid cgroup path %q", a.Cgroup)
+			}
+		}
+	}
+	return a, nil
+}
+
+// sameFirewallApp reports whether two canonical app blocks match the same
+// thing. Comments don't count.
+func sameFirewallApp(a, b config.FirewallApp) bool {
+	a.Comment, b.Comment = "", ""
+	return a == b
+}
+
+// resolveApps matches the configured app blocks against the running
+// system. Must be called with fwMu held.
+func (d *Daemon) resolveApps() ([]firewall.AppRule, []AppInfo) {
+	var rules []firewall.AppRule
+	var infos []AppInfo
+	seen := make(map[string]bool)
+
+	for _, a := range d.cfg.Firewall.Apps {
+		info := AppInfo{FirewallApp: a}
+		a, err := parseFirewallApp(a)
+		if err != nil {
+			d.logger.Warn("skipping invalid app block", "error", err)
+			infos = append(infos, info)
+			continue
+		}
+
+		var cgroups []string
+		comment := a.Comment
+		if a.Exe != "" {
+			cgroups, err = d.cgroups.ForExe(a.Exe)
+			if comment == "" {
+				comment = a.Exe
+			}
+		} else {
+			cgroups, err = d.cgroups.Match(a.Cgroup)
+		}
+		if err != nil {
+			d.logger.Warn("failed to match app cgroups", "cgroup", a.Cgroup, "exe", a.Exe, "error", err)
+		}
+
+		for _, cg := range cgroups {
+			id, err := d.cgroups.ID(cg)
+			if err != nil {
+				// gone between matching and now
+				continue
+			}
+			info.Cgroups = append(info.Cgroups, cg)
+			if seen[cg] {
+				continue
+			}
+			seen[cg] = true
+			rules = append(rules, firewall.AppRule{Cgroup: cg, ID: id, Comment: comment})
+		}
+		infos = append(infos, info)
+	}
+	return rules, infos
+}
+
+// refreshApps reloads the app rules if the cgroups they cover changed.
+// Must be called with fwMu held.
+func (d *Daemon) refreshApps() error {
+	rules, _ := d.resolveApps()
+	if slices.Equal(rules, d.firewall.AppRules()) {
+		return nil
+	}
+	if err := d.firewall.SetAppRules(rules); err != nil {
+		return err
+	}
+	d.logger.Debug("blocked app cgroups changed", "cgroups", len(rules))
+	return nil
+}
+
+// watchApps keeps the app rules in step with running cgroups.
+func (d *Daemon) watchApps(ctx context.Context) {
+	ticker := time.NewTicker(d.appRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.fwMu.Lock()
+			err := d.refreshApps()
+			d.fwMu.Unlock()
+			if err != nil {
+				d.logger.Warn("failed to update blocked apps", "error", err)
+			}
+		}
+	}
+}
+
+// FirewallApps returns the configured app blocks and what each currently
+// covers.
+func (d *Daemon) FirewallApps() []AppInfo {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	_, infos := d.resolveApps()
+	return infos
+}
+
+// AddFirewallApp blocks outbound traffic from an app, applies it and
+// saves the config.
+func (d *Daemon) AddFirewallApp(a config.FirewallApp) error {
+	a, err := parseFirewallApp(a)
+	if err != nil {
+		return err
+	}
+	return d.editFirewallApps("app_add", func(apps []config.FirewallApp) ([]config.FirewallApp, error) {
+		for _, existing := range apps {
+			if c, err := parseFirewallApp(existing); err == nil && sameFirewallApp(c, a) {
+				return nil, errors.New("app already blocked")
+			}
+		}
+		return append(apps, a), nil
+	})
+}
+
+// RemoveFirewallApp unblocks an app. The comment is ignored when
+// matching.
+func (d *Daemon) RemoveFirewallApp(a config.FirewallApp) error {
+	a, err := parseFirewallApp(a)
+	if err != nil {
+		return err
+	}
+	return d.editFirewallApps("app_remove", func(apps []config.FirewallApp) ([]config.FirewallApp, error) {
+		for i, existing := range apps {
+			if c, err := parseFirewallApp(existing); err == nil && sameFirewallApp(c, a) {
+				return slices.Delete(apps, i, i+1), nil
+			}
+		}
+		return nil, errors.New("no matching app")
+	})
+}
+
+// editFirewallApps applies edit to the app blocks like editFirewallRules
+// does to port rules.
+func (d *Daemon) editFirewallApps(action string, edit func([]config.FirewallApp) ([]config.FirewallApp, error)) error {
+	return d.confirmable(func() error {
+		return d.applyAppEdit(action, edit)
+	})
+}
+
+func (d *Daemon) applyAppEdit(action string, edit func([]config.FirewallApp) ([]config.FirewallApp, error)) error {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	evt := events.StartFirewall(action).Profile(d.FirewallProfile())
+	defer func() {
+		d.events.Emit(evt.End())
+	}()
+
+	old := d.cfg.Firewall.Apps
+	apps, err := edit(slices.Clone(old))
+	if err != nil {
+		evt.SetError(err)
+		return err
+	}
+	d.cfg.Firewall.Apps = apps
+
+	if err := d.refreshApps(); err != nil {
+		d.cfg.Firewall.Apps = old
+		evt.SetError(err)
+		return err
+	}
+	if st, err := d.firewall.Status(); err == nil {
+		evt.RuleCount(st.Rules)
+	}
+
+	// saved along with the firewall state once confirmed
+	d.configDirty = true
+	d.logger.Info("blocked apps changed", "action", action, "apps", len(apps))
+	return nil
+}
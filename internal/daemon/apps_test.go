@@ -0,0 +1,144 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+const agentScope = "user.slice/user-1000.slice/user@1000.service/app.slice/app-agent-1.scope"
+
+func TestParseFirewallApp(t *testing.T) {
+	tests := []struct {
+		name    string
+		app     config.FirewallApp
+		want    config.FirewallApp
+		wantErr bool
+	}{
+		{
+			name: "cgroup slashes trimmed",
+			app:  config.FirewallApp{Cgroup: "/user.slice/user-*.slice/"},
+			want: config.FirewallApp{Cgroup: "user.slice/user-*.slice"},
+		},
+		{
+			name: "exe cleaned",
+			app:  config.FirewallApp{Exe: "/opt//vendor/bin/../bin/agent"},
+			want: config.FirewallApp{Exe: "/opt/vendor/bin/agent"},
+		},
+		{name: "neither", app: config.FirewallApp{Comment: "x"}, wantErr: true},
+		{name: "both", app: config.FirewallApp{Cgroup: "a.slice", Exe: "/bin/a"}, wantErr: true},
+		{name: "relative exe", app: config.FirewallApp{Exe: "bin/agent"}, wantErr: true},
+		{name: "bad pattern", app: config.FirewallApp{Cgroup: "user.slice/[x"}, wantErr: true},
+		{name: "parent element", app: config.FirewallApp{Cgroup: "user.slice/../system.slice"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFirewallApp(tt.app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeAgent sets up a cgroup hierarchy and procfs with the agent running
+// in its own scope.
+func fakeAgent(t *testing.T) firewall.Cgroups {
+	t.Helper()
+	c := firewall.Cgroups{Root: t.TempDir(), Proc: t.TempDir()}
+	if err := os.MkdirAll(filepath.Join(c.Root, agentScope), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pid := filepath.Join(c.Proc, "4242")
+	if err := os.MkdirAll(pid, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/opt/vendor/bin/agent", filepath.Join(pid, "exe")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pid, "cgroup"), []byte("0::/"+agentScope+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestAddFirewallApp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defense.toml")
+	cgroups := fakeAgent(t)
+	d := New(config.Default(), slog.Default(),
+		WithFirewallConn(firewall.NewMemConn()), WithConfigPath(path), WithCgroups(cgroups))
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+
+	agent := config.FirewallApp{Exe: "/opt/vendor/bin/agent", Comment: "telemetry"}
+	if err := d.AddFirewallApp(agent); err != nil {
+		t.Fatalf("AddFirewallApp() error = %v", err)
+	}
+	if err := d.AddFirewallApp(config.FirewallApp{Exe: "/opt/vendor/bin/agent"}); err == nil {
+		t.Error("duplicate app accepted")
+	}
+
+	rules := d.Firewall().AppRules()
+	if len(rules) != 1 || rules[0].Cgroup != agentScope || rules[0].Comment != "telemetry" {
+		t.Errorf("app rules = %+v, want the agent scope", rules)
+	}
+	infos := d.FirewallApps()
+	if len(infos) != 1 || len(infos[0].Cgroups) != 1 {
+		t.Errorf("FirewallApps() = %+v", infos)
+	}
+
+	saved, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apps := saved.Firewall.Apps; len(apps) != 1 || apps[0] != agent {
+		t.Errorf("saved apps = %+v, want the agent", apps)
+	}
+
+	if err := d.RemoveFirewallApp(config.FirewallApp{Exe: "/opt/vendor/bin/agent"}); err != nil {
+		t.Fatalf("RemoveFirewallApp() error = %v", err)
+	}
+	if rules := d.Firewall().AppRules(); len(rules) != 0 {
+		t.Errorf("app rules after remove = %+v", rules)
+	}
+}
+
+func TestRefreshApps(t *testing.T) {
+	cgroups := fakeAgent(t)
+	cfg := config.Default()
+	cfg.Firewall.Apps = []config.FirewallApp{{Cgroup: "user.slice/*/*/app.slice/app-agent-*.scope"}}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithCgroups(cgroups))
+
+	if rules := d.Firewall().AppRules(); len(rules) != 1 {
+		t.Fatalf("app rules at startup = %+v, want one", rules)
+	}
+
+	// the app restarts in a new scope
+	if err := os.Remove(filepath.Join(cgroups.Root, agentScope)); err != nil {
+		t.Fatal(err)
+	}
+	restarted := "user.slice/user-1000.slice/user@1000.service/app.slice/app-agent-2.scope"
+	if err := os.MkdirAll(filepath.Join(cgroups.Root, restarted), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d.fwMu.Lock()
+	err := d.refreshApps()
+	d.fwMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := d.Firewall().AppRules(); len(rules) != 1 || rules[0].Cgroup != restarted {
+		t.Errorf("app rules after restart = %+v, want %s", rules, restarted)
+	}
+}
@@ -0,0 +1,44 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"log/slog"
+	"net"
+	"os/user"
+	"strconv"
+
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/ipc"
+)
+
+// peerIdentity asks the kernel who is on the other end of an IPC
+// connection.
+func peerIdentity(conn net.Conn) (*scanner.Identity, error) {
+	uid, groups, err := ipc.PeerCred(conn)
+	if err != nil {
+		return nil, err
+	}
+	return scanner.NewIdentity(uid, groups...), nil
+}
+
+// isAdmin reports whether peer is root or in general.admin_group.
+func (d *Daemon) isAdmin(peer *scanner.Identity) bool {
+	if peer == nil {
+		return false
+	}
+	if peer.UID() == 0 {
+		return true
+	}
+	name := d.Config().General.AdminGroup
+	if name == "" {
+		return false
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		slog.Warn("admin group not found", "group", name, "error", err)
+		return false
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	return err == nil && peer.InGroup(uint32(gid))
+}
@@ -0,0 +1,118 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"slices"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/events"
+)
+
+// BlocklistInfo reports how a configured blocklist last loaded.
+type BlocklistInfo struct {
+	Name    string
+	Path    string
+	Entries int   // addresses and networks currently loaded
+	Skipped int   // lines that were neither, nor a comment
+	Err     error // reading failed; the previous contents, if any, stay loaded
+}
+
+// readBlocklists reads every configured blocklist. A list that can't be
+// read keeps whatever was loaded for it before, so a file being replaced
+// at the wrong moment doesn't unblock anything.
+func (d *Daemon) readBlocklists() ([]firewall.Blocklist, []BlocklistInfo) {
+	prev := make(map[string]firewall.Blocklist)
+	for _, b := range d.firewall.Blocklists() {
+		prev[b.Name] = b
+	}
+
+	var lists []firewall.Blocklist
+	var infos []BlocklistInfo
+	for _, c := range d.cfg.Firewall.Blocklists {
+		info := BlocklistInfo{Name: c.Name, Path: c.Path}
+		b, skipped, err := firewall.LoadBlocklist(c.Name, c.Path)
+		if err != nil {
+			info.Err = err
+			d.logger.Warn("failed to load blocklist", "name", c.Name, "path", c.Path, "error", err)
+			if old, ok := prev[c.Name]; ok {
+				b = old
+			} else {
+				infos = append(infos, info)
+				continue
+			}
+		} else if skipped > 0 {
+			d.logger.Warn("skipped unparseable blocklist lines", "name", c.Name, "lines", skipped)
+		}
+		info.Skipped = skipped
+		lists = append(lists, b)
+		infos = append(infos, info)
+	}
+	return lists, infos
+}
+
+// loadBlocklists reads the configured blocklists and hands them to the
+// firewall, which loads them now if it is enabled or with the ruleset
+// otherwise.
+func (d *Daemon) loadBlocklists() error {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	lists, infos := d.readBlocklists()
+	if err := d.firewall.SetBlocklists(lists); err != nil {
+		return err
+	}
+	d.blocklists = infos
+	return nil
+}
+
+// ReloadBlocklists re-reads the blocklist files and replaces the loaded
+// sets. Lists that fail to read are reported in the result rather than
+// failing the reload.
+func (d *Daemon) ReloadBlocklists() ([]BlocklistInfo, error) {
+	err := d.confirmable(func() error {
+		evt := events.StartFirewall("blocklist_reload").Profile(d.FirewallProfile())
+		defer func() {
+			d.events.Emit(evt.End())
+		}()
+
+		if err := d.loadBlocklists(); err != nil {
+			evt.SetError(err)
+			return err
+		}
+		if st, err := d.firewall.Status(); err == nil {
+			evt.RuleCount(st.Rules)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	infos := d.Blocklists()
+	failed := 0
+	for _, info := range infos {
+		if info.Err != nil {
+			failed++
+		}
+	}
+	d.logger.Info("blocklists reloaded", "lists", len(infos), "failed", failed)
+	return infos, nil
+}
+
+// Blocklists reports how each configured blocklist last loaded. Entries
+// come from the firewall, so they stay right if a reload is reverted.
+func (d *Daemon) Blocklists() []BlocklistInfo {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	loaded := make(map[string]int)
+	for _, b := range d.firewall.Blocklists() {
+		loaded[b.Name] = len(b.Prefixes)
+	}
+	infos := slices.Clone(d.blocklists)
+	for i := range infos {
+		infos[i].Entries = loaded[infos[i].Name]
+	}
+	return infos
+}
@@ -0,0 +1,63 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+func TestReloadBlocklists(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "internal.csv")
+	if err := os.WriteFile(path, []byte("ip,reason\n203.0.113.7,scanner\n198.51.100.0/24,botnet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Firewall.Blocklists = []config.FirewallBlocklist{
+		{Name: "internal", Path: path},
+		{Name: "missing", Path: filepath.Join(dir, "missing.txt")},
+	}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := d.Blocklists()
+	if len(infos) != 2 {
+		t.Fatalf("got %d blocklists, want 2", len(infos))
+	}
+	if in := infos[0]; in.Entries != 2 || in.Skipped != 1 || in.Err != nil {
+		t.Errorf("internal = %+v, want 2 entries and the header skipped", in)
+	}
+	if infos[1].Err == nil {
+		t.Error("missing blocklist reported no error")
+	}
+
+	if err := os.WriteFile(path, []byte("203.0.113.7\n198.51.100.0/24\n2001:db8::/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := d.ReloadBlocklists()
+	if err != nil {
+		t.Fatalf("ReloadBlocklists() error = %v", err)
+	}
+	if infos[0].Entries != 3 {
+		t.Errorf("entries after reload = %d, want 3", infos[0].Entries)
+	}
+
+	// a list that disappears keeps what was loaded
+	os.Remove(path)
+	infos, err = d.ReloadBlocklists()
+	if err != nil {
+		t.Fatalf("ReloadBlocklists() error = %v", err)
+	}
+	if infos[0].Err == nil || infos[0].Entries != 3 {
+		t.Errorf("internal after removal = %+v, want an error and 3 entries kept", infos[0])
+	}
+}
@@ -4,42 +4,307 @@ package daemon
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/network"
+	"github.com/oreonproject/defense/internal/onaccess"
+	"github.com/oreonproject/defense/internal/quarantine"
 	"github.com/oreonproject/defense/internal/scanner"
 	"github.com/oreonproject/defense/pkg/config"
 	"github.com/oreonproject/defense/pkg/events"
+	"github.com/oreonproject/defense/pkg/logging"
 )
 
 // Daemon is the main defense daemon that coordinates scanning,
 // firewall, and protection state.
 type Daemon struct {
-	cfg     *config.Config
-	state   *StateManager
-	logger  *slog.Logger
-	scanner *scanner.ClamAV
-	events  *events.Emitter
+	cfg      *config.Config
+	state    *StateManager
+	logger   *slog.Logger
+	scanner  *scanner.ClamAV
+	engine   *scanner.Engine
+	scans    *scanJobs
+	policy   *remediationPolicy
+	asks     *threatAsks
+	firewall *firewall.Firewall
+	events   *events.Emitter
 
 	// Runtime state (may differ from config)
-	firewallEnabled bool
-	lastScan        time.Time
-	rulesUpdated    time.Time
+	lastScan     time.Time // guarded by scans.mu
+	rulesUpdated time.Time
+
+	fwConn     firewall.Conn
+	netBus     network.Bus
+	configPath string
+	statePath  string
+	logStore   *logging.LogStore
+	vault      *quarantine.Vault
+	scanCache  *scanner.VerdictCache
+
+	notifier onaccess.Notifier
+	realtime *onaccess.Monitor // nil unless real-time protection started
+	foundMu  sync.Mutex
+	found    []func(ThreatFound) // guarded by foundMu
+
+	dropSource firewall.DropSource
+	dropWindow time.Duration
+
+	blocklists []BlocklistInfo // guarded by fwMu
+
+	cgroups    firewall.Cgroups
+	appRefresh time.Duration
+
+	preLockdown     State // guarded by fwMu; the state a lockdown interrupted
+	lockdownAtStart bool  // the state file says a lockdown was in force
+
+	// other firewall managers and what to do about them
+	fwBus    firewall.Bus
+	conflict string
+	managers []firewall.Manager // guarded by fwMu
+
+	// serialises edits to the firewall section of the config
+	fwMu sync.Mutex
+
+	// confirm-or-revert for firewall changes made over IPC
+	confirmTimeout  time.Duration
+	rbMu            sync.Mutex
+	pending         *pendingChange
+	configDirty     bool   // guarded by rbMu; rule or app edits not yet in the config file
+	heldProfile     string // guarded by rbMu; an automatic switch waiting on pending
+	revertListeners []func()
+}
+
+// Option configures a Daemon.
+type Option func(*Daemon)
+
+// WithFirewallConn sets the nftables connection used by the firewall.
+// Defaults to the kernel; tests pass firewall.NewMemConn().
+func WithFirewallConn(conn firewall.Conn) Option {
+	return func(d *Daemon) {
+		d.fwConn = conn
+	}
+}
+
+// WithNetworkBus sets the D-Bus connection used to watch NetworkManager.
+// Defaults to the system bus.
+func WithNetworkBus(bus network.Bus) Option {
+	return func(d *Daemon) {
+		d.netBus = bus
+	}
+}
+
+// WithConfigPath sets where config changes made over IPC are saved.
+// Without it they only last until the daemon restarts.
+func WithConfigPath(path string) Option {
+	return func(d *Daemon) {
+		d.configPath = path
+	}
+}
+
+// WithStatePath sets the file the firewall posture is kept in across
+// restarts. Without it, changes made over IPC only last as long as the
+// config file they're saved to, if any.
+func WithStatePath(path string) Option {
+	return func(d *Daemon) {
+		d.statePath = path
+	}
+}
+
+// WithLogStore sets where events worth keeping, like dropped packets,
+// are recorded. Without it they are only logged.
+func WithLogStore(store *logging.LogStore) Option {
+	return func(d *Daemon) {
+		d.logStore = store
+	}
+}
+
+// WithDropSource sets where dropped packets are read from when
+// log_drops is on. Defaults to the firewall's NFLOG group.
+func WithDropSource(src firewall.DropSource) Option {
+	return func(d *Daemon) {
+		d.dropSource = src
+	}
+}
+
+// WithCgroups sets where blocked apps are looked up. Defaults to the
+// system's cgroup2 and proc mounts.
+func WithCgroups(c firewall.Cgroups) Option {
+	return func(d *Daemon) {
+		d.cgroups = c
+	}
+}
+
+// WithFirewallBus sets the D-Bus connection used to look for other
+// firewall managers. Defaults to the system bus once Run starts; without
+// one only their nftables tables are found.
+func WithFirewallBus(bus firewall.Bus) Option {
+	return func(d *Daemon) {
+		d.fwBus = bus
+	}
+}
+
+// WithQuarantine sets the vault infected files are moved into. Without
+// it threats are only reported.
+func WithQuarantine(v *quarantine.Vault) Option {
+	return func(d *Daemon) {
+		d.vault = v
+	}
+}
+
+// WithScanCache sets where files found clean are remembered, so scans
+// can skip them while scanning.cache is on. Without it every file is
+// scanned every time.
+func WithScanCache(c *scanner.VerdictCache) Option {
+	return func(d *Daemon) {
+		d.scanCache = c
+	}
+}
+
+// WithNotifier sets where real-time protection hears about file
+// accesses. Defaults to the one realtime.method picks.
+func WithNotifier(n onaccess.Notifier) Option {
+	return func(d *Daemon) {
+		d.notifier = n
+	}
+}
+
+// newScanner builds the clamd client. The stream limit has to agree with
+// clamd's, so unless the config sets one it is read from clamd.conf.
+func newScanner(cfg config.ClamAV, logger *slog.Logger) *scanner.ClamAV {
+	mode, err := scanner.ParseMode(cfg.Mode)
+	if err != nil {
+		logger.Warn("invalid clamav mode, using auto", "value", cfg.Mode)
+	}
+
+	limit := int64(scanner.DefaultStreamMaxLength)
+	if cfg.StreamMaxLength != "" {
+		if n, err := scanner.ParseSize(cfg.StreamMaxLength); err != nil {
+			logger.Warn("invalid clamav stream_max_length, using the default", "value", cfg.StreamMaxLength)
+		} else {
+			limit = n
+		}
+	} else {
+		for _, path := range scanner.ClamdConfPaths {
+			if n, err := scanner.ReadStreamMaxLength(path); err == nil {
+				limit = n
+				break
+			}
+		}
+	}
+
+	return scanner.New(cfg.SocketPath, scanner.WithMode(mode), scanner.WithStreamMaxLength(limit))
+}
+
+// newEngine builds the scan engine that walks directories for scans.
+// cache may be nil.
+func newEngine(cfg config.Scanning, s *scanner.ClamAV, cache *scanner.VerdictCache, logger *slog.Logger) *scanner.Engine {
+	maxLoad := cfg.MaxLoad
+	if maxLoad == 0 {
+		maxLoad = float64(runtime.NumCPU())
+	}
+	opts := []scanner.EngineOption{
+		scanner.WithWorkers(cfg.Concurrency),
+		scanner.WithLowPriority(cfg.LowPriority),
+		scanner.WithExclusions(newExclusions(cfg, logger)),
+		scanner.WithBackoff(scanner.Backoff{
+			OnBattery: cfg.BatteryBackoff,
+			MaxLoad:   maxLoad,
+			Load:      scanner.SystemLoad,
+		}),
+	}
+	if cfg.Cache && cache != nil {
+		opts = append(opts, scanner.WithCache(cache, s.Version))
+	}
+	return scanner.NewEngine(s, opts...)
+}
+
+// newExclusions builds what every scan leaves out. Rules that don't
+// parse are dropped with a warning; the rest still apply.
+//
+// TODO: there are no scheduled scans yet. When a scheduler is added it
+// should start jobs through StartScan, so they run on d.engine and get
+// these exclusions like manual and on-access scans do.
+func newExclusions(cfg config.Scanning, logger *slog.Logger) *scanner.Exclusions {
+	rules := scanner.ExclusionRules{
+		Paths:   cfg.Exclusions,
+		FSTypes: cfg.SkipFSTypes,
+		Cross:   cfg.CrossMounts,
+	}
+	if rules.FSTypes == nil {
+		rules.FSTypes = scanner.DefaultSkipFSTypes
+	}
+	if cfg.MaxFileSize != "" {
+		if n, err := scanner.ParseSize(cfg.MaxFileSize); err != nil {
+			logger.Warn("invalid scanning max_file_size, not limiting", "value", cfg.MaxFileSize)
+		} else {
+			rules.MaxFileSize = n
+		}
+	}
+	x, err := scanner.NewExclusions(rules)
+	if err != nil {
+		logger.Warn("ignoring invalid scan exclusions", "error", err)
+	}
+	return x
 }
 
 // New creates a new daemon instance.
-func New(cfg *config.Config, logger *slog.Logger) *Daemon {
+func New(cfg *config.Config, logger *slog.Logger, opts ...Option) *Daemon {
 	d := &Daemon{
-		cfg:             cfg,
-		state:           NewStateManager(),
-		logger:          logger,
-		scanner:         scanner.New(cfg.ClamAV.SocketPath),
-		events:          events.NewEmitter(events.WithLogger(logger)),
-		firewallEnabled: cfg.Firewall.Enabled,
-		rulesUpdated:    time.Now(), // Assume rules are current at startup
+		cfg:          cfg,
+		state:        NewStateManager(),
+		logger:       logger,
+		scanner:      newScanner(cfg.ClamAV, logger),
+		scans:        newScanJobs(),
+		policy:       newRemediationPolicy(cfg.Scanning, logger),
+		asks:         newThreatAsks(),
+		events:       events.NewEmitter(events.WithLogger(logger)),
+		rulesUpdated: time.Now(), // Assume rules are current at startup
+		dropWindow:   dropWindow,
+		cgroups:      firewall.SystemCgroups,
+		appRefresh:   appRefresh,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.engine = newEngine(cfg.Scanning, d.scanner, d.scanCache, logger)
+	if d.fwConn == nil {
+		d.fwConn = firewall.NewKernelConn()
 	}
+	d.firewall = firewall.New(d.fwConn)
+
+	if cfg.Firewall.ConfirmTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.Firewall.ConfirmTimeout)
+		if err != nil {
+			logger.Warn("invalid firewall confirm_timeout, changes won't be reverted", "value", cfg.Firewall.ConfirmTimeout)
+		}
+		d.confirmTimeout = timeout
+	}
+
+	if err := d.loadFirewallState(); err != nil {
+		logger.Error("using firewall settings from the config", "error", err)
+	}
+
+	d.conflict = d.parseConflict(cfg.Firewall.Conflict)
+	d.firewall.SetPriority(cfg.Firewall.Priority)
+
+	// Not enabled yet, so this only selects the profile Run will install
+	if p, ok := d.firewallProfile(cfg.Firewall.Profile); ok {
+		d.firewall.SetProfile(p)
+	} else if cfg.Firewall.Profile != "" {
+		logger.Warn("unknown firewall profile, using strict defaults", "profile", cfg.Firewall.Profile)
+	}
+	d.loadBlocklists()
+	d.fwMu.Lock()
+	d.refreshApps()
+	d.fwMu.Unlock()
 
 	// Register listener to emit state change events
 	d.state.OnStateChange(func(old, new State) {
@@ -55,25 +320,111 @@ func (d *Daemon) Config() *config.Config {
 	return d.cfg
 }
 
-// FirewallEnabled returns whether the firewall is currently enabled.
+// FirewallEnabled returns whether the firewall ruleset is currently installed.
 func (d *Daemon) FirewallEnabled() bool {
-	return d.firewallEnabled
+	return d.firewall.Enabled()
 }
 
-// SetFirewallEnabled enables or disables the firewall.
-func (d *Daemon) SetFirewallEnabled(enabled bool) {
-	d.firewallEnabled = enabled
+// SetFirewallEnabled installs or removes the firewall ruleset.
+// The config is only updated if the kernel accepted the change.
+func (d *Daemon) SetFirewallEnabled(enabled bool) error {
+	return d.confirmable(func() error {
+		return d.setFirewallEnabled(enabled)
+	})
+}
+
+func (d *Daemon) setFirewallEnabled(enabled bool) error {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	action := "disable"
+	if enabled {
+		action = "enable"
+	}
+	evt := events.StartFirewall(action)
+	defer func() {
+		d.events.Emit(evt.End())
+	}()
+
+	var err error
+	if enabled {
+		d.detectManagers()
+		if err = d.managerConflict(); err == nil {
+			err = d.firewall.Enable()
+		}
+	} else {
+		err = d.firewall.Disable()
+	}
+	if err != nil {
+		evt.SetError(err)
+		return err
+	}
+
 	d.cfg.Firewall.Enabled = enabled
+	if st, err := d.firewall.Status(); err == nil {
+		evt.RuleCount(st.Rules)
+	}
 	d.logger.Info("firewall toggled", "enabled", enabled)
+	return nil
+}
+
+// FirewallProfile returns the name of the active firewall profile.
+func (d *Daemon) FirewallProfile() string {
+	return d.firewall.Profile().Name
+}
+
+// SetFirewallProfile switches to the named profile from the config.
+// If the firewall is enabled the new ruleset is applied immediately.
+func (d *Daemon) SetFirewallProfile(name string) error {
+	return d.confirmable(func() error {
+		return d.setFirewallProfile(name)
+	})
+}
+
+func (d *Daemon) setFirewallProfile(name string) error {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	evt := events.StartFirewall("profile").Profile(name)
+	defer func() {
+		d.events.Emit(evt.End())
+	}()
+
+	p, ok := d.firewallProfile(name)
+	if !ok {
+		err := fmt.Errorf("unknown profile %q", name)
+		evt.SetError(err)
+		return err
+	}
+	if err := d.firewall.SetProfile(p); err != nil {
+		evt.SetError(err)
+		return err
+	}
+
+	d.cfg.Firewall.Profile = name
+	if st, err := d.firewall.Status(); err == nil {
+		evt.RuleCount(st.Rules)
+	}
+	d.logger.Info("firewall profile changed", "profile", name)
+	return nil
+}
+
+// Firewall returns the firewall instance.
+func (d *Daemon) Firewall() *firewall.Firewall {
+	return d.firewall
 }
 
 // LastScan returns the time of the last scan.
 func (d *Daemon) LastScan() time.Time {
+	d.scans.mu.Lock()
+	defer d.scans.mu.Unlock()
 	return d.lastScan
 }
 
 // SetLastScan updates the last scan time.
 func (d *Daemon) SetLastScan(t time.Time) {
+	d.scans.mu.Lock()
+	defer d.scans.mu.Unlock()
 	d.lastScan = t
 }
 
@@ -92,6 +443,11 @@ func (d *Daemon) Scanner() *scanner.ClamAV {
 	return d.scanner
 }
 
+// ScanEngine returns the engine scans walk directories with.
+func (d *Daemon) ScanEngine() *scanner.Engine {
+	return d.engine
+}
+
 // Events returns the event emitter for logging wide events.
 func (d *Daemon) Events() *events.Emitter {
 	return d.events
@@ -101,6 +457,41 @@ func (d *Daemon) Events() *events.Emitter {
 func (d *Daemon) Run(ctx context.Context, socketPath string) error {
 	d.logger.Info("daemon starting")
 
+	if d.fwBus == nil {
+		if bus, err := firewall.SystemBus(); err != nil {
+			d.logger.Debug("firewall manager detection limited to nftables tables", "error", err)
+		} else {
+			d.fwBus = bus
+		}
+	}
+
+	// Install the ruleset before accepting clients so nobody sees a
+	// "firewall enabled" status that isn't true yet
+	if d.cfg.Firewall.Enabled {
+		d.fwMu.Lock()
+		d.detectManagers()
+		err := d.managerConflict()
+		if err == nil {
+			err = d.firewall.Enable()
+		}
+		d.fwMu.Unlock()
+		if errors.Is(err, ErrManagerConflict) {
+			d.logger.Warn("firewall not enabled", "error", err)
+		} else if err != nil {
+			d.logger.Error("failed to enable firewall", "error", err)
+		}
+	}
+	if d.lockdownAtStart {
+		if err := d.Lockdown(); err != nil {
+			d.logger.Error("failed to restore lockdown", "error", err)
+		}
+	}
+
+	defer d.scanner.Close()
+
+	// before clients connect, so the status they see says whether it's on
+	d.watchRealTime(ctx)
+
 	// Start IPC server
 	server := NewServer(socketPath, d)
 	if err := server.Listen(); err != nil {
@@ -109,6 +500,12 @@ func (d *Daemon) Run(ctx context.Context, socketPath string) error {
 	go server.Serve()
 	defer server.Close()
 
+	d.watchNetwork(ctx)
+	go d.watchApps(ctx)
+	if d.cfg.Firewall.LogDrops {
+		d.watchDrops(ctx)
+	}
+
 	// initial health check
 	d.healthCheck()
 
@@ -119,6 +516,8 @@ func (d *Daemon) Run(ctx context.Context, socketPath string) error {
 		select {
 		case <-ctx.Done():
 			d.logger.Info("daemon shutting down")
+			d.cancelScans()
+			d.settleAsks()
 			return nil
 		case <-ticker.C:
 			d.healthCheck()
@@ -126,6 +525,89 @@ func (d *Daemon) Run(ctx context.Context, socketPath string) error {
 	}
 }
 
+// watchNetwork follows NetworkManager's primary connection in the
+// background. Machines without NetworkManager just don't get automatic
+// profile switching.
+func (d *Daemon) watchNetwork(ctx context.Context) {
+	bus := d.netBus
+	if bus == nil {
+		var err error
+		if bus, err = network.SystemBus(); err != nil {
+			d.logger.Debug("network watch unavailable", "error", err)
+			return
+		}
+	}
+
+	changes, err := network.NewWatcher(bus).Watch(ctx)
+	if err != nil {
+		d.logger.Debug("network watch unavailable", "error", err)
+		bus.Close()
+		return
+	}
+
+	go func() {
+		defer bus.Close()
+		for conn := range changes {
+			d.handleNetworkChange(conn)
+		}
+	}()
+}
+
+// handleNetworkChange classifies a new primary connection and, if
+// automatic switching is on, moves the firewall to the matching profile.
+func (d *Daemon) handleNetworkChange(conn network.Connection) {
+	trusted := network.Trusted(conn, d.cfg.Network.Rules)
+	evt := events.StartNetworkChange(conn.ID, conn.UUID).
+		Type(conn.Type).
+		SSID(conn.SSID).
+		Interface(conn.Interface).
+		Trusted(trusted)
+	defer func() {
+		d.events.Emit(evt.End())
+	}()
+
+	// going offline leaves the current posture alone; the next connection
+	// will pick its own profile
+	if !conn.Connected() || !d.cfg.Network.AutoProfile {
+		return
+	}
+
+	profile := d.cfg.Network.UntrustedProfile
+	if trusted {
+		profile = d.cfg.Network.TrustedProfile
+	}
+	evt.Profile(profile)
+
+	d.rbMu.Lock()
+	defer d.rbMu.Unlock()
+	// a revert would undo the switch along with the user's change, so it
+	// waits until that change is confirmed or reverted
+	if d.pending != nil {
+		d.heldProfile = profile
+		evt.Set("held", true)
+		d.logger.Info("firewall profile switch held until the pending change is settled", "profile", profile)
+		return
+	}
+	if err := d.autoSwitchProfile(profile); err != nil {
+		evt.SetError(err)
+	}
+}
+
+// autoSwitchProfile switches profile for a network change and saves the
+// result. Automatic switches don't need confirming; nobody is there to
+// do it. Must be called with rbMu held and nothing pending.
+func (d *Daemon) autoSwitchProfile(profile string) error {
+	d.heldProfile = ""
+	if profile == d.FirewallProfile() {
+		return nil
+	}
+	if err := d.setFirewallProfile(profile); err != nil {
+		return err
+	}
+	d.saveFirewallState()
+	return nil
+}
+
 // healthCheck evaluates system state and updates the state machine.
 func (d *Daemon) healthCheck() {
 	evt := events.StartHealthCheck()
@@ -133,32 +615,39 @@ func (d *Daemon) healthCheck() {
 		d.events.Emit(evt.End())
 	}()
 
-	// Don't change state if we're scanning or paused
+	d.reconcileManagers()
+	managers, _ := d.FirewallManagers()
+	evt.FirewallManagers(len(managers))
+
+	// Don't change state if we're scanning, paused or locked down
 	currentState := d.state.State()
-	if currentState == StateScanning || currentState == StatePaused {
+	if currentState == StateScanning || currentState == StatePaused || currentState == StateLockdown {
 		return
 	}
 
 	// Check ClamAV availability
 	clamAvailable := d.checkClamAV()
 	evt.ClamAVAvailable(clamAvailable)
-	evt.FirewallEnabled(d.firewallEnabled)
+	evt.FirewallEnabled(d.FirewallEnabled())
+	evt.RealTimeActive(d.RealTimeActive())
 
-	// Determine the appropriate state
-	var newState State
+	newState := d.healthState(clamAvailable)
+	if currentState != newState {
+		d.state.SetState(newState)
+	}
+}
 
+// healthState is the state the health check settles on when nothing is
+// scanning, paused or locked down.
+func (d *Daemon) healthState(clamAvailable bool) State {
 	if !clamAvailable {
-		newState = StateWarning
-	} else if !d.firewallEnabled && d.cfg.Firewall.Enabled {
-		// Firewall should be on but isn't
-		newState = StateWarning
-	} else {
-		newState = StateProtected
+		return StateWarning
 	}
-
-	if currentState != newState {
-		d.state.SetState(newState)
+	if !d.FirewallEnabled() && d.cfg.Firewall.Enabled {
+		// Firewall should be on but isn't
+		return StateWarning
 	}
+	return d.settledState()
 }
 
 // checkClamAV verifies ClamAV daemon is available.
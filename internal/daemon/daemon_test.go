@@ -8,6 +8,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/network"
 	"github.com/oreonproject/defense/pkg/config"
 )
 
@@ -15,7 +17,7 @@ func TestDaemonRun(t *testing.T) {
 	cfg := &config.Config{}
 	logger := slog.Default()
 
-	d := New(cfg, logger)
+	d := New(cfg, logger, WithFirewallConn(firewall.NewMemConn()))
 
 	socketPath := t.TempDir() + "/test.sock"
 
@@ -34,3 +36,61 @@ func TestDaemonRun(t *testing.T) {
 		t.Errorf("state = %v, want %v or %v", state, StateWarning, StateProtected)
 	}
 }
+
+func TestDaemonRun_EnablesFirewall(t *testing.T) {
+	cfg := &config.Config{Firewall: config.Firewall{Enabled: true}}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := d.Run(ctx, t.TempDir()+"/test.sock"); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if !d.FirewallEnabled() {
+		t.Error("FirewallEnabled() = false, want ruleset installed at startup")
+	}
+	st, err := d.Firewall().Status()
+	if err != nil {
+		t.Fatalf("Status() error = %v", err)
+	}
+	if !st.Loaded {
+		t.Error("table not loaded after startup")
+	}
+}
+
+func TestHandleNetworkChange(t *testing.T) {
+	cfg := config.Default()
+	cfg.Network.AutoProfile = true
+	cfg.Network.Rules = []config.NetworkRule{{SSID: "HomeWifi", Trusted: true}}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+
+	d.handleNetworkChange(network.Connection{UUID: "uuid-home", SSID: "HomeWifi"})
+	if got := d.FirewallProfile(); got != "home" {
+		t.Errorf("profile on trusted network = %q, want home", got)
+	}
+
+	d.handleNetworkChange(network.Connection{UUID: "uuid-cafe", SSID: "FreeWifi"})
+	if got := d.FirewallProfile(); got != "public" {
+		t.Errorf("profile on untrusted network = %q, want public", got)
+	}
+
+	// disconnecting keeps the last profile
+	d.handleNetworkChange(network.Connection{})
+	if got := d.FirewallProfile(); got != "public" {
+		t.Errorf("profile after disconnect = %q, want public", got)
+	}
+}
+
+func TestHandleNetworkChange_AutoProfileOff(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.Profile = "strict"
+	cfg.Network.Rules = []config.NetworkRule{{SSID: "HomeWifi", Trusted: true}}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+
+	d.handleNetworkChange(network.Connection{UUID: "uuid-home", SSID: "HomeWifi"})
+	if got := d.FirewallProfile(); got != "strict" {
+		t.Errorf("profile = %q, want strict (auto_profile off)", got)
+	}
+}
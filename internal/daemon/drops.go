@@ -0,0 +1,163 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/events"
+	"github.com/oreonproject/defense/pkg/logging"
+)
+
+// Dropped packets are summarised per source, destination and port over a
+// window, so a port scan turns into a handful of events instead of one per
+// packet.
+const (
+	dropWindow  = 10 * time.Second
+	maxDropKeys = 100 // distinct summaries per window; the rest are only counted
+)
+
+// dropKey groups drops that are reported together.
+type dropKey struct {
+	src   netip.Addr
+	dst   netip.Addr
+	proto string
+	port  uint16
+	iface string
+}
+
+// dropSummary is one reported group.
+type dropSummary struct {
+	key   dropKey
+	count int
+}
+
+// dropAggregator counts drops per key until flushed.
+type dropAggregator struct {
+	max      int
+	counts   map[dropKey]int
+	order    []dropKey // first-seen order, so reports are stable
+	overflow int
+}
+
+func newDropAggregator(max int) *dropAggregator {
+	return &dropAggregator{max: max, counts: make(map[dropKey]int)}
+}
+
+// add counts a drop. Once max distinct keys have been seen in a window,
+// new keys only bump the overflow counter.
+func (a *dropAggregator) add(d firewall.Drop) {
+	key := dropKey{src: d.Src, dst: d.Dst, proto: d.Proto, port: d.Port, iface: d.Interface}
+	if _, ok := a.counts[key]; !ok {
+		if len(a.order) >= a.max {
+			a.overflow++
+			return
+		}
+		a.order = append(a.order, key)
+	}
+	a.counts[key]++
+}
+
+// flush returns the window's summaries and the number of drops that
+// didn't fit, and starts a new window.
+func (a *dropAggregator) flush() ([]dropSummary, int) {
+	out := make([]dropSummary, 0, len(a.order))
+	for _, key := range a.order {
+		out = append(out, dropSummary{key: key, count: a.counts[key]})
+	}
+	overflow := a.overflow
+
+	a.counts = make(map[dropKey]int)
+	a.order = nil
+	a.overflow = 0
+	return out, overflow
+}
+
+// watchDrops reads packets the firewall logged and reports them in
+// batches. Reading NFLOG needs CAP_NET_ADMIN; without it drops just
+// aren't recorded.
+func (d *Daemon) watchDrops(ctx context.Context) {
+	src := d.dropSource
+	if src == nil {
+		src = firewall.NewNFLog(firewall.LogGroup)
+	}
+
+	drops, err := src.Drops(ctx)
+	if err != nil {
+		d.logger.Warn("dropped packet logging unavailable", "error", err)
+		return
+	}
+
+	go func() {
+		agg := newDropAggregator(maxDropKeys)
+		ticker := time.NewTicker(d.dropWindow)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case drop, ok := <-drops:
+				if !ok {
+					d.reportDrops(agg.flush())
+					return
+				}
+				agg.add(drop)
+			case <-ticker.C:
+				d.reportDrops(agg.flush())
+			}
+		}
+	}()
+}
+
+// reportDrops emits and stores one event per summary.
+func (d *Daemon) reportDrops(summaries []dropSummary, overflow int) {
+	for _, s := range summaries {
+		evt := events.StartFirewallDrop(s.key.src.String(), s.key.dst.String()).
+			Proto(s.key.proto).
+			Interface(s.key.iface).
+			Count(s.count)
+		if s.key.port != 0 {
+			evt.Port(int(s.key.port))
+		}
+		e := evt.End()
+		d.events.Emit(e)
+		d.storeEvent(e)
+	}
+	if overflow > 0 {
+		d.logger.Warn("too many distinct dropped flows, not all recorded", "packets", overflow)
+	}
+}
+
+// storeEvent records an event in the log store, if there is one.
+func (d *Daemon) storeEvent(evt events.Event) {
+	if d.logStore == nil {
+		return
+	}
+	err := d.logStore.Insert(logging.LogEntry{
+		Timestamp:   evt.StartedAt,
+		Level:       "info",
+		Component:   evt.Component,
+		OperationID: evt.OperationID,
+		Message:     string(evt.Type),
+		Metadata:    evt.Fields,
+	})
+	if err != nil {
+		d.logger.Warn("failed to store event", "event_type", evt.Type, "error", err)
+	}
+}
+
+// FirewallDrops returns recorded drop summaries, newest first.
+func (d *Daemon) FirewallDrops(since time.Time, limit int) ([]logging.LogEntry, error) {
+	if d.logStore == nil {
+		return nil, errors.New("no event store configured")
+	}
+	return d.logStore.Query(logging.QueryOptions{
+		Component: "firewall",
+		Message:   string(events.EventTypeDrop),
+		After:     since,
+		Limit:     limit,
+	})
+}
@@ -0,0 +1,101 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/config"
+	"github.com/oreonproject/defense/pkg/logging"
+)
+
+// fakeDrops is a DropSource fed by the test.
+type fakeDrops chan firewall.Drop
+
+func (f fakeDrops) Drops(ctx context.Context) (<-chan firewall.Drop, error) {
+	return f, nil
+}
+
+func drop(src string, port uint16) firewall.Drop {
+	return firewall.Drop{
+		Src:       netip.MustParseAddr(src),
+		Dst:       netip.MustParseAddr("192.168.1.10"),
+		Proto:     "tcp",
+		Port:      port,
+		Interface: "wlan0",
+	}
+}
+
+func newTestStore(t *testing.T) *logging.LogStore {
+	t.Helper()
+	store, err := logging.NewLogStore(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestDropAggregator(t *testing.T) {
+	agg := newDropAggregator(2)
+	agg.add(drop("203.0.113.5", 22))
+	agg.add(drop("203.0.113.5", 22))
+	agg.add(drop("203.0.113.5", 23))
+	agg.add(drop("198.51.100.7", 22)) // third key, over the limit
+	agg.add(drop("203.0.113.5", 22))
+
+	summaries, overflow := agg.flush()
+	if len(summaries) != 2 || summaries[0].count != 3 || summaries[1].count != 1 {
+		t.Errorf("summaries = %+v, want counts 3 and 1", summaries)
+	}
+	if overflow != 1 {
+		t.Errorf("overflow = %d, want 1", overflow)
+	}
+
+	if summaries, overflow := agg.flush(); len(summaries) != 0 || overflow != 0 {
+		t.Errorf("second flush = %+v, %d, want empty", summaries, overflow)
+	}
+}
+
+func TestWatchDrops(t *testing.T) {
+	src := make(fakeDrops, 8)
+	d := New(config.Default(), slog.Default(),
+		WithFirewallConn(firewall.NewMemConn()),
+		WithDropSource(src),
+		WithLogStore(newTestStore(t)))
+	d.dropWindow = time.Hour // only the final flush on close reports
+
+	d.watchDrops(context.Background())
+	for i := 0; i < 5; i++ {
+		src <- drop("203.0.113.5", 22)
+	}
+	src <- drop("198.51.100.7", 443)
+	close(src)
+
+	var entries []logging.LogEntry
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		entries, _ = d.FirewallDrops(time.Time{}, 10)
+		if len(entries) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("stored %d summaries, want 2", len(entries))
+	}
+
+	counts := make(map[string]float64)
+	for _, e := range entries {
+		counts[e.Metadata["src"].(string)] = e.Metadata["packet_count"].(float64)
+	}
+	if counts["203.0.113.5"] != 5 || counts["198.51.100.7"] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+}
@@ -0,0 +1,444 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/config"
+	"github.com/oreonproject/defense/pkg/events"
+	"golang.org/x/sys/unix"
+)
+
+// firewallProfile looks up a profile in the config by name. Rules that
+// don't parse are skipped so one typo can't keep the firewall down.
+func (d *Daemon) firewallProfile(name string) (firewall.Profile, bool) {
+	p, ok := d.cfg.Firewall.Profiles[name]
+	if !ok {
+		return firewall.Profile{}, false
+	}
+	return d.buildProfile(name, p), true
+}
+
+// buildProfile converts a configured profile for the firewall package.
+func (d *Daemon) buildProfile(name string, p config.FirewallProfile) firewall.Profile {
+	fp := firewall.Profile{
+		Name:      name,
+		AllowPing: p.AllowPing,
+		AllowLAN:  p.AllowLAN,
+		Reject:    p.Reject,
+		LogDrops:  d.cfg.Firewall.LogDrops,
+	}
+	for _, r := range p.Rules {
+		_, rule, err := parseFirewallRule(r)
+		if err != nil {
+			d.logger.Warn("skipping invalid firewall rule", "profile", name, "error", err)
+			continue
+		}
+		fp.Rules = append(fp.Rules, rule)
+	}
+	return fp
+}
+
+// maxRuleComment is the longest comment nft will show for a rule.
+const maxRuleComment = 128
+
+// parseFirewallRule validates a configured rule. It returns the rule in
+// canonical form (lowercase proto, explicit direction, masked source) along
+// with what the firewall package installs for it.
+func parseFirewallRule(r config.FirewallRule) (config.FirewallRule, firewall.Rule, error) {
+	var rule firewall.Rule
+
+	r.Proto = strings.ToLower(strings.TrimSpace(r.Proto))
+	switch r.Proto {
+	case "tcp":
+		rule.Proto = unix.IPPROTO_TCP
+	case "udp":
+		rule.Proto = unix.IPPROTO_UDP
+	default:
+		return r, rule, fmt.Errorf("unsupported protocol %q", r.Proto)
+	}
+
+	if r.Port < 1 || r.Port > 65535 {
+		return r, rule, fmt.Errorf("port %d out of range", r.Port)
+	}
+	if r.PortEnd == r.Port {
+		r.PortEnd = 0
+	}
+	if r.PortEnd != 0 && (r.PortEnd < r.Port || r.PortEnd > 65535) {
+		return r, rule, fmt.Errorf("invalid port range %d-%d", r.Port, r.PortEnd)
+	}
+	rule.FromPort = uint16(r.Port)
+	rule.ToPort = rule.FromPort
+	if r.PortEnd != 0 {
+		rule.ToPort = uint16(r.PortEnd)
+	}
+
+	if r.Source = strings.TrimSpace(r.Source); r.Source != "" {
+		prefix, err := netip.ParsePrefix(r.Source)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(r.Source)
+			if addrErr != nil {
+				return r, rule, fmt.Errorf("invalid source %q", r.Source)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rule.Addr = prefix.Masked()
+		r.Source = rule.Addr.String()
+	}
+
+	switch r.Direction = strings.ToLower(strings.TrimSpace(r.Direction)); r.Direction {
+	case "", "in":
+		r.Direction = "in"
+	case "out":
+		rule.Out = true
+	default:
+		return r, rule, fmt.Errorf("invalid direction %q", r.Direction)
+	}
+
+	if len(r.Comment) > maxRuleComment {
+		return r, rule, fmt.Errorf("comment is %d bytes, limit %d", len(r.Comment), maxRuleComment)
+	}
+	rule.Comment = r.Comment
+	return r, rule, nil
+}
+
+// sameFirewallRule reports whether two canonical rules match the same
+// traffic. Comments don't count.
+func sameFirewallRule(a, b config.FirewallRule) bool {
+	a.Comment, b.Comment = "", ""
+	return a == b
+}
+
+// FirewallProfiles returns a copy of the configured profiles by name.
+func (d *Daemon) FirewallProfiles() map[string]config.FirewallProfile {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	profiles := make(map[string]config.FirewallProfile, len(d.cfg.Firewall.Profiles))
+	for name, p := range d.cfg.Firewall.Profiles {
+		p.Rules = slices.Clone(p.Rules)
+		profiles[name] = p
+	}
+	return profiles
+}
+
+// FirewallRules returns the port rules of a profile. An empty name means
+// the active profile; the resolved name is returned alongside.
+func (d *Daemon) FirewallRules(profile string) (string, []config.FirewallRule, error) {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	if profile == "" {
+		profile = d.FirewallProfile()
+	}
+	p, ok := d.cfg.Firewall.Profiles[profile]
+	if !ok {
+		return profile, nil, fmt.Errorf("unknown profile %q", profile)
+	}
+	return profile, slices.Clone(p.Rules), nil
+}
+
+// AddFirewallRule adds a port rule to a profile (the active one if profile
+// is empty), applies it if that profile is loaded and saves the config.
+func (d *Daemon) AddFirewallRule(profile string, r config.FirewallRule) error {
+	r, _, err := parseFirewallRule(r)
+	if err != nil {
+		return err
+	}
+	return d.editFirewallRules(profile, "rule_add", func(rules []config.FirewallRule) ([]config.FirewallRule, error) {
+		for _, existing := range rules {
+			if c, _, err := parseFirewallRule(existing); err == nil && sameFirewallRule(c, r) {
+				return nil, errors.New("rule already exists")
+			}
+		}
+		return append(rules, r), nil
+	})
+}
+
+// RemoveFirewallRule removes the rule matching r from a profile (the
+// active one if profile is empty). The comment is ignored when matching.
+func (d *Daemon) RemoveFirewallRule(profile string, r config.FirewallRule) error {
+	r, _, err := parseFirewallRule(r)
+	if err != nil {
+		return err
+	}
+	return d.editFirewallRules(profile, "rule_remove", func(rules []config.FirewallRule) ([]config.FirewallRule, error) {
+		for i, existing := range rules {
+			if c, _, err := parseFirewallRule(existing); err == nil && sameFirewallRule(c, r) {
+				return slices.Delete(rules, i, i+1), nil
+			}
+		}
+		return nil, errors.New("no matching rule")
+	})
+}
+
+// editFirewallRules applies edit to a profile's rules, reloads the
+// ruleset if the profile is active and persists the result once it no
+// longer needs confirming. If the kernel
+// rejects the new ruleset the config is left untouched.
+func (d *Daemon) editFirewallRules(profile, action string, edit func([]config.FirewallRule) ([]config.FirewallRule, error)) error {
+	return d.confirmable(func() error {
+		return d.applyRuleEdit(profile, action, edit)
+	})
+}
+
+func (d *Daemon) applyRuleEdit(profile, action string, edit func([]config.FirewallRule) ([]config.FirewallRule, error)) error {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	if profile == "" {
+		profile = d.FirewallProfile()
+	}
+	evt := events.StartFirewall(action).Profile(profile)
+	defer func() {
+		d.events.Emit(evt.End())
+	}()
+
+	p, ok := d.cfg.Firewall.Profiles[profile]
+	if !ok {
+		err := fmt.Errorf("unknown profile %q", profile)
+		evt.SetError(err)
+		return err
+	}
+
+	old := p.Rules
+	rules, err := edit(slices.Clone(old))
+	if err != nil {
+		evt.SetError(err)
+		return err
+	}
+	p.Rules = rules
+	d.cfg.Firewall.Profiles[profile] = p
+
+	if profile == d.FirewallProfile() {
+		fp, _ := d.firewallProfile(profile)
+		if err := d.firewall.SetProfile(fp); err != nil {
+			p.Rules = old
+			d.cfg.Firewall.Profiles[profile] = p
+			evt.SetError(err)
+			return err
+		}
+		if st, err := d.firewall.Status(); err == nil {
+			evt.RuleCount(st.Rules)
+		}
+	}
+
+	// written out by confirmable, once there's nothing left to confirm
+	d.configDirty = true
+	d.logger.Info("firewall rules changed", "profile", profile, "action", action, "rules", len(rules))
+	return nil
+}
+
+// saveConfig writes the config back to disk if the daemon was given a
+// path to it.
+func (d *Daemon) saveConfig() error {
+	if d.configPath == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(d.cfg); err != nil {
+		return fmt.Errorf("save config: %w", err)
+	}
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(d.configPath); err == nil {
+		perm = fi.Mode().Perm() // keep whatever the admin set
+	}
+	// atomically, so a crash mid-write can't leave a config that won't load
+	if err := writeFileAtomic(d.configPath, buf.Bytes(), perm); err != nil {
+		return fmt.Errorf("save config: %w", err)
+	}
+	return nil
+}
+
+// PreviewFirewall shows what a profile would load, with add and remove
+// applied to its rules first, and how that differs from the live table.
+// Nothing is changed. An empty profile means the active one.
+func (d *Daemon) PreviewFirewall(profile string, add, remove []config.FirewallRule) (string, firewall.Preview, error) {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	if profile == "" {
+		profile = d.FirewallProfile()
+	}
+	p, ok := d.cfg.Firewall.Profiles[profile]
+	if !ok {
+		return profile, firewall.Preview{}, fmt.Errorf("unknown profile %q", profile)
+	}
+
+	rules := slices.Clone(p.Rules)
+	for _, r := range remove {
+		r, _, err := parseFirewallRule(r)
+		if err != nil {
+			return profile, firewall.Preview{}, err
+		}
+		rules = slices.DeleteFunc(rules, func(existing config.FirewallRule) bool {
+			c, _, err := parseFirewallRule(existing)
+			return err == nil && sameFirewallRule(c, r)
+		})
+	}
+	for _, r := range add {
+		r, _, err := parseFirewallRule(r)
+		if err != nil {
+			return profile, firewall.Preview{}, err
+		}
+		rules = append(rules, r)
+	}
+	p.Rules = rules
+
+	pv, err := d.firewall.Preview(d.buildProfile(profile, p))
+	return profile, pv, err
+}
+
+// pendingChange is a firewall change waiting for ConfirmFirewall.
+type pendingChange struct {
+	snapshot firewall.Snapshot
+	config   config.Firewall
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// confirmable runs a user-initiated firewall change. With a confirm
+// timeout configured, the state before the change is recorded and put
+// back unless ConfirmFirewall is called in time. Further changes made
+// while one is pending ride on the same snapshot and deadline.
+func (d *Daemon) confirmable(change func() error) error {
+	d.rbMu.Lock()
+	defer d.rbMu.Unlock()
+
+	var p *pendingChange
+	if d.confirmTimeout > 0 && d.pending == nil {
+		d.fwMu.Lock()
+		p = &pendingChange{
+			snapshot: d.firewall.Snapshot(),
+			config:   cloneFirewallConfig(d.cfg.Firewall),
+		}
+		d.fwMu.Unlock()
+	}
+
+	if err := change(); err != nil {
+		return err
+	}
+
+	if p == nil {
+		d.saveFirewallState()
+	} else {
+		p.deadline = time.Now().Add(d.confirmTimeout)
+		p.timer = time.AfterFunc(d.confirmTimeout, func() {
+			d.revertFirewall(p)
+		})
+		d.pending = p
+		d.logger.Info("firewall change needs confirming", "timeout", d.confirmTimeout)
+	}
+	return nil
+}
+
+// ConfirmFirewall keeps the pending firewall change.
+func (d *Daemon) ConfirmFirewall() error {
+	d.rbMu.Lock()
+	defer d.rbMu.Unlock()
+
+	if d.pending == nil {
+		return errors.New("no firewall change waiting for confirmation")
+	}
+	d.pending.timer.Stop()
+	d.pending = nil
+	d.saveFirewallState()
+	d.applyHeldProfile()
+
+	evt := events.StartFirewall("confirm").Profile(d.FirewallProfile())
+	d.events.Emit(evt.End())
+	d.logger.Info("firewall change confirmed")
+	return nil
+}
+
+// FirewallConfirmDeadline returns when the pending change will be
+// reverted, or the zero time if nothing is pending.
+func (d *Daemon) FirewallConfirmDeadline() time.Time {
+	d.rbMu.Lock()
+	defer d.rbMu.Unlock()
+
+	if d.pending == nil {
+		return time.Time{}
+	}
+	return d.pending.deadline
+}
+
+// OnFirewallRevert registers fn to run after an unconfirmed change has
+// been rolled back.
+func (d *Daemon) OnFirewallRevert(fn func()) {
+	d.rbMu.Lock()
+	defer d.rbMu.Unlock()
+	d.revertListeners = append(d.revertListeners, fn)
+}
+
+// revertFirewall puts back the state recorded before p's change.
+func (d *Daemon) revertFirewall(p *pendingChange) {
+	d.rbMu.Lock()
+	// confirmed, or superseded between the timer firing and us getting the lock
+	if d.pending != p {
+		d.rbMu.Unlock()
+		return
+	}
+	d.pending = nil
+	listeners := slices.Clone(d.revertListeners)
+
+	evt := events.StartFirewall("revert").Profile(p.snapshot.Profile().Name)
+	if err := d.firewall.Restore(p.snapshot); err != nil {
+		evt.SetError(err)
+		d.logger.Error("failed to revert firewall change", "error", err)
+	} else {
+		d.fwMu.Lock()
+		d.cfg.Firewall = p.config
+		d.fwMu.Unlock()
+		// the edits were never written, so the file already matches
+		d.configDirty = false
+		if st, err := d.firewall.Status(); err == nil {
+			evt.RuleCount(st.Rules)
+		}
+		d.logger.Warn("firewall change not confirmed, reverted", "profile", p.snapshot.Profile().Name)
+		d.saveFirewallState()
+	}
+	d.events.Emit(evt.End())
+	d.applyHeldProfile()
+	d.rbMu.Unlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// applyHeldProfile makes the automatic profile switch that arrived while
+// a change was pending. Must be called with rbMu held.
+func (d *Daemon) applyHeldProfile() {
+	profile := d.heldProfile
+	if profile == "" {
+		return
+	}
+	if err := d.autoSwitchProfile(profile); err != nil {
+		d.logger.Error("failed to switch firewall profile", "profile", profile, "error", err)
+	}
+}
+
+// cloneFirewallConfig deep-copies the firewall section so later edits to
+// the live config don't leak into a snapshot.
+func cloneFirewallConfig(c config.Firewall) config.Firewall {
+	profiles := make(map[string]config.FirewallProfile, len(c.Profiles))
+	for name, p := range c.Profiles {
+		p.Rules = slices.Clone(p.Rules)
+		profiles[name] = p
+	}
+	c.Profiles = profiles
+	c.Blocklists = slices.Clone(c.Blocklists)
+	c.Apps = slices.Clone(c.Apps)
+	return c
+}
@@ -0,0 +1,307 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/network"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+func TestParseFirewallRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    config.FirewallRule
+		want    config.FirewallRule
+		wantErr bool
+	}{
+		{
+			name: "canonical form",
+			rule: config.FirewallRule{Proto: "TCP", Port: 22, PortEnd: 22, Source: "10.1.2.3/8"},
+			want: config.FirewallRule{Proto: "tcp", Port: 22, Source: "10.0.0.0/8", Direction: "in"},
+		},
+		{
+			name: "single address",
+			rule: config.FirewallRule{Proto: "udp", Port: 1714, PortEnd: 1764, Source: "fd00::1", Direction: "out"},
+			want: config.FirewallRule{Proto: "udp", Port: 1714, PortEnd: 1764, Source: "fd00::1/128", Direction: "out"},
+		},
+		{name: "bad proto", rule: config.FirewallRule{Proto: "icmp", Port: 1}, wantErr: true},
+		{name: "port zero", rule: config.FirewallRule{Proto: "tcp"}, wantErr: true},
+		{name: "reversed range", rule: config.FirewallRule{Proto: "tcp", Port: 100, PortEnd: 10}, wantErr: true},
+		{name: "bad source", rule: config.FirewallRule{Proto: "tcp", Port: 22, Source: "lan"}, wantErr: true},
+		{name: "bad direction", rule: config.FirewallRule{Proto: "tcp", Port: 22, Direction: "both"}, wantErr: true},
+		{name: "long comment", rule: config.FirewallRule{Proto: "tcp", Port: 22, Comment: strings.Repeat("x", maxRuleComment+1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := parseFirewallRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddFirewallRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defense.toml")
+	cfg := config.Default()
+	cfg.Firewall.Profile = "home"
+	conn := firewall.NewMemConn()
+	d := New(cfg, slog.Default(), WithFirewallConn(conn), WithConfigPath(path))
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := d.Firewall().Status()
+
+	ssh := config.FirewallRule{Proto: "tcp", Port: 22, Source: "10.0.0.0/8", Comment: "ssh"}
+	if err := d.AddFirewallRule("", ssh); err != nil {
+		t.Fatalf("AddFirewallRule() error = %v", err)
+	}
+	if err := d.AddFirewallRule("home", config.FirewallRule{Proto: "tcp", Port: 22, Source: "10.0.0.0/8"}); err == nil {
+		t.Error("duplicate rule accepted")
+	}
+
+	after, _ := d.Firewall().Status()
+	if after.Rules != before.Rules+1 {
+		t.Errorf("loaded rules = %d, want %d", after.Rules, before.Rules+1)
+	}
+
+	saved, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := saved.Firewall.Profiles["home"].Rules; len(rules) != 1 || rules[0].Comment != "ssh" {
+		t.Errorf("saved rules = %+v, want the ssh rule", rules)
+	}
+
+	// removal ignores the comment
+	if err := d.RemoveFirewallRule("", config.FirewallRule{Proto: "tcp", Port: 22, Source: "10.0.0.0/8"}); err != nil {
+		t.Fatalf("RemoveFirewallRule() error = %v", err)
+	}
+	if _, rules, _ := d.FirewallRules(""); len(rules) != 0 {
+		t.Errorf("rules after remove = %+v", rules)
+	}
+	if err := d.RemoveFirewallRule("", ssh); err == nil {
+		t.Error("removing a missing rule succeeded")
+	}
+}
+
+func TestFirewallProfiles(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.Profile = "home"
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+
+	// listing while rules are edited is safe under -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for port := 1000; port < 1050; port++ {
+			d.AddFirewallRule("", config.FirewallRule{Proto: "tcp", Port: port})
+		}
+	}()
+	for range 50 {
+		d.FirewallProfiles()
+	}
+	<-done
+
+	profiles := d.FirewallProfiles()
+	if len(profiles["home"].Rules) != 50 {
+		t.Fatalf("home has %d rules, want 50", len(profiles["home"].Rules))
+	}
+	profiles["home"].Rules[0].Port = 1
+	delete(profiles, "home")
+	if _, rules, _ := d.FirewallRules("home"); len(rules) != 50 || rules[0].Port != 1000 {
+		t.Error("changing the copy changed the config")
+	}
+}
+
+func TestAddFirewallRule_InactiveProfile(t *testing.T) {
+	cfg := config.Default()
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := d.Firewall().Status()
+
+	if err := d.AddFirewallRule("home", config.FirewallRule{Proto: "udp", Port: 1714, PortEnd: 1764}); err != nil {
+		t.Fatalf("AddFirewallRule() error = %v", err)
+	}
+	if after, _ := d.Firewall().Status(); after.Rules != before.Rules {
+		t.Errorf("loaded rules changed from %d to %d for an inactive profile", before.Rules, after.Rules)
+	}
+	if err := d.AddFirewallRule("nope", config.FirewallRule{Proto: "tcp", Port: 22}); err == nil {
+		t.Error("rule added to unknown profile")
+	}
+}
+
+func TestFirewallRevert(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.ConfirmTimeout = "50ms"
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+	if err := d.setFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+
+	reverted := make(chan struct{}, 1)
+	d.OnFirewallRevert(func() { reverted <- struct{}{} })
+
+	if err := d.SetFirewallProfile("home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddFirewallRule("", config.FirewallRule{Proto: "tcp", Port: 22}); err != nil {
+		t.Fatal(err)
+	}
+	if d.FirewallConfirmDeadline().IsZero() {
+		t.Error("no confirm deadline after change")
+	}
+
+	select {
+	case <-reverted:
+	case <-time.After(time.Second):
+		t.Fatal("change not reverted")
+	}
+
+	// both changes ride on the first snapshot
+	if got := d.FirewallProfile(); got != "public" {
+		t.Errorf("profile after revert = %q, want public", got)
+	}
+	if cfg.Firewall.Profile != "public" || len(cfg.Firewall.Profiles["home"].Rules) != 0 {
+		t.Errorf("config not restored: profile %q, home rules %+v", cfg.Firewall.Profile, cfg.Firewall.Profiles["home"].Rules)
+	}
+	if !d.FirewallConfirmDeadline().IsZero() {
+		t.Error("confirm deadline still set after revert")
+	}
+	if err := d.ConfirmFirewall(); err == nil {
+		t.Error("ConfirmFirewall() succeeded with nothing pending")
+	}
+}
+
+func TestFirewallConfirm(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.ConfirmTimeout = "50ms"
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+
+	reverted := make(chan struct{}, 1)
+	d.OnFirewallRevert(func() { reverted <- struct{}{} })
+
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ConfirmFirewall(); err != nil {
+		t.Fatalf("ConfirmFirewall() error = %v", err)
+	}
+
+	select {
+	case <-reverted:
+		t.Fatal("confirmed change was reverted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !d.FirewallEnabled() {
+		t.Error("firewall disabled after confirmed enable")
+	}
+}
+
+func TestFirewallRevert_HoldsAutoSwitch(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.ConfirmTimeout = "50ms"
+	cfg.Network.AutoProfile = true
+	cfg.Network.Rules = []config.NetworkRule{{SSID: "HomeWifi", Trusted: true}}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+	reverted := make(chan struct{}, 1)
+	d.OnFirewallRevert(func() { reverted <- struct{}{} })
+
+	if err := d.SetFirewallProfile("strict"); err != nil {
+		t.Fatal(err)
+	}
+	d.handleNetworkChange(network.Connection{UUID: "uuid-home", SSID: "HomeWifi"})
+	if got := d.FirewallProfile(); got != "strict" {
+		t.Errorf("profile while a change is pending = %q, want strict", got)
+	}
+
+	select {
+	case <-reverted:
+	case <-time.After(time.Second):
+		t.Fatal("change not reverted")
+	}
+	// the revert takes back the user's change, not the network's
+	if got := d.FirewallProfile(); got != "home" {
+		t.Errorf("profile after revert = %q, want home", got)
+	}
+	if cfg.Firewall.Profile != "home" {
+		t.Errorf("config profile after revert = %q, want home", cfg.Firewall.Profile)
+	}
+}
+
+func TestFirewallConfirm_HoldsAutoSwitch(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.ConfirmTimeout = "1m"
+	cfg.Network.AutoProfile = true
+	cfg.Network.Rules = []config.NetworkRule{{SSID: "HomeWifi", Trusted: true}}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+
+	if err := d.SetFirewallProfile("strict"); err != nil {
+		t.Fatal(err)
+	}
+	d.handleNetworkChange(network.Connection{UUID: "uuid-home", SSID: "HomeWifi"})
+	if err := d.ConfirmFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.FirewallProfile(); got != "home" {
+		t.Errorf("profile after confirm = %q, want home", got)
+	}
+	if !d.FirewallConfirmDeadline().IsZero() {
+		t.Error("held switch is waiting for confirmation")
+	}
+}
+
+func TestFirewallConfirm_SavesConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defense.toml")
+	cfg := config.Default()
+	cfg.Firewall.ConfirmTimeout = "1m"
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithConfigPath(path))
+
+	ssh := config.FirewallRule{Proto: "tcp", Port: 22}
+	if err := d.AddFirewallRule("home", ssh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("config written before the change was confirmed: %v", err)
+	}
+
+	if err := d.ConfirmFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := saved.Firewall.Profiles["home"].Rules; len(rules) != 1 || rules[0].Port != 22 {
+		t.Errorf("saved rules = %+v, want the ssh rule", rules)
+	}
+}
+
+func TestFirewallRevert_AutoSwitchNotGuarded(t *testing.T) {
+	cfg := config.Default()
+	cfg.Firewall.ConfirmTimeout = "50ms"
+	cfg.Network.AutoProfile = true
+	cfg.Network.Rules = []config.NetworkRule{{SSID: "HomeWifi", Trusted: true}}
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+
+	d.handleNetworkChange(network.Connection{UUID: "uuid-home", SSID: "HomeWifi"})
+	if got := d.FirewallProfile(); got != "home" {
+		t.Fatalf("profile = %q, want home", got)
+	}
+	if !d.FirewallConfirmDeadline().IsZero() {
+		t.Error("automatic profile switch is waiting for confirmation")
+	}
+}
@@ -0,0 +1,114 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"errors"
+
+	"github.com/oreonproject/defense/pkg/events"
+)
+
+// Lockdown cuts the machine off the network, loopback aside, until
+// ReleaseLockdown. It isn't confirmable: a lockdown that lifted itself
+// after a timeout would defeat the point.
+func (d *Daemon) Lockdown() error {
+	if err := d.lockdown(); err != nil {
+		return err
+	}
+	d.persistFirewall()
+	return nil
+}
+
+func (d *Daemon) lockdown() error {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	evt := events.StartFirewall("lockdown").Profile(d.FirewallProfile())
+	defer func() {
+		d.events.Emit(evt.End())
+	}()
+
+	if d.firewall.LockedDown() {
+		err := errors.New("already locked down")
+		evt.SetError(err)
+		return err
+	}
+	prior := d.state.State()
+	if err := d.firewall.Lockdown(); err != nil {
+		evt.SetError(err)
+		return err
+	}
+	if st, err := d.firewall.Status(); err == nil {
+		evt.RuleCount(st.Rules)
+	}
+
+	d.preLockdown = prior
+	d.state.SetState(StateLockdown)
+	d.logger.Warn("firewall locked down, all traffic blocked")
+	return nil
+}
+
+// ReleaseLockdown ends a lockdown, putting back the ruleset from before
+// it.
+func (d *Daemon) ReleaseLockdown() error {
+	if err := d.releaseLockdown(); err != nil {
+		return err
+	}
+	d.endLockdownState()
+	d.persistFirewall()
+	return nil
+}
+
+func (d *Daemon) releaseLockdown() error {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	evt := events.StartFirewall("lockdown_release").Profile(d.FirewallProfile())
+	defer func() {
+		d.events.Emit(evt.End())
+	}()
+
+	if !d.firewall.LockedDown() {
+		err := errors.New("not locked down")
+		evt.SetError(err)
+		return err
+	}
+	if err := d.firewall.Release(); err != nil {
+		evt.SetError(err)
+		return err
+	}
+	if st, err := d.firewall.Status(); err == nil {
+		evt.RuleCount(st.Rules)
+	}
+
+	d.logger.Info("firewall lockdown released")
+	return nil
+}
+
+// endLockdownState leaves StateLockdown for the state the daemon is in
+// now, rather than the one it was in when the lockdown began: a scan may
+// have finished, or ClamAV gone away, in the meantime. Only a pause is
+// kept, as it's the user's to end. Must be called without fwMu held, as
+// pinging clamd can take a while.
+func (d *Daemon) endLockdownState() {
+	clamAvailable := d.checkClamAV()
+
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+	if d.firewall.LockedDown() {
+		return // locked down again while clamd was asked
+	}
+	next := d.healthState(clamAvailable)
+	if d.preLockdown == StatePaused {
+		next = StatePaused
+	}
+	// a scan that finishes after this sees the lockdown over and sets
+	// its own state
+	jobs := d.scans
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	if jobs.running != nil {
+		next = StateScanning
+	}
+	d.state.EndLockdown(next)
+}
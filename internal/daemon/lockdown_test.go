@@ -0,0 +1,146 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/scanner"
+)
+
+func TestLockdown(t *testing.T) {
+	d, _ := newScanDaemon(t, &gatedScanner{}, 0)
+	d.cfg.General.RealTimeProtection = false
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	d.State().SetState(StateProtected)
+
+	if err := d.Lockdown(); err != nil {
+		t.Fatalf("Lockdown() error = %v", err)
+	}
+	if err := d.Lockdown(); err == nil {
+		t.Error("second Lockdown() succeeded")
+	}
+	if !d.Firewall().LockedDown() {
+		t.Error("firewall not locked down")
+	}
+	if got := d.State().State(); got != StateLockdown {
+		t.Errorf("state = %v, want StateLockdown", got)
+	}
+
+	// nothing else gets to move the state or take the table away
+	d.healthCheck()
+	if got := d.State().State(); got != StateLockdown {
+		t.Errorf("state after health check = %v, want StateLockdown", got)
+	}
+	if err := d.SetFirewallEnabled(false); !errors.Is(err, firewall.ErrLockedDown) {
+		t.Errorf("SetFirewallEnabled(false) error = %v, want ErrLockedDown", err)
+	}
+
+	if err := d.ReleaseLockdown(); err != nil {
+		t.Fatalf("ReleaseLockdown() error = %v", err)
+	}
+	if d.Firewall().LockedDown() {
+		t.Error("firewall still locked down")
+	}
+	if got := d.State().State(); got != StateProtected {
+		t.Errorf("state after release = %v, want StateProtected", got)
+	}
+	if err := d.ReleaseLockdown(); err == nil {
+		t.Error("ReleaseLockdown() outside a lockdown succeeded")
+	}
+
+}
+
+func TestLockdown_ScanEnds(t *testing.T) {
+	s := &gatedScanner{release: make(chan struct{})}
+	d, root := newScanDaemon(t, s, 1)
+	d.cfg.General.RealTimeProtection = false
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	id, err := d.StartScan("quick", []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitScan(t, d, id, ScanRunning)
+
+	// released while the scan is still going
+	d.Lockdown()
+	d.ReleaseLockdown()
+	if got := d.State().State(); got != StateScanning {
+		t.Errorf("state after release mid-scan = %v, want StateScanning", got)
+	}
+
+	// released after it has finished
+	d.Lockdown()
+	close(s.release)
+	waitScan(t, d, id, ScanCompleted)
+	if err := d.ReleaseLockdown(); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.State().State(); got != StateProtected {
+		t.Errorf("state after release = %v, want StateProtected", got)
+	}
+}
+
+func TestLockdown_KeepsPause(t *testing.T) {
+	d, _ := newScanDaemon(t, &gatedScanner{}, 0)
+	d.State().SetState(StatePaused)
+	d.Lockdown()
+	d.ReleaseLockdown()
+	if got := d.State().State(); got != StatePaused {
+		t.Errorf("state after release = %v, want StatePaused", got)
+	}
+}
+
+func TestLockdown_ReleasePingsUnlocked(t *testing.T) {
+	d, _ := newScanDaemon(t, &gatedScanner{}, 0)
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	held := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// the ping is where fwMu would have been held
+			if d.fwMu.TryLock() {
+				d.fwMu.Unlock()
+				held <- false
+			} else {
+				held <- true
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte("PONG\n"))
+			conn.Close()
+		}
+	}()
+	d.scanner = scanner.New(sock)
+
+	if err := d.Lockdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReleaseLockdown(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case locked := <-held:
+		if locked {
+			t.Error("clamd was pinged with fwMu held")
+		}
+	default:
+		t.Error("clamd wasn't pinged on release")
+	}
+}
@@ -0,0 +1,145 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/events"
+)
+
+// What to do about other firewall managers, from firewall.conflict.
+const (
+	conflictCoexist = "coexist" // load our table alongside theirs
+	conflictDefer   = "defer"   // stand aside while firewalld or ufw is active
+	conflictRefuse  = "refuse"  // don't enable while one is active
+)
+
+// ErrManagerConflict is returned when the conflict strategy keeps the
+// firewall from being enabled.
+var ErrManagerConflict = errors.New("another firewall manager is active")
+
+// parseConflict validates the configured conflict strategy, falling back
+// to coexisting, which is what happened before there was a choice.
+func (d *Daemon) parseConflict(s string) string {
+	switch s {
+	case "":
+		return conflictCoexist
+	case conflictCoexist, conflictDefer, conflictRefuse:
+		return s
+	}
+	d.logger.Warn("invalid firewall conflict strategy, coexisting", "value", s)
+	return conflictCoexist
+}
+
+// managerNames lists managers for messages, e.g. "firewalld, ufw".
+func managerNames(managers []firewall.Manager) string {
+	names := make([]string, len(managers))
+	for i, m := range managers {
+		names[i] = m.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// detectManagers refreshes the list of other firewall managers. Must be
+// called with fwMu held.
+func (d *Daemon) detectManagers() {
+	managers, err := d.firewall.Managers(d.fwBus)
+	if err != nil {
+		// whatever could be checked is still worth having
+		d.logger.Debug("firewall manager detection incomplete", "error", err)
+	}
+	if !slices.EqualFunc(managers, d.managers, func(a, b firewall.Manager) bool {
+		return a.Name == b.Name && slices.Equal(a.Via, b.Via)
+	}) {
+		if len(managers) > 0 {
+			d.logger.Warn("other firewall managers active", "managers", managerNames(managers), "strategy", d.conflict)
+		} else if len(d.managers) > 0 {
+			d.logger.Info("no other firewall managers active")
+		}
+	}
+	d.managers = managers
+}
+
+// conflicting returns the managers last detected that the conflict
+// strategy acts on. Deferring only stands aside for managers positively
+// identified: tables nothing claims are as likely Docker or libvirt as a
+// firewall, and deferring to them would leave such hosts unprotected.
+// Must be called with fwMu held.
+func (d *Daemon) conflicting() []firewall.Manager {
+	switch d.conflict {
+	case conflictCoexist:
+		return nil
+	case conflictDefer:
+		var out []firewall.Manager
+		for _, m := range d.managers {
+			if m.Identified() {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+	return d.managers
+}
+
+// managerConflict returns an error if the conflict strategy says our
+// table shouldn't be loaded alongside the managers last detected. Must be
+// called with fwMu held.
+func (d *Daemon) managerConflict() error {
+	managers := d.conflicting()
+	if len(managers) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w (%s), firewall.conflict is %q", ErrManagerConflict, managerNames(managers), d.conflict)
+}
+
+// FirewallManagers returns the other firewall managers found by the last
+// check, and what is being done about them.
+func (d *Daemon) FirewallManagers() ([]firewall.Manager, string) {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+	return slices.Clone(d.managers), d.conflict
+}
+
+// reconcileManagers checks for other firewall managers and, when
+// deferring to them, removes our table while an identified one is active
+// and puts it back once they're all gone.
+func (d *Daemon) reconcileManagers() {
+	d.fwMu.Lock()
+	defer d.fwMu.Unlock()
+
+	d.detectManagers()
+	// a lockdown outranks any other manager
+	if d.conflict != conflictDefer || !d.cfg.Firewall.Enabled || d.firewall.LockedDown() {
+		return
+	}
+
+	managers := d.conflicting()
+	var action string
+	var err error
+	switch enabled := d.firewall.Enabled(); {
+	case len(managers) > 0 && enabled:
+		action = "defer"
+		err = d.firewall.Disable()
+	case len(managers) == 0 && !enabled:
+		action = "resume"
+		err = d.firewall.Enable()
+	default:
+		return
+	}
+
+	evt := events.StartFirewall(action).Profile(d.FirewallProfile())
+	if err != nil {
+		evt.SetError(err)
+		d.logger.Error("failed to follow other firewall managers", "action", action, "error", err)
+	} else if action == "defer" {
+		d.logger.Warn("firewall removed, deferring to other managers", "managers", managerNames(managers))
+	} else {
+		d.logger.Info("firewall reloaded, no other managers left")
+	}
+	d.events.Emit(evt.End())
+}
@@ -0,0 +1,125 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+// firewalldBus reports firewalld as running or not.
+type firewalldBus struct{ running bool }
+
+func (b *firewalldBus) NameHasOwner(name string) (bool, error) {
+	return b.running && name == "org.fedoraproject.FirewallD1", nil
+}
+
+func (b *firewalldBus) UnitActive(unit string) (bool, error) {
+	return b.running && unit == "firewalld.service", nil
+}
+
+func conflictDaemon(t *testing.T, conflict string, bus firewall.Bus) *Daemon {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Firewall.Conflict = conflict
+	return New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithFirewallBus(bus))
+}
+
+func TestManagerConflict_Coexist(t *testing.T) {
+	d := conflictDaemon(t, "coexist", &firewalldBus{running: true})
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatalf("SetFirewallEnabled(true) error = %v", err)
+	}
+	managers, conflict := d.FirewallManagers()
+	if len(managers) != 1 || managers[0].Name != "firewalld" || conflict != "coexist" {
+		t.Errorf("FirewallManagers() = %+v, %q", managers, conflict)
+	}
+}
+
+func TestManagerConflict_Refuse(t *testing.T) {
+	bus := &firewalldBus{running: true}
+	d := conflictDaemon(t, "refuse", bus)
+
+	if err := d.SetFirewallEnabled(true); !errors.Is(err, ErrManagerConflict) {
+		t.Fatalf("SetFirewallEnabled(true) error = %v, want ErrManagerConflict", err)
+	}
+	if d.FirewallEnabled() {
+		t.Error("firewall enabled alongside firewalld")
+	}
+
+	bus.running = false
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Errorf("SetFirewallEnabled(true) with firewalld gone: %v", err)
+	}
+}
+
+func TestManagerConflict_Defer(t *testing.T) {
+	conn := firewall.NewMemConn()
+	cfg := config.Default()
+	cfg.Firewall.Conflict = "defer"
+	d := New(cfg, slog.Default(), WithFirewallConn(conn))
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	addFilterTable := func(name string) *nftables.Table {
+		table := conn.AddTable(&nftables.Table{Name: name, Family: nftables.TableFamilyINet})
+		conn.AddChain(&nftables.Chain{
+			Name:     "input",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookInput,
+			Priority: nftables.ChainPriorityFilter,
+		})
+		if err := conn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return table
+	}
+
+	// a table nothing claims, e.g. Docker's, is reported but not deferred to
+	addFilterTable("filter")
+	d.reconcileManagers()
+	if !d.FirewallEnabled() {
+		t.Error("firewall removed for a table nothing claims")
+	}
+	if managers, _ := d.FirewallManagers(); len(managers) != 1 || managers[0].Name != "nftables" {
+		t.Errorf("FirewallManagers() = %+v, want the unclaimed table", managers)
+	}
+	d.SetFirewallEnabled(false)
+	if err := d.SetFirewallEnabled(true); err != nil {
+		t.Errorf("SetFirewallEnabled(true) alongside an unclaimed table: %v", err)
+	}
+
+	// firewalld's own table is
+	firewalld := addFilterTable("firewalld")
+	d.reconcileManagers()
+	if d.FirewallEnabled() {
+		t.Error("firewall still loaded alongside firewalld")
+	}
+	if !d.Config().Firewall.Enabled {
+		t.Error("deferring changed the configured state")
+	}
+
+	conn.DelTable(firewalld)
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.reconcileManagers()
+	if !d.FirewallEnabled() {
+		t.Error("firewall not reloaded once firewalld was gone")
+	}
+}
+
+func TestParseConflict(t *testing.T) {
+	d := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+	for in, want := range map[string]string{"": "coexist", "defer": "defer", "refuse": "refuse", "fight": "coexist"} {
+		if got := d.parseConflict(in); got != want {
+			t.Errorf("parseConflict(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
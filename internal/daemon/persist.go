@@ -0,0 +1,152 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+// firewallState is the posture the user last chose, kept in a file the
+// daemon owns so it survives restarts even when the config file is read
+// only. On startup it wins over the config.
+type firewallState struct {
+	Enabled  bool                             `toml:"enabled"`
+	Profile  string                           `toml:"profile"`
+	Lockdown bool                             `toml:"lockdown"`
+	Rules    map[string][]config.FirewallRule `toml:"rules"` // port rules by profile
+	Apps     []config.FirewallApp             `toml:"apps"`
+}
+
+// loadFirewallState applies the state file over the config. Profiles that
+// have since been removed from the config are ignored. A missing file is
+// not an error: nothing has been changed yet.
+func (d *Daemon) loadFirewallState() error {
+	if d.statePath == "" {
+		return nil
+	}
+	var st firewallState
+	if _, err := toml.DecodeFile(d.statePath, &st); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("load firewall state: %w", err)
+	}
+
+	fw := &d.cfg.Firewall
+	fw.Enabled = st.Enabled
+	if _, ok := fw.Profiles[st.Profile]; ok {
+		fw.Profile = st.Profile
+	} else if st.Profile != "" {
+		d.logger.Warn("saved firewall profile no longer configured", "profile", st.Profile)
+	}
+	for name, rules := range st.Rules {
+		if p, ok := fw.Profiles[name]; ok {
+			p.Rules = rules
+			fw.Profiles[name] = p
+		}
+	}
+	fw.Apps = st.Apps
+	d.lockdownAtStart = st.Lockdown
+	return nil
+}
+
+// saveFirewallState writes the state file, and the config file if rules
+// or apps were edited, unless a change is waiting for confirmation: only
+// confirmed changes should outlive a restart, and ConfirmFirewall saves
+// once it arrives. Must be called with rbMu held.
+func (d *Daemon) saveFirewallState() {
+	if d.pending != nil {
+		return
+	}
+	if d.configDirty {
+		d.fwMu.Lock()
+		err := d.saveConfig()
+		d.fwMu.Unlock()
+		if err != nil {
+			d.logger.Error("failed to save config", "path", d.configPath, "error", err)
+		} else {
+			d.configDirty = false
+		}
+	}
+	if d.statePath == "" {
+		return
+	}
+
+	d.fwMu.Lock()
+	st := firewallState{
+		Enabled:  d.cfg.Firewall.Enabled,
+		Profile:  d.cfg.Firewall.Profile,
+		Lockdown: d.firewall.LockedDown(),
+		Rules:    make(map[string][]config.FirewallRule, len(d.cfg.Firewall.Profiles)),
+		Apps:     d.cfg.Firewall.Apps,
+	}
+	for name, p := range d.cfg.Firewall.Profiles {
+		st.Rules[name] = p.Rules
+	}
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).Encode(st)
+	d.fwMu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(d.statePath, buf.Bytes(), 0600)
+	}
+	if err != nil {
+		d.logger.Error("failed to save firewall state", "path", d.statePath, "error", err)
+	}
+}
+
+// persistFirewall saves the firewall state after a change made outside
+// confirmable.
+func (d *Daemon) persistFirewall() {
+	d.rbMu.Lock()
+	defer d.rbMu.Unlock()
+	d.saveFirewallState()
+}
+
+// writeFileAtomic replaces path with data so that a crash or power loss
+// leaves either the old file or the new one, never a torn mix.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // fails harmlessly once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,93 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+func TestFirewallState_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firewall-state.toml")
+	d := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithStatePath(path))
+
+	ssh := config.FirewallRule{Proto: "tcp", Port: 22, Direction: "in", Comment: "ssh"}
+	if err := d.SetFirewallProfile("home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddFirewallRule("home", ssh); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFirewallEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config says otherwise, but the state file wins
+	restarted := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithStatePath(path))
+	cfg := restarted.Config().Firewall
+	if cfg.Enabled {
+		t.Error("firewall enabled after restart, want disabled")
+	}
+	if restarted.FirewallProfile() != "home" {
+		t.Errorf("profile after restart = %q, want home", restarted.FirewallProfile())
+	}
+	if rules := cfg.Profiles["home"].Rules; len(rules) != 1 || rules[0] != ssh {
+		t.Errorf("home rules after restart = %+v, want ssh", rules)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("state dir holds %d files, want only the state file", len(entries))
+	}
+}
+
+func TestFirewallState_OnlyConfirmed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firewall-state.toml")
+	cfg := config.Default()
+	cfg.Firewall.ConfirmTimeout = "1h"
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithStatePath(path))
+
+	if err := d.SetFirewallProfile("strict"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state saved before confirmation: %v", err)
+	}
+
+	if err := d.ConfirmFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	restarted := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithStatePath(path))
+	if restarted.FirewallProfile() != "strict" {
+		t.Errorf("profile after restart = %q, want strict", restarted.FirewallProfile())
+	}
+}
+
+func TestFirewallState_Lockdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firewall-state.toml")
+	d := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithStatePath(path))
+	if err := d.Lockdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithStatePath(path))
+	if !restarted.lockdownAtStart {
+		t.Error("lockdown not restored")
+	}
+}
+
+func TestFirewallState_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firewall-state.toml")
+	if err := os.WriteFile(path, []byte("enabled = maybe"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithStatePath(path))
+	if !d.Config().Firewall.Enabled || d.FirewallProfile() != "public" {
+		t.Error("unreadable state file changed the config")
+	}
+}
@@ -0,0 +1,94 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"errors"
+
+	"github.com/oreonproject/defense/internal/quarantine"
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/events"
+)
+
+// ErrNoQuarantine is returned by the quarantine calls when the daemon
+// has no vault.
+var ErrNoQuarantine = errors.New("quarantine is not available")
+
+// Quarantined lists what as may see in the vault, newest first: all of
+// it for root, and only files they owned for anyone else.
+func (d *Daemon) Quarantined(as *scanner.Identity) ([]quarantine.Item, error) {
+	if d.vault == nil {
+		return nil, ErrNoQuarantine
+	}
+	items, err := d.vault.List()
+	if err != nil {
+		return nil, err
+	}
+	visible := items[:0]
+	for _, item := range items {
+		if canSee(as, item) {
+			visible = append(visible, item)
+		}
+	}
+	return visible, nil
+}
+
+// RestoreQuarantined puts an item back where it was found. Only root
+// may, since it brings back a known threat.
+func (d *Daemon) RestoreQuarantined(id string, as *scanner.Identity) (quarantine.Item, error) {
+	item, err := d.quarantined(id, as)
+	if err != nil {
+		return quarantine.Item{}, err
+	}
+	if as.UID() != 0 {
+		return quarantine.Item{}, errors.New("only root can restore from quarantine")
+	}
+	if _, err := d.vault.Restore(id); err != nil {
+		return quarantine.Item{}, err
+	}
+	d.events.Emit(events.StartThreat(item.Path, item.Threat).
+		Action("restored").
+		QuarantineID(item.ID).
+		FileSize(item.Size).
+		End())
+	return item, nil
+}
+
+// DeleteQuarantined destroys an item for good. Root and the file's
+// owner may.
+func (d *Daemon) DeleteQuarantined(id string, as *scanner.Identity) error {
+	item, err := d.quarantined(id, as)
+	if err != nil {
+		return err
+	}
+	if err := d.vault.Delete(id); err != nil {
+		return err
+	}
+	d.events.Emit(events.StartThreat(item.Path, item.Threat).
+		Action("deleted").
+		QuarantineID(item.ID).
+		FileSize(item.Size).
+		End())
+	return nil
+}
+
+// quarantined looks up an item as may see. Others' items are reported
+// as not found, so IDs can't be probed.
+func (d *Daemon) quarantined(id string, as *scanner.Identity) (quarantine.Item, error) {
+	if d.vault == nil {
+		return quarantine.Item{}, ErrNoQuarantine
+	}
+	item, err := d.vault.Get(id)
+	if err != nil {
+		return quarantine.Item{}, err
+	}
+	if !canSee(as, item) {
+		return quarantine.Item{}, quarantine.ErrNotFound
+	}
+	return item, nil
+}
+
+// canSee reports whether as may see a quarantined item.
+func canSee(as *scanner.Identity, item quarantine.Item) bool {
+	return as != nil && (as.UID() == 0 || as.UID() == item.UID)
+}
@@ -0,0 +1,133 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oreonproject/defense/internal/quarantine"
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/ipc"
+)
+
+// eicarScanner finds a threat in every file.
+type eicarScanner struct{}
+
+func (eicarScanner) ScanFile(path string) *scanner.ScanResult {
+	return &scanner.ScanResult{Path: path, Threat: "Eicar-Test-Signature"}
+}
+
+func openTestVault(t *testing.T) *quarantine.Vault {
+	t.Helper()
+	v, err := quarantine.Open(filepath.Join(t.TempDir(), "quarantine"))
+	if err != nil {
+		t.Fatalf("quarantine.Open: %v", err)
+	}
+	t.Cleanup(func() { v.Close() })
+	return v
+}
+
+// lstat returns what a scan would have found at path.
+func lstat(path string) os.FileInfo {
+	fi, _ := os.Lstat(path)
+	return fi
+}
+
+func TestScanJobs_Quarantine(t *testing.T) {
+	d, root := newScanDaemon(t, eicarScanner{}, 2)
+	d.vault = openTestVault(t)
+
+	id, _ := d.StartScan("quick", []string{root})
+	job := waitScan(t, d, id, ScanCompleted)
+	if job.ThreatsFound != 2 {
+		t.Errorf("ThreatsFound = %d, want 2", job.ThreatsFound)
+	}
+	if left, _ := os.ReadDir(root); len(left) != 0 {
+		t.Errorf("%d infected files left in place", len(left))
+	}
+	items, err := d.vault.List()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("vault holds %+v, %v", items, err)
+	}
+
+	// with quarantine off, threats are only reported
+	d.cfg.Scanning.Quarantine = false
+	d.policy = newRemediationPolicy(d.cfg.Scanning, d.logger)
+	infected := filepath.Join(root, "again")
+	os.WriteFile(infected, []byte("data"), 0644)
+	id, _ = d.StartScan("quick", []string{root})
+	waitScan(t, d, id, ScanCompleted)
+	if _, err := os.Stat(infected); err != nil {
+		t.Errorf("quarantined with quarantine off: %v", err)
+	}
+}
+
+func TestServer_Quarantine(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+	server.daemon.vault = openTestVault(t)
+
+	path := filepath.Join(t.TempDir(), "eicar.com")
+	os.WriteFile(path, []byte("EICAR"), 0640)
+	added, err := server.daemon.vault.Add(path, "Eicar-Test-Signature", lstat(path))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	call := func(cmd, id string) *ipc.Response {
+		params, _ := json.Marshal(ipc.QuarantineParams{ID: id})
+		return sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: cmd, Params: params})
+	}
+
+	// the test runs as the file's owner, who can always see it
+	resp := call(ipc.CmdQuarantineList, "")
+	if !resp.Success {
+		t.Fatalf("QuarantineList failed: %s", resp.Error)
+	}
+	var list ipc.QuarantineListResponse
+	resp.UnmarshalData(&list)
+	if len(list.Items) != 1 || list.Items[0].ID != added.ID || list.Items[0].Path != path ||
+		list.Items[0].Mode != "-rw-r-----" {
+		t.Fatalf("list = %+v", list)
+	}
+
+	if resp := call(ipc.CmdQuarantineDelete, "nope"); resp.Success {
+		t.Error("deleting an unknown item succeeded")
+	}
+
+	if os.Getuid() == 0 {
+		if resp := call(ipc.CmdQuarantineRestore, added.ID); !resp.Success {
+			t.Fatalf("QuarantineRestore failed: %s", resp.Error)
+		}
+		if got, _ := os.ReadFile(path); string(got) != "EICAR" {
+			t.Errorf("restored %q", got)
+		}
+		if added, err = server.daemon.vault.Add(path, "Eicar-Test-Signature", lstat(path)); err != nil {
+			t.Fatalf("Add after restore: %v", err)
+		}
+	} else if resp := call(ipc.CmdQuarantineRestore, added.ID); resp.Success {
+		t.Error("restore succeeded for a user other than root")
+	}
+
+	if resp := call(ipc.CmdQuarantineDelete, added.ID); !resp.Success {
+		t.Fatalf("QuarantineDelete failed: %s", resp.Error)
+	}
+	resp = call(ipc.CmdQuarantineList, "")
+	resp.UnmarshalData(&list)
+	if len(list.Items) != 0 {
+		t.Errorf("list after delete = %+v", list)
+	}
+}
+
+func TestServer_QuarantineUnavailable(t *testing.T) {
+	_, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdQuarantineList})
+	if resp.Success {
+		t.Error("QuarantineList succeeded without a vault")
+	}
+}
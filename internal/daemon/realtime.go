@@ -0,0 +1,161 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"context"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/oreonproject/defense/internal/onaccess"
+	"github.com/oreonproject/defense/internal/scanner"
+)
+
+// ThreatFound is a threat real-time protection found and what was done
+// with it: "detected", "quarantined" or "deleted".
+type ThreatFound struct {
+	Path   string
+	Threat string
+	Action string
+	UID    uint32 // the file's owner, who is told as well as root
+}
+
+// watchRealTime starts on-access scanning in the background, if the
+// config turns it on. Where it can't start, protection stays at warning.
+func (d *Daemon) watchRealTime(ctx context.Context) {
+	if !d.cfg.General.RealTimeProtection {
+		return
+	}
+	cfg := d.cfg.RealTime
+
+	opts := []onaccess.Option{
+		onaccess.WithExclusions(newExclusions(d.cfg.Scanning, d.logger)),
+		onaccess.WithLogger(d.logger),
+	}
+	n := d.notifier
+	if n == nil {
+		var fanotify bool
+		var err error
+		if n, fanotify, err = d.realTimeNotifier(ctx); err != nil {
+			d.logger.Error("real-time protection unavailable", "error", err)
+			return
+		}
+		// fanotify watches whole mounts, inotify only the folders
+		if fanotify {
+			opts = append(opts, onaccess.WithPaths(cfg.Paths))
+		}
+	}
+
+	debounce := onaccess.DefaultDebounce
+	if cfg.Debounce != "" {
+		if v, err := time.ParseDuration(cfg.Debounce); err != nil {
+			d.logger.Warn("invalid realtime debounce, using the default", "value", cfg.Debounce)
+		} else {
+			debounce = v
+		}
+	}
+	opts = append(opts, onaccess.WithDebounce(debounce))
+
+	m := onaccess.New(n, d.scanner, d.reportFound, opts...)
+	d.realtime = m
+	go func() {
+		if err := m.Run(ctx); err != nil {
+			d.logger.Error("real-time protection stopped", "error", err)
+			if d.state.State() == StateProtected {
+				d.state.SetState(StateWarning)
+			}
+		}
+	}()
+	d.logger.Info("real-time protection started", "method", cfg.Method)
+}
+
+// realTimeNotifier opens what realtime.method asks for, reporting
+// whether it's fanotify.
+func (d *Daemon) realTimeNotifier(ctx context.Context) (onaccess.Notifier, bool, error) {
+	cfg := d.cfg.RealTime
+	switch cfg.Method {
+	case "fanotify", "inotify", "auto", "":
+	default:
+		d.logger.Warn("unknown realtime method, using auto", "value", cfg.Method)
+	}
+
+	if cfg.Method != "inotify" {
+		fa, err := onaccess.NewFanotify(cfg.Paths, cfg.BlockExec)
+		if err == nil {
+			return fa, true, nil
+		}
+		if cfg.Method == "fanotify" {
+			return nil, false, err
+		}
+		d.logger.Info("fanotify unavailable, watching folders with inotify", "error", err)
+	}
+	if cfg.BlockExec {
+		d.logger.Warn("realtime block_exec needs fanotify, programs won't be held up")
+	}
+
+	logind, err := onaccess.SystemLogind()
+	if err != nil {
+		d.logger.Warn("logind unavailable, not watching users' folders", "error", err)
+	}
+	in, err := onaccess.WatchFolders(ctx, cfg.Folders, logind, d.logger)
+	if err != nil {
+		if logind != nil {
+			logind.Close()
+		}
+		return nil, false, err
+	}
+	return in, false, nil
+}
+
+// reportFound deals with a threat real-time protection found, then tells
+// the OnThreatFound listeners what was done. Threats the user is asked
+// about go to the OnThreatAsk listeners instead.
+func (d *Daemon) reportFound(result *scanner.ScanResult, size int64) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(result.Path, &st); err != nil {
+		return // gone already
+	}
+	action := d.reportThreat(result, size)
+	if action == "" {
+		return
+	}
+
+	d.foundMu.Lock()
+	listeners := slices.Clone(d.found)
+	d.foundMu.Unlock()
+	found := ThreatFound{Path: result.Path, Threat: result.Threat, Action: action, UID: st.Uid}
+	for _, fn := range listeners {
+		fn(found)
+	}
+}
+
+// OnThreatFound registers fn to be told about threats real-time
+// protection finds.
+func (d *Daemon) OnThreatFound(fn func(ThreatFound)) {
+	d.foundMu.Lock()
+	defer d.foundMu.Unlock()
+	d.found = append(d.found, fn)
+}
+
+// RealTimeActive reports whether on-access scanning is running.
+func (d *Daemon) RealTimeActive() bool {
+	if d.realtime == nil {
+		return false
+	}
+	select {
+	case <-d.realtime.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// settledState is the state to rest in when nothing needs attention:
+// protected, unless real-time protection should be running and isn't.
+func (d *Daemon) settledState() State {
+	if d.cfg.General.RealTimeProtection && !d.RealTimeActive() {
+		return StateWarning
+	}
+	return StateProtected
+}
@@ -0,0 +1,124 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/onaccess"
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+// stubNotifier reports nothing until it's closed or made to fail.
+type stubNotifier struct {
+	once   sync.Once
+	closed chan struct{}
+	fail   chan error
+}
+
+func newStubNotifier() *stubNotifier {
+	return &stubNotifier{closed: make(chan struct{}), fail: make(chan error, 1)}
+}
+
+func (n *stubNotifier) Read() ([]onaccess.Event, error) {
+	select {
+	case <-n.closed:
+		return nil, errors.New("closed")
+	case err := <-n.fail:
+		return nil, err
+	}
+}
+
+func (n *stubNotifier) Respond(onaccess.Event, bool) error { return nil }
+
+func (n *stubNotifier) Close() error {
+	n.once.Do(func() { close(n.closed) })
+	return nil
+}
+
+func TestRealTime(t *testing.T) {
+	n := newStubNotifier()
+	cfg := config.Default()
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithNotifier(n))
+	if d.RealTimeActive() || d.settledState() != StateWarning {
+		t.Fatal("protected before real-time protection started")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.watchRealTime(ctx)
+	if !d.RealTimeActive() {
+		t.Fatal("RealTimeActive() = false after starting")
+	}
+	if got := d.settledState(); got != StateProtected {
+		t.Errorf("settledState() = %s, want protected", got)
+	}
+	d.state.SetState(StateProtected)
+
+	n.fail <- errors.New("fanotify went away")
+	select {
+	case <-d.realtime.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitor still running after its notifier failed")
+	}
+	if d.RealTimeActive() {
+		t.Error("RealTimeActive() = true after the monitor stopped")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for d.state.State() != StateWarning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := d.state.State(); got != StateWarning {
+		t.Errorf("state = %s, want warning", got)
+	}
+}
+
+func TestRealTime_Off(t *testing.T) {
+	cfg := config.Default()
+	cfg.General.RealTimeProtection = false
+	n := newStubNotifier()
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()), WithNotifier(n))
+
+	d.watchRealTime(context.Background())
+	if d.RealTimeActive() {
+		t.Error("real-time protection started while turned off")
+	}
+	if got := d.settledState(); got != StateProtected {
+		t.Errorf("settledState() = %s, want protected", got)
+	}
+}
+
+func TestReportFound(t *testing.T) {
+	d := New(config.Default(), slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+	d.vault = openTestVault(t)
+	var found []ThreatFound
+	d.OnThreatFound(func(f ThreatFound) { found = append(found, f) })
+
+	path := filepath.Join(t.TempDir(), "eicar.com")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	d.reportFound(&scanner.ScanResult{Path: path, Threat: "Eicar-Test-Signature", Info: lstat(path)}, 5)
+	want := ThreatFound{Path: path, Threat: "Eicar-Test-Signature", Action: "quarantined", UID: uint32(os.Getuid())}
+	if len(found) != 1 || found[0] != want {
+		t.Fatalf("found = %+v, want [%+v]", found, want)
+	}
+
+	// asking the user goes through OnThreatAsk instead
+	d.policy = newRemediationPolicy(config.Scanning{
+		Remediation: []config.RemediationRule{{Action: "ask"}},
+	}, d.logger)
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	d.reportFound(&scanner.ScanResult{Path: path, Threat: "Eicar-Test-Signature", Info: lstat(path)}, 5)
+	if len(found) != 1 {
+		t.Errorf("told about a threat the user is being asked about: %+v", found[1:])
+	}
+	d.settleAsks()
+}
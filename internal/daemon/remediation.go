@@ -0,0 +1,308 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oreonproject/defense/internal/quarantine"
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/config"
+	"github.com/oreonproject/defense/pkg/events"
+)
+
+// What can be done with a threat, as in config.RemediationRule.
+const (
+	RemediateReport     = "report"
+	RemediateQuarantine = "quarantine"
+	RemediateDelete     = "delete"
+	RemediateAsk        = "ask"
+)
+
+// askTimeout is how long a threat waits for the user to choose before
+// it is quarantined anyway.
+const askTimeout = 5 * time.Minute
+
+// ErrAskNotFound is returned for threats the daemon isn't waiting on an
+// answer for.
+var ErrAskNotFound = errors.New("no such threat waiting for an answer")
+
+// remediationPolicy picks what to do with each threat.
+type remediationPolicy struct {
+	rules    []remediationRule
+	fallback string // for threats no rule matches
+}
+
+type remediationRule struct {
+	paths   *scanner.PathRules // nil matches every path
+	threats []string           // empty matches every threat
+	action  string
+}
+
+// newRemediationPolicy compiles the remediation rules. Rules that don't
+// parse are dropped with a warning, rather than have them match more
+// than they were meant to.
+func newRemediationPolicy(cfg config.Scanning, logger *slog.Logger) *remediationPolicy {
+	p := &remediationPolicy{fallback: RemediateReport}
+	if cfg.Quarantine {
+		p.fallback = RemediateQuarantine
+	}
+	for i, r := range cfg.Remediation {
+		rule := remediationRule{threats: r.Threats, action: r.Action}
+		if !slices.Contains([]string{RemediateReport, RemediateQuarantine, RemediateDelete, RemediateAsk}, r.Action) {
+			logger.Warn("ignoring remediation rule with an unknown action", "rule", i, "action", r.Action)
+			continue
+		}
+		if len(r.Paths) > 0 {
+			paths, err := scanner.NewPathRules(r.Paths)
+			if err != nil {
+				logger.Warn("ignoring invalid remediation rule", "rule", i, "error", err)
+				continue
+			}
+			rule.paths = paths
+		}
+		bad := slices.ContainsFunc(r.Threats, func(t string) bool {
+			_, err := path.Match(t, "")
+			return err != nil
+		})
+		if bad {
+			logger.Warn("ignoring remediation rule with an invalid threat pattern", "rule", i, "threats", r.Threats)
+			continue
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p
+}
+
+// action returns what the first matching rule says to do with a threat
+// found at file.
+func (p *remediationPolicy) action(file, threat string) string {
+	for _, r := range p.rules {
+		if r.paths != nil && !r.paths.Match(file) {
+			continue
+		}
+		if len(r.threats) > 0 && !slices.ContainsFunc(r.threats, func(t string) bool {
+			ok, _ := path.Match(t, threat)
+			return ok
+		}) {
+			continue
+		}
+		return r.action
+	}
+	return p.fallback
+}
+
+// ThreatAsk is a threat waiting for the user to say what to do with it.
+type ThreatAsk struct {
+	ID      string
+	Path    string
+	Threat  string
+	Size    int64
+	UID     uint32 // the file's owner, who may answer as well as root
+	Expires time.Time
+}
+
+type threatAsk struct {
+	ThreatAsk
+	file  fileStamp   // so an answer isn't applied to a file swapped in since
+	info  fs.FileInfo // the file as it was scanned
+	timer *time.Timer
+}
+
+// fileStamp tells a file apart from one put in its place, even if the
+// inode is reused.
+type fileStamp struct {
+	dev, ino uint64
+	size     int64
+	ctime    syscall.Timespec
+}
+
+func stampOf(st *syscall.Stat_t) fileStamp {
+	return fileStamp{uint64(st.Dev), st.Ino, st.Size, st.Ctim}
+}
+
+// threatAsks holds the threats waiting on an answer.
+type threatAsks struct {
+	mu        sync.Mutex
+	pending   map[string]*threatAsk
+	next      int // for IDs
+	listeners []func(ThreatAsk)
+}
+
+func newThreatAsks() *threatAsks {
+	return &threatAsks{pending: make(map[string]*threatAsk)}
+}
+
+// reportThreat deals with a file a scan found a threat in as the policy
+// says, and emits the event recording what was done. It returns that
+// action, or "" if the user is being asked.
+func (d *Daemon) reportThreat(result *scanner.ScanResult, size int64) string {
+	action := d.policy.action(result.Path, result.Threat)
+	if action == RemediateAsk {
+		err := d.askThreat(result, size)
+		if err == nil {
+			return ""
+		}
+		d.logger.Warn("can't ask about threat, quarantining it", "path", result.Path, "error", err)
+		action = RemediateQuarantine
+	}
+	return d.remediate(result.Path, result.Threat, size, result.Info, action, "")
+}
+
+// remediate carries out action on a threat and emits the event for it,
+// returning the action recorded. info is the file as it was scanned; a
+// file that no longer matches it is left alone. Whatever can't be done
+// leaves the file reported as "detected".
+func (d *Daemon) remediate(file, threat string, size int64, info fs.FileInfo, action, askID string) string {
+	evt := events.StartThreat(file, threat).FileSize(size)
+	if askID != "" {
+		evt.AskID(askID)
+	}
+	done := "detected"
+	var err error
+	switch action {
+	case RemediateQuarantine:
+		if d.vault == nil {
+			break
+		}
+		item, qerr := d.vault.Add(file, threat, info)
+		if err = qerr; err == nil {
+			done = "quarantined"
+			evt.QuarantineID(item.ID)
+		}
+	case RemediateDelete:
+		if err = quarantine.RemoveFile(file, info); err == nil {
+			done = "deleted"
+		}
+	}
+	if err != nil {
+		d.logger.Error("remediation failed", "path", file, "threat", threat, "action", action, "error", err)
+		evt.SetError(err)
+	}
+	evt.Action(done)
+	d.events.Emit(evt.End())
+	return done
+}
+
+// askThreat holds a threat for the user to decide on, telling the
+// OnThreatAsk listeners. Unanswered, it is quarantined after askTimeout.
+func (d *Daemon) askThreat(result *scanner.ScanResult, size int64) error {
+	file, threat := result.Path, result.Threat
+	var st syscall.Stat_t
+	if err := syscall.Lstat(file, &st); err != nil {
+		return err
+	}
+	ask := &threatAsk{
+		ThreatAsk: ThreatAsk{
+			Path:    file,
+			Threat:  threat,
+			Size:    size,
+			UID:     st.Uid,
+			Expires: time.Now().Add(askTimeout),
+		},
+		file: stampOf(&st),
+		info: result.Info,
+	}
+
+	asks := d.asks
+	asks.mu.Lock()
+	asks.next++
+	ask.ID = fmt.Sprintf("ask-%d", asks.next)
+	asks.pending[ask.ID] = ask
+	ask.timer = time.AfterFunc(askTimeout, func() {
+		if d.takeAsk(ask.ID) != nil {
+			d.logger.Info("no answer about threat, quarantining it", "path", file, "threat", threat)
+			d.settle(ask, RemediateQuarantine)
+		}
+	})
+	listeners := slices.Clone(asks.listeners)
+	asks.mu.Unlock()
+
+	d.logger.Info("asking what to do about threat", "path", file, "threat", threat, "id", ask.ID)
+	for _, fn := range listeners {
+		fn(ask.ThreatAsk)
+	}
+	return nil
+}
+
+// OnThreatAsk registers fn to be told about threats the policy says to
+// ask the user about. They are answered with ResolveThreat.
+func (d *Daemon) OnThreatAsk(fn func(ThreatAsk)) {
+	d.asks.mu.Lock()
+	defer d.asks.mu.Unlock()
+	d.asks.listeners = append(d.asks.listeners, fn)
+}
+
+// ResolveThreat answers an ask with "report", "quarantine" or
+// "delete". Root and the file's owner may answer.
+func (d *Daemon) ResolveThreat(id, action string, as *scanner.Identity) error {
+	if !slices.Contains([]string{RemediateReport, RemediateQuarantine, RemediateDelete}, action) {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	asks := d.asks
+	asks.mu.Lock()
+	ask, ok := asks.pending[id]
+	if !ok || !canAnswer(as, ask.ThreatAsk) {
+		asks.mu.Unlock()
+		return ErrAskNotFound
+	}
+	delete(asks.pending, id)
+	ask.timer.Stop()
+	asks.mu.Unlock()
+
+	return d.settle(ask, action)
+}
+
+// settleAsks quarantines every threat still waiting for an answer, so
+// shutting down doesn't leave them be.
+func (d *Daemon) settleAsks() {
+	d.asks.mu.Lock()
+	pending := d.asks.pending
+	d.asks.pending = make(map[string]*threatAsk)
+	d.asks.mu.Unlock()
+	for _, ask := range pending {
+		ask.timer.Stop()
+		d.settle(ask, RemediateQuarantine)
+	}
+}
+
+// takeAsk removes an ask from those pending, returning nil if it has
+// already been answered.
+func (d *Daemon) takeAsk(id string) *threatAsk {
+	d.asks.mu.Lock()
+	defer d.asks.mu.Unlock()
+	ask := d.asks.pending[id]
+	delete(d.asks.pending, id)
+	return ask
+}
+
+// settle carries out the answer to an ask, if the file is still the one
+// it was about.
+func (d *Daemon) settle(ask *threatAsk, action string) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(ask.Path, &st); err != nil || stampOf(&st) != ask.file {
+		err := fmt.Errorf("%s has changed since it was scanned", ask.Path)
+		evt := events.StartThreat(ask.Path, ask.Threat).
+			FileSize(ask.Size).
+			AskID(ask.ID).
+			Action("detected")
+		evt.SetError(err)
+		d.events.Emit(evt.End())
+		return err
+	}
+	d.remediate(ask.Path, ask.Threat, ask.Size, ask.info, action, ask.ID)
+	return nil
+}
+
+// canAnswer reports whether as may answer an ask.
+func canAnswer(as *scanner.Identity, ask ThreatAsk) bool {
+	return as != nil && (as.UID() == 0 || as.UID() == ask.UID)
+}
@@ -0,0 +1,214 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/config"
+	"github.com/oreonproject/defense/pkg/ipc"
+)
+
+// selfIdentity returns the identity of the user running the tests, as
+// the IPC server would see it.
+func selfIdentity(t *testing.T) *scanner.Identity {
+	t.Helper()
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "self.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	id, err := peerIdentity(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestRemediationPolicy(t *testing.T) {
+	cfg := config.Scanning{
+		Quarantine: true,
+		Remediation: []config.RemediationRule{
+			{Threats: []string{"PUA.*"}, Action: "ask"},
+			{Paths: []string{"/srv/samples"}, Action: "report"},
+			{Paths: []string{"**/Downloads/**"}, Threats: []string{"Heuristics.*", "Win.*"}, Action: "delete"},
+			{Threats: []string{"[bad"}, Action: "delete"},
+			{Action: "shred"},
+		},
+	}
+	p := newRemediationPolicy(cfg, slog.Default())
+	if len(p.rules) != 3 {
+		t.Errorf("kept %d rules, want the 3 valid ones", len(p.rules))
+	}
+
+	tests := []struct {
+		path, threat, want string
+	}{
+		{"/home/a/Downloads/tool.exe", "PUA.Win.Tool.Agent", "ask"},
+		{"/srv/samples/x/eicar.com", "Eicar-Test-Signature", "report"},
+		{"/home/a/Downloads/x.doc", "Heuristics.OLE2.ContainsMacros", "delete"},
+		{"/home/a/Downloads/x.doc", "Doc.Dropper.Agent", "quarantine"},
+		{"/home/a/x.exe", "Win.Trojan.Agent", "quarantine"},
+	}
+	for _, tt := range tests {
+		if got := p.action(tt.path, tt.threat); got != tt.want {
+			t.Errorf("action(%s, %s) = %s, want %s", tt.path, tt.threat, got, tt.want)
+		}
+	}
+
+	if got := newRemediationPolicy(config.Scanning{}, slog.Default()).action("/x", "Win.Trojan.Agent"); got != "report" {
+		t.Errorf("with quarantine off, action = %s, want report", got)
+	}
+}
+
+func TestRemediate_Delete(t *testing.T) {
+	d, root := newScanDaemon(t, eicarScanner{}, 1)
+	d.vault = openTestVault(t)
+	d.cfg.Scanning.Remediation = []config.RemediationRule{{Action: "delete"}}
+	d.policy = newRemediationPolicy(d.cfg.Scanning, d.logger)
+
+	id, _ := d.StartScan("quick", []string{root})
+	waitScan(t, d, id, ScanCompleted)
+	if left, _ := os.ReadDir(root); len(left) != 0 {
+		t.Errorf("%d infected files left in place", len(left))
+	}
+	if items, _ := d.vault.List(); len(items) != 0 {
+		t.Errorf("deleted files were quarantined: %+v", items)
+	}
+}
+
+func TestRemediate_Ask(t *testing.T) {
+	d, root := newScanDaemon(t, eicarScanner{}, 2)
+	d.vault = openTestVault(t)
+	d.cfg.Scanning.Remediation = []config.RemediationRule{{Threats: []string{"Eicar-*"}, Action: "ask"}}
+	d.policy = newRemediationPolicy(d.cfg.Scanning, d.logger)
+	asked := make(chan ThreatAsk, 2)
+	d.OnThreatAsk(func(ask ThreatAsk) { asked <- ask })
+
+	id, _ := d.StartScan("quick", []string{root})
+	waitScan(t, d, id, ScanCompleted)
+	var asks []ThreatAsk
+	for range 2 {
+		select {
+		case ask := <-asked:
+			asks = append(asks, ask)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no ask for a threat")
+		}
+	}
+	// nothing is done until someone answers
+	if left, _ := os.ReadDir(root); len(left) != 2 {
+		t.Fatalf("%d files left while waiting for an answer, want 2", len(left))
+	}
+
+	me := selfIdentity(t)
+	if err := d.ResolveThreat(asks[0].ID, "shred", me); err == nil {
+		t.Error("ResolveThreat with an unknown action succeeded")
+	}
+	if err := d.ResolveThreat(asks[0].ID, "report", nil); !errors.Is(err, ErrAskNotFound) {
+		t.Errorf("ResolveThreat without an identity: %v, want ErrAskNotFound", err)
+	}
+	if err := d.ResolveThreat(asks[0].ID, "report", me); err != nil {
+		t.Fatalf("ResolveThreat(report) error = %v", err)
+	}
+	if _, err := os.Stat(asks[0].Path); err != nil {
+		t.Errorf("reported file: %v", err)
+	}
+	if err := d.ResolveThreat(asks[0].ID, "quarantine", me); !errors.Is(err, ErrAskNotFound) {
+		t.Errorf("answering twice: %v, want ErrAskNotFound", err)
+	}
+
+	// a file swapped in since isn't the one that was asked about
+	os.Remove(asks[1].Path)
+	os.WriteFile(asks[1].Path, []byte("innocent"), 0644)
+	if err := d.ResolveThreat(asks[1].ID, "delete", me); err == nil {
+		t.Error("ResolveThreat acted on a replaced file")
+	}
+	if _, err := os.Stat(asks[1].Path); err != nil {
+		t.Errorf("replacement file: %v", err)
+	}
+}
+
+func TestRemediate_AskUnansweredAtShutdown(t *testing.T) {
+	d, root := newScanDaemon(t, eicarScanner{}, 1)
+	d.vault = openTestVault(t)
+	d.cfg.Scanning.Remediation = []config.RemediationRule{{Action: "ask"}}
+	d.policy = newRemediationPolicy(d.cfg.Scanning, d.logger)
+
+	id, _ := d.StartScan("quick", []string{root})
+	waitScan(t, d, id, ScanCompleted)
+	d.settleAsks()
+	if left, _ := os.ReadDir(root); len(left) != 0 {
+		t.Errorf("%d files left after settling", len(left))
+	}
+	if items, _ := d.vault.List(); len(items) != 1 {
+		t.Errorf("vault holds %d items, want 1", len(items))
+	}
+}
+
+func TestServer_ThreatAsk(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+	d := server.daemon
+	d.vault = openTestVault(t)
+	d.policy = newRemediationPolicy(config.Scanning{
+		Remediation: []config.RemediationRule{{Action: "ask"}},
+	}, d.logger)
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, _ := json.Marshal(ipc.Request{ID: "1", Command: ipc.CmdSubscribe})
+	conn.Write(append(data, '\n'))
+	r := bufio.NewReader(conn)
+	r.ReadBytes('\n') // subscribed
+
+	path := filepath.Join(t.TempDir(), "eicar.com")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	d.reportThreat(&scanner.ScanResult{Path: path, Threat: "Eicar-Test-Signature", Info: lstat(path)}, 5)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("no push: %v", err)
+	}
+	var resp ipc.Response
+	var event ipc.StateChangeEvent
+	json.Unmarshal(line, &resp)
+	resp.UnmarshalData(&event)
+	if event.Reason != ipc.ReasonThreatAsk || event.Threat == nil || event.Threat.Path != path {
+		t.Fatalf("push = %+v", event)
+	}
+
+	params, _ := json.Marshal(ipc.ThreatResolveParams{ID: event.Threat.ID, Action: "quarantine"})
+	if resp := sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdThreatResolve, Params: params}); !resp.Success {
+		t.Fatalf("ThreatResolve failed: %s", resp.Error)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file not quarantined: %v", err)
+	}
+	if items, _ := d.vault.List(); len(items) != 1 {
+		t.Errorf("vault holds %d items, want 1", len(items))
+	}
+}
@@ -0,0 +1,498 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/events"
+)
+
+// Scan job statuses.
+const (
+	ScanQueued    = "queued"
+	ScanRunning   = "running"
+	ScanCompleted = "completed"
+	ScanCancelled = "cancelled"
+	ScanFailed    = "failed"
+)
+
+// scanProgressInterval is how often listeners hear about a running scan.
+const scanProgressInterval = 2 * time.Second
+
+// keepScanJobs is how many finished jobs stay around for scan_status.
+const keepScanJobs = 10
+
+// ErrScanNotFound is returned for job IDs the daemon doesn't know.
+var ErrScanNotFound = errors.New("no such scan job")
+
+// ErrScanNoAccess is returned for custom scan paths the caller can't
+// read, or that don't exist.
+var ErrScanNoAccess = errors.New("cannot read")
+
+// ErrScanNotYours is returned when someone other than root, an admin or
+// whoever started a scan tries to cancel it.
+var ErrScanNotYours = errors.New("scan was started by someone else")
+
+// ScanCustom is the kind of scans started with StartCustomScan.
+const ScanCustom = "custom"
+
+// maxCustomScans is how many custom scans can be running or queued.
+const maxCustomScans = 8
+
+// ScanJob is a snapshot of one scan.
+type ScanJob struct {
+	ID     string
+	Kind   string // quick, full or custom
+	Status string
+	Error  string // why the scan failed
+	Paths  []string
+	Owner  uint32 // who started a custom scan; root for quick and full
+
+	FilesScanned int
+	BytesScanned int64
+	ThreatsFound int
+	CurrentPath  string // the file scanned last
+	Queued       int    // jobs ahead of this one while queued
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// TotalFiles and TotalBytes are what the pre-count found the scan
+	// covers; zero until it finishes, or with pre_count off.
+	TotalFiles int
+	TotalBytes int64
+
+	// Progress and ETA are measured against the pre-count, or until it
+	// is in against the bytes the last completed scan of the same kind
+	// covered; zero when there is neither.
+	Progress float64
+	ETA      time.Time
+}
+
+// scanJob is a scan from being requested until it finishes. Its fields
+// are guarded by scanJobs.mu.
+type scanJob struct {
+	ScanJob
+	as     *scanner.Identity // who a custom scan is for
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// scanJobs runs one scan at a time and queues the rest, at most one of
+// each kind.
+type scanJobs struct {
+	mu       sync.Mutex
+	running  *scanJob
+	queue    []*scanJob
+	finished []*scanJob       // oldest first
+	expected map[string]int64 // bytes the last completed scan of each kind covered
+
+	listeners []func(ScanJob)
+}
+
+func newScanJobs() *scanJobs {
+	return &scanJobs{expected: make(map[string]int64)}
+}
+
+// StartScan queues a scan of paths and returns its job ID. It starts
+// straight away unless another scan is running. A second scan of a kind
+// that is already running or queued is refused.
+func (d *Daemon) StartScan(kind string, paths []string) (string, error) {
+	jobs := d.scans
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	for _, j := range jobs.active() {
+		if j.Kind == kind {
+			return "", fmt.Errorf("a %s scan is already %s (%s)", kind, j.Status, j.ID)
+		}
+	}
+	return d.queueScan(kind, paths, nil), nil
+}
+
+// StartCustomScan queues a scan of paths on behalf of as, who must be
+// able to read each of them; nothing as couldn't read is scanned. Any
+// number of custom scans can wait in the queue, up to maxCustomScans.
+func (d *Daemon) StartCustomScan(paths []string, as *scanner.Identity) (string, error) {
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no paths to scan")
+	}
+	if as == nil {
+		return "", fmt.Errorf("can't tell who is asking")
+	}
+	resolved := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return "", fmt.Errorf("%s: not an absolute path", p)
+		}
+		// the same answer whether it's missing or hidden from them, so
+		// this can't be used to find out what exists
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil || !as.CanRead(real) {
+			return "", fmt.Errorf("%s: %w", p, ErrScanNoAccess)
+		}
+		resolved = append(resolved, real)
+	}
+
+	jobs := d.scans
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	custom := 0
+	for _, j := range jobs.active() {
+		if j.Kind == ScanCustom {
+			custom++
+		}
+	}
+	if custom >= maxCustomScans {
+		return "", fmt.Errorf("%d custom scans are already waiting", custom)
+	}
+	return d.queueScan(ScanCustom, resolved, as), nil
+}
+
+// ownedBy reports whether peer started the job. Quick and full scans
+// belong to root.
+func (j *ScanJob) ownedBy(peer *scanner.Identity) bool {
+	return peer != nil && peer.UID() == j.Owner
+}
+
+// queueScan adds a job to the queue, starting it if nothing is running.
+// Must be called with scans.mu held.
+func (d *Daemon) queueScan(kind string, paths []string, as *scanner.Identity) string {
+	jobs := d.scans
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &scanJob{
+		ScanJob: ScanJob{
+			ID:     jobs.newID(kind),
+			Kind:   kind,
+			Status: ScanQueued,
+			Paths:  paths,
+		},
+		as:     as,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if as != nil {
+		job.Owner = as.UID()
+	}
+	jobs.queue = append(jobs.queue, job)
+	if jobs.running == nil {
+		d.startNextScan()
+	}
+	return job.ID
+}
+
+// ScanStatus returns the job with the given ID, or with an empty ID the
+// running scan, falling back to the last one to finish.
+func (d *Daemon) ScanStatus(id string) (ScanJob, error) {
+	jobs := d.scans
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	job := jobs.find(id)
+	if job == nil {
+		return ScanJob{}, ErrScanNotFound
+	}
+	return jobs.snapshot(job), nil
+}
+
+// OnScanProgress registers fn to be told how the running scan is going
+// every scanProgressInterval, and once more when it finishes.
+func (d *Daemon) OnScanProgress(fn func(ScanJob)) {
+	d.scans.mu.Lock()
+	defer d.scans.mu.Unlock()
+	d.scans.listeners = append(d.scans.listeners, fn)
+}
+
+// CancelScan stops a running scan or drops a queued one on behalf of as,
+// who must be root, an admin or the user who started it. An empty ID
+// means the running scan.
+func (d *Daemon) CancelScan(id string, as *scanner.Identity) error {
+	admin := d.isAdmin(as) // the group lookup stays outside scans.mu
+	jobs := d.scans
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	var job *scanJob
+	if id == "" {
+		job = jobs.running
+	} else if j := jobs.find(id); j != nil && j.Status != ScanCompleted && j.Status != ScanFailed && j.Status != ScanCancelled {
+		job = j
+	}
+	if job == nil {
+		return ErrScanNotFound
+	}
+	if !admin && !job.ownedBy(as) {
+		return ErrScanNotYours
+	}
+
+	job.cancel()
+	if i := slices.Index(jobs.queue, job); i >= 0 {
+		// it never started, so no worker will finish it
+		jobs.queue = slices.Delete(jobs.queue, i, i+1)
+		job.Status = ScanCancelled
+		job.FinishedAt = time.Now()
+		jobs.keep(job)
+	}
+	return nil
+}
+
+// cancelScans stops the running scan and drops the queued ones, for
+// shutdown.
+func (d *Daemon) cancelScans() {
+	jobs := d.scans
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	for _, job := range jobs.queue {
+		job.cancel()
+		job.Status = ScanCancelled
+		job.FinishedAt = time.Now()
+		jobs.keep(job)
+	}
+	jobs.queue = nil
+	if jobs.running != nil {
+		jobs.running.cancel()
+	}
+}
+
+// startNextScan starts the first queued job, if any. Must be called with
+// scans.mu held and no job running.
+func (d *Daemon) startNextScan() {
+	jobs := d.scans
+	if len(jobs.queue) == 0 {
+		return
+	}
+	job := jobs.queue[0]
+	jobs.queue = jobs.queue[1:]
+	job.Status = ScanRunning
+	job.StartedAt = time.Now()
+	jobs.running = job
+	go d.runScanJob(job)
+}
+
+// runScanJob scans the job's paths and starts whatever is queued next.
+func (d *Daemon) runScanJob(job *scanJob) {
+	jobs := d.scans
+	evt := events.StartScan(job.Kind, job.ID)
+	d.state.SetState(StateScanning)
+
+	var stats scanner.Stats
+	var err error
+	if !d.scanner.IsAvailable() {
+		err = fmt.Errorf("ClamAV not available")
+	} else {
+		if d.cfg.Scanning.PreCount {
+			go d.countScanJob(job)
+		}
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(scanProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					jobs.notify(job)
+				}
+			}
+		}()
+
+		stats, err = d.engine.Run(job.ctx, job.Paths, func(result *scanner.ScanResult, size int64) {
+			jobs.mu.Lock()
+			job.FilesScanned++
+			job.BytesScanned += size
+			job.CurrentPath = result.Path
+			if !result.Clean {
+				job.ThreatsFound++
+			}
+			jobs.mu.Unlock()
+
+			if !result.Clean {
+				d.reportThreat(result, size)
+			}
+		}, job.runOpts()...)
+		close(done)
+	}
+
+	jobs.mu.Lock()
+	job.cancel()
+	job.FinishedAt = time.Now()
+	switch {
+	case errors.Is(err, context.Canceled):
+		job.Status = ScanCancelled
+	case err != nil:
+		job.Status = ScanFailed
+		job.Error = err.Error()
+	default:
+		job.Status = ScanCompleted
+		if job.Kind != ScanCustom {
+			jobs.expected[job.Kind] = stats.Bytes
+		}
+	}
+	jobs.running = nil
+	jobs.keep(job)
+	status := job.Status
+	d.startNextScan()
+	more := jobs.running != nil
+	jobs.mu.Unlock()
+
+	jobs.notify(job)
+
+	evt.FilesScanned(stats.Scanned).ThreatsFound(stats.Threats).FilesSkipped(stats.Skipped).
+		CacheHits(stats.CacheHits).CacheMisses(stats.CacheMisses)
+	if status == ScanFailed {
+		evt.SetError(err)
+	} else if status == ScanCancelled {
+		evt.Set("cancelled", true)
+	}
+	d.events.Emit(evt.End())
+
+	if status == ScanCompleted {
+		d.SetLastScan(time.Now())
+	}
+	if more {
+		return
+	}
+	switch {
+	case status == ScanFailed:
+		d.state.SetState(StateWarning)
+	case stats.Threats > 0:
+		d.state.SetState(StateAlert)
+	default:
+		d.state.SetState(d.settledState())
+	}
+}
+
+// runOpts limits a custom scan to what its user could read.
+func (j *scanJob) runOpts() []scanner.RunOption {
+	if j.as == nil {
+		return nil
+	}
+	return []scanner.RunOption{scanner.AsUser(j.as)}
+}
+
+// countScanJob totals up what the job's scan covers, so its progress can
+// be measured. It gives up when the scan finishes first.
+func (d *Daemon) countScanJob(job *scanJob) {
+	files, bytes, err := d.engine.Count(job.ctx, job.Paths, job.runOpts()...)
+	if err != nil {
+		return
+	}
+	d.scans.mu.Lock()
+	job.TotalFiles = files
+	job.TotalBytes = bytes
+	d.scans.mu.Unlock()
+}
+
+// snapshot copies a job for reporting, working out its place in the
+// queue and how far along it is. Must be called with mu held.
+func (j *scanJobs) snapshot(job *scanJob) ScanJob {
+	snap := job.ScanJob
+	if i := slices.Index(j.queue, job); i >= 0 {
+		snap.Queued = i
+		if j.running != nil {
+			snap.Queued++
+		}
+	}
+	if job.Status == ScanCompleted {
+		snap.Progress = 1
+		return snap
+	}
+	if job.Status != ScanRunning {
+		return snap
+	}
+	switch {
+	case job.TotalBytes > 0:
+		snap.Progress = float64(job.BytesScanned) / float64(job.TotalBytes)
+	case job.TotalFiles > 0:
+		// nothing but empty files
+		snap.Progress = float64(job.FilesScanned) / float64(job.TotalFiles)
+	case j.expected[job.Kind] > 0:
+		snap.Progress = float64(job.BytesScanned) / float64(j.expected[job.Kind])
+	}
+	// files can grow or appear after they were counted
+	snap.Progress = min(snap.Progress, 0.99)
+	if snap.Progress > 0 {
+		elapsed := time.Since(job.StartedAt)
+		snap.ETA = job.StartedAt.Add(time.Duration(float64(elapsed) / snap.Progress))
+	}
+	return snap
+}
+
+// notify passes a snapshot of job to the progress listeners.
+func (j *scanJobs) notify(job *scanJob) {
+	j.mu.Lock()
+	snap := j.snapshot(job)
+	listeners := slices.Clone(j.listeners)
+	j.mu.Unlock()
+	for _, fn := range listeners {
+		fn(snap)
+	}
+}
+
+// active returns the running job and the queued ones.
+func (j *scanJobs) active() []*scanJob {
+	if j.running == nil {
+		return j.queue
+	}
+	return append([]*scanJob{j.running}, j.queue...)
+}
+
+// find looks a job up by ID; see ScanStatus for the empty ID.
+func (j *scanJobs) find(id string) *scanJob {
+	if id == "" {
+		if j.running != nil {
+			return j.running
+		}
+		if len(j.finished) > 0 {
+			return j.finished[len(j.finished)-1]
+		}
+		return nil
+	}
+	for _, job := range append(j.active(), j.finished...) {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// keep files a job as finished, forgetting the oldest beyond keepScanJobs.
+func (j *scanJobs) keep(job *scanJob) {
+	j.finished = append(j.finished, job)
+	if len(j.finished) > keepScanJobs {
+		j.finished = j.finished[len(j.finished)-keepScanJobs:]
+	}
+}
+
+// newID names a job after its kind and start time, adding a counter if
+// that's taken.
+func (j *scanJobs) newID(kind string) string {
+	base := kind + "-" + time.Now().Format("20060102-150405")
+	id := base
+	for n := 2; j.find(id) != nil; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	return id
+}
+
+// scanPaths returns what a scan of the given kind covers.
+func (d *Daemon) scanPaths(kind string) []string {
+	if kind == "quick" {
+		return d.cfg.Scanning.QuickScanPaths
+	}
+	if len(d.cfg.Scanning.FullScanPaths) == 0 {
+		return []string{"/"}
+	}
+	return d.cfg.Scanning.FullScanPaths
+}
@@ -0,0 +1,216 @@
+// oreon/defense · watchthelight <wtl>
+
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+// gatedScanner holds every file until release is closed.
+type gatedScanner struct {
+	release chan struct{}
+}
+
+func (s *gatedScanner) ScanFile(path string) *scanner.ScanResult {
+	<-s.release
+	return &scanner.ScanResult{Path: path, Clean: true}
+}
+
+// newScanDaemon returns a daemon whose clamd answers PING and whose
+// scans go through s, along with a directory of n files to scan.
+func newScanDaemon(t *testing.T, s scanner.FileScanner, n int) (*Daemon, string) {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte("PONG\n"))
+			conn.Close()
+		}
+	}()
+
+	cfg := config.Default()
+	cfg.ClamAV.SocketPath = sock
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
+	d.engine = scanner.NewEngine(s, scanner.WithWorkers(1))
+
+	root := t.TempDir()
+	for i := range n {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("file%d", i)), []byte("data"), 0644)
+	}
+	return d, root
+}
+
+// waitScan polls until the job reaches status.
+func waitScan(t *testing.T, d *Daemon, id, status string) ScanJob {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, err := d.ScanStatus(id)
+		if err != nil {
+			t.Fatalf("ScanStatus(%q) error = %v", id, err)
+		}
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, job.Status, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestScanJobs_Queue(t *testing.T) {
+	s := &gatedScanner{release: make(chan struct{})}
+	d, root := newScanDaemon(t, s, 3)
+
+	quick, err := d.StartScan("quick", []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.StartScan("quick", []string{root}); err == nil {
+		t.Error("second quick scan was accepted while one is running")
+	}
+	full, err := d.StartScan("full", []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quick == full {
+		t.Fatalf("both jobs got ID %s", quick)
+	}
+
+	waitScan(t, d, quick, ScanRunning)
+	if job := waitScan(t, d, full, ScanQueued); job.Queued != 1 {
+		t.Errorf("full scan queued behind %d jobs, want 1", job.Queued)
+	}
+
+	close(s.release)
+	job := waitScan(t, d, quick, ScanCompleted)
+	if job.FilesScanned != 3 || job.BytesScanned != 12 || job.Progress != 1 {
+		t.Errorf("quick scan = %+v, want 3 files, 12 bytes, done", job)
+	}
+	waitScan(t, d, full, ScanCompleted)
+	if d.LastScan().IsZero() {
+		t.Error("last scan time not set")
+	}
+}
+
+func TestScanJobs_Cancel(t *testing.T) {
+	s := &gatedScanner{release: make(chan struct{})}
+	d, root := newScanDaemon(t, s, 3)
+
+	root0 := scanner.NewIdentity(0, 0)
+	quick, _ := d.StartScan("quick", []string{root})
+	full, _ := d.StartScan("full", []string{root})
+	waitScan(t, d, quick, ScanRunning)
+
+	// the queued one is dropped without ever starting
+	if err := d.CancelScan(full, root0); err != nil {
+		t.Fatalf("CancelScan(%s) error = %v", full, err)
+	}
+	if job := waitScan(t, d, full, ScanCancelled); !job.StartedAt.IsZero() {
+		t.Error("cancelled queued job has a start time")
+	}
+
+	if err := d.CancelScan("", root0); err != nil {
+		t.Fatalf("CancelScan(\"\") error = %v", err)
+	}
+	close(s.release)
+	waitScan(t, d, quick, ScanCancelled)
+	if !d.LastScan().IsZero() {
+		t.Error("cancelled scan set the last scan time")
+	}
+
+	if err := d.CancelScan(quick, root0); !errors.Is(err, ErrScanNotFound) {
+		t.Errorf("cancelling a finished job: error = %v, want ErrScanNotFound", err)
+	}
+	if _, err := d.ScanStatus("quick-nope"); !errors.Is(err, ErrScanNotFound) {
+		t.Errorf("ScanStatus(unknown) error = %v, want ErrScanNotFound", err)
+	}
+}
+
+func TestScanJobs_CancelOwner(t *testing.T) {
+	s := &gatedScanner{release: make(chan struct{})}
+	defer close(s.release)
+	d, root := newScanDaemon(t, s, 1)
+	owner := scanner.NewIdentity(1000, 1000)
+	nobody := scanner.NewIdentity(65534, 65534)
+
+	quick, _ := d.StartScan("quick", []string{root})
+	waitScan(t, d, quick, ScanRunning)
+	d.scans.mu.Lock()
+	custom := d.queueScan(ScanCustom, []string{root}, owner)
+	d.scans.mu.Unlock()
+
+	for _, c := range []struct {
+		id string
+		as *scanner.Identity
+	}{{quick, nobody}, {quick, owner}, {quick, nil}, {custom, nobody}} {
+		if err := d.CancelScan(c.id, c.as); !errors.Is(err, ErrScanNotYours) {
+			t.Errorf("CancelScan(%s) by %v: error = %v, want ErrScanNotYours", c.id, c.as, err)
+		}
+	}
+	waitScan(t, d, custom, ScanQueued)
+
+	if err := d.CancelScan(custom, owner); err != nil {
+		t.Fatalf("owner cancelling their scan: error = %v", err)
+	}
+	waitScan(t, d, custom, ScanCancelled)
+	if err := d.CancelScan(quick, scanner.NewIdentity(0, 0)); err != nil {
+		t.Fatalf("root cancelling a scan: error = %v", err)
+	}
+}
+
+func TestScanJobs_Progress(t *testing.T) {
+	s := &gatedScanner{release: make(chan struct{})}
+	d, root := newScanDaemon(t, s, 3)
+	updates := make(chan ScanJob, 10)
+	d.OnScanProgress(func(job ScanJob) { updates <- job })
+
+	id, _ := d.StartScan("quick", []string{root})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, _ := d.ScanStatus(id)
+		if job.TotalFiles == 3 {
+			if job.TotalBytes != 12 || job.Progress != 0 || !job.ETA.IsZero() {
+				t.Errorf("before any file is done: %+v", job)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pre-count never finished: %+v", job)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(s.release)
+	select {
+	case job := <-updates:
+		if job.ID != id || job.Status != ScanCompleted || job.Progress != 1 {
+			t.Errorf("final update = %+v", job)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no progress update when the scan finished")
+	}
+}
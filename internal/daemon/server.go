@@ -10,11 +10,16 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
-	"time"
 
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/quarantine"
+	"github.com/oreonproject/defense/internal/scanner"
+	"github.com/oreonproject/defense/pkg/config"
 	"github.com/oreonproject/defense/pkg/events"
 	"github.com/oreonproject/defense/pkg/ipc"
+	"github.com/oreonproject/defense/pkg/logging"
 )
 
 // Server handles IPC connections from clients (tray, CLI).
@@ -23,7 +28,7 @@ type Server struct {
 	listener    net.Listener
 	daemon      *Daemon
 	done        chan struct{}
-	subscribers map[net.Conn]bool
+	subscribers map[net.Conn]*scanner.Identity // who each is, nil if unknown
 	subMu       sync.Mutex
 }
 
@@ -33,7 +38,7 @@ func NewServer(socketPath string, daemon *Daemon) *Server {
 		socketPath:  socketPath,
 		daemon:      daemon,
 		done:        make(chan struct{}),
-		subscribers: make(map[net.Conn]bool),
+		subscribers: make(map[net.Conn]*scanner.Identity),
 	}
 
 	// Register for state changes to push to subscribers
@@ -41,6 +46,75 @@ func NewServer(socketPath string, daemon *Daemon) *Server {
 		s.broadcastStateChange(old.String(), new.String())
 	})
 
+	// A revert doesn't change the protection state, but clients still need
+	// to know their firewall change was thrown away
+	daemon.OnFirewallRevert(func() {
+		state := daemon.State().State().String()
+		s.broadcast(ipc.StateChangeEvent{
+			OldState: state,
+			NewState: state,
+			Reason:   ipc.ReasonFirewallReverted,
+		})
+	})
+
+	// everyone sees how a scan is going, but only those who could have
+	// started it see which files it covers
+	daemon.OnScanProgress(func(job ScanJob) {
+		state := daemon.State().State().String()
+		full, counts := scanStatus(job), scanCounts(job)
+		s.broadcastTo(ipc.StateChangeEvent{
+			OldState: state,
+			NewState: state,
+			Reason:   ipc.ReasonScanProgress,
+			Scan:     &full,
+		}, func(peer *scanner.Identity) bool {
+			return s.canSeeScan(peer, job)
+		})
+		s.broadcastTo(ipc.StateChangeEvent{
+			OldState: state,
+			NewState: state,
+			Reason:   ipc.ReasonScanProgress,
+			Scan:     &counts,
+		}, func(peer *scanner.Identity) bool {
+			return !s.canSeeScan(peer, job)
+		})
+	})
+
+	// only those who may answer hear about a threat, since its path
+	// could say more than they should know
+	daemon.OnThreatAsk(func(ask ThreatAsk) {
+		state := daemon.State().State().String()
+		s.broadcastTo(ipc.StateChangeEvent{
+			OldState: state,
+			NewState: state,
+			Reason:   ipc.ReasonThreatAsk,
+			Threat: &ipc.ThreatAsk{
+				ID:      ask.ID,
+				Path:    ask.Path,
+				Threat:  ask.Threat,
+				Size:    ask.Size,
+				Expires: ask.Expires,
+			},
+		}, func(peer *scanner.Identity) bool {
+			return canAnswer(peer, ask)
+		})
+	})
+	daemon.OnThreatFound(func(found ThreatFound) {
+		state := daemon.State().State().String()
+		s.broadcastTo(ipc.StateChangeEvent{
+			OldState: state,
+			NewState: state,
+			Reason:   ipc.ReasonThreatFound,
+			Found: &ipc.ThreatFound{
+				Path:   found.Path,
+				Threat: found.Threat,
+				Action: found.Action,
+			},
+		}, func(peer *scanner.Identity) bool {
+			return peer != nil && (peer.UID() == 0 || peer.UID() == found.UID)
+		})
+	})
+
 	return s
 }
 
@@ -98,9 +172,9 @@ func (s *Server) Close() error {
 }
 
 // subscribe adds a connection to the subscriber list.
-func (s *Server) subscribe(conn net.Conn) {
+func (s *Server) subscribe(conn net.Conn, peer *scanner.Identity) {
 	s.subMu.Lock()
-	s.subscribers[conn] = true
+	s.subscribers[conn] = peer
 	s.subMu.Unlock()
 	slog.Debug("client subscribed", "remote", conn.RemoteAddr())
 }
@@ -114,16 +188,28 @@ func (s *Server) unsubscribe(conn net.Conn) {
 
 // broadcastStateChange sends state change events to all subscribers.
 func (s *Server) broadcastStateChange(oldState, newState string) {
-	event := ipc.StateChangeEvent{
+	s.broadcast(ipc.StateChangeEvent{
 		OldState: oldState,
 		NewState: newState,
-	}
+	})
+}
+
+// broadcast pushes an event to all subscribers.
+func (s *Server) broadcast(event ipc.StateChangeEvent) {
+	s.broadcastTo(event, nil)
+}
+
+// broadcastTo pushes an event to the subscribers want accepts, or all of
+// them if want is nil.
+func (s *Server) broadcastTo(event ipc.StateChangeEvent, want func(peer *scanner.Identity) bool) {
 	resp := makeResponse("event", event)
 
 	s.subMu.Lock()
 	subscribers := make([]net.Conn, 0, len(s.subscribers))
-	for conn := range s.subscribers {
-		subscribers = append(subscribers, conn)
+	for conn, peer := range s.subscribers {
+		if want == nil || want(peer) {
+			subscribers = append(subscribers, conn)
+		}
 	}
 	s.subMu.Unlock()
 
@@ -143,6 +229,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	encoder := json.NewEncoder(conn)
 
+	// who is asking, for commands that act on their behalf
+	peer, err := peerIdentity(conn)
+	if err != nil {
+		slog.Debug("no peer credentials", "error", err)
+	}
+
 	for {
 		// Read one line (one JSON request)
 		line, err := reader.ReadBytes('\n')
@@ -164,7 +256,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 		// Handle subscribe specially - it registers this connection for push events
 		if req.Command == ipc.CmdSubscribe {
-			s.subscribe(conn)
+			s.subscribe(conn, peer)
 			resp := makeResponse(req.ID, "subscribed")
 			if err := encoder.Encode(resp); err != nil {
 				slog.Warn("failed to encode response", "error", err)
@@ -173,7 +265,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
-		resp := s.handleRequest(&req)
+		resp := s.handleRequest(&req, peer)
 		if err := encoder.Encode(resp); err != nil {
 			slog.Warn("failed to encode response", "error", err)
 			return
@@ -194,7 +286,31 @@ func makeResponse(id string, data interface{}) *ipc.Response {
 	return resp
 }
 
-func (s *Server) handleRequest(req *ipc.Request) *ipc.Response {
+// errorResponse creates a failed response with the given message.
+func errorResponse(id, msg string) *ipc.Response {
+	return &ipc.Response{ID: id, Success: false, Error: msg}
+}
+
+// adminCommands change the firewall or lock the machine down, so only
+// root or the admin group may send them; the socket itself is open to
+// everyone.
+var adminCommands = map[string]bool{
+	ipc.CmdFirewallEnable:          true,
+	ipc.CmdFirewallDisable:         true,
+	ipc.CmdFirewallConfirm:         true,
+	ipc.CmdFirewallProfileSet:      true,
+	ipc.CmdFirewallRuleAdd:         true,
+	ipc.CmdFirewallRuleRemove:      true,
+	ipc.CmdFirewallBlocklistReload: true,
+	ipc.CmdFirewallAppAdd:          true,
+	ipc.CmdFirewallAppRemove:       true,
+	ipc.CmdLockdown:                true,
+	ipc.CmdLockdownRelease:         true,
+}
+
+// handleRequest runs one command. peer is who sent it, nil if the
+// kernel wouldn't say.
+func (s *Server) handleRequest(req *ipc.Request, peer *scanner.Identity) *ipc.Response {
 	evt := events.StartIPCRequest(req.Command, req.ID).ClientVersion(req.Version)
 	var resp *ipc.Response
 	defer func() {
@@ -217,45 +333,334 @@ func (s *Server) handleRequest(req *ipc.Request) *ipc.Response {
 		return resp
 	}
 
+	if adminCommands[req.Command] && !s.daemon.isAdmin(peer) {
+		resp = errorResponse(req.ID, req.Command+": permission denied")
+		return resp
+	}
+
 	switch req.Command {
 	case ipc.CmdPing:
 		resp = makeResponse(req.ID, "pong")
 
 	case ipc.CmdStatus:
 		resp = makeResponse(req.ID, ipc.StatusResponse{
-			State:           s.daemon.State().State().String(),
-			FirewallEnabled: s.daemon.FirewallEnabled(),
-			LastScan:        s.daemon.LastScan(),
-			RulesUpdated:    s.daemon.RulesUpdated(),
+			State:              s.daemon.State().State().String(),
+			FirewallEnabled:    s.daemon.FirewallEnabled(),
+			FirewallProfile:    s.daemon.FirewallProfile(),
+			RealTimeProtection: s.daemon.RealTimeActive(),
+			LastScan:           s.daemon.LastScan(),
+			RulesUpdated:       s.daemon.RulesUpdated(),
 		})
 
 	case ipc.CmdFirewallEnable:
-		s.daemon.SetFirewallEnabled(true)
+		if err := s.daemon.SetFirewallEnabled(true); err != nil {
+			resp = errorResponse(req.ID, "enable firewall: "+err.Error())
+			break
+		}
 		resp = makeResponse(req.ID, "firewall enabled")
 
 	case ipc.CmdFirewallDisable:
-		s.daemon.SetFirewallEnabled(false)
+		if err := s.daemon.SetFirewallEnabled(false); err != nil {
+			resp = errorResponse(req.ID, "disable firewall: "+err.Error())
+			break
+		}
 		resp = makeResponse(req.ID, "firewall disabled")
 
 	case ipc.CmdFirewallStatus:
+		st, err := s.daemon.Firewall().Status()
+		if err != nil {
+			resp = errorResponse(req.ID, "firewall status: "+err.Error())
+			break
+		}
+		managers, conflict := s.daemon.FirewallManagers()
 		resp = makeResponse(req.ID, ipc.FirewallStatusResponse{
-			Enabled: s.daemon.FirewallEnabled(),
+			Enabled:    s.daemon.FirewallEnabled(),
+			TableCount: st.Tables,
+			ChainCount: st.Chains,
+			RuleCount:  st.Rules,
+
+			ConfirmDeadline: s.daemon.FirewallConfirmDeadline(),
+			Lockdown:        s.daemon.Firewall().LockedDown(),
+			Blocklists:      firewallBlocklists(s.daemon.Blocklists()),
+			Managers:        firewallManagers(managers),
+			Conflict:        conflict,
 		})
 
-	case ipc.CmdScanQuick:
-		s.daemon.State().SetState(StateScanning)
-		go s.runScan("quick")
-		resp = makeResponse(req.ID, ipc.ScanResponse{
-			JobID: "quick-" + time.Now().Format("20060102-150405"),
-		})
+	case ipc.CmdFirewallConfirm:
+		if err := s.daemon.ConfirmFirewall(); err != nil {
+			resp = errorResponse(req.ID, "confirm firewall: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "firewall change confirmed")
+
+	case ipc.CmdFirewallProfileList:
+		resp = makeResponse(req.ID, s.firewallProfiles())
+
+	case ipc.CmdFirewallProfileSet:
+		var params ipc.FirewallProfileParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if err := s.daemon.SetFirewallProfile(params.Name); err != nil {
+			resp = errorResponse(req.ID, "set firewall profile: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "firewall profile set")
+
+	case ipc.CmdFirewallRuleList:
+		var params ipc.FirewallRuleListParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				resp = errorResponse(req.ID, "invalid params: "+err.Error())
+				break
+			}
+		}
+		profile, rules, err := s.daemon.FirewallRules(params.Profile)
+		if err != nil {
+			resp = errorResponse(req.ID, "list firewall rules: "+err.Error())
+			break
+		}
+		list := ipc.FirewallRuleListResponse{Profile: profile, Rules: []ipc.FirewallRule{}}
+		for _, r := range rules {
+			list.Rules = append(list.Rules, ipc.FirewallRule(r))
+		}
+		resp = makeResponse(req.ID, list)
+
+	case ipc.CmdFirewallRuleAdd:
+		var params ipc.FirewallRuleParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if err := s.daemon.AddFirewallRule(params.Profile, config.FirewallRule(params.Rule)); err != nil {
+			resp = errorResponse(req.ID, "add firewall rule: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "firewall rule added")
+
+	case ipc.CmdFirewallRuleRemove:
+		var params ipc.FirewallRuleParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if err := s.daemon.RemoveFirewallRule(params.Profile, config.FirewallRule(params.Rule)); err != nil {
+			resp = errorResponse(req.ID, "remove firewall rule: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "firewall rule removed")
+
+	case ipc.CmdFirewallPreview:
+		var params ipc.FirewallPreviewParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				resp = errorResponse(req.ID, "invalid params: "+err.Error())
+				break
+			}
+		}
+		profile, pv, err := s.daemon.PreviewFirewall(params.Profile, configRules(params.Add), configRules(params.Remove))
+		if err != nil {
+			resp = errorResponse(req.ID, "preview firewall: "+err.Error())
+			break
+		}
+		preview := ipc.FirewallPreviewResponse{
+			Profile: profile,
+			Ruleset: pv.Ruleset,
+			Changed: pv.Changed,
+			Diff:    []ipc.FirewallDiffLine{},
+		}
+		for _, l := range pv.Diff {
+			preview.Diff = append(preview.Diff, ipc.FirewallDiffLine{Op: string(l.Op), Chain: l.Chain, Text: l.Text})
+		}
+		resp = makeResponse(req.ID, preview)
+
+	case ipc.CmdFirewallLog:
+		var params ipc.FirewallLogParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				resp = errorResponse(req.ID, "invalid params: "+err.Error())
+				break
+			}
+		}
+		if params.Limit <= 0 || params.Limit > maxLogLimit {
+			params.Limit = maxLogLimit
+		}
+		entries, err := s.daemon.FirewallDrops(params.Since, params.Limit)
+		if err != nil {
+			resp = errorResponse(req.ID, "firewall log: "+err.Error())
+			break
+		}
+		log := ipc.FirewallLogResponse{Drops: []ipc.FirewallDrop{}}
+		for _, e := range entries {
+			log.Drops = append(log.Drops, firewallDrop(e))
+		}
+		resp = makeResponse(req.ID, log)
 
-	case ipc.CmdScanFull:
-		s.daemon.State().SetState(StateScanning)
-		go s.runScan("full")
-		resp = makeResponse(req.ID, ipc.ScanResponse{
-			JobID: "full-" + time.Now().Format("20060102-150405"),
+	case ipc.CmdFirewallBlocklistReload:
+		infos, err := s.daemon.ReloadBlocklists()
+		if err != nil {
+			resp = errorResponse(req.ID, "reload blocklists: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, ipc.FirewallBlocklistReloadResponse{
+			Blocklists: firewallBlocklists(infos),
 		})
 
+	case ipc.CmdFirewallAppList:
+		list := ipc.FirewallAppListResponse{Apps: []ipc.FirewallAppStatus{}}
+		for _, info := range s.daemon.FirewallApps() {
+			list.Apps = append(list.Apps, ipc.FirewallAppStatus{
+				FirewallApp: ipc.FirewallApp(info.FirewallApp),
+				Cgroups:     append([]string{}, info.Cgroups...),
+			})
+		}
+		resp = makeResponse(req.ID, list)
+
+	case ipc.CmdFirewallAppAdd:
+		var app ipc.FirewallApp
+		if err := json.Unmarshal(req.Params, &app); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if err := s.daemon.AddFirewallApp(config.FirewallApp(app)); err != nil {
+			resp = errorResponse(req.ID, "block app: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "app blocked")
+
+	case ipc.CmdFirewallAppRemove:
+		var app ipc.FirewallApp
+		if err := json.Unmarshal(req.Params, &app); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if err := s.daemon.RemoveFirewallApp(config.FirewallApp(app)); err != nil {
+			resp = errorResponse(req.ID, "unblock app: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "app unblocked")
+
+	case ipc.CmdLockdown:
+		if err := s.daemon.Lockdown(); err != nil {
+			resp = errorResponse(req.ID, "lockdown: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "locked down")
+
+	case ipc.CmdLockdownRelease:
+		if err := s.daemon.ReleaseLockdown(); err != nil {
+			resp = errorResponse(req.ID, "release lockdown: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "lockdown released")
+
+	case ipc.CmdScanQuick, ipc.CmdScanFull:
+		kind := "quick"
+		if req.Command == ipc.CmdScanFull {
+			kind = "full"
+		}
+		id, err := s.daemon.StartScan(kind, s.daemon.scanPaths(kind))
+		if err != nil {
+			resp = errorResponse(req.ID, "scan: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, ipc.ScanResponse{JobID: id})
+
+	case ipc.CmdScanCustom:
+		var params ipc.ScanCustomParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		id, err := s.daemon.StartCustomScan(params.Paths, peer)
+		if err != nil {
+			resp = errorResponse(req.ID, "scan: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, ipc.ScanResponse{JobID: id})
+
+	case ipc.CmdScanStatus:
+		var params ipc.ScanJobParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				resp = errorResponse(req.ID, "invalid params: "+err.Error())
+				break
+			}
+		}
+		job, err := s.daemon.ScanStatus(params.JobID)
+		if err != nil {
+			resp = errorResponse(req.ID, "scan status: "+err.Error())
+			break
+		}
+		if s.canSeeScan(peer, job) {
+			resp = makeResponse(req.ID, scanStatus(job))
+		} else {
+			resp = makeResponse(req.ID, scanCounts(job))
+		}
+
+	case ipc.CmdScanCancel:
+		var params ipc.ScanJobParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				resp = errorResponse(req.ID, "invalid params: "+err.Error())
+				break
+			}
+		}
+		if err := s.daemon.CancelScan(params.JobID, peer); err != nil {
+			resp = errorResponse(req.ID, "cancel scan: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "scan cancelled")
+
+	case ipc.CmdQuarantineList:
+		items, err := s.daemon.Quarantined(peer)
+		if err != nil {
+			resp = errorResponse(req.ID, "quarantine: "+err.Error())
+			break
+		}
+		list := ipc.QuarantineListResponse{Items: []ipc.QuarantineItem{}}
+		for _, item := range items {
+			list.Items = append(list.Items, quarantineItem(item))
+		}
+		resp = makeResponse(req.ID, list)
+
+	case ipc.CmdQuarantineRestore:
+		var params ipc.QuarantineParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if _, err := s.daemon.RestoreQuarantined(params.ID, peer); err != nil {
+			resp = errorResponse(req.ID, "restore: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "restored")
+
+	case ipc.CmdQuarantineDelete:
+		var params ipc.QuarantineParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if err := s.daemon.DeleteQuarantined(params.ID, peer); err != nil {
+			resp = errorResponse(req.ID, "delete: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "deleted")
+
+	case ipc.CmdThreatResolve:
+		var params ipc.ThreatResolveParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp = errorResponse(req.ID, "invalid params: "+err.Error())
+			break
+		}
+		if err := s.daemon.ResolveThreat(params.ID, params.Action, peer); err != nil {
+			resp = errorResponse(req.ID, "resolve threat: "+err.Error())
+			break
+		}
+		resp = makeResponse(req.ID, "threat resolved")
+
 	case ipc.CmdPause:
 		s.daemon.State().SetState(StatePaused)
 		resp = makeResponse(req.ID, "protection paused")
@@ -275,67 +680,136 @@ func (s *Server) handleRequest(req *ipc.Request) *ipc.Response {
 	return resp
 }
 
-// runScan performs a scan using ClamAV.
-func (s *Server) runScan(scanType string) {
-	jobID := scanType + "-" + time.Now().Format("20060102-150405")
-	evt := events.StartScan(scanType, jobID)
-	defer func() {
-		s.daemon.Events().Emit(evt.End())
-	}()
+// maxLogLimit caps how many log entries one request returns.
+const maxLogLimit = 500
 
-	if !s.daemon.Scanner().IsAvailable() {
-		evt.SetError(fmt.Errorf("ClamAV not available"))
-		s.daemon.State().SetState(StateWarning)
-		return
+// firewallDrop converts a stored drop event for IPC. Numbers come back
+// from the store's JSON metadata as float64.
+func firewallDrop(e logging.LogEntry) ipc.FirewallDrop {
+	str := func(key string) string {
+		v, _ := e.Metadata[key].(string)
+		return v
 	}
-
-	var paths []string
-	if scanType == "quick" {
-		paths = s.daemon.Config().Scanning.QuickScanPaths
-	} else {
-		// Full scan: start from root (be careful with this)
-		paths = []string{"/home", "/tmp", "/var/tmp"}
+	num := func(key string) int {
+		v, _ := e.Metadata[key].(float64)
+		return int(v)
 	}
+	return ipc.FirewallDrop{
+		Time:      e.Timestamp,
+		Src:       str(events.FieldSrcAddr),
+		Dst:       str(events.FieldDstAddr),
+		Proto:     str(events.FieldProto),
+		Port:      num(events.FieldDstPort),
+		Interface: str(events.FieldInterface),
+		Count:     num(events.FieldPacketCount),
+	}
+}
 
-	var filesScanned, threatsFound int
-	for _, basePath := range paths {
-		s.scanDirectory(basePath, &filesScanned, &threatsFound)
+// scanStatus converts a scan job snapshot for IPC.
+func scanStatus(job ScanJob) ipc.ScanStatusResponse {
+	return ipc.ScanStatusResponse{
+		JobID:        job.ID,
+		Type:         job.Kind,
+		Status:       job.Status,
+		Error:        job.Error,
+		Paths:        job.Paths,
+		Progress:     job.Progress,
+		FilesScanned: job.FilesScanned,
+		BytesScanned: job.BytesScanned,
+		ThreatsFound: job.ThreatsFound,
+		TotalFiles:   job.TotalFiles,
+		TotalBytes:   job.TotalBytes,
+		CurrentPath:  job.CurrentPath,
+		Queued:       job.Queued,
+		StartedAt:    job.StartedAt,
+		FinishedAt:   job.FinishedAt,
+		ETA:          job.ETA,
 	}
+}
+
+// scanCounts is scanStatus without the paths, for those who may not
+// see them.
+func scanCounts(job ScanJob) ipc.ScanStatusResponse {
+	status := scanStatus(job)
+	status.Paths = nil
+	status.CurrentPath = ""
+	return status
+}
 
-	evt.FilesScanned(filesScanned).ThreatsFound(threatsFound)
-	s.daemon.SetLastScan(time.Now())
+// canSeeScan reports whether peer may see the paths job covers: root, an
+// admin or whoever started it.
+func (s *Server) canSeeScan(peer *scanner.Identity, job ScanJob) bool {
+	return job.ownedBy(peer) || s.daemon.isAdmin(peer)
+}
 
-	if threatsFound > 0 {
-		s.daemon.State().SetState(StateAlert)
-	} else {
-		s.daemon.State().SetState(StateProtected)
+// quarantineItem converts a vault item for IPC.
+func quarantineItem(item quarantine.Item) ipc.QuarantineItem {
+	return ipc.QuarantineItem{
+		ID:            item.ID,
+		Path:          item.Path,
+		Threat:        item.Threat,
+		Size:          item.Size,
+		SHA256:        item.SHA256,
+		UID:           item.UID,
+		GID:           item.GID,
+		Mode:          item.Mode.String(),
+		QuarantinedAt: item.QuarantinedAt,
 	}
 }
 
-// scanDirectory recursively scans a directory.
-func (s *Server) scanDirectory(basePath string, filesScanned, threatsFound *int) {
-	filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil // skip inaccessible paths
+// firewallBlocklists converts blocklist load results for IPC.
+func firewallBlocklists(infos []BlocklistInfo) []ipc.FirewallBlocklist {
+	out := make([]ipc.FirewallBlocklist, 0, len(infos))
+	for _, info := range infos {
+		b := ipc.FirewallBlocklist{
+			Name:    info.Name,
+			Path:    info.Path,
+			Entries: info.Entries,
+			Skipped: info.Skipped,
 		}
-		if info.IsDir() {
-			return nil
+		if info.Err != nil {
+			b.Error = info.Err.Error()
 		}
+		out = append(out, b)
+	}
+	return out
+}
 
-		result := s.daemon.Scanner().ScanFile(path)
-		if result.Error != nil {
-			return nil // skip files that can't be scanned
-		}
+// firewallManagers converts detected firewall managers for IPC.
+func firewallManagers(managers []firewall.Manager) []ipc.FirewallManager {
+	out := make([]ipc.FirewallManager, 0, len(managers))
+	for _, m := range managers {
+		out = append(out, ipc.FirewallManager{Name: m.Name, Via: m.Via})
+	}
+	return out
+}
 
-		*filesScanned++
-		if !result.Clean {
-			*threatsFound++
-			// Emit threat detection event
-			threatEvt := events.StartThreat(path, result.Threat).
-				Action("detected").
-				FileSize(info.Size())
-			s.daemon.Events().Emit(threatEvt.End())
-		}
-		return nil
+// configRules converts rules received over IPC to their config form.
+func configRules(rules []ipc.FirewallRule) []config.FirewallRule {
+	out := make([]config.FirewallRule, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, config.FirewallRule(r))
+	}
+	return out
+}
+
+// firewallProfiles lists the configured profiles, sorted by name.
+func (s *Server) firewallProfiles() ipc.FirewallProfileListResponse {
+	list := ipc.FirewallProfileListResponse{
+		Active:   s.daemon.FirewallProfile(),
+		Profiles: []ipc.FirewallProfile{},
+	}
+	for name, p := range s.daemon.FirewallProfiles() {
+		list.Profiles = append(list.Profiles, ipc.FirewallProfile{
+			Name:        name,
+			Description: p.Description,
+			AllowPing:   p.AllowPing,
+			AllowLAN:    p.AllowLAN,
+			Reject:      p.Reject,
+		})
+	}
+	sort.Slice(list.Profiles, func(i, j int) bool {
+		return list.Profiles[i].Name < list.Profiles[j].Name
 	})
+	return list
 }
@@ -7,9 +7,15 @@ import (
 	"encoding/json"
 	"log/slog"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/oreonproject/defense/internal/firewall"
+	"github.com/oreonproject/defense/internal/scanner"
 	"github.com/oreonproject/defense/pkg/config"
 	"github.com/oreonproject/defense/pkg/ipc"
 )
@@ -18,7 +24,7 @@ func setupTestServer(t *testing.T) (*Server, string, func()) {
 	t.Helper()
 
 	cfg := &config.Config{}
-	d := New(cfg, slog.Default())
+	d := New(cfg, slog.Default(), WithFirewallConn(firewall.NewMemConn()))
 	d.State().SetState(StateProtected)
 
 	sockPath := t.TempDir() + "/test.sock"
@@ -129,6 +135,276 @@ func TestServer_FirewallToggle(t *testing.T) {
 	}
 }
 
+func TestServer_AdminCommands(t *testing.T) {
+	server, _, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	nobody := scanner.NewIdentity(65534, 65534)
+	for cmd := range adminCommands {
+		resp := server.handleRequest(&ipc.Request{ID: "1", Command: cmd}, nobody)
+		if resp.Success || !strings.Contains(resp.Error, "permission denied") {
+			t.Errorf("%s from a non-root peer: success=%v error=%q", cmd, resp.Success, resp.Error)
+		}
+		resp = server.handleRequest(&ipc.Request{ID: "2", Command: cmd}, nil)
+		if resp.Success {
+			t.Errorf("%s from an unknown peer succeeded", cmd)
+		}
+	}
+	if server.daemon.FirewallEnabled() {
+		t.Error("firewall enabled by a non-root peer")
+	}
+
+	// members of the admin group are let in; gid 0 is always root's group
+	server.daemon.Config().General.AdminGroup = "root"
+	resp := server.handleRequest(&ipc.Request{ID: "3", Command: ipc.CmdFirewallEnable}, scanner.NewIdentity(1000, 1000, 0))
+	if !resp.Success {
+		t.Fatalf("firewall_enable from the admin group failed: %s", resp.Error)
+	}
+	resp = server.handleRequest(&ipc.Request{ID: "4", Command: ipc.CmdFirewallDisable}, nobody)
+	if resp.Success {
+		t.Error("non-member let in once an admin group is set")
+	}
+}
+
+func TestServer_FirewallStatus(t *testing.T) {
+	_, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdFirewallStatus})
+	if !resp.Success {
+		t.Fatalf("FirewallStatus failed: %s", resp.Error)
+	}
+	var st ipc.FirewallStatusResponse
+	if err := resp.UnmarshalData(&st); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if st.Enabled || st.TableCount != 0 || st.RuleCount != 0 {
+		t.Errorf("status before enable = %+v, want empty", st)
+	}
+	if st.Conflict != "coexist" || len(st.Managers) != 0 {
+		t.Errorf("conflict = %q, managers = %+v, want coexisting with nothing", st.Conflict, st.Managers)
+	}
+
+	sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdFirewallEnable})
+
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "3", Command: ipc.CmdFirewallStatus})
+	if err := resp.UnmarshalData(&st); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if !st.Enabled || st.TableCount != 1 || st.ChainCount == 0 || st.RuleCount == 0 {
+		t.Errorf("status after enable = %+v, want table, chains and rules", st)
+	}
+}
+
+func TestServer_FirewallProfiles(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+	server.daemon.Config().Firewall.Profiles = config.DefaultFirewallProfiles()
+
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdFirewallProfileList})
+	if !resp.Success {
+		t.Fatalf("FirewallProfileList failed: %s", resp.Error)
+	}
+	var list ipc.FirewallProfileListResponse
+	if err := resp.UnmarshalData(&list); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if len(list.Profiles) != 3 || list.Profiles[0].Name != "home" {
+		t.Errorf("profiles = %+v, want home, public, strict", list.Profiles)
+	}
+
+	params, _ := json.Marshal(ipc.FirewallProfileParams{Name: "home"})
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdFirewallProfileSet, Params: params})
+	if !resp.Success {
+		t.Fatalf("FirewallProfileSet failed: %s", resp.Error)
+	}
+
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "3", Command: ipc.CmdStatus})
+	var status ipc.StatusResponse
+	if err := resp.UnmarshalData(&status); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if status.FirewallProfile != "home" {
+		t.Errorf("FirewallProfile = %q, want home", status.FirewallProfile)
+	}
+
+	params, _ = json.Marshal(ipc.FirewallProfileParams{Name: "nope"})
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "4", Command: ipc.CmdFirewallProfileSet, Params: params})
+	if resp.Success {
+		t.Error("Success = true for unknown profile")
+	}
+}
+
+func TestServer_FirewallRules(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+	server.daemon.Config().Firewall.Profiles = config.DefaultFirewallProfiles()
+	server.daemon.SetFirewallProfile("public")
+
+	kde := ipc.FirewallRule{Proto: "udp", Port: 1714, PortEnd: 1764, Comment: "KDE Connect"}
+	params, _ := json.Marshal(ipc.FirewallRuleParams{Rule: kde})
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdFirewallRuleAdd, Params: params})
+	if !resp.Success {
+		t.Fatalf("FirewallRuleAdd failed: %s", resp.Error)
+	}
+
+	params, _ = json.Marshal(ipc.FirewallRuleParams{Rule: ipc.FirewallRule{Proto: "sctp", Port: 1}})
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdFirewallRuleAdd, Params: params})
+	if resp.Success {
+		t.Error("Success = true for invalid rule")
+	}
+
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "3", Command: ipc.CmdFirewallRuleList})
+	if !resp.Success {
+		t.Fatalf("FirewallRuleList failed: %s", resp.Error)
+	}
+	var list ipc.FirewallRuleListResponse
+	if err := resp.UnmarshalData(&list); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if list.Profile != "public" || len(list.Rules) != 1 || list.Rules[0].Comment != "KDE Connect" {
+		t.Errorf("list = %+v, want the KDE Connect rule on public", list)
+	}
+
+	params, _ = json.Marshal(ipc.FirewallRuleParams{Profile: "public", Rule: kde})
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "4", Command: ipc.CmdFirewallRuleRemove, Params: params})
+	if !resp.Success {
+		t.Fatalf("FirewallRuleRemove failed: %s", resp.Error)
+	}
+}
+
+func TestServer_FirewallPreview(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+	server.daemon.Config().Firewall.Profiles = config.DefaultFirewallProfiles()
+	server.daemon.SetFirewallProfile("public")
+	server.daemon.SetFirewallEnabled(true)
+	before, _ := server.daemon.Firewall().Status()
+
+	params, _ := json.Marshal(ipc.FirewallPreviewParams{
+		Add: []ipc.FirewallRule{{Proto: "tcp", Port: 22, Source: "10.0.0.0/8"}},
+	})
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdFirewallPreview, Params: params})
+	if !resp.Success {
+		t.Fatalf("FirewallPreview failed: %s", resp.Error)
+	}
+	var pv ipc.FirewallPreviewResponse
+	if err := resp.UnmarshalData(&pv); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if pv.Profile != "public" || !pv.Changed {
+		t.Errorf("preview = %+v, want a change to public", pv)
+	}
+	var added []string
+	for _, l := range pv.Diff {
+		if l.Op == "+" {
+			added = append(added, l.Text)
+		}
+	}
+	if len(added) != 1 || added[0] != "ip saddr 10.0.0.0/8 tcp dport 22 accept" {
+		t.Errorf("added lines = %v, want only the ssh rule", added)
+	}
+
+	if after, _ := server.daemon.Firewall().Status(); after != before {
+		t.Errorf("status changed from %+v to %+v by a preview", before, after)
+	}
+}
+
+func TestServer_FirewallBlocklistReload(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "internal.txt")
+	if err := os.WriteFile(path, []byte("# bad hosts\n203.0.113.7\n2001:db8::/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.daemon.Config().Firewall.Blocklists = []config.FirewallBlocklist{{Name: "internal", Path: path}}
+
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdFirewallBlocklistReload})
+	if !resp.Success {
+		t.Fatalf("reload failed: %s", resp.Error)
+	}
+	var reload ipc.FirewallBlocklistReloadResponse
+	if err := resp.UnmarshalData(&reload); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if len(reload.Blocklists) != 1 || reload.Blocklists[0].Entries != 2 {
+		t.Errorf("blocklists = %+v, want internal with 2 entries", reload.Blocklists)
+	}
+
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdFirewallStatus})
+	var status ipc.FirewallStatusResponse
+	if err := resp.UnmarshalData(&status); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if len(status.Blocklists) != 1 || status.Blocklists[0].Name != "internal" || status.Blocklists[0].Entries != 2 {
+		t.Errorf("status blocklists = %+v", status.Blocklists)
+	}
+}
+
+func TestServer_FirewallApps(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+	server.daemon.cgroups = fakeAgent(t)
+
+	params, _ := json.Marshal(ipc.FirewallApp{Exe: "/opt/vendor/bin/agent"})
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdFirewallAppAdd, Params: params})
+	if !resp.Success {
+		t.Fatalf("app add failed: %s", resp.Error)
+	}
+
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdFirewallAppList})
+	var list ipc.FirewallAppListResponse
+	if err := resp.UnmarshalData(&list); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if len(list.Apps) != 1 || list.Apps[0].Exe != "/opt/vendor/bin/agent" || len(list.Apps[0].Cgroups) != 1 || list.Apps[0].Cgroups[0] != agentScope {
+		t.Errorf("apps = %+v, want the agent in its scope", list.Apps)
+	}
+
+	params, _ = json.Marshal(ipc.FirewallApp{Cgroup: "user.slice", Exe: "/bin/sh"})
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "3", Command: ipc.CmdFirewallAppAdd, Params: params})
+	if resp.Success {
+		t.Error("app with both cgroup and exe accepted")
+	}
+}
+
+func TestServer_Lockdown(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdLockdown})
+	if !resp.Success {
+		t.Fatalf("Lockdown failed: %s", resp.Error)
+	}
+	if server.daemon.State().State() != StateLockdown {
+		t.Errorf("State = %v, want StateLockdown", server.daemon.State().State())
+	}
+
+	// resuming protection doesn't end a lockdown
+	sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdResume})
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "3", Command: ipc.CmdFirewallStatus})
+	var st ipc.FirewallStatusResponse
+	if err := resp.UnmarshalData(&st); err != nil {
+		t.Fatal(err)
+	}
+	if !st.Lockdown {
+		t.Error("firewall status doesn't report the lockdown")
+	}
+
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "4", Command: ipc.CmdLockdownRelease})
+	if !resp.Success {
+		t.Fatalf("LockdownRelease failed: %s", resp.Error)
+	}
+	if server.daemon.Firewall().LockedDown() {
+		t.Error("still locked down after release")
+	}
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "5", Command: ipc.CmdLockdownRelease})
+	if resp.Success {
+		t.Error("release without a lockdown succeeded")
+	}
+}
+
 func TestServer_PauseResume(t *testing.T) {
 	server, sockPath, cleanup := setupTestServer(t)
 	defer cleanup()
@@ -181,6 +457,87 @@ func TestServer_ScanQuick(t *testing.T) {
 	if scanResp.JobID == "" {
 		t.Error("JobID is empty")
 	}
+
+	params, _ := json.Marshal(ipc.ScanJobParams{JobID: scanResp.JobID})
+	resp = sendRequest(t, sockPath, &ipc.Request{
+		ID:      "2",
+		Command: ipc.CmdScanStatus,
+		Params:  params,
+	})
+	if !resp.Success {
+		t.Fatalf("ScanStatus failed: %s", resp.Error)
+	}
+	var status ipc.ScanStatusResponse
+	if err := resp.UnmarshalData(&status); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	if status.JobID != scanResp.JobID || status.Type != "quick" {
+		t.Errorf("status = %+v, want quick job %s", status, scanResp.JobID)
+	}
+
+	params, _ = json.Marshal(ipc.ScanJobParams{JobID: "full-nope"})
+	resp = sendRequest(t, sockPath, &ipc.Request{
+		ID:      "3",
+		Command: ipc.CmdScanCancel,
+		Params:  params,
+	})
+	if resp.Success {
+		t.Error("cancelling an unknown job succeeded")
+	}
+}
+
+func TestServer_ScanCustom(t *testing.T) {
+	_, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+	dir := t.TempDir()
+
+	scan := func(paths ...string) *ipc.Response {
+		params, _ := json.Marshal(ipc.ScanCustomParams{Paths: paths})
+		return sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdScanCustom, Params: params})
+	}
+
+	resp := scan(dir)
+	if !resp.Success {
+		t.Fatalf("ScanCustom failed: %s", resp.Error)
+	}
+	var scanResp ipc.ScanResponse
+	resp.UnmarshalData(&scanResp)
+	if !strings.HasPrefix(scanResp.JobID, "custom-") {
+		t.Errorf("JobID = %q, want a custom job", scanResp.JobID)
+	}
+
+	for _, paths := range [][]string{nil, {"relative/path"}, {dir + "/missing"}} {
+		if resp := scan(paths...); resp.Success {
+			t.Errorf("ScanCustom(%v) succeeded", paths)
+		}
+	}
+}
+
+func TestServer_ScanStatusPaths(t *testing.T) {
+	server, _, cleanup := setupTestServer(t)
+	defer cleanup()
+	dir := t.TempDir()
+	id, err := server.daemon.StartScan("quick", []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(peer *scanner.Identity) ipc.ScanStatusResponse {
+		params, _ := json.Marshal(ipc.ScanJobParams{JobID: id})
+		resp := server.handleRequest(&ipc.Request{ID: "1", Command: ipc.CmdScanStatus, Params: params}, peer)
+		if !resp.Success {
+			t.Fatalf("ScanStatus failed: %s", resp.Error)
+		}
+		var status ipc.ScanStatusResponse
+		resp.UnmarshalData(&status)
+		return status
+	}
+	if got := status(scanner.NewIdentity(0, 0)); len(got.Paths) != 1 || got.Paths[0] != dir {
+		t.Errorf("root sees paths %v, want [%s]", got.Paths, dir)
+	}
+	if got := status(scanner.NewIdentity(65534, 65534)); got.Paths != nil || got.CurrentPath != "" || got.JobID != id {
+		t.Errorf("nobody sees %+v, want the job without paths", got)
+	}
 }
 
 func TestServer_UnknownCommand(t *testing.T) {
@@ -279,3 +636,41 @@ func TestServer_LegacyClient(t *testing.T) {
 		t.Error("Success = false for version 0 (legacy client)")
 	}
 }
+
+func TestServer_FirewallLog(t *testing.T) {
+	server, sockPath, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp := sendRequest(t, sockPath, &ipc.Request{ID: "1", Command: ipc.CmdFirewallLog})
+	if resp.Success {
+		t.Error("Success = true without an event store")
+	}
+
+	server.daemon.logStore = newTestStore(t)
+	server.daemon.reportDrops([]dropSummary{{key: dropKey{
+		src:   netip.MustParseAddr("203.0.113.5"),
+		dst:   netip.MustParseAddr("192.168.1.10"),
+		proto: "tcp",
+		port:  22,
+		iface: "wlan0",
+	}, count: 7}}, 0)
+
+	params, _ := json.Marshal(ipc.FirewallLogParams{Limit: 10})
+	resp = sendRequest(t, sockPath, &ipc.Request{ID: "2", Command: ipc.CmdFirewallLog, Params: params})
+	if !resp.Success {
+		t.Fatalf("FirewallLog failed: %s", resp.Error)
+	}
+	var log ipc.FirewallLogResponse
+	if err := resp.UnmarshalData(&log); err != nil {
+		t.Fatalf("UnmarshalData error: %v", err)
+	}
+	want := ipc.FirewallDrop{Src: "203.0.113.5", Dst: "192.168.1.10", Proto: "tcp", Port: 22, Interface: "wlan0", Count: 7}
+	if len(log.Drops) != 1 {
+		t.Fatalf("drops = %+v, want one", log.Drops)
+	}
+	got := log.Drops[0]
+	got.Time = time.Time{}
+	if got != want {
+		t.Errorf("drop = %+v, want %+v", got, want)
+	}
+}
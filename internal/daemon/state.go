@@ -17,6 +17,7 @@ const (
 	StateAlert                  // something is wrong (e.g. threat detected)
 	StateScanning               // scan in progress
 	StatePaused                 // protection temporarily disabled
+	StateLockdown               // all traffic blocked except loopback
 )
 
 func (s State) String() string {
@@ -33,6 +34,8 @@ func (s State) String() string {
 		return "scanning"
 	case StatePaused:
 		return "paused"
+	case StateLockdown:
+		return "lockdown"
 	default:
 		return "unknown"
 	}
@@ -65,8 +68,30 @@ func (sm *StateManager) State() State {
 
 // SetState changes the state and notifies all listeners.
 // Listeners are called asynchronously so slow listeners don't block.
+// Once in StateLockdown, only EndLockdown leaves it.
 func (sm *StateManager) SetState(s State) {
 	sm.mu.Lock()
+	if sm.state == StateLockdown {
+		sm.mu.Unlock()
+		return
+	}
+	sm.set(s)
+}
+
+// EndLockdown leaves StateLockdown for s. It does nothing outside a
+// lockdown.
+func (sm *StateManager) EndLockdown(s State) {
+	sm.mu.Lock()
+	if sm.state != StateLockdown {
+		sm.mu.Unlock()
+		return
+	}
+	sm.set(s)
+}
+
+// set changes the state and notifies listeners. Must be called with mu
+// held; it releases it.
+func (sm *StateManager) set(s State) {
 	old := sm.state
 	sm.state = s
 	listeners := make([]StateListener, len(sm.listeners))
@@ -19,6 +19,7 @@ func TestStateString(t *testing.T) {
 		{StateAlert, "alert"},
 		{StateScanning, "scanning"},
 		{StatePaused, "paused"},
+		{StateLockdown, "lockdown"},
 	}
 
 	for _, tt := range tests {
@@ -41,6 +42,26 @@ func TestStateManager(t *testing.T) {
 	}
 }
 
+func TestStateManager_Lockdown(t *testing.T) {
+	sm := NewStateManager()
+	sm.SetState(StateLockdown)
+
+	sm.SetState(StateProtected)
+	if sm.State() != StateLockdown {
+		t.Errorf("state = %v, want SetState to leave StateLockdown alone", sm.State())
+	}
+
+	sm.EndLockdown(StatePaused)
+	if sm.State() != StatePaused {
+		t.Errorf("state = %v, want StatePaused", sm.State())
+	}
+
+	sm.EndLockdown(StateProtected)
+	if sm.State() != StatePaused {
+		t.Errorf("EndLockdown outside a lockdown changed state to %v", sm.State())
+	}
+}
+
 func TestStateListener(t *testing.T) {
 	sm := NewStateManager()
 
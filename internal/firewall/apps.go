@@ -0,0 +1,156 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// AppRule blocks outbound traffic from every process in a cgroup v2
+// cgroup and the cgroups below it. The kernel matches cgroups by id, so
+// a rule only holds for the cgroup instance it was built for; if the
+// cgroup is removed and created again the rule has to be rebuilt.
+type AppRule struct {
+	Cgroup  string // path below the cgroup2 mount, without a leading slash
+	ID      uint64 // the cgroup's id, which is the inode of its directory
+	Comment string
+}
+
+// level is the depth of the cgroup in the hierarchy, which is what
+// socket cgroupv2 compares at.
+func (a AppRule) level() uint32 {
+	return uint32(strings.Count(a.Cgroup, "/") + 1)
+}
+
+// text renders the rule the way nft would print it.
+func (a AppRule) text() string {
+	s := fmt.Sprintf("socket cgroupv2 level %d %q reject with icmpx admin-prohibited", a.level(), a.Cgroup)
+	if a.Comment != "" {
+		s += fmt.Sprintf(" comment %q", a.Comment)
+	}
+	return s
+}
+
+// spec builds the nftables rule for a.
+func (a AppRule) spec() ruleSpec {
+	return rule(a.text(), matchCgroup(a.level(), a.ID), reject())
+}
+
+// Cgroups finds cgroups on the running system. The zero value is not
+// usable; use SystemCgroups outside tests.
+type Cgroups struct {
+	Root string // where the cgroup v2 hierarchy is mounted
+	Proc string // where procfs is mounted
+}
+
+// SystemCgroups looks at the standard mounts.
+var SystemCgroups = Cgroups{Root: "/sys/fs/cgroup", Proc: "/proc"}
+
+// Match returns the cgroups matching a path pattern relative to the
+// hierarchy root, with path.Match wildcards allowed in each element so
+// one pattern can cover every user's instance of an app scope.
+func (c Cgroups) Match(pattern string) ([]string, error) {
+	pattern = strings.Trim(pattern, "/")
+	matches, err := filepath.Glob(filepath.Join(c.Root, pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err != nil || !fi.IsDir() {
+			continue
+		}
+		rel, err := filepath.Rel(c.Root, m)
+		if err != nil || rel == "." {
+			continue
+		}
+		out = append(out, filepath.ToSlash(rel))
+	}
+	return out, nil
+}
+
+// ID returns the id nftables identifies a cgroup by.
+func (c Cgroups) ID(cgroup string) (uint64, error) {
+	fi, err := os.Stat(filepath.Join(c.Root, cgroup))
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.New("no inode for " + cgroup)
+	}
+	return st.Ino, nil
+}
+
+// ForExe returns the cgroups of the running processes whose executable
+// is exe. Processes in the root cgroup or a login session scope are left
+// out: blocking those would cut off far more than the one program.
+func (c Cgroups) ForExe(exe string) ([]string, error) {
+	entries, err := os.ReadDir(c.Proc)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join(c.Proc, e.Name())
+		// the process may have exited, or belong to a kernel thread
+		target, err := os.Readlink(filepath.Join(dir, "exe"))
+		if err != nil {
+			continue
+		}
+		// a binary replaced by an upgrade while running
+		target = strings.TrimSuffix(target, " (deleted)")
+		if target != exe {
+			continue
+		}
+
+		cgroup, err := procCgroup(filepath.Join(dir, "cgroup"))
+		if err != nil || cgroup == "" || isSessionScope(cgroup) {
+			continue
+		}
+		if !slices.Contains(out, cgroup) {
+			out = append(out, cgroup)
+		}
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// procCgroup reads a process's cgroup v2 path from /proc/PID/cgroup,
+// returning "" for the root cgroup.
+func procCgroup(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// the unified hierarchy is "0::/path"
+		if rest, ok := strings.CutPrefix(sc.Text(), "0::"); ok {
+			return strings.Trim(rest, "/"), nil
+		}
+	}
+	return "", sc.Err()
+}
+
+// isSessionScope reports whether a cgroup is a logind session scope,
+// which holds everything started from a login rather than one app.
+func isSessionScope(cgroup string) bool {
+	base := cgroup[strings.LastIndex(cgroup, "/")+1:]
+	return strings.HasPrefix(base, "session-") && strings.HasSuffix(base, ".scope")
+}
@@ -0,0 +1,110 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// fakeCgroups builds a cgroup hierarchy and a procfs with one process
+// per entry of procs, mapping pid to executable and cgroup.
+func fakeCgroups(t *testing.T, cgroups []string, procs map[string][2]string) Cgroups {
+	t.Helper()
+	c := Cgroups{Root: t.TempDir(), Proc: t.TempDir()}
+	for _, cg := range cgroups {
+		if err := os.MkdirAll(filepath.Join(c.Root, cg), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pid, p := range procs {
+		dir := filepath.Join(c.Proc, pid)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(p[0], filepath.Join(dir, "exe")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::/"+p[1]+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+const spotifyScope = "user.slice/user-1000.slice/user@1000.service/app.slice/app-flatpak-com.spotify.Client-4242.scope"
+
+func TestCgroups_Match(t *testing.T) {
+	c := fakeCgroups(t, []string{
+		spotifyScope,
+		"user.slice/user-1001.slice/user@1001.service/app.slice/app-flatpak-com.spotify.Client-77.scope",
+		"user.slice/user-1000.slice/user@1000.service/app.slice/app-firefox-1.scope",
+	}, nil)
+
+	got, err := c.Match("/user.slice/*/*/app.slice/app-flatpak-com.spotify.Client-*.scope")
+	if err != nil {
+		t.Fatalf("Match() error = %v", err)
+	}
+	if len(got) != 2 || got[0] != spotifyScope {
+		t.Errorf("Match() = %v, want both spotify scopes", got)
+	}
+
+	id, err := c.ID(spotifyScope)
+	if err != nil || id == 0 {
+		t.Errorf("ID() = %d, %v", id, err)
+	}
+}
+
+func TestCgroups_ForExe(t *testing.T) {
+	c := fakeCgroups(t, nil, map[string][2]string{
+		"100": {"/opt/telemetry/agent", "user.slice/user-1000.slice/user@1000.service/app.slice/app-agent-1.scope"},
+		"101": {"/opt/telemetry/agent (deleted)", "user.slice/user-1000.slice/user@1000.service/app.slice/app-agent-1.scope"},
+		"102": {"/opt/telemetry/agent", "system.slice/agent.service"},
+		"103": {"/opt/telemetry/agent", "user.slice/user-1000.slice/session-2.scope"},
+		"104": {"/opt/telemetry/agent", ""},
+		"105": {"/usr/bin/bash", "system.slice/other.service"},
+	})
+	if err := os.WriteFile(filepath.Join(c.Proc, "uptime"), []byte("1 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.ForExe("/opt/telemetry/agent")
+	if err != nil {
+		t.Fatalf("ForExe() error = %v", err)
+	}
+	want := []string{
+		"system.slice/agent.service",
+		"user.slice/user-1000.slice/user@1000.service/app.slice/app-agent-1.scope",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ForExe() = %v, want %v", got, want)
+	}
+}
+
+func TestSetAppRules(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := AppRule{Cgroup: spotifyScope, ID: 4242, Comment: "spotify"}
+	if err := fw.SetAppRules([]AppRule{app}); err != nil {
+		t.Fatalf("SetAppRules() error = %v", err)
+	}
+
+	want := `socket cgroupv2 level 5 "` + spotifyScope + `" reject with icmpx admin-prohibited comment "spotify"`
+	if output := chainTexts(t, conn, "output"); !slices.Equal(output, []string{want}) {
+		t.Errorf("output chain = %q, want %q", output, want)
+	}
+
+	// a profile switch keeps the app rules
+	if err := fw.SetProfile(Profile{Name: "home", AllowPing: true}); err != nil {
+		t.Fatal(err)
+	}
+	if output := chainTexts(t, conn, "output"); !contains(output, want) {
+		t.Errorf("output chain after profile switch = %q", output)
+	}
+}
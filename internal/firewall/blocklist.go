@@ -0,0 +1,176 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// Blocklist is a named list of addresses and networks whose traffic is
+// dropped in both directions, whatever the active profile. Each list is
+// loaded as a pair of interval sets, one per address family.
+type Blocklist struct {
+	Name     string
+	Prefixes []netip.Prefix
+}
+
+// validBlocklistName keeps list names usable inside nft set names.
+var validBlocklistName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,31}$`)
+
+// LoadBlocklist reads a blocklist file. It returns the number of lines
+// that were neither an address, a network, a comment nor blank, so
+// callers can warn about a malformed list without rejecting all of it.
+func LoadBlocklist(name, path string) (Blocklist, int, error) {
+	if !validBlocklistName.MatchString(name) {
+		return Blocklist{}, 0, fmt.Errorf("invalid blocklist name %q", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Blocklist{}, 0, err
+	}
+	defer f.Close()
+
+	prefixes, skipped, err := ParseBlocklist(f)
+	if err != nil {
+		return Blocklist{}, 0, fmt.Errorf("read %s: %w", path, err)
+	}
+	return Blocklist{Name: name, Prefixes: prefixes}, skipped, nil
+}
+
+// ParseBlocklist reads one address or CIDR network per line. Lines may
+// also be CSV records, in which case the first column is used, so
+// exports with a header row or extra columns load as they are. Anything
+// after a # is a comment.
+func ParseBlocklist(r io.Reader) ([]netip.Prefix, int, error) {
+	var prefixes []netip.Prefix
+	skipped := 0
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		field, _, _ := strings.Cut(line, ",")
+		field = strings.Trim(strings.TrimSpace(field), `"`)
+		if field == "" {
+			continue
+		}
+
+		prefix, ok := parsePrefix(field)
+		if !ok {
+			skipped++
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, skipped, sc.Err()
+}
+
+// parsePrefix accepts a bare address as a single-address network.
+func parsePrefix(s string) (netip.Prefix, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	if prefix.Addr().Is4In6() {
+		addr := prefix.Addr().Unmap()
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			return netip.Prefix{}, false
+		}
+		prefix = netip.PrefixFrom(addr, bits)
+	}
+	return prefix.Masked(), true
+}
+
+// setName returns the name of the list's set for one family.
+func (b Blocklist) setName(v6 bool) string {
+	if v6 {
+		return "blocklist_" + b.Name + "_v6"
+	}
+	return "blocklist_" + b.Name + "_v4"
+}
+
+// split returns the list's prefixes for each family.
+func (b Blocklist) split() (v4, v6 []netip.Prefix) {
+	for _, p := range b.Prefixes {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+	return v4, v6
+}
+
+// addrRange is an inclusive range of addresses.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+// lastAddr returns the highest address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// mergeRanges turns prefixes of one family into sorted ranges with
+// overlapping and adjacent ones joined. The kernel refuses overlapping
+// elements in an interval set, and lists often repeat themselves.
+func mergeRanges(prefixes []netip.Prefix) []addrRange {
+	ranges := make([]addrRange, 0, len(prefixes))
+	for _, p := range prefixes {
+		ranges = append(ranges, addrRange{first: p.Masked().Addr(), last: lastAddr(p)})
+	}
+	slices.SortFunc(ranges, func(a, b addrRange) int {
+		return cmp.Or(a.first.Compare(b.first), a.last.Compare(b.last))
+	})
+
+	var out []addrRange
+	for _, r := range ranges {
+		if n := len(out); n > 0 {
+			prev := &out[n-1]
+			next := prev.last.Next()
+			// an invalid next means prev already runs to the end of the
+			// address space
+			if !next.IsValid() || r.first.Compare(next) <= 0 {
+				if r.last.Compare(prev.last) > 0 {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// intervalElements encodes ranges the way an interval set stores them:
+// the first address of each range, and the address after its end flagged
+// as an interval end.
+func intervalElements(ranges []addrRange) []nftables.SetElement {
+	elems := make([]nftables.SetElement, 0, 2*len(ranges))
+	for _, r := range ranges {
+		elems = append(elems, nftables.SetElement{Key: r.first.AsSlice()})
+		if end := r.last.Next(); end.IsValid() {
+			elems = append(elems, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+		}
+	}
+	return elems
+}
@@ -0,0 +1,162 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	in := `# known bad hosts
+203.0.113.7
+198.51.100.0/24   # scanner range
+2001:db8::/32
+
+ip,reason,first_seen
+"192.0.2.1",botnet,2026-01-02
+::ffff:192.0.2.2
+not-an-address
+10.1.2.3/8
+`
+	prefixes, skipped, err := ParseBlocklist(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("ParseBlocklist() error = %v", err)
+	}
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("203.0.113.7/32"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("192.0.2.2/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+	if !slices.Equal(prefixes, want) {
+		t.Errorf("prefixes = %v, want %v", prefixes, want)
+	}
+	// the CSV header and the garbage line
+	if skipped != 2 {
+		t.Errorf("skipped = %d, want 2", skipped)
+	}
+}
+
+func TestLoadBlocklist_InvalidName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte("192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadBlocklist("bad name", path); err == nil {
+		t.Error("LoadBlocklist() with a space in the name succeeded")
+	}
+	b, _, err := LoadBlocklist("internal", path)
+	if err != nil || len(b.Prefixes) != 1 {
+		t.Errorf("LoadBlocklist() = %+v, %v", b, err)
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	var prefixes []netip.Prefix
+	for _, s := range []string{
+		"10.0.0.0/24",
+		"10.0.0.128/25", // inside the first
+		"10.0.1.0/24",   // adjacent, joins
+		"10.0.3.5/32",
+		"255.255.255.255/32",
+		"255.255.255.0/24", // runs to the end of the address space
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(s))
+	}
+
+	got := mergeRanges(prefixes)
+	want := []addrRange{
+		{netip.MustParseAddr("10.0.0.0"), netip.MustParseAddr("10.0.1.255")},
+		{netip.MustParseAddr("10.0.3.5"), netip.MustParseAddr("10.0.3.5")},
+		{netip.MustParseAddr("255.255.255.0"), netip.MustParseAddr("255.255.255.255")},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("mergeRanges() = %v, want %v", got, want)
+	}
+
+	elems := intervalElements(got)
+	// no interval end after the last range, there's no address past it
+	if len(elems) != 5 {
+		t.Fatalf("got %d elements, want 5", len(elems))
+	}
+	if end := elems[1]; !end.IntervalEnd || netip.AddrFrom4([4]byte(end.Key)) != netip.MustParseAddr("10.0.2.0") {
+		t.Errorf("first interval end = %+v, want 10.0.2.0", end)
+	}
+}
+
+func TestSetBlocklists(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	list := Blocklist{Name: "internal", Prefixes: []netip.Prefix{
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("203.0.113.7/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}}
+	if err := fw.SetBlocklists([]Blocklist{list}); err != nil {
+		t.Fatalf("SetBlocklists() error = %v", err)
+	}
+
+	if n := len(conn.state.sets); n != 2 {
+		t.Fatalf("got %d sets, want 2", n)
+	}
+	v4 := conn.state.sets[0]
+	if v4.set.Name != "blocklist_internal_v4" || !v4.set.Interval || len(v4.elems) != 4 {
+		t.Errorf("v4 set = %+v with %d elements", v4.set, len(v4.elems))
+	}
+
+	input := chainTexts(t, conn, "input")
+	if !contains(input, "ip saddr @blocklist_internal_v4 drop") || !contains(input, "ip6 saddr @blocklist_internal_v6 drop") {
+		t.Errorf("input chain missing blocklist rules: %q", input)
+	}
+	// ahead of established so existing connections are cut off too
+	if input[1] != "ip saddr @blocklist_internal_v4 drop" {
+		t.Errorf("input[1] = %q, want the blocklist drop", input[1])
+	}
+	output := chainTexts(t, conn, "output")
+	if !contains(output, "ip6 daddr @blocklist_internal_v6 reject with icmpx admin-prohibited") {
+		t.Errorf("output chain missing blocklist rule: %q", output)
+	}
+
+	if lists := fw.Blocklists(); len(lists) != 1 || len(lists[0].Prefixes) != 3 {
+		t.Errorf("Blocklists() = %+v, want internal with 3 entries", lists)
+	}
+
+	// clearing the lists removes sets and rules
+	if err := fw.SetBlocklists(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(conn.state.sets); n != 0 {
+		t.Errorf("got %d sets after clearing, want 0", n)
+	}
+}
+
+func TestSetBlocklists_Disabled(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+
+	list := Blocklist{Name: "internal", Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}}
+	if err := fw.SetBlocklists([]Blocklist{list}); err != nil {
+		t.Fatal(err)
+	}
+	if conn.flushes != 0 {
+		t.Errorf("SetBlocklists() while disabled flushed %d times", conn.flushes)
+	}
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(conn.state.sets); n != 1 {
+		t.Errorf("got %d sets after Enable, want 1", n)
+	}
+}
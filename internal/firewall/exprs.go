@@ -0,0 +1,230 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Helpers that build nftables expression fragments. Each returns a slice
+// so they can be concatenated into a full rule. All matches load into
+// register 1, which is fine since every fragment ends in a compare.
+
+// ifname pads an interface name to IFNAMSIZ the way the kernel stores it.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// matchIifname matches the input interface name (iifname "lo").
+func matchIifname(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// matchOifname matches the output interface name (oifname "lo").
+func matchOifname(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// matchCtState matches if any of the given conntrack state bits are set
+// (ct state established,related).
+func matchCtState(mask uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(mask),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+	}
+}
+
+// matchL4Proto matches the transport protocol (meta l4proto tcp).
+func matchL4Proto(proto byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+// matchNFProto matches the network family within an inet table.
+func matchNFProto(proto byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+// matchICMPType matches an ICMP or ICMPv6 message type (icmp type
+// echo-request). proto selects which of the two.
+func matchICMPType(proto, typ byte) []expr.Any {
+	return append(matchL4Proto(proto),
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       0,
+			Len:          1,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{typ}},
+	)
+}
+
+// matchDport matches a destination port or inclusive port range. Must come
+// after matchL4Proto so the transport header offset is meaningful.
+func matchDport(lo, hi uint16) []expr.Any {
+	load := &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       2,
+		Len:          2,
+	}
+	if lo == hi {
+		return []expr.Any{
+			load,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(lo)},
+		}
+	}
+	return []expr.Any{
+		load,
+		&expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			FromData: binaryutil.BigEndian.PutUint16(lo),
+			ToData:   binaryutil.BigEndian.PutUint16(hi),
+		},
+	}
+}
+
+// matchAddr matches a source or destination address prefix. The family
+// check is included because ip and ip6 addresses live at different header
+// offsets.
+func matchAddr(prefix netip.Prefix, dst bool) []expr.Any {
+	prefix = prefix.Masked()
+	addr := prefix.Addr().AsSlice()
+
+	var nfproto byte = unix.NFPROTO_IPV4
+	var offset uint32 = 12 // ip saddr
+	if prefix.Addr().Is6() {
+		nfproto = unix.NFPROTO_IPV6
+		offset = 8 // ip6 saddr
+	}
+	if dst {
+		offset += uint32(len(addr))
+	}
+
+	exprs := matchNFProto(nfproto)
+	exprs = append(exprs, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          uint32(len(addr)),
+	})
+	if prefix.Bits() < len(addr)*8 {
+		mask := make([]byte, len(addr))
+		for i := 0; i < prefix.Bits(); i++ {
+			mask[i/8] |= 0x80 >> (i % 8)
+		}
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(addr)),
+			Mask:           mask,
+			Xor:            make([]byte, len(addr)),
+		})
+	}
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr})
+}
+
+// matchAddrSet matches a source or destination address against a named
+// set (ip saddr @blocklist). The set must hold addresses of the family v6
+// selects.
+func matchAddrSet(set *nftables.Set, v6, dst bool) []expr.Any {
+	var nfproto byte = unix.NFPROTO_IPV4
+	var offset, size uint32 = 12, 4
+	if v6 {
+		nfproto = unix.NFPROTO_IPV6
+		offset, size = 8, 16
+	}
+	if dst {
+		offset += size
+	}
+
+	return append(matchNFProto(nfproto),
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          size,
+		},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	)
+}
+
+// matchSaddr matches a source address prefix (ip saddr 10.0.0.0/8).
+func matchSaddr(prefix netip.Prefix) []expr.Any {
+	return matchAddr(prefix, false)
+}
+
+// matchDaddr matches a destination address prefix (ip daddr 10.0.0.0/8).
+func matchDaddr(prefix netip.Prefix) []expr.Any {
+	return matchAddr(prefix, true)
+}
+
+// matchCgroup matches packets from sockets owned by a cgroup or one of
+// its descendants (socket cgroupv2 level 2 "user.slice/...").
+func matchCgroup(level uint32, id uint64) []expr.Any {
+	return []expr.Any{
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: level, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint64(id)},
+	}
+}
+
+// verdict terminates a rule with accept, drop, etc.
+func verdict(kind expr.VerdictKind) []expr.Any {
+	return []expr.Any{&expr.Verdict{Kind: kind}}
+}
+
+// reject answers with ICMP or ICMPv6 admin-prohibited, whichever matches
+// the packet's family (reject with icmpx admin-prohibited).
+func reject() []expr.Any {
+	return []expr.Any{&expr.Reject{
+		Type: unix.NFT_REJECT_ICMPX_UNREACH,
+		Code: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED,
+	}}
+}
+
+// limitRate passes at most rate packets per second with the given burst
+// (limit rate 10/second burst 20 packets).
+func limitRate(rate uint64, burst uint32) []expr.Any {
+	return []expr.Any{&expr.Limit{
+		Type:  expr.LimitTypePkts,
+		Rate:  rate,
+		Unit:  expr.LimitTimeSecond,
+		Burst: burst,
+	}}
+}
+
+// nflog copies the packet to userspace on an NFLOG group
+// (log prefix "..." group N).
+func nflog(group uint16, prefix string) []expr.Any {
+	return []expr.Any{&expr.Log{
+		Key:   1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX,
+		Group: group,
+		Data:  []byte(prefix),
+	}}
+}
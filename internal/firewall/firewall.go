@@ -0,0 +1,372 @@
+// oreon/defense · watchthelight <wtl>
+
+// Package firewall manages the daemon's nftables table.
+//
+// Everything we install lives in a single inet table so it never touches
+// rules owned by anything else on the system, and removing it is a single
+// table delete.
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/userdata"
+)
+
+// TableName is the nftables table owned by the daemon.
+const TableName = "oreon_defense"
+
+// Conn is the subset of *nftables.Conn the firewall uses.
+// Tests swap in a MemConn so nothing touches the kernel.
+type Conn interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	AddChain(c *nftables.Chain) *nftables.Chain
+	AddRule(r *nftables.Rule) *nftables.Rule
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error)
+	ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error)
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+	Flush() error
+}
+
+// NewKernelConn returns a Conn backed by netlink.
+func NewKernelConn() Conn {
+	// a non-lasting conn dials per operation, so New can't fail here
+	conn, _ := nftables.New()
+	return conn
+}
+
+// Status reports what is currently loaded in the kernel for our table.
+type Status struct {
+	Loaded bool // our table exists
+	Tables int
+	Chains int
+	Rules  int
+}
+
+// Firewall owns the oreon_defense table.
+// Thread-safe - can be called from multiple goroutines.
+type Firewall struct {
+	mu      sync.Mutex
+	conn    Conn
+	enabled bool
+	cur     settings
+}
+
+// settings is everything the ruleset is built from.
+type settings struct {
+	profile  Profile
+	lists    []Blocklist
+	apps     []AppRule
+	lockdown bool  // load the drop-all ruleset instead, enabled or not
+	priority int32 // hook priority of our chains, relative to filter
+}
+
+// ErrLockedDown is returned when removing our table would lift a lockdown.
+var ErrLockedDown = errors.New("firewall is locked down")
+
+// clone copies s so changes made through the caller's slices don't leak
+// into it.
+func (s settings) clone() settings {
+	s.profile.Rules = slices.Clone(s.profile.Rules)
+	s.lists = slices.Clone(s.lists)
+	s.apps = slices.Clone(s.apps)
+	return s
+}
+
+// New creates a firewall that talks to nftables through conn.
+func New(conn Conn) *Firewall {
+	return &Firewall{conn: conn}
+}
+
+// table returns a handle for our table.
+func (f *Firewall) table() *nftables.Table {
+	return &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+}
+
+// Enabled returns whether the ruleset has been installed by this process.
+func (f *Firewall) Enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled
+}
+
+// Profile returns the active profile.
+func (f *Firewall) Profile() Profile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cur.profile
+}
+
+// SetProfile switches the active profile. If the firewall is enabled the
+// new ruleset is applied immediately; on failure the old profile stays
+// active and loaded.
+func (f *Firewall) SetProfile(p Profile) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.cur
+	next.profile = p
+	return f.update(next)
+}
+
+// Blocklists returns the loaded blocklists.
+func (f *Firewall) Blocklists() []Blocklist {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.cur.lists)
+}
+
+// SetBlocklists replaces the blocklists. Like SetProfile, the change is
+// applied immediately if the firewall is enabled, and on failure the old
+// lists stay loaded.
+func (f *Firewall) SetBlocklists(lists []Blocklist) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.cur
+	next.lists = slices.Clone(lists)
+	return f.update(next)
+}
+
+// AppRules returns the loaded per-application rules.
+func (f *Firewall) AppRules() []AppRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.cur.apps)
+}
+
+// SetAppRules replaces the per-application rules, applying them as
+// SetBlocklists does.
+func (f *Firewall) SetAppRules(apps []AppRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.cur
+	next.apps = slices.Clone(apps)
+	return f.update(next)
+}
+
+// update makes next current, loading it first if the firewall is enabled
+// or locked down, and removing our table if a lockdown of a disabled
+// firewall is ending.
+func (f *Firewall) update(next settings) error {
+	switch {
+	case f.enabled || next.lockdown:
+		if err := f.apply(buildRuleset(next)); err != nil {
+			return err
+		}
+	case f.cur.lockdown:
+		if err := f.remove(); err != nil {
+			return err
+		}
+	}
+	f.cur = next
+	return nil
+}
+
+// Priority returns the hook priority of our chains relative to the
+// standard filter priority.
+func (f *Firewall) Priority() int32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cur.priority
+}
+
+// SetPriority moves our chains to a hook priority relative to filter;
+// lower runs earlier. Other managers' chains at the same priority run in
+// no particular order relative to ours. Applied immediately if the
+// firewall is enabled.
+func (f *Firewall) SetPriority(prio int32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.cur
+	next.priority = prio
+	return f.update(next)
+}
+
+// LockedDown reports whether the drop-all ruleset is in force.
+func (f *Firewall) LockedDown() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cur.lockdown
+}
+
+// Lockdown replaces the ruleset with one that drops all traffic except
+// loopback, whether or not the firewall is enabled. Profile, blocklist
+// and app changes made while locked down are kept for when it ends.
+func (f *Firewall) Lockdown() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.cur
+	next.lockdown = true
+	return f.update(next)
+}
+
+// Release ends a lockdown, going back to the normal ruleset, or to no
+// table at all if the firewall is disabled.
+func (f *Firewall) Release() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.cur
+	next.lockdown = false
+	return f.update(next)
+}
+
+// Enable installs the ruleset for the active profile, replacing whatever
+// version of our table is currently loaded.
+func (f *Firewall) Enable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.apply(buildRuleset(f.cur)); err != nil {
+		return err
+	}
+	f.enabled = true
+	return nil
+}
+
+// Disable removes our table. Rules owned by other tables are left alone.
+// It fails with ErrLockedDown during a lockdown.
+func (f *Firewall) Disable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cur.lockdown {
+		return ErrLockedDown
+	}
+	if err := f.remove(); err != nil {
+		return err
+	}
+	f.enabled = false
+	return nil
+}
+
+// Snapshot records what the firewall has loaded so it can be put back
+// with Restore. Lockdown isn't part of it: restoring a snapshot never
+// starts or ends one.
+type Snapshot struct {
+	enabled bool
+	settings
+}
+
+// Profile returns the profile that was active when the snapshot was taken.
+func (s Snapshot) Profile() Profile {
+	return s.profile
+}
+
+// Snapshot captures the current state.
+func (f *Firewall) Snapshot() Snapshot {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return Snapshot{enabled: f.enabled, settings: f.cur.clone()}
+}
+
+// Restore puts back the state recorded by Snapshot, loading or removing
+// our table to match.
+func (f *Firewall) Restore(s Snapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := s.settings.clone()
+	next.lockdown = f.cur.lockdown
+
+	var err error
+	if s.enabled || next.lockdown {
+		err = f.apply(buildRuleset(next))
+	} else {
+		err = f.remove()
+	}
+	if err != nil {
+		return err
+	}
+	f.enabled = s.enabled
+	f.cur = next
+	return nil
+}
+
+// remove deletes our table.
+func (f *Firewall) remove() error {
+	// add before delete so the delete can't fail if the table is already gone
+	table := f.table()
+	f.conn.AddTable(table)
+	f.conn.DelTable(table)
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("remove table: %w", err)
+	}
+	return nil
+}
+
+// apply replaces our table with the given ruleset in a single
+// transaction, so the kernel never sees a half-built ruleset.
+func (f *Firewall) apply(rs ruleset) error {
+	table := f.table()
+	f.conn.AddTable(table)
+	f.conn.DelTable(table)
+	f.conn.AddTable(table)
+
+	for _, ss := range rs.sets {
+		ss.set.Table = table
+		if err := f.conn.AddSet(ss.set, ss.elems); err != nil {
+			return fmt.Errorf("add set %s: %w", ss.set.Name, err)
+		}
+	}
+
+	for _, cs := range rs.chains {
+		policy := cs.policy
+		chain := f.conn.AddChain(&nftables.Chain{
+			Name:     cs.name,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  cs.hook,
+			Priority: cs.priority,
+			Policy:   &policy,
+		})
+		for _, rs := range cs.rules {
+			f.conn.AddRule(&nftables.Rule{
+				Table:    table,
+				Chain:    chain,
+				Exprs:    rs.exprs,
+				UserData: userdata.AppendString(nil, userdata.TypeComment, rs.text),
+			})
+		}
+	}
+
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("apply ruleset: %w", err)
+	}
+	return nil
+}
+
+// Status reads our table back from the kernel and counts what is loaded.
+func (f *Firewall) Status() (Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var st Status
+
+	chains, err := f.loaded()
+	if err != nil {
+		return st, err
+	}
+	if chains == nil {
+		return st, nil
+	}
+
+	st.Loaded = true
+	st.Tables = 1
+	st.Chains = len(chains)
+	for _, c := range chains {
+		st.Rules += len(c.rules)
+	}
+	return st, nil
+}
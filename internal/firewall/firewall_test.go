@@ -0,0 +1,496 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/userdata"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestEnable(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+
+	if err := fw.Enable(); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	if !fw.Enabled() {
+		t.Error("Enabled() = false after Enable")
+	}
+
+	st, err := fw.Status()
+	if err != nil {
+		t.Fatalf("Status() error = %v", err)
+	}
+	if !st.Loaded || st.Tables != 1 {
+		t.Errorf("Loaded = %v, Tables = %d, want true, 1", st.Loaded, st.Tables)
+	}
+	if st.Chains != 1 {
+		t.Errorf("Chains = %d, want 1", st.Chains)
+	}
+	if want := len(buildRuleset(settings{}).chains[0].rules); st.Rules != want {
+		t.Errorf("Rules = %d, want %d", st.Rules, want)
+	}
+}
+
+func TestEnable_InputPolicyDrop(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+
+	chains, _ := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if len(chains) != 1 {
+		t.Fatalf("got %d chains, want 1", len(chains))
+	}
+	c := chains[0]
+	if c.Name != "input" || c.Hooknum != nftables.ChainHookInput {
+		t.Errorf("chain = %s, want input hook", c.Name)
+	}
+	if c.Policy == nil || *c.Policy != nftables.ChainPolicyDrop {
+		t.Error("input chain policy is not drop")
+	}
+}
+
+func TestEnable_RuleComments(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+
+	chains, _ := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	rules, _ := conn.GetRules(fw.table(), chains[0])
+	for _, r := range rules {
+		if text, ok := userdata.GetString(r.UserData, userdata.TypeComment); !ok || text == "" {
+			t.Errorf("rule missing comment: %+v", r)
+		}
+	}
+}
+
+func TestEnable_Idempotent(t *testing.T) {
+	fw := New(NewMemConn())
+
+	for i := 0; i < 3; i++ {
+		if err := fw.Enable(); err != nil {
+			t.Fatalf("Enable() #%d error = %v", i, err)
+		}
+	}
+
+	st, _ := fw.Status()
+	if st.Chains != 1 {
+		t.Errorf("Chains = %d after repeated enable, want 1", st.Chains)
+	}
+	if want := len(buildRuleset(settings{}).chains[0].rules); st.Rules != want {
+		t.Errorf("Rules = %d after repeated enable, want %d", st.Rules, want)
+	}
+}
+
+func TestDisable(t *testing.T) {
+	fw := New(NewMemConn())
+
+	if err := fw.Enable(); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	if err := fw.Disable(); err != nil {
+		t.Fatalf("Disable() error = %v", err)
+	}
+	if fw.Enabled() {
+		t.Error("Enabled() = true after Disable")
+	}
+
+	st, _ := fw.Status()
+	if st.Loaded || st.Tables != 0 || st.Chains != 0 || st.Rules != 0 {
+		t.Errorf("Status() = %+v, want empty", st)
+	}
+}
+
+func TestDisable_NotLoaded(t *testing.T) {
+	fw := New(NewMemConn())
+	if err := fw.Disable(); err != nil {
+		t.Errorf("Disable() on empty ruleset error = %v", err)
+	}
+}
+
+func TestDisable_LeavesForeignTables(t *testing.T) {
+	conn := NewMemConn()
+	foreign := &nftables.Table{Name: "firewalld", Family: nftables.TableFamilyINet}
+	conn.AddTable(foreign)
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	fw := New(conn)
+	fw.Enable()
+	fw.Disable()
+
+	tables, _ := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if len(tables) != 1 || tables[0].Name != "firewalld" {
+		t.Errorf("tables = %v, want only firewalld", tables)
+	}
+}
+
+func TestEnable_FlushError(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+
+	conn.flushErr = errors.New("operation not permitted")
+	if err := fw.Enable(); err == nil {
+		t.Fatal("Enable() should fail when flush fails")
+	}
+	if fw.Enabled() {
+		t.Error("Enabled() = true after failed Enable")
+	}
+
+	st, _ := fw.Status()
+	if st.Loaded {
+		t.Error("table loaded after failed flush")
+	}
+}
+
+func TestMemConn_AtomicFlush(t *testing.T) {
+	conn := NewMemConn()
+	table := &nftables.Table{Name: "t", Family: nftables.TableFamilyINet}
+	conn.AddTable(table)
+	conn.DelTable(&nftables.Table{Name: "missing", Family: nftables.TableFamilyINet})
+
+	if err := conn.Flush(); err == nil {
+		t.Fatal("Flush() should fail deleting a missing table")
+	}
+	tables, _ := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if len(tables) != 0 {
+		t.Errorf("partial batch applied: %v", tables)
+	}
+}
+
+func TestEnable_MarshalsForKernel(t *testing.T) {
+	// run the real nftables encoder against a fake netlink socket to catch
+	// expressions the kernel would reject as malformed
+	var msgs int
+	conn, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		msgs += len(req)
+		return req, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "home", AllowPing: true, AllowLAN: true, Reject: true, LogDrops: true, Rules: testRules})
+	fw.SetBlocklists([]Blocklist{{Name: "internal", Prefixes: []netip.Prefix{
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}}})
+	fw.SetAppRules([]AppRule{{Cgroup: "user.slice/user-1000.slice", ID: 1234, Comment: "test"}})
+	if err := fw.Enable(); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	if err := fw.Lockdown(); err != nil {
+		t.Fatalf("Lockdown() error = %v", err)
+	}
+	if msgs == 0 {
+		t.Error("no netlink messages sent")
+	}
+}
+
+// ruleTexts returns the comments of all rules loaded in our input chain.
+func ruleTexts(t *testing.T, conn *MemConn) []string {
+	t.Helper()
+	return chainTexts(t, conn, "input")
+}
+
+// chainTexts returns the comments of all rules loaded in a chain.
+func chainTexts(t *testing.T, conn *MemConn, chain string) []string {
+	t.Helper()
+	table := &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+	rules, err := conn.GetRules(table, &nftables.Chain{Name: chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, r := range rules {
+		text, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+		texts = append(texts, text)
+	}
+	return texts
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProfiles(t *testing.T) {
+	tests := []struct {
+		profile Profile
+		want    []string
+		notWant []string
+	}{
+		{
+			profile: Profile{Name: "home", AllowPing: true, AllowLAN: true, Reject: true},
+			want:    []string{"icmp type echo-request accept", "ip saddr 192.168.0.0/16 accept", "reject with icmpx admin-prohibited"},
+			notWant: []string{"icmpv6 type echo-request drop"},
+		},
+		{
+			profile: Profile{Name: "public", Reject: true},
+			want:    []string{"icmpv6 type echo-request drop", "reject with icmpx admin-prohibited"},
+			notWant: []string{"icmp type echo-request accept", "ip saddr 192.168.0.0/16 accept"},
+		},
+		{
+			profile: Profile{Name: "strict"},
+			want:    []string{"icmpv6 type echo-request drop"},
+			notWant: []string{"reject with icmpx admin-prohibited", "ip saddr 10.0.0.0/8 accept"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile.Name, func(t *testing.T) {
+			conn := NewMemConn()
+			fw := New(conn)
+			if err := fw.SetProfile(tt.profile); err != nil {
+				t.Fatalf("SetProfile() error = %v", err)
+			}
+			if err := fw.Enable(); err != nil {
+				t.Fatalf("Enable() error = %v", err)
+			}
+
+			texts := ruleTexts(t, conn)
+			for _, w := range tt.want {
+				if !contains(texts, w) {
+					t.Errorf("missing rule %q in %v", w, texts)
+				}
+			}
+			for _, nw := range tt.notWant {
+				if contains(texts, nw) {
+					t.Errorf("unexpected rule %q", nw)
+				}
+			}
+		})
+	}
+}
+
+func TestSetProfile_AppliesWhenEnabled(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fw.SetProfile(Profile{Name: "home", AllowPing: true}); err != nil {
+		t.Fatalf("SetProfile() error = %v", err)
+	}
+	if !contains(ruleTexts(t, conn), "icmp type echo-request accept") {
+		t.Error("profile not applied to loaded ruleset")
+	}
+	if fw.Profile().Name != "home" {
+		t.Errorf("Profile() = %q, want home", fw.Profile().Name)
+	}
+}
+
+func TestSetProfile_FailureKeepsOld(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "public"})
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.flushErr = errors.New("operation not permitted")
+	if err := fw.SetProfile(Profile{Name: "home", AllowPing: true}); err == nil {
+		t.Fatal("SetProfile() should fail when flush fails")
+	}
+	if fw.Profile().Name != "public" {
+		t.Errorf("Profile() = %q after failed switch, want public", fw.Profile().Name)
+	}
+	if contains(ruleTexts(t, conn), "icmp type echo-request accept") {
+		t.Error("failed profile switch changed the loaded ruleset")
+	}
+}
+
+func TestSetProfile_DisabledDoesNotLoad(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.SetProfile(Profile{Name: "home"}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := fw.Status(); st.Loaded {
+		t.Error("SetProfile loaded a ruleset while disabled")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "public", Reject: true})
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	snap := fw.Snapshot()
+
+	fw.SetProfile(Profile{Name: "home", AllowPing: true})
+	if err := fw.Disable(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fw.Restore(snap); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if !fw.Enabled() || fw.Profile().Name != "public" {
+		t.Errorf("after restore enabled = %v, profile = %q, want enabled public", fw.Enabled(), fw.Profile().Name)
+	}
+	texts := ruleTexts(t, conn)
+	if !contains(texts, "reject with icmpx admin-prohibited") || contains(texts, "icmp type echo-request accept") {
+		t.Errorf("restored rules = %v, want the public ruleset", texts)
+	}
+}
+
+func TestRestore_Disabled(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	snap := fw.Snapshot()
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fw.Restore(snap); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if st, _ := fw.Status(); fw.Enabled() || st.Loaded {
+		t.Error("restoring a disabled snapshot left the table loaded")
+	}
+}
+
+func TestLockdown(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "home", AllowLAN: true, Rules: testRules})
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fw.Lockdown(); err != nil {
+		t.Fatalf("Lockdown() error = %v", err)
+	}
+	checkLockdown := func() {
+		t.Helper()
+		chains, _ := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+		if len(chains) != 3 {
+			t.Fatalf("got %d chains, want input, forward and output", len(chains))
+		}
+		for _, c := range chains {
+			if c.Policy == nil || *c.Policy != nftables.ChainPolicyDrop {
+				t.Errorf("%s chain policy is not drop", c.Name)
+			}
+		}
+		if input := chainTexts(t, conn, "input"); len(input) != 1 || input[0] != `iifname "lo" accept` {
+			t.Errorf("input chain = %q, want only loopback", input)
+		}
+		if output := chainTexts(t, conn, "output"); len(output) != 1 || output[0] != `oifname "lo" accept` {
+			t.Errorf("output chain = %q, want only loopback", output)
+		}
+	}
+	checkLockdown()
+
+	// changes while locked down are kept but not loaded
+	if err := fw.SetProfile(Profile{Name: "public"}); err != nil {
+		t.Fatal(err)
+	}
+	checkLockdown()
+	if err := fw.Disable(); !errors.Is(err, ErrLockedDown) {
+		t.Errorf("Disable() error = %v, want ErrLockedDown", err)
+	}
+
+	if err := fw.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if fw.LockedDown() {
+		t.Error("LockedDown() = true after Release")
+	}
+	if input := ruleTexts(t, conn); contains(input, "ip saddr 10.0.0.0/8 accept") {
+		t.Error("released into the profile from before the lockdown")
+	}
+	if st, _ := fw.Status(); st.Chains != 1 {
+		t.Errorf("Chains = %d after release, want 1", st.Chains)
+	}
+}
+
+func TestLockdown_Disabled(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+
+	if err := fw.Lockdown(); err != nil {
+		t.Fatalf("Lockdown() error = %v", err)
+	}
+	if st, _ := fw.Status(); !st.Loaded {
+		t.Fatal("lockdown of a disabled firewall loaded nothing")
+	}
+
+	// a revert doesn't lift the lockdown
+	if err := fw.Restore(fw.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := fw.Status(); !fw.LockedDown() || !st.Loaded {
+		t.Error("Restore() lifted the lockdown")
+	}
+
+	if err := fw.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if st, _ := fw.Status(); st.Loaded || fw.Enabled() {
+		t.Error("releasing a disabled firewall left the table loaded")
+	}
+}
+
+var testRules = []Rule{
+	{Proto: unix.IPPROTO_TCP, FromPort: 22, ToPort: 22, Addr: netip.MustParsePrefix("10.0.0.0/8"), Comment: "ssh"},
+	{Proto: unix.IPPROTO_UDP, FromPort: 1714, ToPort: 1764},
+	{Proto: unix.IPPROTO_TCP, FromPort: 443, ToPort: 443, Addr: netip.MustParsePrefix("2001:db8::/32"), Out: true},
+}
+
+func TestRules(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "public", Reject: true, Rules: testRules})
+	if err := fw.Enable(); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+
+	input := ruleTexts(t, conn)
+	for _, w := range []string{`ip saddr 10.0.0.0/8 tcp dport 22 accept comment "ssh"`, "udp dport 1714-1764 accept"} {
+		if !contains(input, w) {
+			t.Errorf("input rules missing %q, got %v", w, input)
+		}
+	}
+	// port rules must come before the catch-all reject
+	if last := input[len(input)-1]; last != "reject with icmpx admin-prohibited" {
+		t.Errorf("last input rule = %q, want reject", last)
+	}
+
+	output := chainTexts(t, conn, "output")
+	if len(output) != 1 || output[0] != "ip6 daddr 2001:db8::/32 tcp dport 443 accept" {
+		t.Errorf("output rules = %v", output)
+	}
+}
+
+func TestRules_NoOutputChainWithoutOutboundRules(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "public", Rules: testRules[:2]})
+	if err := fw.Enable(); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	if st, _ := fw.Status(); st.Chains != 1 {
+		t.Errorf("Chains = %d, want only input", st.Chains)
+	}
+}
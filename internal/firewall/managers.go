@@ -0,0 +1,204 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/google/nftables"
+)
+
+// Manager is another firewall manager found on the system. Their rules
+// live in tables of their own, so nothing we load replaces them: a packet
+// has to get past every table's base chains, and whichever drops it wins.
+type Manager struct {
+	Name string   // "firewalld", "ufw", or "nftables" for tables nothing claims
+	Via  []string // what gave it away, e.g. "unit firewalld.service"
+}
+
+// Identified reports whether m is a manager recognised by name, rather
+// than tables nothing claims, which may belong to anything from Docker
+// to a hand-written ruleset.
+func (m Manager) Identified() bool {
+	return m.Name != "nftables"
+}
+
+// knownManagers are the managers recognised by name.
+var knownManagers = []struct {
+	name    string
+	busName string // well-known D-Bus name, if it has one
+	unit    string
+}{
+	{name: "firewalld", busName: "org.fedoraproject.FirewallD1", unit: "firewalld.service"},
+	{name: "ufw", unit: "ufw.service"},
+}
+
+// Bus is what manager detection asks of the system bus.
+type Bus interface {
+	// NameHasOwner reports whether something owns a well-known name.
+	NameHasOwner(name string) (bool, error)
+	// UnitActive reports whether a systemd unit is active.
+	UnitActive(unit string) (bool, error)
+}
+
+// systemBus is a Bus backed by a private system bus connection.
+type systemBus struct {
+	conn *dbus.Conn
+}
+
+// SystemBus connects to the system bus.
+func SystemBus() (Bus, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connect to system bus: %w", err)
+	}
+	return &systemBus{conn: conn}, nil
+}
+
+func (b *systemBus) NameHasOwner(name string) (bool, error) {
+	var owned bool
+	err := b.conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, name).Store(&owned)
+	return owned, err
+}
+
+func (b *systemBus) UnitActive(unit string) (bool, error) {
+	systemd := b.conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+	var path dbus.ObjectPath
+	if err := systemd.Call("org.freedesktop.systemd1.Manager.GetUnit", 0, unit).Store(&path); err != nil {
+		// units that aren't loaded aren't running either
+		var dbusErr dbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.systemd1.NoSuchUnit" {
+			return false, nil
+		}
+		return false, err
+	}
+	state, err := b.conn.Object("org.freedesktop.systemd1", path).GetProperty("org.freedesktop.systemd1.Unit.ActiveState")
+	if err != nil {
+		return false, err
+	}
+	return state.Value() == "active", nil
+}
+
+// Managers looks for other firewall managers: known ones by D-Bus name
+// and systemd unit, and any table other than ours with a filter base
+// chain. bus may be nil, in which case only tables are looked at.
+func (f *Firewall) Managers(bus Bus) ([]Manager, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []Manager
+	found := func(name, via string) {
+		for i := range out {
+			if out[i].Name == name {
+				out[i].Via = append(out[i].Via, via)
+				return
+			}
+		}
+		out = append(out, Manager{Name: name, Via: []string{via}})
+	}
+
+	var errs []error
+	if bus != nil {
+		for _, m := range knownManagers {
+			if m.busName != "" {
+				owned, err := bus.NameHasOwner(m.busName)
+				if err != nil {
+					errs = append(errs, err)
+				} else if owned {
+					found(m.name, "dbus "+m.busName)
+				}
+			}
+			active, err := bus.UnitActive(m.unit)
+			if err != nil {
+				errs = append(errs, err)
+			} else if active {
+				found(m.name, "unit "+m.unit)
+			}
+		}
+	}
+
+	tables, err := f.foreignTables()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, t := range tables {
+		found(t.owner, "table "+t.text)
+	}
+
+	// keep the order stable so callers can compare results
+	slices.SortStableFunc(out, func(a, b Manager) int { return strings.Compare(a.Name, b.Name) })
+	return out, errors.Join(errs...)
+}
+
+// foreignTable is a table that filters traffic and isn't ours.
+type foreignTable struct {
+	text  string // "family name", as nft lists it
+	owner string
+}
+
+// foreignTables lists the tables other than ours that have a filter base
+// chain. Tables with only nat or other chain types don't decide what
+// gets through, so they don't count.
+func (f *Firewall) foreignTables() ([]foreignTable, error) {
+	chains, err := f.conn.ListChainsOfTableFamily(nftables.TableFamilyUnspecified)
+	if err != nil {
+		return nil, fmt.Errorf("list chains: %w", err)
+	}
+
+	var out []foreignTable
+	index := make(map[string]int)
+	for _, c := range chains {
+		if c.Table == nil || (c.Table.Name == TableName && c.Table.Family == nftables.TableFamilyINet) {
+			continue
+		}
+		text := familyName(c.Table.Family) + " " + c.Table.Name
+		i, seen := index[text]
+		if !seen {
+			i = -1
+		}
+
+		// ufw's chains are all prefixed, whichever table it puts them in
+		if strings.HasPrefix(c.Name, "ufw-") || strings.HasPrefix(c.Name, "ufw6-") {
+			if i < 0 {
+				index[text] = len(out)
+				out = append(out, foreignTable{text: text, owner: "ufw"})
+			} else {
+				out[i].owner = "ufw"
+			}
+			continue
+		}
+		if i >= 0 || c.Hooknum == nil || (c.Type != "" && c.Type != nftables.ChainTypeFilter) {
+			continue
+		}
+		owner := "nftables"
+		if c.Table.Name == "firewalld" {
+			owner = "firewalld"
+		}
+		index[text] = len(out)
+		out = append(out, foreignTable{text: text, owner: owner})
+	}
+	return out, nil
+}
+
+// familyName returns the nft keyword for a table family.
+func familyName(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	}
+	return fmt.Sprint(uint8(f))
+}
@@ -0,0 +1,126 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+// fakeBus answers detection queries from fixed sets of names and units.
+type fakeBus struct {
+	names map[string]bool
+	units map[string]bool
+	err   error
+}
+
+func (b fakeBus) NameHasOwner(name string) (bool, error) { return b.names[name], b.err }
+func (b fakeBus) UnitActive(unit string) (bool, error)   { return b.units[unit], b.err }
+
+// addForeignChain loads a chain into a table we don't own. hook is nil
+// for a regular chain.
+func addForeignChain(t *testing.T, conn *MemConn, family nftables.TableFamily, table, chain string, hook *nftables.ChainHook, typ nftables.ChainType) {
+	t.Helper()
+	tbl := conn.AddTable(&nftables.Table{Name: table, Family: family})
+	c := &nftables.Chain{Name: chain, Table: tbl, Type: typ}
+	if hook != nil {
+		c.Hooknum = hook
+		c.Priority = nftables.ChainPriorityFilter
+	}
+	conn.AddChain(c)
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagers(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing but ours
+	got, err := fw.Managers(fakeBus{})
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Managers() = %v, %v, want none", got, err)
+	}
+
+	addForeignChain(t, conn, nftables.TableFamilyINet, "firewalld", "filter_INPUT", nftables.ChainHookInput, nftables.ChainTypeFilter)
+	addForeignChain(t, conn, nftables.TableFamilyIPv4, "filter", "INPUT", nftables.ChainHookInput, nftables.ChainTypeFilter)
+	addForeignChain(t, conn, nftables.TableFamilyIPv4, "filter", "ufw-before-input", nil, "")
+	addForeignChain(t, conn, nftables.TableFamilyIPv6, "filter", "INPUT", nftables.ChainHookInput, nftables.ChainTypeFilter)
+	// nat only, doesn't filter
+	addForeignChain(t, conn, nftables.TableFamilyIPv4, "nat", "POSTROUTING", nftables.ChainHookPostrouting, nftables.ChainTypeNAT)
+
+	bus := fakeBus{
+		names: map[string]bool{"org.fedoraproject.FirewallD1": true},
+		units: map[string]bool{"firewalld.service": true},
+	}
+	got, err = fw.Managers(bus)
+	if err != nil {
+		t.Fatalf("Managers() error = %v", err)
+	}
+
+	want := map[string][]string{
+		"firewalld": {"dbus org.fedoraproject.FirewallD1", "unit firewalld.service", "table inet firewalld"},
+		"nftables":  {"table ip6 filter"},
+		"ufw":       {"table ip filter"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Managers() = %+v, want %v", got, want)
+	}
+	for i, m := range got {
+		if i > 0 && got[i-1].Name > m.Name {
+			t.Errorf("managers not sorted: %+v", got)
+		}
+		if !slices.Equal(m.Via, want[m.Name]) {
+			t.Errorf("%s found via %q, want %q", m.Name, m.Via, want[m.Name])
+		}
+	}
+}
+
+func TestManagers_BusError(t *testing.T) {
+	conn := NewMemConn()
+	addForeignChain(t, conn, nftables.TableFamilyINet, "filter", "input", nftables.ChainHookInput, nftables.ChainTypeFilter)
+	fw := New(conn)
+
+	// tables are still reported when the bus can't be asked
+	got, err := fw.Managers(fakeBus{err: errors.New("no bus")})
+	if err == nil {
+		t.Error("bus error not reported")
+	}
+	if len(got) != 1 || got[0].Name != "nftables" {
+		t.Errorf("Managers() = %+v, want the foreign table", got)
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.SetPriority(-10); err != nil {
+		t.Fatalf("SetPriority() error = %v", err)
+	}
+
+	chains, _ := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	for _, c := range chains {
+		if *c.Priority != -10 {
+			t.Errorf("chain %s priority = %d, want -10", c.Name, *c.Priority)
+		}
+	}
+
+	pv, err := fw.Preview(fw.Profile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Changed || !strings.Contains(pv.Ruleset, "priority filter - 10;") {
+		t.Errorf("preview at the loaded priority: changed %v, ruleset %q", pv.Changed, pv.Ruleset)
+	}
+}
@@ -0,0 +1,217 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/nftables"
+)
+
+// MemConn is an in-memory Conn for tests. Like the kernel, it queues
+// changes until Flush and applies them as one transaction: if any
+// operation in the batch fails, none of them take effect.
+type MemConn struct {
+	mu      sync.Mutex
+	state   memState
+	pending []func(*memState) error
+
+	flushErr error // if set, the next Flush fails with this error
+	flushes  int   // number of successful flushes
+}
+
+type memState struct {
+	tables []*nftables.Table
+	sets   []memSet
+	chains []*nftables.Chain
+	rules  []*nftables.Rule
+}
+
+type memSet struct {
+	set   *nftables.Set
+	elems []nftables.SetElement
+}
+
+// NewMemConn creates an empty in-memory ruleset.
+func NewMemConn() *MemConn {
+	return &MemConn{}
+}
+
+func sameTable(a, b *nftables.Table) bool {
+	return a != nil && b != nil && a.Name == b.Name && a.Family == b.Family
+}
+
+func (s *memState) clone() memState {
+	return memState{
+		tables: append([]*nftables.Table(nil), s.tables...),
+		sets:   append([]memSet(nil), s.sets...),
+		chains: append([]*nftables.Chain(nil), s.chains...),
+		rules:  append([]*nftables.Rule(nil), s.rules...),
+	}
+}
+
+func (s *memState) hasTable(t *nftables.Table) bool {
+	for _, have := range s.tables {
+		if sameTable(have, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemConn) queue(op func(*memState) error) {
+	m.mu.Lock()
+	m.pending = append(m.pending, op)
+	m.mu.Unlock()
+}
+
+func (m *MemConn) AddTable(t *nftables.Table) *nftables.Table {
+	m.queue(func(s *memState) error {
+		if !s.hasTable(t) {
+			s.tables = append(s.tables, t)
+		}
+		return nil
+	})
+	return t
+}
+
+func (m *MemConn) DelTable(t *nftables.Table) {
+	m.queue(func(s *memState) error {
+		if !s.hasTable(t) {
+			return fmt.Errorf("delete table %s: no such file or directory", t.Name)
+		}
+		tables := s.tables[:0:0]
+		for _, have := range s.tables {
+			if !sameTable(have, t) {
+				tables = append(tables, have)
+			}
+		}
+		chains := s.chains[:0:0]
+		for _, c := range s.chains {
+			if !sameTable(c.Table, t) {
+				chains = append(chains, c)
+			}
+		}
+		rules := s.rules[:0:0]
+		for _, r := range s.rules {
+			if !sameTable(r.Table, t) {
+				rules = append(rules, r)
+			}
+		}
+		sets := s.sets[:0:0]
+		for _, set := range s.sets {
+			if !sameTable(set.set.Table, t) {
+				sets = append(sets, set)
+			}
+		}
+		s.tables, s.sets, s.chains, s.rules = tables, sets, chains, rules
+		return nil
+	})
+}
+
+func (m *MemConn) AddChain(c *nftables.Chain) *nftables.Chain {
+	m.queue(func(s *memState) error {
+		if !s.hasTable(c.Table) {
+			return fmt.Errorf("add chain %s: no such table", c.Name)
+		}
+		s.chains = append(s.chains, c)
+		return nil
+	})
+	return c
+}
+
+func (m *MemConn) AddSet(set *nftables.Set, vals []nftables.SetElement) error {
+	m.queue(func(s *memState) error {
+		if !s.hasTable(set.Table) {
+			return fmt.Errorf("add set %s: no such table", set.Name)
+		}
+		for _, have := range s.sets {
+			if sameTable(have.set.Table, set.Table) && have.set.Name == set.Name {
+				return fmt.Errorf("add set %s: file exists", set.Name)
+			}
+		}
+		s.sets = append(s.sets, memSet{set: set, elems: vals})
+		return nil
+	})
+	return nil
+}
+
+func (m *MemConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	m.queue(func(s *memState) error {
+		for _, c := range s.chains {
+			if sameTable(c.Table, r.Table) && c.Name == r.Chain.Name {
+				s.rules = append(s.rules, r)
+				return nil
+			}
+		}
+		return fmt.Errorf("add rule: no such chain %s", r.Chain.Name)
+	})
+	return r
+}
+
+// Flush applies all queued operations atomically.
+func (m *MemConn) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := m.pending
+	m.pending = nil
+
+	if m.flushErr != nil {
+		err := m.flushErr
+		m.flushErr = nil
+		return err
+	}
+
+	next := m.state.clone()
+	for _, op := range pending {
+		if err := op(&next); err != nil {
+			return err
+		}
+	}
+	m.state = next
+	m.flushes++
+	return nil
+}
+
+// ListTablesOfFamily lists every family's tables for
+// TableFamilyUnspecified, as the kernel does.
+func (m *MemConn) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []*nftables.Table
+	for _, t := range m.state.tables {
+		if family == nftables.TableFamilyUnspecified || t.Family == family {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemConn) ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []*nftables.Chain
+	for _, c := range m.state.chains {
+		if family == nftables.TableFamilyUnspecified || c.Table.Family == family {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemConn) GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []*nftables.Rule
+	for _, r := range m.state.rules {
+		if sameTable(r.Table, t) && r.Chain.Name == c.Name {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,253 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Packets logged by profiles with LogDrops go to this NFLOG group with
+// this prefix, so we can tell them apart from anyone else's.
+const (
+	LogGroup  uint16 = 40
+	LogPrefix        = "oreon-drop: "
+)
+
+// nfnetlink_log message types, attributes and commands, from
+// linux/netfilter/nfnetlink_log.h. x/sys/unix doesn't carry them.
+const (
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaTimestamp    = 3
+	nfulaIfindexIndev = 4
+	nfulaPayload      = 9
+	nfulaPrefix       = 10
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind = 1
+	nfulnlCopyPacket = 2
+
+	// enough for IPv6 plus a transport header
+	logCopyRange = 128
+)
+
+// Drop is a packet our input chain logged before dropping it.
+type Drop struct {
+	Time      time.Time
+	Src       netip.Addr
+	Dst       netip.Addr
+	Proto     string // "tcp", "udp", "icmp", "ipv6-icmp" or the protocol number
+	Port      uint16 // destination port, 0 unless tcp or udp
+	Interface string
+}
+
+// DropSource delivers dropped packets. NFLog reads them from the kernel;
+// tests feed them directly.
+type DropSource interface {
+	// Drops streams packets until ctx is cancelled, then closes the channel.
+	Drops(ctx context.Context) (<-chan Drop, error)
+}
+
+// NFLog reads packets from an NFLOG group over netlink.
+type NFLog struct {
+	group uint16
+}
+
+// NewNFLog creates a reader for the given NFLOG group.
+func NewNFLog(group uint16) *NFLog {
+	return &NFLog{group: group}
+}
+
+// Drops binds to the group and streams logged packets. Packets arriving
+// faster than the reader keeps up are discarded rather than queued.
+func (n *NFLog) Drops(ctx context.Context) (<-chan Drop, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial netfilter: %w", err)
+	}
+	if err := n.bind(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	out := make(chan Drop, 64)
+	go func() {
+		defer close(out)
+		names := make(map[uint32]string)
+		ifname := func(index uint32) string {
+			if name, ok := names[index]; ok {
+				return name
+			}
+			var name string
+			if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+				name = iface.Name
+			}
+			names[index] = name
+			return name
+		}
+
+		for {
+			msgs, err := conn.Receive()
+			if err != nil {
+				// the socket buffer overflowed; we lost some packets but
+				// the subscription is still good
+				if errors.Is(err, unix.ENOBUFS) && ctx.Err() == nil {
+					continue
+				}
+				return
+			}
+			for _, m := range msgs {
+				d, ok := parseNFLog(m, ifname)
+				if !ok {
+					continue
+				}
+				select {
+				case out <- d:
+				default:
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// bind subscribes conn to the group and asks for packet contents.
+func (n *NFLog) bind(conn *netlink.Conn) error {
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, logCopyRange)
+	mode[4] = nfulnlCopyPacket
+
+	for _, attr := range []netlink.Attribute{
+		{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}},
+		{Type: nfulaCfgMode, Data: mode},
+	} {
+		data, err := netlink.MarshalAttributes([]netlink.Attribute{attr})
+		if err != nil {
+			return err
+		}
+		_, err = conn.Execute(netlink.Message{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgConfig),
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: append(n.nfgenmsg(), data...),
+		})
+		if err != nil {
+			return fmt.Errorf("bind nflog group %d: %w", n.group, err)
+		}
+	}
+	return nil
+}
+
+// nfgenmsg is the header every nfnetlink message starts with; for NFLOG
+// the resource id is the group.
+func (n *NFLog) nfgenmsg() []byte {
+	h := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(h[2:], n.group)
+	return h
+}
+
+// parseNFLog decodes a logged packet. Anything that isn't one of ours or
+// doesn't carry an IP header is skipped.
+func parseNFLog(m netlink.Message, ifname func(uint32) string) (Drop, bool) {
+	var d Drop
+	if m.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgPacket) || len(m.Data) < 4 {
+		return d, false
+	}
+
+	ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+	if err != nil {
+		return d, false
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var prefix string
+	var payload []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case nfulaPrefix:
+			prefix = strings.TrimRight(ad.String(), "\x00")
+		case nfulaIfindexIndev:
+			d.Interface = ifname(ad.Uint32())
+		case nfulaPayload:
+			payload = ad.Bytes()
+		case nfulaTimestamp:
+			if ts := ad.Bytes(); len(ts) == 16 {
+				sec := binary.BigEndian.Uint64(ts)
+				usec := binary.BigEndian.Uint64(ts[8:])
+				d.Time = time.Unix(int64(sec), int64(usec)*1000)
+			}
+		}
+	}
+	if ad.Err() != nil || prefix != LogPrefix {
+		return d, false
+	}
+	if !parsePayload(payload, &d) {
+		return d, false
+	}
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+	return d, true
+}
+
+// parsePayload fills in addresses, protocol and port from the network
+// header. IPv6 extension headers aren't walked, so such packets report the
+// first next-header value and no port.
+func parsePayload(p []byte, d *Drop) bool {
+	if len(p) < 1 {
+		return false
+	}
+
+	var proto byte
+	var l4 []byte
+	switch p[0] >> 4 {
+	case 4:
+		ihl := int(p[0]&0x0f) * 4
+		if len(p) < 20 || ihl < 20 || len(p) < ihl {
+			return false
+		}
+		proto = p[9]
+		d.Src = netip.AddrFrom4([4]byte(p[12:16]))
+		d.Dst = netip.AddrFrom4([4]byte(p[16:20]))
+		// only the first fragment has the transport header
+		if binary.BigEndian.Uint16(p[6:8])&0x1fff == 0 {
+			l4 = p[ihl:]
+		}
+	case 6:
+		if len(p) < 40 {
+			return false
+		}
+		proto = p[6]
+		d.Src = netip.AddrFrom16([16]byte(p[8:24]))
+		d.Dst = netip.AddrFrom16([16]byte(p[24:40]))
+		l4 = p[40:]
+	default:
+		return false
+	}
+
+	d.Proto = protoName(proto)
+	if (proto == unix.IPPROTO_TCP || proto == unix.IPPROTO_UDP) && len(l4) >= 4 {
+		d.Port = binary.BigEndian.Uint16(l4[2:4])
+	}
+	return true
+}
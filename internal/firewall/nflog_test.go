@@ -0,0 +1,135 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ipv4TCP builds an IPv4 header followed by the start of a TCP header.
+func ipv4TCP(src, dst string, dport uint16) []byte {
+	p := make([]byte, 24)
+	p[0] = 0x45
+	p[9] = unix.IPPROTO_TCP
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(p[12:], s[:])
+	copy(p[16:], d[:])
+	binary.BigEndian.PutUint16(p[22:], dport)
+	return p
+}
+
+// ipv6UDP builds an IPv6 header followed by the start of a UDP header.
+func ipv6UDP(src, dst string, dport uint16) []byte {
+	p := make([]byte, 44)
+	p[0] = 0x60
+	p[6] = unix.IPPROTO_UDP
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	copy(p[8:], s[:])
+	copy(p[24:], d[:])
+	binary.BigEndian.PutUint16(p[42:], dport)
+	return p
+}
+
+// nflogMessage builds a packet message the way the kernel sends it.
+func nflogMessage(t *testing.T, prefix string, ifindex uint32, payload []byte) netlink.Message {
+	t.Helper()
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.String(nfulaPrefix, prefix)
+	ae.Uint32(nfulaIfindexIndev, ifindex)
+	ts := make([]byte, 16)
+	binary.BigEndian.PutUint64(ts, 1700000000)
+	ae.Bytes(nfulaTimestamp, ts)
+	ae.Bytes(nfulaPayload, payload)
+	data, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgPacket)},
+		Data:   append([]byte{unix.AF_INET, 0, 0, byte(LogGroup)}, data...),
+	}
+}
+
+func testIfname(index uint32) string {
+	if index == 2 {
+		return "wlan0"
+	}
+	return ""
+}
+
+func TestParseNFLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    Drop
+	}{
+		{
+			name:    "ipv4 tcp",
+			payload: ipv4TCP("203.0.113.5", "192.168.1.10", 22),
+			want: Drop{
+				Src: netip.MustParseAddr("203.0.113.5"), Dst: netip.MustParseAddr("192.168.1.10"),
+				Proto: "tcp", Port: 22, Interface: "wlan0",
+			},
+		},
+		{
+			name:    "ipv6 udp",
+			payload: ipv6UDP("2001:db8::1", "2001:db8::2", 5353),
+			want: Drop{
+				Src: netip.MustParseAddr("2001:db8::1"), Dst: netip.MustParseAddr("2001:db8::2"),
+				Proto: "udp", Port: 5353, Interface: "wlan0",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := parseNFLog(nflogMessage(t, LogPrefix, 2, tt.payload), testIfname)
+			if !ok {
+				t.Fatal("parseNFLog() rejected the packet")
+			}
+			if !d.Time.Equal(time.Unix(1700000000, 0)) {
+				t.Errorf("Time = %v", d.Time)
+			}
+			d.Time = time.Time{}
+			if d != tt.want {
+				t.Errorf("got %+v, want %+v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNFLog_Skips(t *testing.T) {
+	if _, ok := parseNFLog(nflogMessage(t, "someone-else: ", 2, ipv4TCP("10.0.0.1", "10.0.0.2", 80)), testIfname); ok {
+		t.Error("accepted a packet with a foreign prefix")
+	}
+	if _, ok := parseNFLog(nflogMessage(t, LogPrefix, 2, []byte{0x45, 0}), testIfname); ok {
+		t.Error("accepted a truncated packet")
+	}
+	m := nflogMessage(t, LogPrefix, 2, ipv4TCP("10.0.0.1", "10.0.0.2", 80))
+	m.Header.Type = netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgConfig)
+	if _, ok := parseNFLog(m, testIfname); ok {
+		t.Error("accepted a config message")
+	}
+}
+
+func TestLogDrops(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "public", Reject: true, LogDrops: true})
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	texts := ruleTexts(t, conn)
+	want := `limit rate 20/second burst 50 packets log prefix "oreon-drop: " group 40`
+	// logged just before the reject so only unsolicited traffic shows up
+	if len(texts) < 2 || texts[len(texts)-2] != want {
+		t.Errorf("rules = %v, want %q before the reject", texts, want)
+	}
+}
@@ -0,0 +1,272 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/userdata"
+)
+
+// DiffOp says what happens to a line of the ruleset.
+type DiffOp string
+
+const (
+	DiffKeep   DiffOp = " "
+	DiffAdd    DiffOp = "+"
+	DiffRemove DiffOp = "-"
+)
+
+// DiffLine is one line of a ruleset diff. Text is either a rule or, for
+// the first line of a chain, its declaration.
+type DiffLine struct {
+	Op    DiffOp
+	Chain string
+	Text  string
+}
+
+// Preview is what applying a profile would load and how that differs
+// from what is loaded now.
+type Preview struct {
+	Ruleset string // in `nft list table` format
+	Diff    []DiffLine
+	Changed bool // false if the live table already matches
+}
+
+// chainText is a chain reduced to the lines we show and compare.
+type chainText struct {
+	name   string
+	header string
+	rules  []string
+}
+
+// Preview renders the ruleset for p and diffs it against the live table
+// without changing anything.
+func (f *Firewall) Preview(p Profile) (Preview, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.cur
+	next.profile = p
+	rs := buildRuleset(next)
+	var want []chainText
+	for _, cs := range rs.chains {
+		ct := chainText{name: cs.name, header: chainHeader(cs.hook, cs.priority, &cs.policy)}
+		for _, rs := range cs.rules {
+			ct.rules = append(ct.rules, rs.text)
+		}
+		want = append(want, ct)
+	}
+
+	have, err := f.loaded()
+	if err != nil {
+		return Preview{}, err
+	}
+
+	pv := Preview{Ruleset: renderTable(rs.sets, want), Diff: diffChains(have, want)}
+	for _, l := range pv.Diff {
+		if l.Op != DiffKeep {
+			pv.Changed = true
+			break
+		}
+	}
+	return pv, nil
+}
+
+// loaded reads our table back, returning nil if it isn't loaded. Rules
+// are identified by the comment we store on them; anything added behind
+// our back shows up by handle.
+func (f *Firewall) loaded() ([]chainText, error) {
+	tables, err := f.conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
+	}
+	found := false
+	for _, t := range tables {
+		if t.Name == TableName {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	chains, err := f.conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, fmt.Errorf("list chains: %w", err)
+	}
+
+	out := []chainText{}
+	table := f.table()
+	for _, c := range chains {
+		if c.Table == nil || c.Table.Name != TableName {
+			continue
+		}
+		ct := chainText{name: c.Name, header: chainHeader(c.Hooknum, c.Priority, c.Policy)}
+
+		rules, err := f.conn.GetRules(table, c)
+		if err != nil {
+			return nil, fmt.Errorf("list rules in %s: %w", c.Name, err)
+		}
+		for _, r := range rules {
+			text, ok := userdata.GetString(r.UserData, userdata.TypeComment)
+			if !ok {
+				text = fmt.Sprintf("# unknown rule (handle %d)", r.Handle)
+			}
+			ct.rules = append(ct.rules, text)
+		}
+		out = append(out, ct)
+	}
+	return out, nil
+}
+
+// chainHeader renders a base chain declaration the way nft prints it.
+func chainHeader(hook *nftables.ChainHook, prio *nftables.ChainPriority, policy *nftables.ChainPolicy) string {
+	h := "?"
+	if hook != nil {
+		switch *hook {
+		case *nftables.ChainHookInput:
+			h = "input"
+		case *nftables.ChainHookOutput:
+			h = "output"
+		case *nftables.ChainHookForward:
+			h = "forward"
+		default:
+			h = fmt.Sprint(*hook)
+		}
+	}
+
+	pr := "filter"
+	if prio != nil {
+		switch off := *prio - *nftables.ChainPriorityFilter; {
+		case off > 0:
+			pr = fmt.Sprintf("filter + %d", off)
+		case off < 0:
+			pr = fmt.Sprintf("filter - %d", -off)
+		}
+	}
+
+	pol := "accept"
+	if policy != nil && *policy == nftables.ChainPolicyDrop {
+		pol = "drop"
+	}
+
+	return fmt.Sprintf("type filter hook %s priority %s; policy %s;", h, pr, pol)
+}
+
+// renderTable formats sets and chains as `nft list table` would, except
+// that set elements are summarised by count.
+func renderTable(sets []setSpec, chains []chainText) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", TableName)
+	for i, ss := range sets {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		typ := "ipv4_addr"
+		if ss.set.KeyType == nftables.TypeIP6Addr {
+			typ = "ipv6_addr"
+		}
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n\t\t# %d entries\n\t}\n",
+			ss.set.Name, typ, ss.entries)
+	}
+	for i, c := range chains {
+		if i > 0 || len(sets) > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "\tchain %s {\n\t\t%s\n", c.name, c.header)
+		for _, r := range c.rules {
+			fmt.Fprintf(&b, "\t\t%s\n", r)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// diffChains compares two rulesets chain by chain, in the order the new
+// ruleset declares them followed by any chains that would go away.
+func diffChains(have, want []chainText) []DiffLine {
+	old := make(map[string]chainText, len(have))
+	for _, c := range have {
+		old[c.name] = c
+	}
+
+	var out []DiffLine
+	seen := make(map[string]bool, len(want))
+	for _, c := range want {
+		seen[c.name] = true
+		prev, ok := old[c.name]
+		if !ok {
+			out = append(out, chainLines(DiffAdd, c)...)
+			continue
+		}
+		if prev.header == c.header {
+			out = append(out, DiffLine{Op: DiffKeep, Chain: c.name, Text: c.header})
+		} else {
+			out = append(out,
+				DiffLine{Op: DiffRemove, Chain: c.name, Text: prev.header},
+				DiffLine{Op: DiffAdd, Chain: c.name, Text: c.header})
+		}
+		out = append(out, diffLines(c.name, prev.rules, c.rules)...)
+	}
+	for _, c := range have {
+		if !seen[c.name] {
+			out = append(out, chainLines(DiffRemove, c)...)
+		}
+	}
+	return out
+}
+
+// chainLines returns every line of a chain with the same op.
+func chainLines(op DiffOp, c chainText) []DiffLine {
+	out := []DiffLine{{Op: op, Chain: c.name, Text: c.header}}
+	for _, r := range c.rules {
+		out = append(out, DiffLine{Op: op, Chain: c.name, Text: r})
+	}
+	return out
+}
+
+// diffLines is a longest-common-subsequence diff. Chains are a few dozen
+// rules at most, so the quadratic table is fine.
+func diffLines(chain string, a, b []string) []DiffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []DiffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, DiffLine{Op: DiffKeep, Chain: chain, Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, DiffLine{Op: DiffRemove, Chain: chain, Text: a[i]})
+			i++
+		default:
+			out = append(out, DiffLine{Op: DiffAdd, Chain: chain, Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, DiffLine{Op: DiffRemove, Chain: chain, Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, DiffLine{Op: DiffAdd, Chain: chain, Text: b[j]})
+	}
+	return out
+}
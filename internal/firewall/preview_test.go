@@ -0,0 +1,112 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestPreview_NotLoaded(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+
+	pv, err := fw.Preview(Profile{Name: "public", Reject: true})
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+	if !pv.Changed {
+		t.Error("Changed = false with nothing loaded")
+	}
+	for _, l := range pv.Diff {
+		if l.Op != DiffAdd {
+			t.Errorf("line %+v, want every line added", l)
+		}
+	}
+	if !strings.HasPrefix(pv.Ruleset, "table inet oreon_defense {") {
+		t.Errorf("ruleset = %q", pv.Ruleset)
+	}
+	if !strings.Contains(pv.Ruleset, "\t\ttype filter hook input priority filter; policy drop;\n") {
+		t.Errorf("ruleset missing input chain declaration:\n%s", pv.Ruleset)
+	}
+	if st, _ := fw.Status(); st.Loaded || conn.flushes != 0 {
+		t.Error("Preview touched the ruleset")
+	}
+}
+
+func TestPreview_Unchanged(t *testing.T) {
+	fw := New(NewMemConn())
+	p := Profile{Name: "public", Reject: true, Rules: testRules}
+	fw.SetProfile(p)
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	pv, err := fw.Preview(p)
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+	if pv.Changed {
+		t.Errorf("Changed = true for the loaded profile, diff %+v", pv.Diff)
+	}
+}
+
+func TestPreview_Diff(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	fw.SetProfile(Profile{Name: "public", Reject: true, Rules: testRules})
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	flushes := conn.flushes
+
+	pv, err := fw.Preview(Profile{Name: "home", AllowPing: true, Reject: true, Rules: testRules[:1]})
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+
+	got := make(map[string]DiffOp)
+	for _, l := range pv.Diff {
+		got[l.Chain+": "+l.Text] = l.Op
+	}
+	want := map[string]DiffOp{
+		"input: icmp type echo-request accept":                            DiffAdd,
+		"input: icmpv6 type echo-request drop":                            DiffRemove,
+		"input: udp dport 1714-1764 accept":                               DiffRemove,
+		"input: reject with icmpx admin-prohibited":                       DiffKeep,
+		"output: ip6 daddr 2001:db8::/32 tcp dport 443 accept":            DiffRemove,
+		"output: type filter hook output priority filter; policy accept;": DiffRemove,
+	}
+	for line, op := range want {
+		if got[line] != op {
+			t.Errorf("%q op = %q, want %q", line, got[line], op)
+		}
+	}
+	if conn.flushes != flushes || fw.Profile().Name != "public" {
+		t.Error("Preview changed the loaded ruleset")
+	}
+}
+
+func TestPreview_UnknownRule(t *testing.T) {
+	conn := NewMemConn()
+	fw := New(conn)
+	if err := fw.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rule added behind our back has no comment
+	chain := conn.state.chains[0]
+	conn.AddRule(&nftables.Rule{Table: chain.Table, Chain: chain, Handle: 42})
+	conn.Flush()
+
+	pv, err := fw.Preview(Profile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := pv.Diff[len(pv.Diff)-1]
+	if last.Op != DiffRemove || last.Text != "# unknown rule (handle 42)" {
+		t.Errorf("last line = %+v, want the foreign rule removed", last)
+	}
+}
@@ -0,0 +1,320 @@
+// oreon/defense · watchthelight <wtl>
+
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// chainSpec describes one base chain in our table.
+type chainSpec struct {
+	name     string
+	hook     *nftables.ChainHook
+	priority *nftables.ChainPriority
+	policy   nftables.ChainPolicy
+	rules    []ruleSpec
+}
+
+// setSpec describes one named set in our table. Rules refer to the set
+// by pointer, so apply fills in the table before loading either.
+type setSpec struct {
+	set     *nftables.Set
+	elems   []nftables.SetElement
+	entries int // addresses and networks from the list, before merging
+}
+
+// ruleset is everything we load into our table.
+type ruleset struct {
+	sets   []setSpec
+	chains []chainSpec
+}
+
+// ruleSpec pairs a rule's expressions with the statement nft would print
+// for it. The text is stored as the rule comment so `nft list ruleset`
+// shows what each rule is for.
+type ruleSpec struct {
+	text  string
+	exprs []expr.Any
+}
+
+// rule builds a ruleSpec by concatenating expression fragments.
+func rule(text string, parts ...[]expr.Any) ruleSpec {
+	var exprs []expr.Any
+	for _, p := range parts {
+		exprs = append(exprs, p...)
+	}
+	return ruleSpec{text: text, exprs: exprs}
+}
+
+// Profile selects how much unsolicited inbound traffic is let in.
+// The zero value is the most restrictive: drop everything silently.
+type Profile struct {
+	Name      string
+	AllowPing bool // answer ICMP/ICMPv6 echo requests
+	AllowLAN  bool // accept anything from private and link-local ranges
+	Reject    bool // reject unsolicited traffic instead of silently dropping it
+	LogDrops  bool // copy unsolicited packets to the LogGroup NFLOG group
+	Rules     []Rule
+}
+
+// Rule opens a port or port range on top of a profile.
+type Rule struct {
+	Proto    byte         // unix.IPPROTO_TCP or unix.IPPROTO_UDP
+	FromPort uint16       // first port of the range
+	ToPort   uint16       // last port of the range, equal to FromPort for a single port
+	Addr     netip.Prefix // remote network; the zero value matches any address
+	Out      bool         // applies to outbound traffic instead of inbound
+	Comment  string
+}
+
+// text renders the rule the way nft would print it.
+func (r Rule) text() string {
+	var s string
+	if r.Addr.IsValid() {
+		s = addrText(r.Addr, r.Out) + " "
+	}
+	s += protoName(r.Proto) + " dport " + strconv.Itoa(int(r.FromPort))
+	if r.ToPort > r.FromPort {
+		s += "-" + strconv.Itoa(int(r.ToPort))
+	}
+	s += " accept"
+	if r.Comment != "" {
+		s += fmt.Sprintf(" comment %q", r.Comment)
+	}
+	return s
+}
+
+// spec builds the nftables rule for r.
+func (r Rule) spec() ruleSpec {
+	var addr []expr.Any
+	if r.Addr.IsValid() {
+		addr = matchAddr(r.Addr, r.Out)
+	}
+	return rule(r.text(), addr, matchL4Proto(r.Proto), matchDport(r.FromPort, r.ToPort), verdict(expr.VerdictAccept))
+}
+
+// protoName returns the nft keyword for a layer 4 protocol.
+func protoName(proto byte) string {
+	switch proto {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_ICMP:
+		return "icmp"
+	case unix.IPPROTO_ICMPV6:
+		return "ipv6-icmp"
+	}
+	return strconv.Itoa(int(proto))
+}
+
+var linkLocal6 = netip.MustParsePrefix("fe80::/10")
+
+// lanPrefixes are the source ranges trusted by profiles with AllowLAN.
+var lanPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	linkLocal6,
+}
+
+const (
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+)
+
+// Kernel-side cap on logged packets, so a flood can't swamp the daemon.
+const (
+	logRate  = 20
+	logBurst = 50
+)
+
+// buildRuleset returns the ruleset for a profile. Every profile drops
+// unsolicited inbound traffic by default, allows replies to connections
+// we started, and keeps the bits of IPv6 that break without inbound
+// ICMPv6 and DHCPv6 working. Blocklisted addresses are cut off in both
+// directions, including connections that were already established, and
+// blocked applications can't send anything.
+func buildRuleset(s settings) ruleset {
+	prio := chainPriority(s.priority)
+	if s.lockdown {
+		return lockdownRuleset(prio)
+	}
+
+	var rs ruleset
+	p := s.profile
+	input := []ruleSpec{
+		rule(`iifname "lo" accept`,
+			matchIifname("lo"), verdict(expr.VerdictAccept)),
+	}
+
+	var output []ruleSpec
+	for _, b := range s.lists {
+		ip4, ip6 := b.split()
+		for _, v6 := range []bool{false, true} {
+			prefixes, keyType, family := ip4, nftables.TypeIPAddr, "ip"
+			if v6 {
+				prefixes, keyType, family = ip6, nftables.TypeIP6Addr, "ip6"
+			}
+			if len(prefixes) == 0 {
+				continue
+			}
+
+			set := &nftables.Set{
+				Name:     b.setName(v6),
+				ID:       uint32(len(rs.sets) + 1),
+				KeyType:  keyType,
+				Interval: true,
+			}
+			rs.sets = append(rs.sets, setSpec{
+				set:     set,
+				elems:   intervalElements(mergeRanges(prefixes)),
+				entries: len(prefixes),
+			})
+
+			input = append(input,
+				rule(family+" saddr @"+set.Name+" drop",
+					matchAddrSet(set, v6, false), verdict(expr.VerdictDrop)))
+			// reject rather than drop so local programs fail fast
+			output = append(output,
+				rule(family+" daddr @"+set.Name+" reject with icmpx admin-prohibited",
+					matchAddrSet(set, v6, true), reject()))
+		}
+	}
+
+	input = append(input,
+		rule("ct state established,related accept",
+			matchCtState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED), verdict(expr.VerdictAccept)),
+		rule("ct state invalid drop",
+			matchCtState(expr.CtStateBitINVALID), verdict(expr.VerdictDrop)),
+	)
+
+	// ICMPv6 is accepted wholesale below (neighbour discovery needs it), so
+	// echo requests have to be filtered out before that when ping is off
+	if p.AllowPing {
+		input = append(input,
+			rule("icmp type echo-request accept",
+				matchICMPType(unix.IPPROTO_ICMP, icmpEchoRequest), verdict(expr.VerdictAccept)))
+	} else {
+		input = append(input,
+			rule("icmpv6 type echo-request drop",
+				matchICMPType(unix.IPPROTO_ICMPV6, icmpv6EchoRequest), verdict(expr.VerdictDrop)))
+	}
+
+	input = append(input,
+		rule("meta l4proto ipv6-icmp accept",
+			matchL4Proto(unix.IPPROTO_ICMPV6), verdict(expr.VerdictAccept)),
+		rule("ip6 saddr fe80::/10 udp dport 546 accept",
+			matchSaddr(linkLocal6), matchL4Proto(unix.IPPROTO_UDP), matchDport(546, 546), verdict(expr.VerdictAccept)),
+	)
+
+	if p.AllowLAN {
+		for _, prefix := range lanPrefixes {
+			input = append(input,
+				rule(addrText(prefix, false)+" accept", matchSaddr(prefix), verdict(expr.VerdictAccept)))
+		}
+	}
+
+	for _, a := range s.apps {
+		output = append(output, a.spec())
+	}
+
+	for _, r := range p.Rules {
+		if r.Out {
+			output = append(output, r.spec())
+		} else {
+			input = append(input, r.spec())
+		}
+	}
+
+	// everything that reaches this point is about to be dropped or rejected
+	if p.LogDrops {
+		input = append(input,
+			rule(fmt.Sprintf("limit rate %d/second burst %d packets log prefix %q group %d", logRate, logBurst, LogPrefix, LogGroup),
+				limitRate(logRate, logBurst), nflog(LogGroup, LogPrefix)))
+	}
+
+	if p.Reject {
+		input = append(input, rule("reject with icmpx admin-prohibited", reject()))
+	}
+
+	rs.chains = []chainSpec{
+		{
+			name:     "input",
+			hook:     nftables.ChainHookInput,
+			priority: prio,
+			policy:   nftables.ChainPolicyDrop,
+			rules:    input,
+		},
+	}
+
+	// outbound is accepted by default; the chain only exists to block
+	// listed addresses and apps, and so explicit allow rules are visible
+	// in the ruleset
+	if len(output) > 0 {
+		rs.chains = append(rs.chains, chainSpec{
+			name:     "output",
+			hook:     nftables.ChainHookOutput,
+			priority: prio,
+			policy:   nftables.ChainPolicyAccept,
+			rules:    output,
+		})
+	}
+
+	return rs
+}
+
+// chainPriority returns a hook priority offset from filter.
+func chainPriority(offset int32) *nftables.ChainPriority {
+	return nftables.ChainPriorityRef(*nftables.ChainPriorityFilter + nftables.ChainPriority(offset))
+}
+
+// lockdownRuleset drops everything in every direction except loopback,
+// including connections that are already established.
+func lockdownRuleset(prio *nftables.ChainPriority) ruleset {
+	return ruleset{chains: []chainSpec{
+		{
+			name:     "input",
+			hook:     nftables.ChainHookInput,
+			priority: prio,
+			policy:   nftables.ChainPolicyDrop,
+			rules: []ruleSpec{rule(`iifname "lo" accept`,
+				matchIifname("lo"), verdict(expr.VerdictAccept))},
+		},
+		{
+			name:     "forward",
+			hook:     nftables.ChainHookForward,
+			priority: prio,
+			policy:   nftables.ChainPolicyDrop,
+		},
+		{
+			name:     "output",
+			hook:     nftables.ChainHookOutput,
+			priority: prio,
+			policy:   nftables.ChainPolicyDrop,
+			rules: []ruleSpec{rule(`oifname "lo" accept`,
+				matchOifname("lo"), verdict(expr.VerdictAccept))},
+		},
+	}}
+}
+
+// addrText renders a source or destination prefix match the way nft
+// prints it.
+func addrText(prefix netip.Prefix, dst bool) string {
+	dir := " saddr "
+	if dst {
+		dir = " daddr "
+	}
+	if prefix.Addr().Is4() {
+		return "ip" + dir + prefix.String()
+	}
+	return "ip6" + dir + prefix.String()
+}
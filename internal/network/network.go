@@ -0,0 +1,53 @@
+// oreon/defense · watchthelight <wtl>
+
+// Package network watches NetworkManager for changes to the active
+// connection so the firewall can follow the user between networks.
+package network
+
+import (
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+// Connection describes NetworkManager's primary connection.
+// The zero value means there is no active connection.
+type Connection struct {
+	ID        string // user-facing name, e.g. "Home WiFi"
+	UUID      string
+	Type      string // e.g. "802-11-wireless", "802-3-ethernet"
+	Interface string
+	SSID      string // empty unless wifi
+}
+
+// Connected returns whether c describes an active connection.
+func (c Connection) Connected() bool {
+	return c.UUID != ""
+}
+
+// Trusted classifies a connection against the configured rules. Rules are
+// checked in order and the first match decides; anything unmatched is
+// untrusted.
+func Trusted(c Connection, rules []config.NetworkRule) bool {
+	for _, r := range rules {
+		if matches(c, r) {
+			return r.Trusted
+		}
+	}
+	return false
+}
+
+// matches reports whether every field set in r matches c.
+func matches(c Connection, r config.NetworkRule) bool {
+	if r.UUID == "" && r.SSID == "" && r.Interface == "" {
+		return false
+	}
+	if r.UUID != "" && r.UUID != c.UUID {
+		return false
+	}
+	if r.SSID != "" && r.SSID != c.SSID {
+		return false
+	}
+	if r.Interface != "" && r.Interface != c.Interface {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+// oreon/defense · watchthelight <wtl>
+
+package network
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/oreonproject/defense/pkg/config"
+)
+
+// fakeBus serves canned NetworkManager properties and lets tests inject
+// PropertiesChanged signals.
+type fakeBus struct {
+	mu      sync.Mutex
+	props   map[string]dbus.Variant // "path|iface.prop"
+	signals chan *dbus.Signal
+}
+
+func newFakeBus() *fakeBus {
+	b := &fakeBus{
+		props:   make(map[string]dbus.Variant),
+		signals: make(chan *dbus.Signal, 4),
+	}
+	b.set(nmPath, nmIface, "PrimaryConnection", dbus.ObjectPath("/"))
+	return b
+}
+
+func (b *fakeBus) set(path dbus.ObjectPath, iface, prop string, v interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.props[string(path)+"|"+iface+"."+prop] = dbus.MakeVariant(v)
+}
+
+func (b *fakeBus) GetProperty(path dbus.ObjectPath, iface, prop string) (dbus.Variant, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v, ok := b.props[string(path)+"|"+iface+"."+prop]
+	if !ok {
+		return dbus.Variant{}, errors.New("no such property")
+	}
+	return v, nil
+}
+
+func (b *fakeBus) Signals() (<-chan *dbus.Signal, error) { return b.signals, nil }
+func (b *fakeBus) Close() error                          { return nil }
+
+// connectWifi sets up an active wifi connection and makes it primary.
+func (b *fakeBus) connectWifi(active dbus.ObjectPath, id, uuid, iface, ssid string) {
+	dev := dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/" + iface)
+	ap := dbus.ObjectPath(string(active) + "/ap")
+	b.set(active, nmActiveIface, "Id", id)
+	b.set(active, nmActiveIface, "Uuid", uuid)
+	b.set(active, nmActiveIface, "Type", "802-11-wireless")
+	b.set(active, nmActiveIface, "Devices", []dbus.ObjectPath{dev})
+	b.set(active, nmActiveIface, "SpecificObject", ap)
+	b.set(dev, nmDeviceIface, "Interface", iface)
+	b.set(ap, nmAPIface, "Ssid", []byte(ssid))
+	b.set(nmPath, nmIface, "PrimaryConnection", active)
+}
+
+// announce emits the PropertiesChanged signal NetworkManager sends when
+// the primary connection changes.
+func (b *fakeBus) announce() {
+	b.signals <- &dbus.Signal{
+		Path: nmPath,
+		Name: propsChanged,
+		Body: []interface{}{
+			nmIface,
+			map[string]dbus.Variant{"PrimaryConnection": dbus.MakeVariant(dbus.ObjectPath("/"))},
+			[]string{},
+		},
+	}
+}
+
+func receive(t *testing.T, ch <-chan Connection) Connection {
+	t.Helper()
+	select {
+	case c := <-ch:
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for connection change")
+		return Connection{}
+	}
+}
+
+func TestPrimary_Wifi(t *testing.T) {
+	bus := newFakeBus()
+	bus.connectWifi("/org/freedesktop/NetworkManager/ActiveConnection/1", "Home", "uuid-home", "wlan0", "HomeWifi")
+
+	c, err := NewWatcher(bus).Primary()
+	if err != nil {
+		t.Fatalf("Primary() error = %v", err)
+	}
+	want := Connection{ID: "Home", UUID: "uuid-home", Type: "802-11-wireless", Interface: "wlan0", SSID: "HomeWifi"}
+	if c != want {
+		t.Errorf("Primary() = %+v, want %+v", c, want)
+	}
+}
+
+func TestPrimary_Disconnected(t *testing.T) {
+	c, err := NewWatcher(newFakeBus()).Primary()
+	if err != nil {
+		t.Fatalf("Primary() error = %v", err)
+	}
+	if c.Connected() {
+		t.Errorf("Primary() = %+v, want no connection", c)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	bus := newFakeBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := NewWatcher(bus).Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	if c := receive(t, ch); c.Connected() {
+		t.Errorf("initial = %+v, want disconnected", c)
+	}
+
+	bus.connectWifi("/org/freedesktop/NetworkManager/ActiveConnection/1", "Cafe", "uuid-cafe", "wlan0", "FreeWifi")
+	bus.announce()
+	if c := receive(t, ch); c.SSID != "FreeWifi" {
+		t.Errorf("SSID = %q, want FreeWifi", c.SSID)
+	}
+
+	// reconnecting to the same network under a new active path is not a change
+	bus.connectWifi("/org/freedesktop/NetworkManager/ActiveConnection/2", "Cafe", "uuid-cafe", "wlan0", "FreeWifi")
+	bus.announce()
+
+	bus.connectWifi("/org/freedesktop/NetworkManager/ActiveConnection/3", "Home", "uuid-home", "wlan0", "HomeWifi")
+	bus.announce()
+	if c := receive(t, ch); c.UUID != "uuid-home" {
+		t.Errorf("UUID = %q, want uuid-home (duplicate should be skipped)", c.UUID)
+	}
+}
+
+func TestWatch_IgnoresUnrelatedSignals(t *testing.T) {
+	bus := newFakeBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, _ := NewWatcher(bus).Watch(ctx)
+	receive(t, ch)
+
+	bus.connectWifi("/org/freedesktop/NetworkManager/ActiveConnection/1", "Cafe", "uuid-cafe", "wlan0", "FreeWifi")
+	bus.signals <- &dbus.Signal{
+		Path: nmPath,
+		Name: propsChanged,
+		Body: []interface{}{nmIface, map[string]dbus.Variant{"Connectivity": dbus.MakeVariant(uint32(4))}, []string{}},
+	}
+
+	select {
+	case c := <-ch:
+		t.Errorf("unexpected change %+v for unrelated property", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatch_StopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, _ := NewWatcher(newFakeBus()).Watch(ctx)
+	receive(t, ch)
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("unexpected value after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	home := Connection{UUID: "uuid-home", SSID: "HomeWifi", Interface: "wlan0"}
+	office := Connection{UUID: "uuid-office", Interface: "enp3s0"}
+	cafe := Connection{UUID: "uuid-cafe", SSID: "FreeWifi", Interface: "wlan0"}
+
+	rules := []config.NetworkRule{
+		{SSID: "HomeWifi", Trusted: true},
+		{UUID: "uuid-office", Interface: "enp3s0", Trusted: true},
+		{Interface: "wlan0", Trusted: false},
+		{}, // empty rules never match
+	}
+
+	tests := []struct {
+		name string
+		conn Connection
+		want bool
+	}{
+		{"ssid match", home, true},
+		{"uuid and interface match", office, true},
+		{"untrusted by interface", cafe, false},
+		{"unmatched", Connection{UUID: "other", Interface: "eth9"}, false},
+		{"partial match", Connection{UUID: "uuid-office", Interface: "wlan1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Trusted(tt.conn, rules); got != tt.want {
+				t.Errorf("Trusted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// oreon/defense · watchthelight <wtl>
+
+package network
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// NetworkManager D-Bus names.
+const (
+	nmService       = "org.freedesktop.NetworkManager"
+	nmPath          = dbus.ObjectPath("/org/freedesktop/NetworkManager")
+	nmIface         = "org.freedesktop.NetworkManager"
+	nmActiveIface   = "org.freedesktop.NetworkManager.Connection.Active"
+	nmDeviceIface   = "org.freedesktop.NetworkManager.Device"
+	nmAPIface       = "org.freedesktop.NetworkManager.AccessPoint"
+	propertiesIface = "org.freedesktop.DBus.Properties"
+	propsChanged    = propertiesIface + ".PropertiesChanged"
+)
+
+// Bus is the subset of the system bus the watcher needs. The real one
+// talks to NetworkManager; tests use a fake that serves canned properties
+// and injects signals.
+type Bus interface {
+	// GetProperty reads a property of a NetworkManager object.
+	GetProperty(path dbus.ObjectPath, iface, prop string) (dbus.Variant, error)
+	// Signals subscribes to PropertiesChanged on the NetworkManager object.
+	Signals() (<-chan *dbus.Signal, error)
+	Close() error
+}
+
+// systemBus is a Bus backed by a private system bus connection.
+type systemBus struct {
+	conn *dbus.Conn
+}
+
+// SystemBus connects to the system bus.
+func SystemBus() (Bus, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connect to system bus: %w", err)
+	}
+	return &systemBus{conn: conn}, nil
+}
+
+func (b *systemBus) GetProperty(path dbus.ObjectPath, iface, prop string) (dbus.Variant, error) {
+	return b.conn.Object(nmService, path).GetProperty(iface + "." + prop)
+}
+
+func (b *systemBus) Signals() (<-chan *dbus.Signal, error) {
+	err := b.conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(nmPath),
+		dbus.WithMatchInterface(propertiesIface),
+		dbus.WithMatchMember("PropertiesChanged"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe to NetworkManager: %w", err)
+	}
+	ch := make(chan *dbus.Signal, 16)
+	b.conn.Signal(ch)
+	return ch, nil
+}
+
+func (b *systemBus) Close() error {
+	return b.conn.Close()
+}
+
+// Watcher reports changes to NetworkManager's primary connection.
+type Watcher struct {
+	bus Bus
+}
+
+// NewWatcher creates a watcher on the given bus.
+func NewWatcher(bus Bus) *Watcher {
+	return &Watcher{bus: bus}
+}
+
+// Watch sends the current primary connection, then a new value every time
+// it changes, until ctx is cancelled. Reconnecting to the same network
+// doesn't count as a change.
+func (w *Watcher) Watch(ctx context.Context) (<-chan Connection, error) {
+	// subscribe before the first read so we can't miss a change in between
+	signals, err := w.bus.Signals()
+	if err != nil {
+		return nil, err
+	}
+	current, err := w.Primary()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Connection, 1)
+	out <- current
+
+	go func() {
+		defer close(out)
+		last := current
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig, ok := <-signals:
+				if !ok {
+					return
+				}
+				if !primaryChanged(sig) {
+					continue
+				}
+				conn, err := w.Primary()
+				if err != nil || conn == last {
+					continue
+				}
+				last = conn
+				select {
+				case out <- conn:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// primaryChanged reports whether sig announces a new primary connection.
+func primaryChanged(sig *dbus.Signal) bool {
+	if sig.Name != propsChanged || sig.Path != nmPath || len(sig.Body) < 2 {
+		return false
+	}
+	if iface, _ := sig.Body[0].(string); iface != nmIface {
+		return false
+	}
+	changed, _ := sig.Body[1].(map[string]dbus.Variant)
+	_, ok := changed["PrimaryConnection"]
+	return ok
+}
+
+// Primary reads NetworkManager's current primary connection.
+func (w *Watcher) Primary() (Connection, error) {
+	var c Connection
+
+	v, err := w.bus.GetProperty(nmPath, nmIface, "PrimaryConnection")
+	if err != nil {
+		return c, fmt.Errorf("read primary connection: %w", err)
+	}
+	active, _ := v.Value().(dbus.ObjectPath)
+	if active == "" || active == "/" {
+		return c, nil
+	}
+
+	c.ID = w.stringProp(active, nmActiveIface, "Id")
+	c.UUID = w.stringProp(active, nmActiveIface, "Uuid")
+	c.Type = w.stringProp(active, nmActiveIface, "Type")
+
+	if v, err := w.bus.GetProperty(active, nmActiveIface, "Devices"); err == nil {
+		if devices, _ := v.Value().([]dbus.ObjectPath); len(devices) > 0 {
+			c.Interface = w.stringProp(devices[0], nmDeviceIface, "Interface")
+		}
+	}
+
+	// for wifi the specific object is the access point we're associated with
+	if v, err := w.bus.GetProperty(active, nmActiveIface, "SpecificObject"); err == nil {
+		if ap, _ := v.Value().(dbus.ObjectPath); ap != "" && ap != "/" {
+			if v, err := w.bus.GetProperty(ap, nmAPIface, "Ssid"); err == nil {
+				ssid, _ := v.Value().([]byte)
+				c.SSID = string(ssid)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// stringProp reads a string property, returning "" if it's missing.
+func (w *Watcher) stringProp(path dbus.ObjectPath, iface, prop string) string {
+	v, err := w.bus.GetProperty(path, iface, prop)
+	if err != nil {
+		return ""
+	}
+	s, _ := v.Value().(string)
+	return s
+}
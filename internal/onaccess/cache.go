@@ -0,0 +1,89 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// cacheSize caps how many clean verdicts are remembered.
+	cacheSize = 4096
+	// cacheTTL is how long a verdict is trusted, so files are looked at
+	// again with newer signatures.
+	cacheTTL = time.Hour
+)
+
+// fileKey identifies a file's contents well enough to skip rescanning
+// it: any write changes the size, mtime or ctime.
+type fileKey struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime syscall.Timespec
+}
+
+func keyOf(fi os.FileInfo) (fileKey, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{uint64(st.Dev), st.Ino, st.Size, st.Mtim, st.Ctim}, true
+}
+
+// verdictCache remembers files found clean, so a program that's run
+// over and over is only scanned once. It is safe for concurrent use.
+type verdictCache struct {
+	mu      sync.Mutex
+	entries map[fileKey]time.Time // when it was found clean
+	now     func() time.Time
+}
+
+func newVerdictCache() *verdictCache {
+	return &verdictCache{entries: make(map[fileKey]time.Time), now: time.Now}
+}
+
+// clean reports whether the file was found clean as it is now.
+func (c *verdictCache) clean(fi os.FileInfo) bool {
+	key, ok := keyOf(fi)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at, ok := c.entries[key]
+	if ok && c.now().Sub(at) > cacheTTL {
+		delete(c.entries, key)
+		return false
+	}
+	return ok
+}
+
+// add remembers that the file is clean, making room by dropping expired
+// verdicts and then the oldest.
+func (c *verdictCache) add(fi os.FileInfo) {
+	key, ok := keyOf(fi)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= cacheSize {
+		var oldest fileKey
+		var oldestAt time.Time
+		for k, at := range c.entries {
+			if now.Sub(at) > cacheTTL {
+				delete(c.entries, k)
+			} else if oldestAt.IsZero() || at.Before(oldestAt) {
+				oldest, oldestAt = k, at
+			}
+		}
+		if len(c.entries) >= cacheSize {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = now
+}
@@ -0,0 +1,141 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrOverflow is returned by Read when the kernel's queue filled up and
+// events were lost.
+var ErrOverflow = errors.New("fanotify queue overflowed, events were lost")
+
+// Fanotify reports accesses on whole mounts through the kernel's
+// fanotify API. It needs CAP_SYS_ADMIN.
+type Fanotify struct {
+	f *os.File
+}
+
+// NewFanotify watches the mounts paths are on for files closed after
+// writing and, with blockExec, for programs about to run.
+func NewFanotify(paths []string, blockExec bool) (*Fanotify, error) {
+	class, mask := uint(unix.FAN_CLASS_NOTIF), uint64(unix.FAN_CLOSE_WRITE)
+	if blockExec {
+		class, mask = unix.FAN_CLASS_CONTENT, mask|unix.FAN_OPEN_EXEC_PERM
+	}
+	// non-blocking, so Close can interrupt a Read
+	fd, err := unix.FanotifyInit(class|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK,
+		unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("fanotify_init: %w", err)
+	}
+	for _, p := range paths {
+		if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, mask, unix.AT_FDCWD, p); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("fanotify_mark %s: %w", p, err)
+		}
+	}
+	return &Fanotify{f: os.NewFile(uintptr(fd), "fanotify")}, nil
+}
+
+// Read blocks for the next batch of events.
+func (fa *Fanotify) Read() ([]Event, error) {
+	buf := make([]byte, 4096)
+	n, err := fa.f.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var evs []Event
+	var overflow bool
+	for off := 0; off+unix.FAN_EVENT_METADATA_LEN <= n; {
+		meta := parseMetadata(buf[off:])
+		if meta.Event_len < unix.FAN_EVENT_METADATA_LEN || off+int(meta.Event_len) > n {
+			break
+		}
+		if meta.Vers != unix.FANOTIFY_METADATA_VERSION {
+			fa.release(buf[off:n])
+			return evs, fmt.Errorf("fanotify metadata version %d, want %d", meta.Vers, unix.FANOTIFY_METADATA_VERSION)
+		}
+		off += int(meta.Event_len)
+		if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+			overflow = true
+		}
+		if meta.Fd == unix.FAN_NOFD {
+			continue
+		}
+		f := os.NewFile(uintptr(meta.Fd), "")
+		path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", meta.Fd))
+		if err != nil {
+			path = ""
+		}
+		evs = append(evs, Event{
+			File: f,
+			Path: strings.TrimSuffix(path, " (deleted)"),
+			PID:  int(meta.Pid),
+			Exec: meta.Mask&unix.FAN_OPEN_EXEC_PERM != 0,
+		})
+	}
+	if overflow {
+		return evs, ErrOverflow
+	}
+	return evs, nil
+}
+
+// release lets through and closes every event left in buf, for when the
+// batch can't be handled: a program held waiting on an answer would
+// otherwise hang, and the descriptors leak.
+func (fa *Fanotify) release(buf []byte) {
+	for off := 0; off+unix.FAN_EVENT_METADATA_LEN <= len(buf); {
+		meta := parseMetadata(buf[off:])
+		if meta.Event_len < unix.FAN_EVENT_METADATA_LEN || off+int(meta.Event_len) > len(buf) {
+			return
+		}
+		off += int(meta.Event_len)
+		if meta.Fd < 0 {
+			continue
+		}
+		if meta.Mask&(unix.FAN_OPEN_PERM|unix.FAN_OPEN_EXEC_PERM|unix.FAN_ACCESS_PERM) != 0 {
+			resp := make([]byte, 8)
+			binary.NativeEndian.PutUint32(resp, uint32(meta.Fd))
+			binary.NativeEndian.PutUint32(resp[4:], unix.FAN_ALLOW)
+			fa.f.Write(resp)
+		}
+		unix.Close(int(meta.Fd))
+	}
+}
+
+// Respond lets a program run or refuses to.
+func (fa *Fanotify) Respond(ev Event, allow bool) error {
+	resp := uint32(unix.FAN_DENY)
+	if allow {
+		resp = unix.FAN_ALLOW
+	}
+	buf := make([]byte, 8)
+	binary.NativeEndian.PutUint32(buf, uint32(ev.File.Fd()))
+	binary.NativeEndian.PutUint32(buf[4:], resp)
+	_, err := fa.f.Write(buf)
+	return err
+}
+
+// Close stops watching. Programs waiting on an answer are let through.
+func (fa *Fanotify) Close() error {
+	return fa.f.Close()
+}
+
+func parseMetadata(b []byte) unix.FanotifyEventMetadata {
+	return unix.FanotifyEventMetadata{
+		Event_len:    binary.NativeEndian.Uint32(b),
+		Vers:         b[4],
+		Metadata_len: binary.NativeEndian.Uint16(b[6:]),
+		Mask:         binary.NativeEndian.Uint64(b[8:]),
+		Fd:           int32(binary.NativeEndian.Uint32(b[16:])),
+		Pid:          int32(binary.NativeEndian.Uint32(b[20:])),
+	}
+}
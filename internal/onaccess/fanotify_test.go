@@ -0,0 +1,102 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFanotify_CloseWrite(t *testing.T) {
+	dir := t.TempDir()
+	fa, err := NewFanotify([]string{dir}, false)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOSYS) {
+		t.Skipf("fanotify unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fa.Close()
+
+	path := filepath.Join(dir, "written")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole mount is watched, so wait for the file among the others
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		evs, err := fa.Read()
+		if err != nil && !errors.Is(err, ErrOverflow) {
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, unix.EAGAIN) {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			t.Fatal(err)
+		}
+		for _, ev := range evs {
+			ev.File.Close()
+			if ev.Path == path {
+				if ev.PID != os.Getpid() || ev.Exec {
+					t.Errorf("event = %+v", ev)
+				}
+				return
+			}
+		}
+	}
+	t.Fatal("no event for the written file")
+}
+
+// metadata encodes one fanotify event.
+func metadata(vers uint8, mask uint64, fd int) []byte {
+	b := make([]byte, unix.FAN_EVENT_METADATA_LEN)
+	binary.NativeEndian.PutUint32(b, unix.FAN_EVENT_METADATA_LEN)
+	b[4] = vers
+	binary.NativeEndian.PutUint16(b[6:], unix.FAN_EVENT_METADATA_LEN)
+	binary.NativeEndian.PutUint64(b[8:], mask)
+	binary.NativeEndian.PutUint32(b[16:], uint32(int32(fd)))
+	return b
+}
+
+func TestFanotify_Release(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	fa := &Fanotify{f: w}
+	defer fa.Close()
+
+	open := func() int {
+		fd, err := unix.Open(os.Args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fd
+	}
+	written, exec := open(), open()
+	var buf []byte
+	buf = append(buf, metadata(unix.FANOTIFY_METADATA_VERSION+1, unix.FAN_CLOSE_WRITE, written)...)
+	buf = append(buf, metadata(unix.FANOTIFY_METADATA_VERSION+1, unix.FAN_OPEN_EXEC_PERM, exec)...)
+	buf = append(buf, metadata(unix.FANOTIFY_METADATA_VERSION+1, unix.FAN_Q_OVERFLOW, unix.FAN_NOFD)...)
+	fa.release(buf)
+
+	for _, fd := range []int{written, exec} {
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); !errors.Is(err, unix.EBADF) {
+			t.Errorf("fd %d still open", fd)
+		}
+	}
+	// only the program waiting to run is answered
+	resp := make([]byte, 16)
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	n, _ := r.Read(resp)
+	if n != 8 || binary.NativeEndian.Uint32(resp) != uint32(exec) || binary.NativeEndian.Uint32(resp[4:]) != unix.FAN_ALLOW {
+		t.Errorf("responses = %x, want one allow for fd %d", resp[:n], exec)
+	}
+}
@@ -0,0 +1,149 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// folderRefresh is how often the watched folders are looked up again,
+// for users logging in and out and media being mounted.
+const folderRefresh = 15 * time.Second
+
+// User is someone logged in, whose folders are watched.
+type User struct {
+	UID  uint32
+	Name string
+	Home string
+}
+
+// Logind lists who's logged in. The real one asks systemd-logind over
+// the system bus; tests use a fake.
+type Logind interface {
+	Users() ([]User, error)
+	Close() error
+}
+
+// systemLogind is a Logind backed by a private system bus connection.
+type systemLogind struct {
+	conn *dbus.Conn
+}
+
+// SystemLogind connects to systemd-logind on the system bus.
+func SystemLogind() (Logind, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connect to system bus: %w", err)
+	}
+	return &systemLogind{conn: conn}, nil
+}
+
+func (l *systemLogind) Users() ([]User, error) {
+	var listed []struct {
+		UID  uint32
+		Name string
+		Path dbus.ObjectPath
+	}
+	err := l.conn.Object("org.freedesktop.login1", "/org/freedesktop/login1").
+		Call("org.freedesktop.login1.Manager.ListUsers", 0).Store(&listed)
+	if err != nil {
+		return nil, fmt.Errorf("list logind users: %w", err)
+	}
+	var users []User
+	for _, u := range listed {
+		// logind doesn't know homes, the user database does
+		pw, err := user.LookupId(strconv.FormatUint(uint64(u.UID), 10))
+		if err != nil {
+			continue
+		}
+		users = append(users, User{UID: u.UID, Name: u.Name, Home: pw.HomeDir})
+	}
+	return users, nil
+}
+
+func (l *systemLogind) Close() error {
+	return l.conn.Close()
+}
+
+// ExpandFolders turns folder patterns into the directories they name
+// that exist. "~/" stands for each user's home, and globs are expanded.
+// Folders that are symlinks are skipped, so a user can't point a watch
+// elsewhere.
+func ExpandFolders(patterns []string, users []User) []string {
+	var dirs []string
+	for _, p := range patterns {
+		candidates := []string{p}
+		if rest, ok := strings.CutPrefix(p, "~/"); ok {
+			candidates = nil
+			for _, u := range users {
+				if u.Home != "" && u.Home != "/" {
+					candidates = append(candidates, filepath.Join(u.Home, rest))
+				}
+			}
+		}
+		for _, c := range candidates {
+			matches, _ := filepath.Glob(c)
+			for _, m := range matches {
+				if fi, err := os.Lstat(m); err == nil && fi.IsDir() {
+					dirs = append(dirs, filepath.Clean(m))
+				}
+			}
+		}
+	}
+	slices.Sort(dirs)
+	return slices.Compact(dirs)
+}
+
+// WatchFolders watches the folders patterns name, as ExpandFolders does,
+// with inotify. They're looked up again every folderRefresh until ctx is
+// done or the Inotify is closed, when logind, which may be nil, is
+// closed.
+func WatchFolders(ctx context.Context, patterns []string, logind Logind, logger *slog.Logger) (*Inotify, error) {
+	in, err := NewInotify()
+	if err != nil {
+		return nil, err
+	}
+	refresh := func() {
+		var users []User
+		if logind != nil {
+			var err error
+			if users, err = logind.Users(); err != nil {
+				logger.Warn("can't list logged-in users, not watching their folders", "error", err)
+			}
+		}
+		if err := in.Watch(ExpandFolders(patterns, users)); err != nil {
+			logger.Warn("not every folder could be watched", "error", err)
+		}
+	}
+	refresh()
+
+	go func() {
+		if logind != nil {
+			defer logind.Close()
+		}
+		ticker := time.NewTicker(folderRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-in.done:
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+	return in, nil
+}
@@ -0,0 +1,43 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestExpandFolders(t *testing.T) {
+	base := t.TempDir()
+	alice, bob := filepath.Join(base, "alice"), filepath.Join(base, "bob")
+	for _, dir := range []string{
+		filepath.Join(alice, "Downloads"),
+		filepath.Join(bob, "Desktop"),
+		filepath.Join(base, "media", "alice", "USB"),
+		filepath.Join(base, "media", "bob"),
+	} {
+		os.MkdirAll(dir, 0755)
+	}
+	// a user can't send the watch somewhere else with a symlink
+	os.Symlink("/etc", filepath.Join(bob, "Downloads"))
+	os.WriteFile(filepath.Join(base, "media", "file"), nil, 0644)
+
+	users := []User{{UID: 1000, Name: "alice", Home: alice}, {UID: 1001, Name: "bob", Home: bob}, {UID: 0, Name: "root", Home: "/"}}
+	got := ExpandFolders([]string{"~/Downloads", "~/Desktop", filepath.Join(base, "media", "*"), "~/Downloads"}, users)
+	want := []string{
+		filepath.Join(alice, "Downloads"),
+		filepath.Join(base, "media", "alice"),
+		filepath.Join(base, "media", "bob"),
+		filepath.Join(bob, "Desktop"),
+	}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("ExpandFolders() = %v, want %v", got, want)
+	}
+
+	if got := ExpandFolders([]string{"~/Downloads"}, nil); len(got) != 0 {
+		t.Errorf("with nobody logged in, ExpandFolders() = %v", got)
+	}
+}
@@ -0,0 +1,229 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask is what's watched on each directory: files written or moved
+// in, and directories made, so they can be watched too.
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+// Inotify reports files written or moved into a set of directory trees.
+// Unlike Fanotify it needs no privileges beyond reading the directories,
+// but it can't tell who wrote a file or hold up programs, and each
+// directory takes a watch of its own.
+type Inotify struct {
+	f    *os.File
+	done chan struct{} // closed by Close
+
+	mu   sync.Mutex
+	dirs map[int32]string // watched directories by watch descriptor
+	wds  map[string]int32
+}
+
+// NewInotify creates an Inotify watching nothing until Watch is called.
+func NewInotify() (*Inotify, error) {
+	// non-blocking, so Close can interrupt a Read
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init: %w", err)
+	}
+	return &Inotify{
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		done: make(chan struct{}),
+		dirs: make(map[int32]string),
+		wds:  make(map[string]int32),
+	}, nil
+}
+
+// Watch makes roots, and everything under them, what's watched. Whatever
+// is already in them isn't reported, only what's written from now on.
+// It fails if the system's limit on watches is reached, having watched
+// what it could.
+func (in *Inotify) Watch(roots []string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for wd, dir := range in.dirs {
+		if !under(dir, roots) {
+			in.rmWatch(wd)
+		}
+	}
+	var errs []error
+	for _, root := range roots {
+		// directories made since are already watched, from their parent
+		if _, ok := in.wds[root]; ok {
+			continue
+		}
+		if _, err := in.addTree(root); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Read blocks for the next batch of events.
+func (in *Inotify) Read() ([]Event, error) {
+	buf := make([]byte, 16*1024)
+	n, err := in.f.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var evs []Event
+	var overflow bool
+	for off := 0; off+unix.SizeofInotifyEvent <= n; {
+		wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+		mask := binary.NativeEndian.Uint32(buf[off+4:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+		start := off + unix.SizeofInotifyEvent
+		if start+nameLen > n {
+			break
+		}
+		name := string(bytes.TrimRight(buf[start:start+nameLen], "\x00"))
+		off = start + nameLen
+
+		if mask&unix.IN_Q_OVERFLOW != 0 {
+			overflow = true
+			continue
+		}
+		in.mu.Lock()
+		dir, ok := in.dirs[wd]
+		if mask&unix.IN_IGNORED != 0 {
+			// the directory is gone
+			delete(in.dirs, wd)
+			if in.wds[dir] == wd {
+				delete(in.wds, dir)
+			}
+			ok = false
+		}
+		if !ok || name == "" {
+			in.mu.Unlock()
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if mask&unix.IN_ISDIR != 0 {
+			// files may have been put in it before it was watched
+			files, _ := in.addTree(path)
+			in.mu.Unlock()
+			for _, f := range files {
+				evs = append(evs, Event{Path: f})
+			}
+			continue
+		}
+		in.mu.Unlock()
+		if mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0 {
+			evs = append(evs, Event{Path: path})
+		}
+	}
+	if overflow {
+		return evs, ErrOverflow
+	}
+	return evs, nil
+}
+
+// Respond does nothing: nothing waits on inotify.
+func (in *Inotify) Respond(ev Event, allow bool) error {
+	return nil
+}
+
+// Close stops watching.
+func (in *Inotify) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	select {
+	case <-in.done:
+		return nil
+	default:
+	}
+	close(in.done)
+	return in.f.Close()
+}
+
+// addTree watches dir and the directories under it, returning the files
+// found in them. Directories that can't be watched are skipped, unless
+// the limit on watches has been reached. in.mu must be held.
+func (in *Inotify) addTree(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if e != nil && e.IsDir() && path != dir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if e.Type().IsRegular() {
+			files = append(files, path)
+			return nil
+		}
+		if !e.IsDir() {
+			return nil
+		}
+		err = in.addWatch(path)
+		if errors.Is(err, unix.ENOSPC) {
+			return fmt.Errorf("inotify watch limit reached at %s", path)
+		}
+		if err != nil && path != dir {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return files, err
+}
+
+// addWatch watches one directory. in.mu must be held.
+func (in *Inotify) addWatch(dir string) error {
+	rc, err := in.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var wd int
+	var werr error
+	if err := rc.Control(func(fd uintptr) {
+		wd, werr = unix.InotifyAddWatch(int(fd), dir, inotifyMask)
+	}); err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	// the same directory under a new name keeps its descriptor
+	if old, ok := in.dirs[int32(wd)]; ok && old != dir {
+		delete(in.wds, old)
+	}
+	in.dirs[int32(wd)] = dir
+	in.wds[dir] = int32(wd)
+	return nil
+}
+
+// rmWatch stops watching a directory. in.mu must be held.
+func (in *Inotify) rmWatch(wd int32) {
+	if rc, err := in.f.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			unix.InotifyRmWatch(int(fd), uint32(wd))
+		})
+	}
+	delete(in.wds, in.dirs[wd])
+	delete(in.dirs, wd)
+}
+
+// under reports whether path is one of roots or inside one.
+func under(path string, roots []string) bool {
+	for _, root := range roots {
+		if rel, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readPaths reads events until want have all been seen or time runs out,
+// returning the paths seen.
+func readPaths(t *testing.T, in *Inotify, want ...string) []string {
+	t.Helper()
+	var seen []string
+	got := make(chan []Event)
+	deadline := time.After(2 * time.Second)
+	for {
+		if !slices.ContainsFunc(want, func(p string) bool { return !slices.Contains(seen, p) }) {
+			return seen
+		}
+		go func() {
+			evs, _ := in.Read()
+			got <- evs
+		}()
+		select {
+		case evs := <-got:
+			for _, ev := range evs {
+				seen = append(seen, ev.Path)
+			}
+		case <-deadline:
+			in.Close()
+			<-got
+			return seen
+		}
+	}
+}
+
+func TestInotify(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "old"), []byte("x"), 0644)
+	in, err := NewInotify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if err := in.Watch([]string{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	written := filepath.Join(root, "written")
+	os.WriteFile(written, []byte("x"), 0644)
+	// files in a new directory are seen, even if written before it's watched
+	sub := filepath.Join(root, "sub", "deeper")
+	os.MkdirAll(sub, 0755)
+	nested := filepath.Join(sub, "nested")
+	os.WriteFile(nested, []byte("x"), 0644)
+	// and so are files moved in
+	moved := filepath.Join(root, "moved")
+	other := t.TempDir()
+	os.WriteFile(filepath.Join(other, "part"), []byte("x"), 0644)
+	os.Rename(filepath.Join(other, "part"), moved)
+
+	seen := readPaths(t, in, written, nested, moved)
+	for _, p := range []string{written, nested, moved} {
+		if !slices.Contains(seen, p) {
+			t.Errorf("no event for %s, got %v", p, seen)
+		}
+	}
+	if slices.Contains(seen, filepath.Join(root, "old")) {
+		t.Error("a file already there was reported")
+	}
+}
+
+func TestInotify_WatchDropsOldRoots(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	in, err := NewInotify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	in.Watch([]string{a, b})
+	os.Mkdir(filepath.Join(a, "sub"), 0755)
+	f := filepath.Join(a, "sub", "f")
+	os.WriteFile(f, []byte("x"), 0644)
+	if seen := readPaths(t, in, f); !slices.Contains(seen, f) {
+		t.Fatalf("no event for %s", f)
+	}
+	in.Watch([]string{b})
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, dir := range in.dirs {
+		if dir != b {
+			t.Errorf("still watching %s", dir)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// oreon/defense · watchthelight <wtl>
+
+// Package onaccess scans files as they're written and, optionally,
+// before programs run, for real-time protection.
+package onaccess
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oreonproject/defense/internal/scanner"
+)
+
+// Event is a file access reported by a Notifier.
+type Event struct {
+	File *os.File // open on the file, if the Notifier opens it; the monitor closes it
+	Path string
+	PID  int  // who accessed it, if known
+	Exec bool // a program about to run, which waits for Respond
+}
+
+// Notifier reports file accesses. *Fanotify and *Inotify are the real
+// ones.
+type Notifier interface {
+	// Read blocks for the next batch of events, and fails once closed.
+	Read() ([]Event, error)
+	// Respond lets an Exec event go ahead or refuses it.
+	Respond(ev Event, allow bool) error
+	Close() error
+}
+
+const (
+	// DefaultDebounce is how long a file is left alone after a write
+	// before it's scanned.
+	DefaultDebounce = 2 * time.Second
+	// execTimeout is how long a program waits for its scan. Past it, the
+	// program runs: a stuck clamd shouldn't stop the machine working.
+	execTimeout = 10 * time.Second
+	// queueSize is how many written files can wait for a worker.
+	queueSize = 1024
+)
+
+// Monitor scans files a Notifier reports.
+type Monitor struct {
+	notifier Notifier
+	scanner  scanner.FileScanner
+	report   func(result *scanner.ScanResult, size int64)
+	paths    []string
+	exclude  *scanner.Exclusions
+	debounce time.Duration
+	workers  int
+	self     int // accesses by this process are let through unscanned
+	logger   *slog.Logger
+	cache    *verdictCache
+
+	done    chan struct{} // closed when Run returns
+	mu      sync.Mutex
+	pending map[string]*time.Timer // written files waiting out the debounce
+	queue   chan string
+}
+
+// Option configures a Monitor.
+type Option func(*Monitor)
+
+// WithPaths limits scanning to files under paths. Defaults to everything
+// the Notifier reports.
+func WithPaths(paths []string) Option {
+	return func(m *Monitor) {
+		m.paths = paths
+	}
+}
+
+// WithExclusions leaves out what x excludes.
+func WithExclusions(x *scanner.Exclusions) Option {
+	return func(m *Monitor) {
+		m.exclude = x
+	}
+}
+
+// WithDebounce sets how long a file is left alone after a write before
+// it's scanned. Defaults to DefaultDebounce.
+func WithDebounce(d time.Duration) Option {
+	return func(m *Monitor) {
+		if d > 0 {
+			m.debounce = d
+		}
+	}
+}
+
+// WithWorkers sets how many files are scanned at once. Defaults to 2.
+func WithWorkers(n int) Option {
+	return func(m *Monitor) {
+		if n > 0 {
+			m.workers = n
+		}
+	}
+}
+
+// WithLogger sets where problems are logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(m *Monitor) {
+		m.logger = l
+	}
+}
+
+// New creates a monitor that scans what n reports with s, passing each
+// threat and the file's size to report.
+func New(n Notifier, s scanner.FileScanner, report func(result *scanner.ScanResult, size int64), opts ...Option) *Monitor {
+	m := &Monitor{
+		notifier: n,
+		scanner:  s,
+		report:   report,
+		debounce: DefaultDebounce,
+		workers:  2,
+		self:     os.Getpid(),
+		logger:   slog.Default(),
+		cache:    newVerdictCache(),
+		done:     make(chan struct{}),
+		pending:  make(map[string]*time.Timer),
+		queue:    make(chan string, queueSize),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Done is closed once Run has returned, when the monitor has stopped
+// watching.
+func (m *Monitor) Done() <-chan struct{} {
+	return m.done
+}
+
+// Run handles events until ctx is cancelled or the Notifier fails,
+// closing the Notifier either way. It returns nil if ctx ended it. A
+// Monitor can only be run once.
+func (m *Monitor) Run(ctx context.Context) error {
+	defer close(m.done)
+
+	scanCtx, stopScans := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for range m.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.scanWritten(scanCtx)
+		}()
+	}
+	stop := context.AfterFunc(ctx, func() { m.notifier.Close() })
+
+	var err error
+	for {
+		var evs []Event
+		evs, err = m.notifier.Read()
+		for _, ev := range evs {
+			m.handle(ev)
+		}
+		if errors.Is(err, ErrOverflow) {
+			m.logger.Warn("on-access events were lost", "error", err)
+			continue
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if stop() {
+		m.notifier.Close()
+	}
+	m.mu.Lock()
+	for path, t := range m.pending {
+		t.Stop()
+		delete(m.pending, path)
+	}
+	m.mu.Unlock()
+	stopScans()
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// handle deals with one event. Programs waiting to run are checked in
+// the background, so one slow scan doesn't hold up the others.
+func (m *Monitor) handle(ev Event) {
+	if ev.Exec {
+		go m.checkExec(ev)
+		return
+	}
+	if ev.File != nil {
+		ev.File.Close()
+	}
+	if ev.PID == m.self || !m.wanted(ev.Path) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.pending[ev.Path]; ok {
+		t.Reset(m.debounce)
+		return
+	}
+	path := ev.Path
+	m.pending[path] = time.AfterFunc(m.debounce, func() {
+		m.mu.Lock()
+		delete(m.pending, path)
+		m.mu.Unlock()
+		select {
+		case m.queue <- path:
+		default:
+			m.logger.Warn("on-access scan queue full, not scanning", "path", path)
+		}
+	})
+}
+
+// wanted reports whether a file at path is to be scanned.
+func (m *Monitor) wanted(path string) bool {
+	if path == "" || !filepath.IsAbs(path) {
+		return false
+	}
+	if len(m.paths) > 0 && !under(path, m.paths) {
+		return false
+	}
+	if m.exclude != nil {
+		if fi, err := os.Lstat(path); err != nil || !fi.Mode().IsRegular() || m.exclude.SkipFile(path, fi.Size()) {
+			return false
+		}
+	}
+	return true
+}
+
+// scanWritten scans files once their debounce is up.
+func (m *Monitor) scanWritten(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case path := <-m.queue:
+			fi, err := os.Lstat(path)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue // gone or replaced already
+			}
+			if m.cache.clean(fi) {
+				continue
+			}
+			if threat := m.scan(path, fi); threat != nil {
+				m.report(threat, fi.Size())
+			}
+		}
+	}
+}
+
+// checkExec answers a program waiting to run: refused if it's infected,
+// let through otherwise, including when it can't be scanned in time.
+func (m *Monitor) checkExec(ev Event) {
+	defer ev.File.Close()
+	threat, size := m.execThreat(ev)
+	if err := m.notifier.Respond(ev, threat == nil); err != nil {
+		m.logger.Warn("failed to answer exec", "path", ev.Path, "error", err)
+	}
+	// only once the program isn't kept waiting on it
+	if threat != nil {
+		m.report(threat, size)
+	}
+}
+
+// execThreat scans a program about to run, returning the threat in it
+// if there is one.
+func (m *Monitor) execThreat(ev Event) (*scanner.ScanResult, int64) {
+	if ev.PID == m.self || !m.wanted(ev.Path) {
+		return nil, 0
+	}
+	fi, err := ev.File.Stat()
+	if err != nil || m.cache.clean(fi) {
+		return nil, 0
+	}
+
+	done := make(chan *scanner.ScanResult, 1)
+	go func() {
+		done <- m.scan(ev.Path, fi)
+	}()
+	select {
+	case threat := <-done:
+		return threat, fi.Size()
+	case <-time.After(execTimeout):
+		m.logger.Warn("exec scan timed out, letting it run", "path", ev.Path)
+		return nil, 0
+	}
+}
+
+// scan scans one file, remembering a clean verdict. It returns the
+// result if there's a threat, and nil for clean files and those that
+// couldn't be scanned.
+func (m *Monitor) scan(path string, fi os.FileInfo) *scanner.ScanResult {
+	result := m.scanner.ScanFile(path)
+	if result.Error != nil {
+		m.logger.Debug("on-access scan failed", "path", path, "error", result.Error)
+		return nil
+	}
+	if result.Clean {
+		m.cache.add(fi)
+		return nil
+	}
+	if result.Info == nil {
+		result.Info = fi
+	}
+	return result
+}
@@ -0,0 +1,237 @@
+// oreon/defense · watchthelight <wtl>
+
+package onaccess
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oreonproject/defense/internal/scanner"
+)
+
+// fakeNotifier hands out events sent on its channel and records answers.
+type fakeNotifier struct {
+	events  chan []Event
+	closed  chan struct{}
+	once    sync.Once
+	answers chan bool
+}
+
+func newFakeNotifier() *fakeNotifier {
+	return &fakeNotifier{
+		events:  make(chan []Event),
+		closed:  make(chan struct{}),
+		answers: make(chan bool, 16),
+	}
+}
+
+func (n *fakeNotifier) Read() ([]Event, error) {
+	select {
+	case evs := <-n.events:
+		return evs, nil
+	case <-n.closed:
+		return nil, os.ErrClosed
+	}
+}
+
+func (n *fakeNotifier) Respond(ev Event, allow bool) error {
+	n.answers <- allow
+	return nil
+}
+
+func (n *fakeNotifier) Close() error {
+	n.once.Do(func() { close(n.closed) })
+	return nil
+}
+
+// send delivers an event on path as if pid had accessed it.
+func (n *fakeNotifier) send(t *testing.T, path string, pid int, exec bool) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.events <- []Event{{File: f, Path: path, PID: pid, Exec: exec}}
+}
+
+// fakeScanner treats files named "infected*" as threats and counts scans.
+type fakeScanner struct {
+	mu    sync.Mutex
+	scans map[string]int
+}
+
+func (s *fakeScanner) ScanFile(path string) *scanner.ScanResult {
+	s.mu.Lock()
+	if s.scans == nil {
+		s.scans = make(map[string]int)
+	}
+	s.scans[path]++
+	s.mu.Unlock()
+	if strings.HasPrefix(filepath.Base(path), "infected") {
+		return &scanner.ScanResult{Path: path, Threat: "Eicar-Test-Signature"}
+	}
+	return &scanner.ScanResult{Path: path, Clean: true}
+}
+
+func (s *fakeScanner) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans[path]
+}
+
+// startMonitor runs a monitor over dir, returning what it reports.
+func startMonitor(t *testing.T, n Notifier, s scanner.FileScanner, dir string) (*Monitor, chan *scanner.ScanResult) {
+	t.Helper()
+	reported := make(chan *scanner.ScanResult, 16)
+	m := New(n, s, func(result *scanner.ScanResult, size int64) { reported <- result },
+		WithPaths([]string{dir}), WithDebounce(50*time.Millisecond))
+	m.self = -1 // the tests open the files themselves
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	})
+	return m, reported
+}
+
+func writeFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMonitor_DebouncesWrites(t *testing.T) {
+	dir := t.TempDir()
+	n, s := newFakeNotifier(), &fakeScanner{}
+	_, reported := startMonitor(t, n, s, dir)
+
+	path := writeFile(t, dir, "infected.bin")
+	for range 5 {
+		n.send(t, path, 1, false)
+	}
+	select {
+	case result := <-reported:
+		if result.Path != path {
+			t.Errorf("reported %s, want %s", result.Path, path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("threat not reported")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := s.count(path); got != 1 {
+		t.Errorf("scanned %d times, want once", got)
+	}
+}
+
+func TestMonitor_Exec(t *testing.T) {
+	dir := t.TempDir()
+	n, s := newFakeNotifier(), &fakeScanner{}
+	_, reported := startMonitor(t, n, s, dir)
+
+	bad := writeFile(t, dir, "infected.sh")
+	n.send(t, bad, 1, true)
+	if allow := <-n.answers; allow {
+		t.Error("infected program allowed to run")
+	}
+	select {
+	case <-reported:
+	case <-time.After(2 * time.Second):
+		t.Fatal("threat not reported")
+	}
+
+	good := writeFile(t, dir, "tool.sh")
+	for range 2 {
+		n.send(t, good, 1, true)
+		if allow := <-n.answers; !allow {
+			t.Error("clean program refused")
+		}
+	}
+	if got := s.count(good); got != 1 {
+		t.Errorf("clean program scanned %d times, want once", got)
+	}
+}
+
+func TestMonitor_Ignores(t *testing.T) {
+	dir := t.TempDir()
+	n, s := newFakeNotifier(), &fakeScanner{}
+	m, _ := startMonitor(t, n, s, dir)
+	m.self = 42
+
+	outside := writeFile(t, t.TempDir(), "infected.sh")
+	own := writeFile(t, dir, "infected.db")
+	n.send(t, outside, 1, true)
+	n.send(t, own, 42, true)
+	for range 2 {
+		if allow := <-n.answers; !allow {
+			t.Error("ignored program refused")
+		}
+	}
+	n.send(t, outside, 1, false)
+	n.send(t, own, 42, false)
+	time.Sleep(200 * time.Millisecond)
+	if s.count(outside)+s.count(own) != 0 {
+		t.Error("scanned ignored files")
+	}
+}
+
+func TestMonitor_NotifierFails(t *testing.T) {
+	n := &failingNotifier{err: errors.New("gone")}
+	m := New(n, &fakeScanner{}, func(*scanner.ScanResult, int64) {})
+	if err := m.Run(context.Background()); !errors.Is(err, n.err) {
+		t.Errorf("Run() error = %v, want %v", err, n.err)
+	}
+	select {
+	case <-m.Done():
+	default:
+		t.Error("Done() not closed after Run returned")
+	}
+}
+
+type failingNotifier struct{ err error }
+
+func (n *failingNotifier) Read() ([]Event, error)    { return nil, n.err }
+func (n *failingNotifier) Respond(Event, bool) error { return nil }
+func (n *failingNotifier) Close() error              { return nil }
+
+func TestVerdictCache(t *testing.T) {
+	c := newVerdictCache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	path := writeFile(t, t.TempDir(), "a")
+	fi, _ := os.Stat(path)
+	if c.clean(fi) {
+		t.Error("unseen file is clean")
+	}
+	c.add(fi)
+	if !c.clean(fi) {
+		t.Error("file not remembered as clean")
+	}
+
+	// rewriting it makes it a different file as far as the cache goes
+	time.Sleep(10 * time.Millisecond)
+	os.WriteFile(path, []byte("changed"), 0644)
+	changed, _ := os.Stat(path)
+	if c.clean(changed) {
+		t.Error("changed file still clean")
+	}
+
+	now = now.Add(cacheTTL + time.Second)
+	if c.clean(fi) {
+		t.Error("verdict outlived its TTL")
+	}
+}
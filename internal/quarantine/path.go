@@ -0,0 +1,131 @@
+// oreon/defense · watchthelight <wtl>
+
+package quarantine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDir opens an absolute directory path without following a symlink
+// anywhere along it, so a directory a user swaps for a link can't send
+// root somewhere else. The descriptor is for use with the *at calls.
+func openDir(dir string) (int, error) {
+	if !filepath.IsAbs(dir) {
+		return -1, fmt.Errorf("%s is not an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	fd, err := unix.Openat2(unix.AT_FDCWD, dir, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		return openDirWalk(dir) // before Linux 5.6
+	}
+	if err != nil {
+		return -1, &fs.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return fd, nil
+}
+
+// openDirWalk is openDir one component at a time, for kernels without
+// openat2.
+func openDirWalk(dir string) (int, error) {
+	fd, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" {
+			continue
+		}
+		next, err := unix.Openat(fd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, &fs.PathError{Op: "open", Path: dir, Err: err}
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// createTemp creates a new file with a random name in the directory
+// dirfd, which is dir, returning it and its name there.
+func createTemp(dirfd int, dir string) (*os.File, string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	name := ".defense-restore-" + hex.EncodeToString(b)
+	fd, err := unix.Openat(dirfd, name, unix.O_RDWR|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: "create", Path: filepath.Join(dir, name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(dir, name)), name, nil
+}
+
+// RemoveFile deletes the threat at path outright, as long as it is still
+// the file want describes. Like Add, it doesn't follow symlinks to get
+// there.
+func RemoveFile(path string, want fs.FileInfo) error {
+	dirfd, err := openDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	base := filepath.Base(path)
+
+	fd, err := unix.Openat(dirfd, base, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if !sameFile(st, want) {
+		return fmt.Errorf("%s is not the file that was scanned", path)
+	}
+	return unlinkSame(dirfd, base, st)
+}
+
+// sameFile reports whether st is the file want describes, and unchanged
+// since: same device and inode, size and modification time.
+func sameFile(st *syscall.Stat_t, want fs.FileInfo) bool {
+	if want == nil {
+		return false
+	}
+	w, ok := want.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return st.Dev == w.Dev && st.Ino == w.Ino && st.Size == w.Size && st.Mtim == w.Mtim
+}
+
+// unlinkSame removes name from the directory if it is still the file st
+// describes.
+func unlinkSame(dirfd int, name string, st *syscall.Stat_t) error {
+	var now unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &now, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if now.Dev != st.Dev || now.Ino != st.Ino {
+		return errors.New("file was replaced while being removed")
+	}
+	return unix.Unlinkat(dirfd, name, 0)
+}
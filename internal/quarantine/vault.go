@@ -0,0 +1,416 @@
+// oreon/defense · watchthelight <wtl>
+
+// Package quarantine keeps infected files out of harm's way. Files are
+// moved into a vault directory encrypted, so they can't be run or picked
+// up again by a scan, and indexed in SQLite with everything needed to
+// put them back as they were.
+package quarantine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	_ "modernc.org/sqlite"
+)
+
+// ErrNotFound is returned for IDs the vault doesn't hold.
+var ErrNotFound = errors.New("not in quarantine")
+
+// ErrExists is returned when restoring over a file that has since
+// reappeared.
+var ErrExists = errors.New("a file already exists there")
+
+// Item is one quarantined file.
+type Item struct {
+	ID            string
+	Path          string // where it was found
+	Threat        string
+	Size          int64
+	SHA256        string // of the original contents, hex
+	UID, GID      uint32
+	Mode          fs.FileMode
+	Xattrs        map[string][]byte
+	QuarantinedAt time.Time
+}
+
+// Vault stores quarantined files under a directory only root can read.
+type Vault struct {
+	dir string
+	db  *sql.DB
+	key []byte
+}
+
+const (
+	keyFile   = "vault.key"
+	indexFile = "index.db"
+)
+
+// Open opens the vault in dir, creating it and its key on first use.
+func Open(dir string) (*Vault, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadKey(filepath.Join(dir, keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("vault key: %w", err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := createSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Vault{dir: dir, db: db, key: key}, nil
+}
+
+// Close closes the index.
+func (v *Vault) Close() error {
+	return v.db.Close()
+}
+
+func createSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS items (
+		id TEXT PRIMARY KEY,
+		path TEXT NOT NULL,
+		threat TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		uid INTEGER NOT NULL,
+		gid INTEGER NOT NULL,
+		mode INTEGER NOT NULL,
+		xattrs TEXT,
+		quarantined_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_items_path ON items(path);
+	`)
+	return err
+}
+
+// loadKey reads the vault key, generating it if there isn't one yet.
+func loadKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%s is %d bytes, want 32", path, len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// Add moves the file at path into the vault. want is the file as the
+// scan found it; Add refuses a file that is no longer that one. Its
+// directory is opened without following symlinks and everything after
+// goes through descriptors, so a path swapped meanwhile can't point it
+// at another file. The original is only removed once its encrypted copy
+// is safely on disk.
+func (v *Vault) Add(path, threat string, want fs.FileInfo) (Item, error) {
+	dirfd, err := openDir(filepath.Dir(path))
+	if err != nil {
+		return Item{}, err
+	}
+	defer unix.Close(dirfd)
+	base := filepath.Base(path)
+
+	// non-blocking, so a FIFO put in its place can't hang us
+	fd, err := unix.Openat(dirfd, base, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return Item{}, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	src := os.NewFile(uintptr(fd), path)
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return Item{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return Item{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if !sameFile(st, want) {
+		return Item{}, fmt.Errorf("%s is not the file that was scanned", path)
+	}
+
+	item := Item{
+		ID:            newID(),
+		Path:          path,
+		Threat:        threat,
+		UID:           st.Uid,
+		GID:           st.Gid,
+		Mode:          fi.Mode(),
+		QuarantinedAt: time.Now().UTC(),
+	}
+	if item.Xattrs, err = getXattrs(fd); err != nil {
+		return Item{}, fmt.Errorf("read xattrs: %w", err)
+	}
+
+	// hash while encrypting, so both describe the same contents
+	sum := sha256.New()
+	n, err := v.seal(v.blobPath(item.ID), io.TeeReader(src, sum))
+	if err != nil {
+		return Item{}, err
+	}
+	item.Size = n
+	item.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	if err := v.insert(item); err != nil {
+		os.Remove(v.blobPath(item.ID))
+		return Item{}, err
+	}
+	if err := unlinkSame(dirfd, base, st); err != nil {
+		v.forget(item.ID)
+		return Item{}, fmt.Errorf("remove original: %w", err)
+	}
+	return item, nil
+}
+
+// List returns everything in the vault, newest first.
+func (v *Vault) List() ([]Item, error) {
+	rows, err := v.db.Query(`SELECT id, path, threat, size, sha256, uid, gid, mode, xattrs, quarantined_at FROM items ORDER BY quarantined_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []Item
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Get returns one item.
+func (v *Vault) Get(id string) (Item, error) {
+	row := v.db.QueryRow(`SELECT id, path, threat, size, sha256, uid, gid, mode, xattrs, quarantined_at FROM items WHERE id = ?`, id)
+	item, err := scanItem(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Item{}, ErrNotFound
+	}
+	return item, err
+}
+
+// Restore decrypts an item back to where it was found, with its owner,
+// mode and extended attributes, and drops it from the vault. It won't
+// overwrite a file that has appeared there since.
+func (v *Vault) Restore(id string) (Item, error) {
+	item, err := v.Get(id)
+	if err != nil {
+		return Item{}, err
+	}
+
+	// a directory swapped for a link since would send the file, with
+	// its owner and mode, wherever the link points
+	dir := filepath.Dir(item.Path)
+	dirfd, err := openDir(dir)
+	if err != nil {
+		return Item{}, fmt.Errorf("%s is no longer where the file was found: %w", dir, err)
+	}
+	defer unix.Close(dirfd)
+	base := filepath.Base(item.Path)
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		return Item{}, fmt.Errorf("%s: %w", item.Path, ErrExists)
+	}
+
+	// decrypt next to the destination, then link it into place
+	tmp, name, err := createTemp(dirfd, dir)
+	if err != nil {
+		return Item{}, err
+	}
+	defer unix.Unlinkat(dirfd, name, 0)
+
+	sum := sha256.New()
+	if err := v.open(v.blobPath(id), io.MultiWriter(tmp, sum)); err != nil {
+		tmp.Close()
+		return Item{}, err
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != item.SHA256 {
+		tmp.Close()
+		return Item{}, fmt.Errorf("vault copy is corrupt: sha256 %s, want %s", got, item.SHA256)
+	}
+	if err := restoreAttrs(tmp, item); err != nil {
+		tmp.Close()
+		return Item{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Item{}, err
+	}
+	// link fails rather than replace a file that appeared meanwhile
+	if err := unix.Linkat(dirfd, name, dirfd, base, 0); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			return Item{}, fmt.Errorf("%s: %w", item.Path, ErrExists)
+		}
+		return Item{}, &fs.PathError{Op: "link", Path: item.Path, Err: err}
+	}
+	return item, v.Delete(id)
+}
+
+// Delete destroys an item for good.
+func (v *Vault) Delete(id string) error {
+	res, err := v.db.Exec(`DELETE FROM items WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if err := os.Remove(v.blobPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// restoreAttrs gives a restored file back its owner, mode and xattrs.
+func restoreAttrs(f *os.File, item Item) error {
+	if err := f.Chown(int(item.UID), int(item.GID)); err != nil {
+		return err
+	}
+	// after chown, which clears setuid and setgid
+	if err := f.Chmod(item.Mode); err != nil {
+		return err
+	}
+	return setXattrs(int(f.Fd()), item.Xattrs)
+}
+
+func (v *Vault) blobPath(id string) string {
+	return filepath.Join(v.dir, id+".bin")
+}
+
+// seal encrypts r into a new file at path with AES-256-CTR under a
+// random IV, which is written first. It returns the plaintext length.
+func (v *Vault) seal(path string, r io.Reader) (int64, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return 0, err
+	}
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := func() (int64, error) {
+		if _, err := f.Write(iv); err != nil {
+			return 0, err
+		}
+		w := &cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: f}
+		n, err := io.Copy(w, r)
+		if err != nil {
+			return n, err
+		}
+		return n, f.Sync()
+	}()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return n, nil
+}
+
+// open decrypts the file at path into w.
+func (v *Vault) open(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(f, iv); err != nil {
+		return fmt.Errorf("read vault copy: %w", err)
+	}
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, &cipher.StreamReader{S: cipher.NewCTR(block, iv), R: f})
+	return err
+}
+
+func (v *Vault) insert(item Item) error {
+	xattrs, err := json.Marshal(item.Xattrs)
+	if err != nil {
+		return err
+	}
+	_, err = v.db.Exec(
+		`INSERT INTO items (id, path, threat, size, sha256, uid, gid, mode, xattrs, quarantined_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.ID, item.Path, item.Threat, item.Size, item.SHA256, item.UID, item.GID, uint32(item.Mode), string(xattrs), item.QuarantinedAt,
+	)
+	return err
+}
+
+// forget drops an item whose original couldn't be removed after all.
+func (v *Vault) forget(id string) {
+	v.db.Exec(`DELETE FROM items WHERE id = ?`, id)
+	os.Remove(v.blobPath(id))
+}
+
+// rowScanner is a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanItem(row rowScanner) (Item, error) {
+	var item Item
+	var mode uint32
+	var xattrs sql.NullString
+	err := row.Scan(&item.ID, &item.Path, &item.Threat, &item.Size, &item.SHA256,
+		&item.UID, &item.GID, &mode, &xattrs, &item.QuarantinedAt)
+	if err != nil {
+		return Item{}, err
+	}
+	item.Mode = fs.FileMode(mode)
+	if xattrs.String != "" {
+		if err := json.Unmarshal([]byte(xattrs.String), &item.Xattrs); err != nil {
+			return Item{}, fmt.Errorf("item %s xattrs: %w", item.ID, err)
+		}
+	}
+	return item, nil
+}
+
+// newID returns a random item ID.
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
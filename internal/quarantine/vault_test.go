@@ -0,0 +1,324 @@
+// oreon/defense · watchthelight <wtl>
+
+package quarantine
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// lstat returns what a scan would have found at path.
+func lstat(path string) os.FileInfo {
+	fi, _ := os.Lstat(path)
+	return fi
+}
+
+func openVault(t *testing.T) *Vault {
+	t.Helper()
+	v, err := Open(filepath.Join(t.TempDir(), "vault"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { v.Close() })
+	return v
+}
+
+func TestAddAndRestore(t *testing.T) {
+	v := openVault(t)
+	path := filepath.Join(t.TempDir(), "infected.sh")
+	contents := []byte("#!/bin/sh\necho EICAR\n")
+	if err := os.WriteFile(path, contents, 0750); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, 0750) // past the umask
+	// not every filesystem has user xattrs
+	hasXattr := unix.Lsetxattr(path, "user.origin", []byte("download"), 0) == nil
+
+	item, err := v.Add(path, "Eicar-Test-Signature", lstat(path))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("original still there: %v", err)
+	}
+	if item.Size != int64(len(contents)) || item.Mode != 0750 || item.Threat != "Eicar-Test-Signature" {
+		t.Errorf("item = %+v", item)
+	}
+	blob, err := os.ReadFile(v.blobPath(item.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(blob, []byte("EICAR")) || bytes.Contains(blob, []byte("#!")) {
+		t.Error("vault copy is in the clear")
+	}
+
+	items, err := v.List()
+	if err != nil || len(items) != 1 || items[0].ID != item.ID || items[0].Path != path {
+		t.Fatalf("List() = %+v, %v", items, err)
+	}
+	if hasXattr && string(items[0].Xattrs["user.origin"]) != "download" {
+		t.Errorf("xattrs = %v", items[0].Xattrs)
+	}
+
+	if _, err := v.Restore(item.ID); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, contents) {
+		t.Errorf("restored %q, %v", got, err)
+	}
+	fi, _ := os.Stat(path)
+	if fi.Mode() != 0750 {
+		t.Errorf("restored mode = %v, want 0750", fi.Mode())
+	}
+	if hasXattr {
+		buf := make([]byte, 64)
+		n, err := unix.Lgetxattr(path, "user.origin", buf)
+		if err != nil || string(buf[:n]) != "download" {
+			t.Errorf("restored xattr = %q, %v", buf[:n], err)
+		}
+	}
+	if _, err := v.Get(item.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after restore: %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(v.blobPath(item.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Error("vault copy left behind")
+	}
+}
+
+func TestRestoreWontOverwrite(t *testing.T) {
+	v := openVault(t)
+	path := filepath.Join(t.TempDir(), "infected")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	item, err := v.Add(path, "Eicar-Test-Signature", lstat(path))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	os.WriteFile(path, []byte("new"), 0644)
+	if _, err := v.Restore(item.ID); !errors.Is(err, ErrExists) {
+		t.Errorf("Restore over a file: %v, want ErrExists", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "new" {
+		t.Errorf("file now holds %q", got)
+	}
+	if _, err := v.Get(item.ID); err != nil {
+		t.Errorf("item gone after a failed restore: %v", err)
+	}
+}
+
+func TestRestoreSymlinkedDir(t *testing.T) {
+	v := openVault(t)
+	dir := filepath.Join(t.TempDir(), "dir")
+	os.Mkdir(dir, 0755)
+	path := filepath.Join(dir, "infected")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	item, err := v.Add(path, "Eicar-Test-Signature", lstat(path))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// the directory is now a link to somewhere else
+	elsewhere := t.TempDir()
+	os.Remove(dir)
+	os.Symlink(elsewhere, dir)
+	if _, err := v.Restore(item.ID); err == nil {
+		t.Error("Restore went through a symlinked directory")
+	}
+	if entries, _ := os.ReadDir(elsewhere); len(entries) != 0 {
+		t.Errorf("Restore left %d files behind the link", len(entries))
+	}
+	if _, err := v.Get(item.ID); err != nil {
+		t.Errorf("item gone after a failed restore: %v", err)
+	}
+}
+
+func TestAddSymlink(t *testing.T) {
+	v := openVault(t)
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	os.WriteFile(target, []byte("EICAR"), 0644)
+	os.Symlink(target, link)
+
+	if _, err := v.Add(link, "Eicar-Test-Signature", lstat(link)); err == nil {
+		t.Error("Add followed a symlink")
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("target: %v", err)
+	}
+}
+
+func TestAddSymlinkedDir(t *testing.T) {
+	v := openVault(t)
+	real := t.TempDir()
+	os.WriteFile(filepath.Join(real, "eicar"), []byte("EICAR"), 0644)
+	link := filepath.Join(t.TempDir(), "dir")
+	os.Symlink(real, link)
+
+	if _, err := v.Add(filepath.Join(link, "eicar"), "Eicar-Test-Signature", lstat(filepath.Join(real, "eicar"))); err == nil {
+		t.Error("Add went through a symlinked directory")
+	}
+	if _, err := os.Stat(filepath.Join(real, "eicar")); err != nil {
+		t.Errorf("file behind the link: %v", err)
+	}
+}
+
+func TestOpenDir(t *testing.T) {
+	real := t.TempDir()
+	os.Mkdir(filepath.Join(real, "sub"), 0755)
+	link := filepath.Join(t.TempDir(), "dir")
+	os.Symlink(real, link)
+
+	for name, open := range map[string]func(string) (int, error){"openat2": openDir, "walk": openDirWalk} {
+		fd, err := open(filepath.Join(real, "sub"))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else {
+			unix.Close(fd)
+		}
+		// a link anywhere along the path, not just at the end
+		if fd, err := open(filepath.Join(link, "sub")); err == nil {
+			unix.Close(fd)
+			t.Errorf("%s went through a symlink", name)
+		}
+	}
+}
+
+func TestAddChanged(t *testing.T) {
+	v := openVault(t)
+	path := filepath.Join(t.TempDir(), "eicar")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	scanned := lstat(path)
+
+	// replaced by another file since the scan
+	os.Remove(path)
+	os.WriteFile(path, []byte("innocent"), 0644)
+	if _, err := v.Add(path, "Eicar-Test-Signature", scanned); err == nil {
+		t.Error("Add took a file other than the one scanned")
+	}
+	if _, err := v.Add(path, "Eicar-Test-Signature", nil); err == nil {
+		t.Error("Add took a file with nothing to check it against")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "innocent" {
+		t.Errorf("file now holds %q", got)
+	}
+}
+
+func TestRemoveFile(t *testing.T) {
+	real := t.TempDir()
+	path := filepath.Join(real, "eicar")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	scanned := lstat(path)
+
+	link := filepath.Join(t.TempDir(), "dir")
+	os.Symlink(real, link)
+	if err := RemoveFile(filepath.Join(link, "eicar"), scanned); err == nil {
+		t.Error("RemoveFile went through a symlinked directory")
+	}
+
+	os.Remove(path)
+	os.WriteFile(path, []byte("innocent"), 0644)
+	if err := RemoveFile(path, scanned); err == nil {
+		t.Error("RemoveFile deleted a file other than the one scanned")
+	}
+	if err := RemoveFile(path, lstat(path)); err != nil {
+		t.Fatalf("RemoveFile() error = %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("file still there: %v", err)
+	}
+}
+
+func TestUnlinkSame(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "eicar")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirfd)
+
+	// swapped for another file since it was read
+	os.Rename(path, filepath.Join(dir, "moved"))
+	os.WriteFile(path, []byte("innocent"), 0644)
+	if err := unlinkSame(dirfd, "eicar", &st); err == nil {
+		t.Error("removed a file that replaced the one quarantined")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("replacement: %v", err)
+	}
+
+	os.Rename(filepath.Join(dir, "moved"), path)
+	if err := unlinkSame(dirfd, "eicar", &st); err != nil {
+		t.Fatalf("unlinkSame() error = %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("file still there: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	v := openVault(t)
+	path := filepath.Join(t.TempDir(), "infected")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	item, err := v.Add(path, "Eicar-Test-Signature", lstat(path))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if err := v.Delete(item.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if items, _ := v.List(); len(items) != 0 {
+		t.Errorf("List() = %+v after Delete", items)
+	}
+	if _, err := os.Stat(v.blobPath(item.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Error("vault copy left behind")
+	}
+	if err := v.Delete(item.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete twice: %v, want ErrNotFound", err)
+	}
+	if _, err := v.Restore("nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Restore unknown: %v, want ErrNotFound", err)
+	}
+}
+
+func TestOpenKeepsKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "vault")
+	v, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "infected")
+	os.WriteFile(path, []byte("EICAR"), 0644)
+	item, err := v.Add(path, "Eicar-Test-Signature", lstat(path))
+	v.Close()
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// reopened, it can still decrypt what it holds
+	v, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if _, err := v.Restore(item.ID); err != nil {
+		t.Fatalf("Restore after reopening: %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "EICAR" {
+		t.Errorf("restored %q", got)
+	}
+}
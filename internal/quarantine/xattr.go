@@ -0,0 +1,53 @@
+// oreon/defense · watchthelight <wtl>
+
+package quarantine
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// getXattrs reads a file's extended attributes. Filesystems without
+// them just have none.
+func getXattrs(fd int) (map[string][]byte, error) {
+	size, err := unix.Flistxattr(fd, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Flistxattr(fd, buf); err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := unix.Fgetxattr(fd, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, n)
+		if n, err = unix.Fgetxattr(fd, string(name), val); err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = val[:n]
+	}
+	return attrs, nil
+}
+
+// setXattrs puts extended attributes back on a file.
+func setXattrs(fd int, attrs map[string][]byte) error {
+	for name, val := range attrs {
+		if err := unix.Fsetxattr(fd, name, val, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
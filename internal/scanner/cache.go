@@ -0,0 +1,176 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// VerdictCache remembers files clamd found clean, so scans can skip them
+// until they change or the signatures do. It is kept in SQLite, so it
+// lasts across restarts, and is safe for concurrent use.
+type VerdictCache struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	version string // the signatures verdicts hold for; "" until Refresh
+}
+
+// OpenVerdictCache opens the cache at path, creating it on first use.
+func OpenVerdictCache(path string) (*VerdictCache, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// one writer at a time, rather than have the workers see SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if err := createCacheSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &VerdictCache{db: db}, nil
+}
+
+// Close closes the cache.
+func (c *VerdictCache) Close() error {
+	return c.db.Close()
+}
+
+func createCacheSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	PRAGMA journal_mode = WAL;
+	PRAGMA synchronous = NORMAL;
+	CREATE TABLE IF NOT EXISTS meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS clean (
+		dev INTEGER NOT NULL,
+		ino INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		mtime INTEGER NOT NULL,
+		ctime INTEGER NOT NULL,
+		checked_at DATETIME NOT NULL,
+		PRIMARY KEY (dev, ino)
+	);
+	`)
+	return err
+}
+
+// cacheMaxAge is how long a verdict is trusted even if the signatures
+// don't change, so files are looked at afresh now and then and entries
+// for files long gone don't pile up.
+const cacheMaxAge = 30 * 24 * time.Hour
+
+// Refresh sets the signature version verdicts are for, e.g. clamd's
+// VERSION reply. Verdicts recorded under any other version, or longer
+// ago than cacheMaxAge, are dropped. An empty version turns the cache
+// off until the next Refresh, leaving what's stored alone.
+func (c *VerdictCache) Refresh(version string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version == "" {
+		c.version = ""
+		return nil
+	}
+	if _, err := c.db.Exec(`DELETE FROM clean WHERE checked_at < ?`, time.Now().UTC().Add(-cacheMaxAge)); err != nil {
+		return fmt.Errorf("prune cache: %w", err)
+	}
+	if version == c.version {
+		return nil
+	}
+	c.version = ""
+
+	var stored string
+	err := c.db.QueryRow(`SELECT value FROM meta WHERE key = 'version'`).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("read cache version: %w", err)
+	}
+	if stored != version {
+		tx, err := c.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`DELETE FROM clean`); err != nil {
+			return fmt.Errorf("clear cache: %w", err)
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES ('version', ?)`, version); err != nil {
+			return fmt.Errorf("store cache version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	c.version = version
+	return nil
+}
+
+// cacheKey is what a file's verdict is kept under: any write changes
+// the size, mtime or ctime.
+type cacheKey struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime int64 // in nanoseconds
+}
+
+func cacheKeyOf(fi fs.FileInfo) (cacheKey, bool) {
+	if fi == nil {
+		return cacheKey{}, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return cacheKey{}, false
+	}
+	return cacheKey{uint64(st.Dev), st.Ino, st.Size, st.Mtim.Nano(), st.Ctim.Nano()}, true
+}
+
+// unchanged reports whether two looks at a file found it the same.
+func unchanged(before, after fs.FileInfo) bool {
+	a, ok := cacheKeyOf(before)
+	b, ok2 := cacheKeyOf(after)
+	return ok && ok2 && a == b
+}
+
+// ready reports whether verdicts can be trusted: not before Refresh, nor
+// after one that failed.
+func (c *VerdictCache) ready() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version != ""
+}
+
+// Clean reports whether the file was found clean as it is now, under
+// the current signatures.
+func (c *VerdictCache) Clean(fi fs.FileInfo) bool {
+	key, ok := cacheKeyOf(fi)
+	if !ok || !c.ready() {
+		return false
+	}
+	var n int
+	err := c.db.QueryRow(`
+		SELECT COUNT(*) FROM clean
+		WHERE dev = ? AND ino = ? AND size = ? AND mtime = ? AND ctime = ?`,
+		int64(key.dev), int64(key.ino), key.size, key.mtime, key.ctime).Scan(&n)
+	return err == nil && n > 0
+}
+
+// Add remembers that the file is clean.
+func (c *VerdictCache) Add(fi fs.FileInfo) error {
+	key, ok := cacheKeyOf(fi)
+	if !ok || !c.ready() {
+		return nil
+	}
+	_, err := c.db.Exec(`
+		INSERT OR REPLACE INTO clean (dev, ino, size, mtime, ctime, checked_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		int64(key.dev), int64(key.ino), key.size, key.mtime, key.ctime, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,98 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestCache(t *testing.T, path string) *VerdictCache {
+	t.Helper()
+	c, err := OpenVerdictCache(path)
+	if err != nil {
+		t.Fatalf("OpenVerdictCache: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestVerdictCache(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "cache.db")
+	c := openTestCache(t, dbPath)
+	file := filepath.Join(t.TempDir(), "a")
+	os.WriteFile(file, []byte("a"), 0644)
+	fi, _ := os.Stat(file)
+
+	// nothing is trusted before the signature version is known
+	c.Add(fi)
+	if c.Clean(fi) {
+		t.Error("Clean() before Refresh")
+	}
+
+	if err := c.Refresh("v1"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Clean(fi) {
+		t.Error("unseen file is clean")
+	}
+	if err := c.Add(fi); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Clean(fi) {
+		t.Error("file not remembered as clean")
+	}
+
+	// it lasts, as long as the signatures do
+	c.Close()
+	c = openTestCache(t, dbPath)
+	c.Refresh("v1")
+	if !c.Clean(fi) {
+		t.Error("verdict lost on reopening")
+	}
+	c.Refresh("")
+	if c.Clean(fi) {
+		t.Error("Clean() with the signature version unknown")
+	}
+	c.Refresh("v1")
+	if !c.Clean(fi) {
+		t.Error("an unknown version cleared the cache")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	os.WriteFile(file, []byte("b"), 0644)
+	changed, _ := os.Stat(file)
+	if c.Clean(changed) {
+		t.Error("changed file still clean")
+	}
+
+	c.Refresh("v2")
+	c.Refresh("v1")
+	if c.Clean(fi) {
+		t.Error("verdict outlived a signature update")
+	}
+}
+
+func TestVerdictCache_Prune(t *testing.T) {
+	c := openTestCache(t, filepath.Join(t.TempDir(), "cache.db"))
+	file := filepath.Join(t.TempDir(), "a")
+	os.WriteFile(file, []byte("a"), 0644)
+	fi, _ := os.Stat(file)
+	c.Refresh("v1")
+	c.Add(fi)
+
+	c.db.Exec(`UPDATE clean SET checked_at = ?`, time.Now().UTC().Add(-cacheMaxAge-time.Hour))
+	if err := c.Refresh("v1"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Clean(fi) {
+		t.Error("verdict older than cacheMaxAge still trusted")
+	}
+	var n int
+	c.db.QueryRow(`SELECT COUNT(*) FROM clean`).Scan(&n)
+	if n != 0 {
+		t.Errorf("%d rows left after pruning", n)
+	}
+}
@@ -4,22 +4,117 @@ package scanner
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 // ClamAV provides an interface to the ClamAV daemon.
 type ClamAV struct {
 	socketPath string
+	mode       Mode
+	streamMax  int64 // clamd's StreamMaxLength
+	poolSize   int
+	sessions   *pool // nil when every file gets its own connection
+
+	// who clamd runs as, looked up on first use; nil until then or after
+	// clamd went away
+	identMu sync.Mutex
+	ident   *Identity
+}
+
+// Mode selects how files reach clamd.
+type Mode int
+
+const (
+	// ModeAuto sends a path when clamd can open the file itself and the
+	// contents when it can't.
+	ModeAuto Mode = iota
+	// ModeScan always sends the path; clamd opens the file.
+	ModeScan
+	// ModeStream always sends the contents with INSTREAM.
+	ModeStream
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeAuto:
+		return "auto"
+	case ModeScan:
+		return "scan"
+	case ModeStream:
+		return "instream"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseMode parses a mode name as used in the config.
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "auto":
+		return ModeAuto, nil
+	case "scan":
+		return ModeScan, nil
+	case "instream":
+		return ModeStream, nil
+	}
+	return ModeAuto, fmt.Errorf("unknown clamd mode %q", s)
+}
+
+// Option configures a ClamAV scanner.
+type Option func(*ClamAV)
+
+// WithMode sets how files are sent to clamd. Defaults to ModeAuto.
+func WithMode(m Mode) Option {
+	return func(c *ClamAV) {
+		c.mode = m
+	}
+}
+
+// WithStreamMaxLength sets the most clamd accepts over INSTREAM. It has to
+// match StreamMaxLength in clamd.conf; larger files aren't streamed.
+func WithStreamMaxLength(n int64) Option {
+	return func(c *ClamAV) {
+		c.streamMax = n
+	}
+}
+
+// WithSessions sets how many IDSESSION connections are kept open to
+// clamd. Zero dials a new connection for every file instead. Defaults to
+// DefaultSessions.
+func WithSessions(n int) Option {
+	return func(c *ClamAV) {
+		c.poolSize = n
+	}
 }
 
 // New creates a new ClamAV scanner instance.
-func New(socketPath string) *ClamAV {
-	return &ClamAV{
+func New(socketPath string, opts ...Option) *ClamAV {
+	c := &ClamAV{
 		socketPath: socketPath,
+		streamMax:  DefaultStreamMaxLength,
+		poolSize:   DefaultSessions,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.poolSize > 0 {
+		c.sessions = newPool(c.poolSize, c.connect)
+	}
+	return c
+}
+
+// Close ends the scanner's sessions with clamd. Scanning again reconnects.
+func (c *ClamAV) Close() {
+	if c.sessions != nil {
+		c.sessions.close()
 	}
 }
 
@@ -37,18 +132,89 @@ type ScanResult struct {
 	Clean     bool
 	Threat    string
 	Error     error
+	Streamed  bool // the contents were sent with INSTREAM rather than the path
 	ScannedAt time.Time
+
+	// Info is the file as the walk or on-access event found it, so
+	// whatever is done about a threat can make sure it's the same file.
+	// Nil if unknown.
+	Info fs.FileInfo
 }
 
-// Ping sends a PING command to clamd and expects PONG.
-func (c *ClamAV) Ping() error {
+// scanTimeout bounds how long clamd may take over one file.
+const scanTimeout = 60 * time.Second
+
+// connect opens a connection to clamd.
+func (c *ClamAV) connect() (net.Conn, error) {
 	conn, err := net.DialTimeout("unix", c.socketPath, 5*time.Second)
 	if err != nil {
-		return fmt.Errorf("connect to clamd: %w", err)
+		return nil, fmt.Errorf("connect to clamd: %w", err)
+	}
+	return conn, nil
+}
+
+// dial connects to clamd, giving the whole exchange timeout to finish.
+func (c *ClamAV) dial(timeout time.Duration) (net.Conn, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return conn, nil
+}
+
+// command sends cmd, then whatever body writes, and returns clamd's reply.
+// Errors are about reaching clamd; what clamd thought of the file is in
+// the reply.
+func (c *ClamAV) command(cmd string, body func(io.Writer) error) (string, error) {
+	var reply string
+	var err error
+	if c.sessions == nil {
+		reply, err = c.commandOnce(cmd, body)
+	} else {
+		reply, err = c.sessions.do(cmd, body, scanTimeout)
+		if errors.Is(err, errSessionLost) {
+			// clamd closes idle sessions and may have restarted; the
+			// command never got an answer, so send it again once
+			reply, err = c.sessions.do(cmd, body, scanTimeout)
+		}
+	}
+	if err != nil {
+		c.forgetIdentity()
+	}
+	return reply, err
+}
+
+// commandOnce sends cmd over a connection of its own.
+func (c *ClamAV) commandOnce(cmd string, body func(io.Writer) error) (string, error) {
+	conn, err := c.dial(scanTimeout)
+	if err != nil {
+		return "", err
 	}
 	defer conn.Close()
 
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "n%s\n", cmd); err != nil {
+		return "", fmt.Errorf("send %s command: %w", strings.Fields(cmd)[0], err)
+	}
+	if body != nil {
+		if err := body(conn); err != nil {
+			return "", err
+		}
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("read scan response: %w", err)
+	}
+	return response, nil
+}
+
+// Ping sends a PING command to clamd and expects PONG.
+func (c *ClamAV) Ping() error {
+	conn, err := c.dial(5 * time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
 	_, err = conn.Write([]byte("PING\n"))
 	if err != nil {
@@ -68,37 +234,82 @@ func (c *ClamAV) Ping() error {
 	return nil
 }
 
+// Version returns clamd's VERSION reply, which names the engine and
+// signature versions, e.g. "ClamAV 1.4.1/27480/Sun Dec  1 09:45:02 2024".
+// It changes whenever the signatures are updated.
+func (c *ClamAV) Version() (string, error) {
+	reply, err := c.commandOnce("VERSION", nil)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSpace(reply)
+	if !strings.HasPrefix(reply, "ClamAV ") {
+		return "", fmt.Errorf("unexpected VERSION reply: %s", reply)
+	}
+	return reply, nil
+}
+
 // ScanFile scans a single file using clamd.
 func (c *ClamAV) ScanFile(path string) *ScanResult {
-	result := &ScanResult{
-		Path:      path,
-		ScannedAt: time.Now(),
+	return c.ScanWalked(path, nil)
+}
+
+// ScanWalked scans path as long as it is still the file want describes,
+// so a file swapped for another after the walk isn't what gets the
+// verdict. A nil want scans whatever is there.
+func (c *ClamAV) ScanWalked(path string, want fs.FileInfo) *ScanResult {
+	switch c.mode {
+	case ModeScan:
+		return c.scanPath(path, want)
+	case ModeStream:
+		return c.scanStream(path, want)
 	}
 
-	conn, err := net.DialTimeout("unix", c.socketPath, 5*time.Second)
-	if err != nil {
-		result.Error = fmt.Errorf("connect to clamd: %w", err)
-		return result
+	// a newline would end the SCAN command early
+	if !strings.ContainsAny(path, "\n\x00") && c.clamdCanRead(path) {
+		result := c.scanPath(path, want)
+		// ACLs and SELinux can still say no where the mode bits said yes
+		if !errors.Is(result.Error, errAccessDenied) {
+			return result
+		}
 	}
-	defer conn.Close()
+	return c.scanStream(path, want)
+}
 
-	// Use longer timeout for scanning
-	conn.SetDeadline(time.Now().Add(60 * time.Second))
+// errReplaced is set on results for files that aren't the one the caller
+// found.
+var errReplaced = errors.New("file was replaced before it was scanned")
 
-	// Send SCAN command with file path
-	_, err = fmt.Fprintf(conn, "SCAN %s\n", path)
-	if err != nil {
-		result.Error = fmt.Errorf("send SCAN command: %w", err)
-		return result
+// scanPath has clamd open and scan the file itself. clamd goes by the
+// path, so the best it can do is look afterwards that the file is still
+// want.
+func (c *ClamAV) scanPath(path string, want fs.FileInfo) *ScanResult {
+	result := &ScanResult{
+		Path:      path,
+		ScannedAt: time.Now(),
 	}
 
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	response, err := c.command("SCAN "+path, nil)
 	if err != nil {
-		result.Error = fmt.Errorf("read scan response: %w", err)
+		result.Error = err
 		return result
 	}
+	parseReply(result, response)
+	if fi, err := os.Lstat(path); err == nil && result.Error == nil {
+		if want != nil && !os.SameFile(fi, want) {
+			result.Error = errReplaced
+		} else {
+			result.Info = fi
+		}
+	}
+	return result
+}
+
+// errAccessDenied is set on results where clamd couldn't open the file.
+var errAccessDenied = errors.New("clamd can't read the file")
 
+// parseReply fills in result from a clamd reply line.
+func parseReply(result *ScanResult, response string) {
 	// Parse response: "/path: OK" or "/path: ThreatName FOUND"
 	response = strings.TrimSpace(response)
 	if strings.HasSuffix(response, " OK") {
@@ -112,8 +323,10 @@ func (c *ClamAV) ScanFile(path string) *ScanResult {
 		}
 		result.Clean = false
 	} else if strings.Contains(response, "ERROR") {
-		result.Error = fmt.Errorf("clamd error: %s", response)
+		if strings.Contains(response, "Access denied") || strings.Contains(response, "Permission denied") {
+			result.Error = fmt.Errorf("%w: %s", errAccessDenied, response)
+		} else {
+			result.Error = fmt.Errorf("clamd error: %s", response)
+		}
 	}
-
-	return result
 }
@@ -25,7 +25,7 @@ func TestIsAvailable_NoSocket(t *testing.T) {
 }
 
 // mockClamdServer creates a mock ClamAV daemon for testing
-func mockClamdServer(t *testing.T, handler func(conn net.Conn)) (string, func()) {
+func mockClamdServer(t testing.TB, handler func(conn net.Conn)) (string, func()) {
 	t.Helper()
 
 	dir := t.TempDir()
@@ -98,7 +98,8 @@ func TestScanFile_Clean(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "clean.txt")
 	os.WriteFile(tmpFile, []byte("clean content"), 0644)
 
-	scanner := New(sockPath)
+	// the mock only speaks one command per connection
+	scanner := New(sockPath, WithSessions(0))
 	result := scanner.ScanFile(tmpFile)
 
 	if result.Error != nil {
@@ -127,7 +128,8 @@ func TestScanFile_ThreatFound(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "infected.txt")
 	os.WriteFile(tmpFile, []byte("test"), 0644)
 
-	scanner := New(sockPath)
+	// the mock only speaks one command per connection
+	scanner := New(sockPath, WithSessions(0))
 	result := scanner.ScanFile(tmpFile)
 
 	if result.Error != nil {
@@ -150,7 +152,8 @@ func TestScanFile_Error(t *testing.T) {
 	})
 	defer cleanup()
 
-	scanner := New(sockPath)
+	// the mock only speaks one command per connection
+	scanner := New(sockPath, WithSessions(0))
 	result := scanner.ScanFile("/nonexistent/file")
 
 	if result.Error == nil {
@@ -166,3 +169,22 @@ func TestScanFile_ConnectionError(t *testing.T) {
 		t.Error("ScanFile() should return error when can't connect")
 	}
 }
+
+func TestVersion(t *testing.T) {
+	const reply = "ClamAV 1.4.1/27480/Sun Dec  1 09:45:02 2024"
+	sockPath, cleanup := mockClamdServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		cmd, _ := bufio.NewReader(conn).ReadString('\n')
+		if cmd == "nVERSION\n" {
+			conn.Write([]byte(reply + "\n"))
+		} else {
+			conn.Write([]byte("UNKNOWN COMMAND\n"))
+		}
+	})
+	defer cleanup()
+
+	got, err := New(sockPath, WithSessions(0)).Version()
+	if err != nil || got != reply {
+		t.Errorf("Version() = %q, %v, want %q", got, err, reply)
+	}
+}
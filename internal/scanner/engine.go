@@ -0,0 +1,418 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileScanner scans one file. *ClamAV is the real one.
+type FileScanner interface {
+	ScanFile(path string) *ScanResult
+}
+
+// walkedScanner is a FileScanner that can make sure the file it scans is
+// the one the walk found.
+type walkedScanner interface {
+	ScanWalked(path string, want fs.FileInfo) *ScanResult
+}
+
+// Backoff says when a scan should slow down to a single worker.
+type Backoff struct {
+	OnBattery bool    // while a battery is discharging
+	MaxLoad   float64 // while the load average is above this; 0 never
+	Load      Load
+}
+
+// backoffCheck is how often the battery and load are looked at.
+const backoffCheck = 5 * time.Second
+
+// Engine scans directory trees with a bounded pool of workers.
+type Engine struct {
+	scanner     FileScanner
+	workers     int
+	lowPriority bool
+	backoff     Backoff
+	exclude     *Exclusions
+	cache       *VerdictCache
+	version     func() (string, error) // the signature version cached verdicts are for
+
+	mu        sync.Mutex
+	checked   time.Time
+	backedOff bool
+}
+
+// EngineOption configures an Engine.
+type EngineOption func(*Engine)
+
+// WithWorkers sets how many files are scanned at once. Defaults to half
+// the CPUs.
+func WithWorkers(n int) EngineOption {
+	return func(e *Engine) {
+		if n > 0 {
+			e.workers = n
+		}
+	}
+}
+
+// WithLowPriority runs the workers at nice 10 with idle IO priority.
+func WithLowPriority(on bool) EngineOption {
+	return func(e *Engine) {
+		e.lowPriority = on
+	}
+}
+
+// WithBackoff drops to one worker under the conditions in b.
+func WithBackoff(b Backoff) EngineOption {
+	return func(e *Engine) {
+		e.backoff = b
+	}
+}
+
+// WithExclusions leaves out what x excludes.
+func WithExclusions(x *Exclusions) EngineOption {
+	return func(e *Engine) {
+		e.exclude = x
+	}
+}
+
+// WithCache skips files c says are clean under the signatures version
+// returns, asked at the start of each Run. While version fails, every
+// file is scanned.
+func WithCache(c *VerdictCache, version func() (string, error)) EngineOption {
+	return func(e *Engine) {
+		e.cache = c
+		e.version = version
+	}
+}
+
+// NewEngine creates a scan engine feeding files to s.
+func NewEngine(s FileScanner, opts ...EngineOption) *Engine {
+	e := &Engine{
+		scanner: s,
+		workers: max(runtime.NumCPU()/2, 1),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// RunOption adjusts a single Run or Count.
+type RunOption func(*runOptions)
+
+type runOptions struct {
+	as *Identity
+}
+
+// AsUser leaves out what id couldn't read itself, for scans run on
+// someone's behalf. The roots are checked like everything under them.
+func AsUser(id *Identity) RunOption {
+	return func(o *runOptions) {
+		o.as = id
+	}
+}
+
+// Stats counts what a scan got through.
+type Stats struct {
+	Scanned int   // files clamd, or the cache, gave a verdict on
+	Bytes   int64 // their total size
+	Threats int
+	Errors  int // files that couldn't be scanned
+	Skipped int // files and directories left out by the exclusions
+
+	CacheHits   int // files the cache said were still clean
+	CacheMisses int // files scanned with the cache on
+}
+
+// Run scans every regular file under paths, passing each verdict and the
+// file's size to report, which is called from several workers at once.
+// Unreadable directories and files that can't be scanned are skipped. If
+// ctx is cancelled Run stops early, returning what it got through and
+// ctx's error.
+func (e *Engine) Run(ctx context.Context, paths []string, report func(result *ScanResult, size int64), opts ...RunOption) (Stats, error) {
+	cache := e.refreshCache()
+	files := make(chan walkedFile)
+	var skipped int
+	go func() {
+		defer close(files)
+		skipped, _ = e.walk(ctx, paths, runOpts(opts), func(f walkedFile) error {
+			select {
+			case files <- f:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	var mu sync.Mutex
+	var stats Stats
+	var wg sync.WaitGroup
+	for i := range e.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e.lowPriority {
+				// never unlocked, so the thread exits with the goroutine
+				runtime.LockOSThread()
+				lowerPriority()
+			}
+			for f := range files {
+				// backing off leaves the first worker going alone
+				if i > 0 && !e.waitBackoff(ctx) {
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				size := f.size
+				if cache != nil && cache.Clean(f.info) {
+					mu.Lock()
+					stats.CacheHits++
+					stats.Scanned++
+					stats.Bytes += size
+					mu.Unlock()
+					report(&ScanResult{Path: f.path, Clean: true, ScannedAt: time.Now(), Info: f.info}, size)
+					continue
+				}
+				result := e.scan(f.path, f.info)
+				// only remember a file that didn't change between the walk
+				// and the end of its scan
+				if cache != nil && result.Error == nil && result.Clean && unchanged(f.info, result.Info) {
+					cache.Add(result.Info)
+				}
+
+				mu.Lock()
+				if cache != nil {
+					stats.CacheMisses++
+				}
+				switch {
+				case result.Error != nil:
+					stats.Errors++
+				case !result.Clean:
+					stats.Threats++
+					fallthrough
+				default:
+					stats.Scanned++
+					stats.Bytes += size
+				}
+				mu.Unlock()
+				if result.Error == nil {
+					if result.Info == nil {
+						result.Info = f.info
+					}
+					report(result, size)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// let the walker see the cancellation and finish
+	for range files {
+	}
+	stats.Skipped = skipped
+	return stats, ctx.Err()
+}
+
+// scan scans one walked file, through ScanWalked if the scanner has it.
+// The result's Info is whatever the scanner saw, if it says.
+func (e *Engine) scan(path string, info fs.FileInfo) *ScanResult {
+	if s, ok := e.scanner.(walkedScanner); ok {
+		return s.ScanWalked(path, info)
+	}
+	return e.scanner.ScanFile(path)
+}
+
+// refreshCache brings the cache up to date with the signatures,
+// returning nil if it can't be used this time.
+func (e *Engine) refreshCache() *VerdictCache {
+	if e.cache == nil {
+		return nil
+	}
+	version, err := e.version()
+	if err != nil {
+		version = ""
+	}
+	if err := e.cache.Refresh(version); err != nil || version == "" {
+		return nil
+	}
+	return e.cache
+}
+
+// Count adds up the files and bytes Run would scan under paths, without
+// scanning them. It is much faster than Run, so running it alongside
+// gives the scan a total to measure progress against.
+func (e *Engine) Count(ctx context.Context, paths []string, opts ...RunOption) (files int, bytes int64, err error) {
+	_, err = e.walk(ctx, paths, runOpts(opts), func(f walkedFile) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		files++
+		bytes += f.size
+		return nil
+	})
+	return files, bytes, err
+}
+
+func runOpts(opts []RunOption) runOptions {
+	var o runOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// walkedFile is a file found by the walk, on its way to a worker.
+type walkedFile struct {
+	path string
+	size int64
+	info fs.FileInfo // nil if it couldn't be had
+}
+
+// walk passes each regular file under paths to fn, leaving out excluded
+// paths and anything it can't read, and returns how many files and
+// directories the exclusions left out. Mount points below a root that
+// the exclusions skip aren't crossed, and a filesystem bind-mounted in
+// more than one place is only walked once. It stops at the first error
+// from fn.
+func (e *Engine) walk(ctx context.Context, paths []string, o runOptions, fn func(walkedFile) error) (skipped int, err error) {
+	if e.exclude != nil {
+		// without mountinfo the fixed pseudo-filesystem paths still apply
+		e.exclude.Refresh()
+	}
+	seen := make(map[fileID]bool) // roots and mount points walked so far
+	for _, root := range outermost(paths) {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // skip inaccessible paths
+			}
+			if d.IsDir() {
+				if o.as != nil {
+					if info, err := d.Info(); err != nil || !o.as.CanList(info) {
+						return filepath.SkipDir
+					}
+				}
+				if e.exclude == nil {
+					return nil
+				}
+				if e.exclude.SkipDir(path) || (path != root && e.exclude.SkipMount(path)) {
+					skipped++
+					return filepath.SkipDir
+				}
+				if path == root || e.exclude.IsMount(path) {
+					if id, ok := statID(path); ok {
+						if seen[id] {
+							return filepath.SkipDir
+						}
+						seen[id] = true
+					}
+				}
+				return nil
+			}
+			// devices and fifos would never finish streaming
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			var size int64
+			info, err := d.Info()
+			if err == nil {
+				if o.as != nil && !o.as.CanReadFile(info) {
+					return nil
+				}
+				size = info.Size()
+			} else if o.as != nil {
+				return nil
+			}
+			if e.exclude != nil && e.exclude.SkipFile(path, size) {
+				skipped++
+				return nil
+			}
+			return fn(walkedFile{path, size, info})
+		})
+		if err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, ctx.Err()
+}
+
+// fileID identifies a directory across the places it's mounted.
+type fileID struct {
+	dev, ino uint64
+}
+
+// statID returns path's device and inode.
+func statID(path string) (fileID, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return fileID{}, false
+	}
+	return fileID{uint64(st.Dev), st.Ino}, true
+}
+
+// outermost cleans paths and drops any that lie under another, so
+// overlapping roots aren't walked twice.
+func outermost(paths []string) []string {
+	var roots []string
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		covered := false
+		for _, q := range paths {
+			q = filepath.Clean(q)
+			if q != p && within(p, q) {
+				covered = true
+				break
+			}
+		}
+		if !covered && !slices.Contains(roots, p) {
+			roots = append(roots, p)
+		}
+	}
+	return roots
+}
+
+// waitBackoff blocks while the scan should be backing off. It returns
+// false if ctx is cancelled first.
+func (e *Engine) waitBackoff(ctx context.Context) bool {
+	for e.backingOff() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoffCheck):
+		}
+	}
+	return true
+}
+
+// backingOff reports whether the battery or load call for backing off,
+// looking again at most every backoffCheck.
+func (e *Engine) backingOff() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.checked) < backoffCheck {
+		return e.backedOff
+	}
+	e.checked = time.Now()
+
+	b := e.backoff
+	e.backedOff = false
+	if b.OnBattery {
+		if on, err := b.Load.OnBattery(); err == nil && on {
+			e.backedOff = true
+		}
+	}
+	if b.MaxLoad > 0 && !e.backedOff {
+		if avg, err := b.Load.Average(); err == nil && avg > b.MaxLoad {
+			e.backedOff = true
+		}
+	}
+	return e.backedOff
+}
@@ -0,0 +1,265 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// countingScanner records how many scans run at once. Files named
+// "infected*" are threats and "broken*" can't be scanned.
+type countingScanner struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	running int
+	most    int
+	paths   []string
+}
+
+func (s *countingScanner) ScanFile(path string) *ScanResult {
+	s.mu.Lock()
+	s.running++
+	s.most = max(s.most, s.running)
+	s.paths = append(s.paths, path)
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+
+	fi, _ := os.Lstat(path)
+	result := &ScanResult{Path: path, Clean: true, Info: fi}
+	switch name := filepath.Base(path); {
+	case strings.HasPrefix(name, "infected"):
+		result.Clean, result.Threat = false, "Eicar-Test-Signature"
+	case strings.HasPrefix(name, "broken"):
+		result.Clean, result.Error = false, errors.New("clamd error")
+	}
+	return result
+}
+
+// makeTree creates n clean files spread over a few directories, plus the
+// named extra files at the top.
+func makeTree(t *testing.T, n int, extra ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for i := range n {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i%3))
+		os.MkdirAll(dir, 0755)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range extra {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestEngine_Run(t *testing.T) {
+	root := makeTree(t, 20, "infected.com", "broken.bin")
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &countingScanner{delay: 5 * time.Millisecond}
+	var mu sync.Mutex
+	var threats []string
+	stats, err := NewEngine(s, WithWorkers(4)).Run(context.Background(), []string{root}, func(r *ScanResult, _ int64) {
+		if !r.Clean {
+			mu.Lock()
+			threats = append(threats, r.Path)
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (Stats{Scanned: 21, Threats: 1, Errors: 1}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+	if len(threats) != 1 || filepath.Base(threats[0]) != "infected.com" {
+		t.Errorf("reported threats = %v", threats)
+	}
+	if len(s.paths) != 22 {
+		t.Errorf("scanned %d files, want 22 without the fifo", len(s.paths))
+	}
+	if s.most < 2 || s.most > 4 {
+		t.Errorf("%d scans at once, want 2 to 4", s.most)
+	}
+}
+
+func TestEngine_Cancel(t *testing.T) {
+	root := makeTree(t, 50)
+	s := &countingScanner{delay: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(30*time.Millisecond, cancel)
+
+	stats, err := NewEngine(s, WithWorkers(2)).Run(ctx, []string{root}, func(*ScanResult, int64) {})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() error = %v, want context.Canceled", err)
+	}
+	if stats.Scanned == 0 || stats.Scanned >= 50 {
+		t.Errorf("scanned %d of 50 files before cancelling", stats.Scanned)
+	}
+}
+
+func TestEngine_CountAndExclusions(t *testing.T) {
+	root := makeTree(t, 9, "skip.me")
+	if err := os.WriteFile(filepath.Join(root, "dir0", "file0"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	x, err := NewExclusions(ExclusionRules{Paths: []string{
+		filepath.Join(root, "dir1") + "/",
+		filepath.Join(root, "skip.me"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(&countingScanner{}, WithExclusions(x))
+
+	files, bytes, err := e.Count(context.Background(), []string{root})
+	if err != nil || files != 6 || bytes != 100 {
+		t.Errorf("Count() = %d files, %d bytes, %v; want 6, 100", files, bytes, err)
+	}
+	stats, err := e.Run(context.Background(), []string{root}, func(*ScanResult, int64) {})
+	if err != nil || stats.Scanned != files || stats.Bytes != bytes || stats.Skipped != 2 {
+		t.Errorf("Run() = %+v, %v; want what Count found and 2 skipped", stats, err)
+	}
+}
+
+func TestEngine_AsUser(t *testing.T) {
+	root := makeTree(t, 3, "public")
+	for _, d := range []string{root, filepath.Join(root, "dir0"), filepath.Join(root, "dir2")} {
+		os.Chmod(d, 0755)
+	}
+	os.Chmod(filepath.Join(root, "dir1"), 0700)
+	os.Chmod(filepath.Join(root, "dir0", "file0"), 0644)
+	os.Chmod(filepath.Join(root, "dir2", "file2"), 0600)
+	os.Chmod(filepath.Join(root, "public"), 0644)
+
+	s := &countingScanner{}
+	someone := &Identity{uid: 54321, groups: []uint32{54321}}
+	stats, err := NewEngine(s).Run(context.Background(), []string{root}, func(*ScanResult, int64) {}, AsUser(someone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(s.paths)
+	want := []string{filepath.Join(root, "dir0", "file0"), filepath.Join(root, "public")}
+	if !slices.Equal(s.paths, want) || stats.Scanned != 2 {
+		t.Errorf("scanned %v, want only %v", s.paths, want)
+	}
+}
+
+func TestEngine_Backoff(t *testing.T) {
+	load := fakeLoad(t, "Discharging", "0.10 0.20 0.30 1/100 1234\n")
+	root := makeTree(t, 12)
+	s := &countingScanner{delay: 5 * time.Millisecond}
+
+	e := NewEngine(s, WithWorkers(4), WithBackoff(Backoff{OnBattery: true, Load: load}))
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	e.Run(ctx, []string{root}, func(*ScanResult, int64) {})
+	if s.most != 1 {
+		t.Errorf("%d scans at once on battery, want 1", s.most)
+	}
+}
+
+func TestEngine_LowPriority(t *testing.T) {
+	before, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := makeTree(t, 4)
+	s := &countingScanner{}
+	stats, err := NewEngine(s, WithWorkers(2), WithLowPriority(true)).Run(context.Background(), []string{root}, func(*ScanResult, int64) {})
+	if err != nil || stats.Scanned != 4 {
+		t.Errorf("Run() = %+v, %v", stats, err)
+	}
+	// the workers' threads are gone, so this one is untouched
+	if prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0); err != nil || prio != before {
+		t.Errorf("priority = %d, %v; want %d as before", prio, err, before)
+	}
+}
+
+func TestEngine_Cache(t *testing.T) {
+	root := makeTree(t, 10, "infected.com", "broken.bin")
+	cache := openTestCache(t, filepath.Join(t.TempDir(), "cache.db"))
+	version, versionErr := "v1", error(nil)
+	s := &countingScanner{}
+	e := NewEngine(s, WithWorkers(2), WithCache(cache, func() (string, error) {
+		return version, versionErr
+	}))
+	run := func() Stats {
+		t.Helper()
+		s.paths = nil
+		stats, err := e.Run(context.Background(), []string{root}, func(*ScanResult, int64) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	if stats := run(); stats.CacheHits != 0 || stats.CacheMisses != 12 {
+		t.Errorf("first run: %d hits, %d misses, want 0 and 12", stats.CacheHits, stats.CacheMisses)
+	}
+	// only what wasn't found clean is scanned again
+	stats := run()
+	if stats.CacheHits != 10 || stats.CacheMisses != 2 || stats.Scanned != 11 || stats.Threats != 1 {
+		t.Errorf("second run: %+v", stats)
+	}
+	if len(s.paths) != 2 {
+		t.Errorf("scanned %v again, want only the infected and broken files", s.paths)
+	}
+
+	version = "v2"
+	if stats := run(); stats.CacheHits != 0 {
+		t.Errorf("%d hits after the signatures changed", stats.CacheHits)
+	}
+
+	versionErr = errors.New("clamd down")
+	if stats := run(); stats.CacheHits != 0 || stats.CacheMisses != 0 || len(s.paths) != 12 {
+		t.Errorf("without a version: %+v, scanned %d", stats, len(s.paths))
+	}
+}
+
+// rewritingScanner changes each file while it's being scanned.
+type rewritingScanner struct{}
+
+func (rewritingScanner) ScanFile(path string) *ScanResult {
+	os.WriteFile(path, []byte("rewritten"), 0644)
+	fi, _ := os.Lstat(path)
+	return &ScanResult{Path: path, Clean: true, Info: fi}
+}
+
+func TestEngine_CacheChangedDuringScan(t *testing.T) {
+	root := makeTree(t, 3)
+	cache := openTestCache(t, filepath.Join(t.TempDir(), "cache.db"))
+	e := NewEngine(rewritingScanner{}, WithCache(cache, func() (string, error) {
+		return "v1", nil
+	}))
+	if _, err := e.Run(context.Background(), []string{root}, func(*ScanResult, int64) {}); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	cache.db.QueryRow(`SELECT COUNT(*) FROM clean`).Scan(&n)
+	if n != 0 {
+		t.Errorf("cached %d files that changed while they were scanned", n)
+	}
+}
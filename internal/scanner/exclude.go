@@ -0,0 +1,228 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// pseudoFS are always skipped, whatever mountinfo says: their files are
+// generated by the kernel and reading some of them never finishes.
+var pseudoFS = []string{"/proc", "/sys", "/dev"}
+
+// DefaultSkipFSTypes are the filesystem types skipped when the config
+// doesn't name any. tmpfs isn't one of them since /tmp often is.
+var DefaultSkipFSTypes = []string{
+	"proc", "sysfs", "devtmpfs", "devpts", "cgroup", "cgroup2",
+	"securityfs", "debugfs", "tracefs", "pstore", "bpf", "configfs",
+	"fusectl", "mqueue", "hugetlbfs", "autofs", "binfmt_misc",
+	"efivarfs", "selinuxfs",
+}
+
+// MountInfo is where the mounts to skip by type are read from.
+const MountInfo = "/proc/self/mountinfo"
+
+// ExclusionRules configures Exclusions.
+//
+// Each of Paths is one of:
+//
+//	/var/cache           a path, skipped with everything under it
+//	**/node_modules/**   a glob, where ** matches any number of directories
+//	*.iso                a glob without a slash, matched against the base name
+//	re:\.vmdk$           a regular expression matched against the full path
+type ExclusionRules struct {
+	Paths       []string
+	MaxFileSize int64    // larger files are skipped; 0 for no limit
+	FSTypes     []string // mounts of these types are skipped
+	Cross       []string // Mount* categories to scan; the rest are skipped
+	MountInfo   string   // defaults to MountInfo
+}
+
+// Exclusions decides which paths a scan leaves out. It is safe for
+// concurrent use.
+type Exclusions struct {
+	paths     *PathRules
+	maxSize   int64
+	fsTypes   map[string]bool
+	cross     map[string]bool
+	mountInfo string
+
+	// from the last Refresh
+	mu          sync.RWMutex
+	mountPoints map[string]bool
+	skipMounts  map[string]bool // see SkipMount
+}
+
+// NewExclusions compiles the rules. Bad regular expressions and globs are
+// reported in the error, and the Exclusions returned applies the rest.
+func NewExclusions(r ExclusionRules) (*Exclusions, error) {
+	paths, err := NewPathRules(append(append([]string{}, pseudoFS...), r.Paths...))
+	x := &Exclusions{
+		paths:     paths,
+		maxSize:   r.MaxFileSize,
+		fsTypes:   make(map[string]bool),
+		cross:     make(map[string]bool),
+		mountInfo: r.MountInfo,
+	}
+	for _, c := range r.Cross {
+		x.cross[c] = true
+	}
+	if x.mountInfo == "" {
+		x.mountInfo = MountInfo
+	}
+	for _, t := range r.FSTypes {
+		x.fsTypes[t] = true
+	}
+	return x, err
+}
+
+// Refresh rereads the mount table. Scans call it before walking, so
+// filesystems mounted since are picked up. Without a readable mountinfo
+// only the fixed pseudo-filesystem paths are skipped.
+func (x *Exclusions) Refresh() error {
+	mounts, err := ReadMountInfo(x.mountInfo)
+	if err != nil {
+		return err
+	}
+	points := make(map[string]bool)
+	skip := bindDuplicates(mounts)
+	for _, m := range mounts {
+		points[m.Point] = true
+		if c := m.Category(); x.fsTypes[m.FSType] || (c != "" && !x.cross[c]) {
+			skip[m.Point] = true
+		}
+		if !x.cross[MountOverlay] {
+			for _, dir := range m.LowerDirs() {
+				skip[filepath.Clean(unescapeMount(dir))] = true
+			}
+		}
+	}
+	x.mu.Lock()
+	x.mountPoints = points
+	x.skipMounts = skip
+	x.mu.Unlock()
+	return nil
+}
+
+// SkipDir reports whether a directory is left out, along with everything
+// under it, by the path rules.
+func (x *Exclusions) SkipDir(dir string) bool {
+	return x.paths.Match(dir)
+}
+
+// SkipMount reports whether dir is a mount point of a type or category
+// to leave out, a bind mount of something mounted elsewhere, or the
+// lower layer of an overlay mount.
+func (x *Exclusions) SkipMount(dir string) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.skipMounts[dir]
+}
+
+// IsMount reports whether dir is a mount point.
+func (x *Exclusions) IsMount(dir string) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.mountPoints[dir]
+}
+
+// SkipFile reports whether a file of the given size is left out.
+func (x *Exclusions) SkipFile(file string, size int64) bool {
+	if x.maxSize > 0 && size > x.maxSize {
+		return true
+	}
+	return x.paths.Match(file)
+}
+
+// PathRules matches paths against rules in the syntax of
+// ExclusionRules.Paths.
+type PathRules struct {
+	prefixes []string
+	globs    []string
+	regexps  []*regexp.Regexp
+}
+
+// NewPathRules compiles rules. Bad regular expressions and globs are
+// reported in the error, and the PathRules returned applies the rest.
+func NewPathRules(rules []string) (*PathRules, error) {
+	var errs []error
+	r := &PathRules{}
+	for _, rule := range rules {
+		switch {
+		case rule == "":
+		case strings.HasPrefix(rule, "re:"):
+			re, err := regexp.Compile(rule[len("re:"):])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("path rule %q: %w", rule, err))
+				continue
+			}
+			r.regexps = append(r.regexps, re)
+		case strings.ContainsAny(rule, "*?["):
+			if _, err := path.Match(rule, ""); err != nil {
+				errs = append(errs, fmt.Errorf("path rule %q: %w", rule, err))
+				continue
+			}
+			r.globs = append(r.globs, rule)
+		default:
+			r.prefixes = append(r.prefixes, filepath.Clean(rule))
+		}
+	}
+	return r, errors.Join(errs...)
+}
+
+// Match reports whether p is matched by a path, glob or regexp rule.
+func (r *PathRules) Match(p string) bool {
+	for _, prefix := range r.prefixes {
+		if within(p, prefix) {
+			return true
+		}
+	}
+	for _, g := range r.globs {
+		if !strings.Contains(g, "/") {
+			if ok, _ := path.Match(g, path.Base(p)); ok {
+				return true
+			}
+		} else if matchGlob(g, p) {
+			return true
+		}
+	}
+	for _, re := range r.regexps {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches name against a glob in which a ** element stands
+// for any number of directories, including none.
+func matchGlob(pattern, name string) bool {
+	return matchParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,126 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestExclusions(t *testing.T) {
+	x, err := NewExclusions(ExclusionRules{
+		Paths: []string{
+			"/var/cache/",
+			"**/node_modules/**",
+			"/home/*/.cache/**",
+			"*.iso",
+			`re:\.vmdk$`,
+		},
+		MaxFileSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := map[string]bool{
+		"/var/cache":                 true,
+		"/var/cache/dnf":             true,
+		"/var/cacheX":                false,
+		"/proc":                      true,
+		"/sys/kernel":                true,
+		"/home/me/src/node_modules":  true,
+		"/home/me/.cache":            true,
+		"/home/me/.cache/thumbnails": true,
+		"/home/me/src":               false,
+	}
+	for dir, want := range dirs {
+		if got := x.SkipDir(dir); got != want {
+			t.Errorf("SkipDir(%q) = %v, want %v", dir, got, want)
+		}
+	}
+
+	files := []struct {
+		path string
+		size int64
+		want bool
+	}{
+		{"/home/me/disk.iso", 10, true},
+		{"/home/me/vm/disk.vmdk", 10, true},
+		{"/home/me/src/node_modules/a/index.js", 10, true},
+		{"/home/me/notes.txt", 10, false},
+		{"/home/me/big.tar", 2 << 20, true},
+	}
+	for _, f := range files {
+		if got := x.SkipFile(f.path, f.size); got != f.want {
+			t.Errorf("SkipFile(%q, %d) = %v, want %v", f.path, f.size, got, f.want)
+		}
+	}
+
+	// bad rules are reported, the rest still apply
+	x, err = NewExclusions(ExclusionRules{Paths: []string{"re:(", "[a-", "*.iso"}})
+	if err == nil {
+		t.Error("NewExclusions() with bad rules succeeded")
+	}
+	if !x.SkipFile("/home/me/disk.iso", 10) {
+		t.Error("good rule dropped along with the bad ones")
+	}
+}
+
+func TestExclusions_Mounts(t *testing.T) {
+	info := filepath.Join(t.TempDir(), "mountinfo")
+	os.WriteFile(info, []byte(
+		"25 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+			"26 25 8:2 / /home rw - ext4 /dev/sda2 rw\n"+
+			"27 25 8:2 /me/shared /srv/shared rw - ext4 /dev/sda2 rw\n"+
+			"28 25 8:2 / /mnt/home rw - ext4 /dev/sda2 rw\n"+
+			"22 25 0:21 / /run rw,nosuid shared:5 - tmpfs tmpfs rw\n"+
+			"23 22 0:22 / /run/user/1000/doc rw - fuse.portal portal rw\n"+
+			"24 25 0:23 / /mnt/my\\040share rw - cifs //nas/share rw\n"+
+			"29 25 0:24 / /mnt/cd rw - iso9660 /dev/sr0 ro\n"+
+			"30 25 0:25 /@/.snapshots/1/snapshot /.snapshots/1 ro - btrfs /dev/sda3 ro\n"+
+			"31 25 0:26 / /var/lib/containers/merged rw - overlay overlay rw,lowerdir=/var/lib/containers/l1:/var/lib/containers/l2,upperdir=/u\n",
+	), 0644)
+
+	x, _ := NewExclusions(ExclusionRules{
+		FSTypes:   []string{"iso9660"},
+		Cross:     []string{MountFUSE},
+		MountInfo: info,
+	})
+	if err := x.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string]bool{
+		"/":                          false,
+		"/home":                      false,
+		"/srv/shared":                true, // bind of /home/me/shared
+		"/mnt/home":                  true, // /home again
+		"/run":                       false,
+		"/run/user/1000/doc":         false, // fuse crossed as configured
+		"/mnt/my share":              true,
+		"/mnt/cd":                    true,
+		"/.snapshots/1":              true,
+		"/var/lib/containers/merged": false,
+		"/var/lib/containers/l1":     true,
+		"/var/lib/containers/l2":     true,
+	} {
+		if got := x.SkipMount(dir); got != want {
+			t.Errorf("SkipMount(%q) = %v, want %v", dir, got, want)
+		}
+	}
+	if !x.IsMount("/home") || x.IsMount("/home/me") {
+		t.Error("IsMount wrong for /home or /home/me")
+	}
+}
+
+func TestOutermost(t *testing.T) {
+	got := outermost([]string{"/home/me", "/tmp", "/home/", "/home", "/var/tmp"})
+	want := []string{"/tmp", "/home", "/var/tmp"}
+	if !slices.Equal(got, want) {
+		t.Errorf("outermost() = %v, want %v", got, want)
+	}
+	if got := outermost([]string{"/home", "/"}); !slices.Equal(got, []string{"/"}) {
+		t.Errorf("outermost() with / = %v", got)
+	}
+}
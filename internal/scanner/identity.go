@@ -0,0 +1,132 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/oreonproject/defense/pkg/ipc"
+)
+
+// Identity is the user and groups a process runs as.
+type Identity struct {
+	uid    uint32
+	groups []uint32 // primary group first
+}
+
+// clamdIdentity asks the kernel who is on the other end of clamd's
+// socket.
+func (c *ClamAV) clamdIdentity() (*Identity, error) {
+	c.identMu.Lock()
+	defer c.identMu.Unlock()
+
+	if c.ident != nil {
+		return c.ident, nil
+	}
+
+	conn, err := c.dial(5 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	uid, groups, err := ipc.PeerCred(conn)
+	if err != nil {
+		return nil, fmt.Errorf("clamd %w", err)
+	}
+	c.ident = NewIdentity(uid, groups...)
+	return c.ident, nil
+}
+
+// NewIdentity returns the identity of a user with the given groups,
+// primary group first.
+func NewIdentity(uid uint32, groups ...uint32) *Identity {
+	return &Identity{uid: uid, groups: slices.Clone(groups)}
+}
+
+// UID returns the user ID.
+func (id *Identity) UID() uint32 {
+	return id.uid
+}
+
+// InGroup reports whether id is a member of group gid.
+func (id *Identity) InGroup(gid uint32) bool {
+	return slices.Contains(id.groups, gid)
+}
+
+// CanList reports whether id may read a directory's entries and
+// search it, going by its mode bits alone; see CanRead.
+func (id *Identity) CanList(fi os.FileInfo) bool {
+	return id.uid == 0 || (id.allowed(fi, 4) && id.allowed(fi, 1))
+}
+
+// CanReadFile reports whether id may read a file whose directory it has
+// already been let into, going by its mode bits alone.
+func (id *Identity) CanReadFile(fi os.FileInfo) bool {
+	return id.uid == 0 || id.allowed(fi, 4)
+}
+
+// forgetIdentity drops the cached identity, as clamd may come back as
+// someone else.
+func (c *ClamAV) forgetIdentity() {
+	c.identMu.Lock()
+	c.ident = nil
+	c.identMu.Unlock()
+}
+
+// clamdCanRead reports whether clamd could open path by itself. When in
+// doubt it says no, and the file is streamed instead.
+func (c *ClamAV) clamdCanRead(path string) bool {
+	id, err := c.clamdIdentity()
+	if err != nil {
+		return false
+	}
+	return id.CanRead(path)
+}
+
+// CanRead checks the mode bits on path and every directory above it the
+// way the kernel would for id. ACLs and LSMs aren't looked at.
+func (id *Identity) CanRead(path string) bool {
+	if id.uid == 0 {
+		return true
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !id.allowed(fi, 4) {
+		return false
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		fi, err := os.Stat(dir)
+		if err != nil || !id.allowed(fi, 1) {
+			return false
+		}
+		if dir == "/" {
+			return true
+		}
+	}
+}
+
+// allowed reports whether id gets the permission bit (4 read, 1 search)
+// on a file.
+func (id *Identity) allowed(fi os.FileInfo, bit uint32) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	perm := uint32(fi.Mode().Perm())
+	switch {
+	case st.Uid == id.uid:
+		return perm>>6&bit != 0
+	case slices.Contains(id.groups, st.Gid):
+		return perm>>3&bit != 0
+	}
+	return perm&bit != 0
+}
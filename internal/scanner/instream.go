@@ -0,0 +1,154 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultStreamMaxLength is clamd's own default StreamMaxLength.
+const DefaultStreamMaxLength = 25 << 20
+
+// streamChunk is how much of a file goes in each INSTREAM chunk.
+const streamChunk = 64 << 10
+
+// ErrTooLarge is set on results for files bigger than clamd accepts over
+// INSTREAM.
+var ErrTooLarge = errors.New("file exceeds clamd's StreamMaxLength")
+
+// scanStream reads the file itself and sends the contents to clamd, for
+// files clamd isn't allowed to open. It reads through one descriptor, so
+// the file checked against want is the one scanned.
+func (c *ClamAV) scanStream(path string, want fs.FileInfo) *ScanResult {
+	result := &ScanResult{
+		Path:      path,
+		Streamed:  true,
+		ScannedAt: time.Now(),
+	}
+
+	// non-blocking so a FIFO put in the file's place can't hang the open
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	if !fi.Mode().IsRegular() {
+		result.Error = fmt.Errorf("%s is not a regular file", path)
+		return result
+	}
+	if want != nil && !os.SameFile(fi, want) {
+		result.Error = errReplaced
+		return result
+	}
+	// clamd would cut the connection once past the limit
+	if fi.Size() > c.streamMax {
+		result.Error = fmt.Errorf("%w (%d bytes, limit %d)", ErrTooLarge, fi.Size(), c.streamMax)
+		return result
+	}
+
+	response, err := c.command("INSTREAM", func(w io.Writer) error {
+		// from the top, in case this is a retry
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := writeChunks(w, io.LimitReader(f, c.streamMax)); err != nil {
+			return fmt.Errorf("stream %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	parseReply(result, response)
+	// after reading, so a write during the scan shows
+	if fi, err := f.Stat(); err == nil {
+		result.Info = fi
+	}
+	return result
+}
+
+// writeChunks sends r as INSTREAM chunks, each prefixed with its length
+// in network byte order, and the zero-length chunk that ends the stream.
+func writeChunks(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 4+streamChunk)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// ClamdConfPaths are where distributions put clamd's config.
+var ClamdConfPaths = []string{
+	"/etc/clamd.d/scan.conf", // Fedora, RHEL and derivatives
+	"/etc/clamav/clamd.conf", // Debian, Ubuntu
+}
+
+// ReadStreamMaxLength reads StreamMaxLength from a clamd config file,
+// returning DefaultStreamMaxLength if it isn't set.
+func ReadStreamMaxLength(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && fields[0] == "StreamMaxLength" {
+			return ParseSize(fields[1])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return DefaultStreamMaxLength, nil
+}
+
+// ParseSize parses a size the way clamd.conf writes them: a number of
+// bytes with an optional K or M suffix.
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		mult, s = 1<<20, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,360 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeClamd speaks enough of clamd's protocol for the scanner: PING, SCAN
+// and INSTREAM, alone or inside an IDSESSION. Anything containing "EICAR"
+// is a threat.
+type fakeClamd struct {
+	maxLen    int64
+	dropAfter int // end sessions without replying after this many commands
+
+	mu       sync.Mutex
+	denied   map[string]bool          // SCAN fails with access denied for these
+	slow     map[string]time.Duration // SCAN takes this long for these
+	commands []string
+	sessions int
+}
+
+func (f *fakeClamd) serve(t testing.TB) string {
+	t.Helper()
+	sockPath, cleanup := mockClamdServer(t, f.handle)
+	t.Cleanup(cleanup)
+	return sockPath
+}
+
+// readCommand reads one command, returning it without its z or n prefix
+// along with the byte that ends replies to it.
+func readCommand(r *bufio.Reader) (string, byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", 0, err
+	}
+	delim := byte('\n')
+	if b[0] == 'z' {
+		delim = 0
+	}
+	line, err := r.ReadString(delim)
+	if err != nil {
+		return "", 0, err
+	}
+	cmd := line[:len(line)-1]
+	if b[0] == 'z' || b[0] == 'n' {
+		cmd = cmd[1:]
+	}
+	return cmd, delim, nil
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, delim, err := readCommand(r)
+	if err != nil {
+		return
+	}
+	if cmd != "IDSESSION" {
+		if reply, _ := f.run(cmd, r); reply != "" {
+			fmt.Fprintf(conn, "%s%c", reply, delim)
+		}
+		return
+	}
+
+	f.mu.Lock()
+	f.sessions++
+	f.mu.Unlock()
+
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for id := 1; ; id++ {
+		cmd, delim, err := readCommand(r)
+		if err != nil || cmd == "END" || (f.dropAfter > 0 && id > f.dropAfter) {
+			return
+		}
+		// like clamd, a slow file doesn't hold up the replies after it
+		if path, ok := strings.CutPrefix(cmd, "SCAN "); ok {
+			f.record(cmd)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reply := f.scan(path)
+				wmu.Lock()
+				fmt.Fprintf(conn, "%d: %s%c", id, reply, delim)
+				wmu.Unlock()
+			}()
+			continue
+		}
+		reply, ok := f.run(cmd, r)
+		if reply != "" {
+			wmu.Lock()
+			fmt.Fprintf(conn, "%d: %s%c", id, reply, delim)
+			wmu.Unlock()
+		}
+		if !ok {
+			// clamd ends the session after an error
+			return
+		}
+	}
+}
+
+// run carries out one command. ok is false if the connection should close.
+func (f *fakeClamd) run(cmd string, r *bufio.Reader) (reply string, ok bool) {
+	f.record(cmd)
+	switch {
+	case cmd == "PING":
+		return "PONG", true
+	case strings.HasPrefix(cmd, "SCAN "):
+		return f.scan(strings.TrimPrefix(cmd, "SCAN ")), true
+	case cmd == "INSTREAM":
+		var data bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return "", false
+			}
+			if size == 0 {
+				break
+			}
+			if int64(data.Len())+int64(size) > f.maxLen {
+				return "INSTREAM size limit exceeded. ERROR", false
+			}
+			if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+				return "", false
+			}
+		}
+		return "stream: " + verdict(data.Bytes()), true
+	}
+	return "UNKNOWN COMMAND", false
+}
+
+func (f *fakeClamd) scan(path string) string {
+	f.mu.Lock()
+	denied, delay := f.denied[path], f.slow[path]
+	f.mu.Unlock()
+
+	time.Sleep(delay)
+	data, err := os.ReadFile(path)
+	if denied || err != nil {
+		return path + ": Access denied. ERROR"
+	}
+	return path + ": " + verdict(data)
+}
+
+func (f *fakeClamd) record(cmd string) {
+	f.mu.Lock()
+	f.commands = append(f.commands, strings.Fields(cmd)[0])
+	f.mu.Unlock()
+}
+
+func (f *fakeClamd) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func verdict(data []byte) string {
+	if bytes.Contains(data, []byte("EICAR")) {
+		return "Eicar-Test-Signature FOUND"
+	}
+	return "OK"
+}
+
+// writeTestFile creates a file of n bytes ending in content.
+func writeTestFile(t testing.TB, name, content string, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	data := append(bytes.Repeat([]byte{'x'}, max(n-len(content), 0)), content...)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScanFile_Instream(t *testing.T) {
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength}
+	scanner := New(clamd.serve(t), WithMode(ModeStream))
+
+	// several chunks, with the signature in the last one
+	path := writeTestFile(t, "infected.bin", "EICAR", 3*streamChunk+17)
+	result := scanner.ScanFile(path)
+	if result.Error != nil {
+		t.Fatalf("ScanFile() error = %v", result.Error)
+	}
+	if result.Clean || result.Threat != "Eicar-Test-Signature" || !result.Streamed {
+		t.Errorf("ScanFile() = %+v, want a streamed threat", result)
+	}
+	if result.Path != path {
+		t.Errorf("Path = %q, want %q", result.Path, path)
+	}
+
+	clean := writeTestFile(t, "empty", "", 0)
+	if result := scanner.ScanFile(clean); result.Error != nil || !result.Clean {
+		t.Errorf("empty file: %+v", result)
+	}
+}
+
+func TestScanWalked_Instream(t *testing.T) {
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength}
+	scanner := New(clamd.serve(t), WithMode(ModeStream))
+
+	path := writeTestFile(t, "clean.txt", "clean", 5)
+	walked, _ := os.Lstat(path)
+	result := scanner.ScanWalked(path, walked)
+	if result.Error != nil || !result.Clean || !os.SameFile(result.Info, walked) {
+		t.Fatalf("ScanWalked() = %+v, want clean with the walked file's info", result)
+	}
+
+	// swapped for another file since the walk
+	os.WriteFile(path+".new", []byte("EICAR"), 0600)
+	os.Rename(path+".new", path)
+	if result := scanner.ScanWalked(path, walked); !errors.Is(result.Error, errReplaced) {
+		t.Errorf("replaced file: error = %v, want errReplaced", result.Error)
+	}
+
+	// symlinks aren't followed, and a FIFO doesn't block the open
+	link := filepath.Join(t.TempDir(), "link")
+	os.Symlink(path, link)
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{link, fifo} {
+		if result := scanner.ScanWalked(p, nil); result.Error == nil {
+			t.Errorf("ScanWalked(%s) = %+v, want an error", p, result)
+		}
+	}
+	if len(clamd.sent()) != 1 {
+		t.Errorf("streamed %d files, want only the first", len(clamd.sent()))
+	}
+}
+
+func TestScanFile_InstreamTooLarge(t *testing.T) {
+	clamd := &fakeClamd{maxLen: 1024}
+	sockPath := clamd.serve(t)
+	path := writeTestFile(t, "big.bin", "", 2048)
+
+	// the limit is known, so nothing is sent
+	result := New(sockPath, WithMode(ModeStream), WithStreamMaxLength(1024)).ScanFile(path)
+	if !errors.Is(result.Error, ErrTooLarge) {
+		t.Errorf("error = %v, want ErrTooLarge", result.Error)
+	}
+	if len(clamd.sent()) != 0 {
+		t.Errorf("sent %v for a file over the limit", clamd.sent())
+	}
+
+	// clamd's limit is lower than configured
+	result = New(sockPath, WithMode(ModeStream), WithStreamMaxLength(4096)).ScanFile(path)
+	if result.Error == nil || result.Clean {
+		t.Errorf("ScanFile() = %+v, want clamd's size limit error", result)
+	}
+}
+
+func TestScanFile_AutoUsesScan(t *testing.T) {
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength}
+	scanner := New(clamd.serve(t))
+
+	// clamd is this process, so it can read its own files
+	path := writeTestFile(t, "clean.txt", "clean", 5)
+	result := scanner.ScanFile(path)
+	if result.Error != nil || !result.Clean || result.Streamed {
+		t.Errorf("ScanFile() = %+v, want a clean SCAN", result)
+	}
+	if sent := clamd.sent(); len(sent) != 1 || sent[0] != "SCAN" {
+		t.Errorf("commands = %v, want one SCAN", sent)
+	}
+}
+
+func TestScanFile_AutoFallsBackToStream(t *testing.T) {
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength}
+	scanner := New(clamd.serve(t))
+
+	path := writeTestFile(t, "infected.txt", "EICAR", 5)
+	clamd.mu.Lock()
+	clamd.denied = map[string]bool{path: true}
+	clamd.mu.Unlock()
+
+	result := scanner.ScanFile(path)
+	if result.Error != nil {
+		t.Fatalf("ScanFile() error = %v", result.Error)
+	}
+	if !result.Streamed || result.Threat != "Eicar-Test-Signature" {
+		t.Errorf("ScanFile() = %+v, want a streamed threat", result)
+	}
+	if sent := clamd.sent(); len(sent) != 2 || sent[0] != "SCAN" || sent[1] != "INSTREAM" {
+		t.Errorf("commands = %v, want SCAN then INSTREAM", sent)
+	}
+}
+
+func TestIdentity_CanRead(t *testing.T) {
+	dir := t.TempDir()
+	// t.TempDir makes private directories; open them up to test the bits
+	for d := dir; d != os.TempDir() && d != "/"; d = filepath.Dir(d) {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	private := filepath.Join(dir, "private")
+	public := filepath.Join(dir, "public")
+	os.WriteFile(private, []byte("x"), 0600)
+	os.WriteFile(public, []byte("x"), 0644)
+
+	clamav := &Identity{uid: 54321, groups: []uint32{54321}}
+	if clamav.CanRead(private) {
+		t.Error("CanRead(0600 file owned by someone else) = true")
+	}
+	if !clamav.CanRead(public) {
+		t.Error("CanRead(0644 file) = false")
+	}
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if clamav.CanRead(public) {
+		t.Error("CanRead through a 0700 directory = true")
+	}
+	if !(&Identity{uid: 0}).CanRead(private) {
+		t.Error("root can't read")
+	}
+}
+
+func TestReadStreamMaxLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan.conf")
+	conf := "# clamd config\nLocalSocket /run/clamd.scan/clamd.sock\nStreamMaxLength 100M\n"
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ReadStreamMaxLength(path); err != nil || n != 100<<20 {
+		t.Errorf("ReadStreamMaxLength() = %d, %v, want 100M", n, err)
+	}
+
+	os.WriteFile(path, []byte("#StreamMaxLength 10M\n"), 0644)
+	if n, err := ReadStreamMaxLength(path); err != nil || n != DefaultStreamMaxLength {
+		t.Errorf("commented out: %d, %v, want the default", n, err)
+	}
+
+	for in, want := range map[string]int64{"1024": 1024, "64K": 64 << 10, "2m": 2 << 20} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error("ParseSize(lots) succeeded")
+	}
+}
@@ -0,0 +1,146 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mount is one line of /proc/self/mountinfo.
+type Mount struct {
+	Dev       string // major:minor
+	Point     string // where it's mounted
+	Root      string // the directory of the filesystem mounted there
+	FSType    string
+	Source    string
+	SuperOpts string
+}
+
+// Mount categories a scan only crosses into when told to.
+const (
+	MountNetwork  = "network"  // nfs, cifs and the like
+	MountFUSE     = "fuse"     // userspace filesystems, other than fuseblk disks
+	MountSnapshot = "snapshot" // btrfs snapper and zfs snapshots
+	MountOverlay  = "overlay"  // the lower layers of overlay mounts
+)
+
+// networkFS are filesystem types that live on another machine.
+var networkFS = map[string]bool{
+	"nfs": true, "nfs4": true, "cifs": true, "smb3": true, "smbfs": true,
+	"9p": true, "ceph": true, "glusterfs": true, "afs": true, "lustre": true,
+	"davfs": true, "fuse.sshfs": true, "fuse.rclone": true,
+}
+
+// Category says which of the Mount* categories m falls in, if any.
+func (m Mount) Category() string {
+	switch {
+	case networkFS[m.FSType]:
+		return MountNetwork
+	case m.FSType == "fuse" || strings.HasPrefix(m.FSType, "fuse."):
+		return MountFUSE
+	case m.FSType == "btrfs" && (strings.Contains(m.Root, "/.snapshots") || strings.Contains(m.Point, "/.snapshots")),
+		m.FSType == "zfs" && strings.Contains(m.Source, "@"):
+		return MountSnapshot
+	}
+	return ""
+}
+
+// LowerDirs returns the lower layers of an overlay mount. Their contents
+// show through the mount, so scanning them again is wasted work.
+func (m Mount) LowerDirs() []string {
+	if m.FSType != "overlay" {
+		return nil
+	}
+	for _, opt := range strings.Split(m.SuperOpts, ",") {
+		if dirs, ok := strings.CutPrefix(opt, "lowerdir="); ok {
+			return strings.Split(dirs, ":")
+		}
+	}
+	return nil
+}
+
+// bindDuplicates returns the mount points whose contents can also be
+// reached through another mount of the same device: bind mounts, and
+// the same filesystem mounted twice. Of each set the mount of the
+// outermost directory is kept, or the first listed for equal ones.
+func bindDuplicates(mounts []Mount) map[string]bool {
+	dups := make(map[string]bool)
+	for i, m := range mounts {
+		for j, o := range mounts {
+			if i == j || o.Dev != m.Dev || o.Point == m.Point || !within(m.Root, o.Root) {
+				continue
+			}
+			if o.Root != m.Root || j < i {
+				dups[m.Point] = true
+				break
+			}
+		}
+	}
+	return dups
+}
+
+// within reports whether path is dir or lies under it.
+func within(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// ReadMountInfo parses a mountinfo file.
+func ReadMountInfo(file string) ([]Mount, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []Mount
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+3 > len(fields) {
+			continue
+		}
+		m := Mount{
+			Dev:    fields[2],
+			Root:   unescapeMount(fields[3]),
+			Point:  unescapeMount(fields[4]),
+			FSType: fields[sep+1],
+			Source: unescapeMount(fields[sep+2]),
+		}
+		if sep+3 < len(fields) {
+			m.SuperOpts = fields[sep+3]
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, sc.Err()
+}
+
+// unescapeMount undoes the octal escapes mountinfo uses for spaces and
+// other awkward characters in paths.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,277 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSessions is how many clamd connections a scanner keeps open.
+const DefaultSessions = 4
+
+// sessionDepth is how many commands may wait on one connection. clamd
+// stops reading a session once its queue is full, so this stays below
+// its default MaxQueue.
+const sessionDepth = 16
+
+// errSessionLost is returned for commands whose connection went away
+// before clamd replied. They never reached a verdict and can be retried.
+var errSessionLost = errors.New("clamd session lost")
+
+// session is one clamd IDSESSION connection. Commands are written as soon
+// as the connection is free, and replies, which come back in whatever
+// order clamd finishes them, are matched up by the ID clamd numbers them
+// with.
+type session struct {
+	conn  net.Conn
+	slots chan struct{} // one per command waiting on a reply
+
+	wmu    sync.Mutex // held for the whole command, INSTREAM chunks included
+	nextID int        // guarded by wmu: IDs follow the order commands are sent
+
+	mu      sync.Mutex
+	pending map[int]chan sessionReply
+	err     error         // why the session ended
+	done    chan struct{} // closed once err is set
+}
+
+type sessionReply struct {
+	reply string
+	err   error
+}
+
+// startSession turns conn into an IDSESSION and starts reading replies.
+func startSession(conn net.Conn) (*session, error) {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("zIDSESSION\x00")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("start clamd session: %w", err)
+	}
+	s := &session{
+		conn:    conn,
+		slots:   make(chan struct{}, sessionDepth),
+		nextID:  1,
+		pending: make(map[int]chan sessionReply),
+		done:    make(chan struct{}),
+	}
+	go s.readReplies()
+	return s, nil
+}
+
+// readReplies hands each "ID: reply" clamd sends to whoever is waiting
+// for it, until the connection fails.
+func (s *session) readReplies() {
+	r := bufio.NewReader(s.conn)
+	for {
+		line, err := r.ReadString(0)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		line = strings.TrimSuffix(line, "\x00")
+		idField, reply, ok := strings.Cut(line, ": ")
+		id, err := strconv.Atoi(idField)
+		if !ok || err != nil {
+			// clamd answers commands it can't parse without an ID and
+			// then ends the session
+			s.fail(fmt.Errorf("unexpected reply %q", line))
+			return
+		}
+
+		s.mu.Lock()
+		ch := s.pending[id]
+		delete(s.pending, id)
+		s.mu.Unlock()
+		if ch != nil {
+			ch <- sessionReply{reply: reply}
+		}
+	}
+}
+
+// fail ends the session, failing every command still waiting.
+func (s *session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+	s.conn.Close()
+	for id, ch := range s.pending {
+		ch <- sessionReply{err: fmt.Errorf("%w: %v", errSessionLost, err)}
+		delete(s.pending, id)
+	}
+}
+
+// broken reports whether the session has ended.
+func (s *session) broken() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// do sends cmd, then whatever body writes, and waits for the reply.
+func (s *session) do(cmd string, body func(io.Writer) error, timeout time.Duration) (string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-s.done:
+		return "", fmt.Errorf("%w: %v", errSessionLost, s.err)
+	case <-timer.C:
+		return "", fmt.Errorf("clamd session busy for %v", timeout)
+	}
+
+	ch, err := s.send(cmd, body, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case r := <-ch:
+		return r.reply, r.err
+	case <-timer.C:
+		// the reply may still come, but nothing after it can be trusted
+		err := fmt.Errorf("no reply from clamd within %v", timeout)
+		s.fail(err)
+		return "", err
+	}
+}
+
+// send writes one command and registers for its reply.
+func (s *session) send(cmd string, body func(io.Writer) error, timeout time.Duration) (chan sessionReply, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	ch := make(chan sessionReply, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %v", errSessionLost, s.err)
+	}
+	id := s.nextID
+	s.nextID++
+	s.pending[id] = ch
+	s.mu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := fmt.Fprintf(s.conn, "z%s\x00", cmd)
+	if err == nil && body != nil {
+		err = body(s.conn)
+	}
+	if err != nil {
+		// clamd has seen part of a command at best
+		s.fail(err)
+		return nil, fmt.Errorf("%w: %v", errSessionLost, err)
+	}
+	return ch, nil
+}
+
+// end closes the session, telling clamd first.
+func (s *session) end() {
+	s.wmu.Lock()
+	if !s.broken() {
+		s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		s.conn.Write([]byte("zEND\x00"))
+	}
+	s.wmu.Unlock()
+	s.fail(net.ErrClosed)
+}
+
+// pool spreads commands over a few long-lived sessions, replacing any
+// that break.
+type pool struct {
+	connect func() (net.Conn, error)
+
+	mu       sync.Mutex
+	sessions []*session      // nil until first used
+	dialing  []chan struct{} // closed when slot i's dial ends, nil if none
+	next     int
+}
+
+func newPool(size int, connect func() (net.Conn, error)) *pool {
+	return &pool{
+		connect:  connect,
+		sessions: make([]*session, size),
+		dialing:  make([]chan struct{}, size),
+	}
+}
+
+// get returns the next session in turn, connecting it if needed. The
+// slot is reserved while connecting, so a slow clamd holds up only the
+// callers waiting on that slot, not the whole pool.
+func (p *pool) get() (*session, error) {
+	p.mu.Lock()
+	i := p.next
+	p.next = (p.next + 1) % len(p.sessions)
+	for {
+		if s := p.sessions[i]; s != nil && !s.broken() {
+			p.mu.Unlock()
+			return s, nil
+		}
+		wait := p.dialing[i]
+		if wait == nil {
+			break
+		}
+		p.mu.Unlock()
+		<-wait
+		p.mu.Lock()
+	}
+	done := make(chan struct{})
+	p.dialing[i] = done
+	p.mu.Unlock()
+
+	s, err := p.dial()
+
+	p.mu.Lock()
+	p.dialing[i] = nil
+	if err == nil {
+		p.sessions[i] = s
+	}
+	p.mu.Unlock()
+	close(done)
+	return s, err
+}
+
+// dial connects a new session.
+func (p *pool) dial() (*session, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	return startSession(conn)
+}
+
+func (p *pool) do(cmd string, body func(io.Writer) error, timeout time.Duration) (string, error) {
+	s, err := p.get()
+	if err != nil {
+		return "", err
+	}
+	return s.do(cmd, body, timeout)
+}
+
+// close ends every session. The pool reconnects if used again.
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.sessions {
+		if s != nil {
+			s.end()
+			p.sessions[i] = nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSession_Pipelined(t *testing.T) {
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength}
+	scanner := New(clamd.serve(t), WithMode(ModeScan), WithSessions(1))
+	defer scanner.Close()
+
+	slow := writeTestFile(t, "slow.txt", "EICAR", 5)
+	fast := writeTestFile(t, "fast.txt", "clean", 5)
+	clamd.mu.Lock()
+	clamd.slow = map[string]time.Duration{slow: 200 * time.Millisecond}
+	clamd.mu.Unlock()
+
+	// both go down the one connection; the fast reply overtakes the slow one
+	done := make(chan *ScanResult, 2)
+	go func() { done <- scanner.ScanFile(slow) }()
+	time.Sleep(20 * time.Millisecond)
+	go func() { done <- scanner.ScanFile(fast) }()
+
+	first, second := <-done, <-done
+	if first.Path != fast || first.Error != nil || !first.Clean {
+		t.Errorf("first result = %+v, want the fast clean file", first)
+	}
+	if second.Path != slow || second.Threat != "Eicar-Test-Signature" {
+		t.Errorf("second result = %+v, want the slow threat", second)
+	}
+	clamd.mu.Lock()
+	defer clamd.mu.Unlock()
+	if clamd.sessions != 1 {
+		t.Errorf("opened %d sessions, want 1", clamd.sessions)
+	}
+}
+
+func TestSession_Reconnect(t *testing.T) {
+	// clamd ends idle sessions; here it hangs up after every other command
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength, dropAfter: 2}
+	scanner := New(clamd.serve(t), WithMode(ModeStream), WithSessions(1))
+	defer scanner.Close()
+
+	for i := range 5 {
+		path := writeTestFile(t, fmt.Sprintf("file%d", i), "clean", 5)
+		if result := scanner.ScanFile(path); result.Error != nil || !result.Clean {
+			t.Fatalf("scan %d = %+v", i, result)
+		}
+	}
+	clamd.mu.Lock()
+	defer clamd.mu.Unlock()
+	if clamd.sessions < 3 {
+		t.Errorf("opened %d sessions, want a new one after each drop", clamd.sessions)
+	}
+}
+
+func TestSession_Close(t *testing.T) {
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength}
+	scanner := New(clamd.serve(t), WithMode(ModeScan))
+	path := writeTestFile(t, "clean.txt", "clean", 5)
+
+	if result := scanner.ScanFile(path); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	scanner.Close()
+	// a closed scanner reconnects
+	if result := scanner.ScanFile(path); result.Error != nil || !result.Clean {
+		t.Errorf("ScanFile() after Close = %+v", result)
+	}
+}
+
+func TestPool_DialOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	var dials atomic.Int32
+	p := newPool(2, func() (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			<-release
+			return nil, errors.New("clamd not answering")
+		}
+		conn, clamd := net.Pipe()
+		go io.Copy(io.Discard, clamd)
+		t.Cleanup(func() { clamd.Close() })
+		return conn, nil
+	})
+	defer p.close()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := p.get()
+		slow <- err
+	}()
+	for dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the other slot doesn't wait for the first one's dial
+	fast := make(chan error, 1)
+	go func() {
+		_, err := p.get()
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatalf("get() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("get() blocked behind another slot's dial")
+	}
+
+	close(release)
+	if err := <-slow; err == nil {
+		t.Fatal("failed dial returned a session")
+	}
+	// the failed slot is free to try again
+	if _, err := p.get(); err != nil {
+		t.Errorf("get() on the released slot error = %v", err)
+	}
+}
+
+// The benchmarks compare a connection per file with pooled sessions,
+// scanning from several goroutines as a full scan does.
+func benchmarkScan(b *testing.B, opts ...Option) {
+	clamd := &fakeClamd{maxLen: DefaultStreamMaxLength}
+	scanner := New(clamd.serve(b), append([]Option{WithMode(ModeScan)}, opts...)...)
+	defer scanner.Close()
+
+	path := writeTestFile(b, "clean.txt", "clean", 4096)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if result := scanner.ScanFile(path); result.Error != nil {
+				b.Error(result.Error)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkScanFile_Dial(b *testing.B) {
+	benchmarkScan(b, WithSessions(0))
+}
+
+func BenchmarkScanFile_Session(b *testing.B) {
+	benchmarkScan(b)
+}
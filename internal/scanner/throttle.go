@@ -0,0 +1,87 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Load reads how busy the machine is. The zero value is not usable; use
+// SystemLoad outside tests.
+type Load struct {
+	PowerSupply string // where power supplies show up in sysfs
+	LoadAvg     string // the loadavg file in procfs
+}
+
+// SystemLoad looks at the standard mounts.
+var SystemLoad = Load{PowerSupply: "/sys/class/power_supply", LoadAvg: "/proc/loadavg"}
+
+// OnBattery reports whether a battery is discharging. Machines without
+// one are never on battery.
+func (l Load) OnBattery() (bool, error) {
+	entries, err := os.ReadDir(l.PowerSupply)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, e := range entries {
+		dir := filepath.Join(l.PowerSupply, e.Name())
+		// peripherals like mice report a battery too, with scope Device
+		if readAttr(dir, "type") != "Battery" || readAttr(dir, "scope") == "Device" {
+			continue
+		}
+		if readAttr(dir, "status") == "Discharging" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Average returns the one minute load average.
+func (l Load) Average() (float64, error) {
+	data, err := os.ReadFile(l.LoadAvg)
+	if err != nil {
+		return 0, err
+	}
+	first, _, _ := strings.Cut(string(data), " ")
+	return strconv.ParseFloat(first, 64)
+}
+
+// readAttr reads a sysfs attribute, returning "" if it can't.
+func readAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// ioprio_set(2) constants, which x/sys/unix doesn't carry.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerPriority makes the calling thread nice 10 with idle IO priority,
+// so it only gets disk time nothing else wants. The calling goroutine
+// must have locked its thread and never unlock it: the thread then exits
+// with the goroutine instead of going on to run others slowly.
+func lowerPriority() error {
+	tid := unix.Gettid()
+	if err := unix.Setpriority(unix.PRIO_PROCESS, tid, 10); err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
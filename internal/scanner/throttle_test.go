@@ -0,0 +1,69 @@
+// oreon/defense · watchthelight <wtl>
+
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeLoad lays out a sysfs power supply directory with a laptop battery
+// in the given state and a mouse that is always discharging.
+func fakeLoad(t *testing.T, status, loadavg string) Load {
+	t.Helper()
+	dir := t.TempDir()
+	attrs := map[string]string{
+		"AC/type":                "Mains",
+		"AC/online":              "1",
+		"BAT0/type":              "Battery",
+		"BAT0/scope":             "",
+		"BAT0/status":            status,
+		"hidpp_battery_0/type":   "Battery",
+		"hidpp_battery_0/scope":  "Device",
+		"hidpp_battery_0/status": "Discharging",
+	}
+	for name, value := range attrs {
+		path := filepath.Join(dir, "power_supply", name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loadPath := filepath.Join(dir, "loadavg")
+	if err := os.WriteFile(loadPath, []byte(loadavg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load{PowerSupply: filepath.Join(dir, "power_supply"), LoadAvg: loadPath}
+}
+
+func TestLoad_OnBattery(t *testing.T) {
+	for status, want := range map[string]bool{"Discharging": true, "Charging": false, "Full": false} {
+		on, err := fakeLoad(t, status, "0.00 0.00 0.00 1/1 1\n").OnBattery()
+		if err != nil || on != want {
+			t.Errorf("battery %s: OnBattery() = %v, %v; want %v", status, on, err, want)
+		}
+	}
+
+	// desktops have no batteries, or no power supplies at all
+	none := Load{PowerSupply: filepath.Join(t.TempDir(), "missing")}
+	if on, err := none.OnBattery(); err != nil || on {
+		t.Errorf("no power supplies: OnBattery() = %v, %v", on, err)
+	}
+}
+
+func TestLoad_Average(t *testing.T) {
+	avg, err := fakeLoad(t, "Full", "3.52 2.10 1.05 2/812 40213\n").Average()
+	if err != nil || avg != 3.52 {
+		t.Errorf("Average() = %v, %v; want 3.52", avg, err)
+	}
+
+	busy := NewEngine(nil, WithBackoff(Backoff{MaxLoad: 2, Load: fakeLoad(t, "Full", "3.52 2.10 1.05 2/812 40213\n")}))
+	if !busy.backingOff() {
+		t.Error("not backing off with load 3.52 over 2")
+	}
+	idle := NewEngine(nil, WithBackoff(Backoff{MaxLoad: 4, Load: fakeLoad(t, "Full", "3.52 2.10 1.05 2/812 40213\n")}))
+	if idle.backingOff() {
+		t.Error("backing off with load 3.52 under 4")
+	}
+}
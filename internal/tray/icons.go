@@ -22,6 +22,9 @@ var ScanningIcon []byte
 //go:embed icons/paused-16.png
 var PausedIcon []byte
 
+//go:embed icons/lockdown-16.png
+var LockdownIcon []byte
+
 // loadIcon returns the appropriate icon for the given state
 func loadIcon(state string) []byte {
 	switch state {
@@ -35,6 +38,8 @@ func loadIcon(state string) []byte {
 		return ScanningIcon
 	case "paused":
 		return PausedIcon
+	case "lockdown":
+		return LockdownIcon
 	default:
 		return ProtectedIcon
 	}
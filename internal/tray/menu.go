@@ -1,9 +1,13 @@
 package tray
 
 import (
+	"fmt"
 	"log/slog"
+	"path"
+	"strings"
 
 	"github.com/energye/systray"
+	"github.com/oreonproject/defense/pkg/ipc"
 )
 
 // menu represents the system tray menu structure
@@ -19,22 +23,42 @@ type menu struct {
 	pause1HourItem   *systray.MenuItem
 	pauseUntilReboot *systray.MenuItem
 	firewallItem     *systray.MenuItem
+	profileMenu      *systray.MenuItem
+	appsMenu         *systray.MenuItem
+	noAppsItem       *systray.MenuItem
+	lockdownItem     *systray.MenuItem
 	alertsMenu       *systray.MenuItem
 	openAppItem      *systray.MenuItem
 	settingsItem     *systray.MenuItem
 	quitItem         *systray.MenuItem
 
+	// Profile submenu items, created once the daemon tells us which exist
+	profileItems map[string]*systray.MenuItem
+
+	// Blocked app submenu items. Unblocked apps keep their item, unticked,
+	// until the tray restarts so they can be blocked again.
+	appItems map[ipc.FirewallApp]*appItem
+
 	// State tracking
-	isPaused bool
+	isPaused     bool
+	isLockedDown bool
 }
 
 // newMenu creates a new menu instance
 func newMenu(t *Tray) *menu {
 	return &menu{
-		tray: t,
+		tray:         t,
+		profileItems: make(map[string]*systray.MenuItem),
+		appItems:     make(map[ipc.FirewallApp]*appItem),
 	}
 }
 
+// appItem is a blocked app's entry in the tray menu.
+type appItem struct {
+	item *systray.MenuItem
+	app  ipc.FirewallApp
+}
+
 // build creates and initializes the menu structure
 func (m *menu) build() {
 	// Add menu items
@@ -55,6 +79,15 @@ func (m *menu) build() {
 
 	// Firewall toggle
 	m.firewallItem = systray.AddMenuItemCheckbox("Firewall: Enabled ✓", "Toggle firewall protection", true)
+	m.profileMenu = systray.AddMenuItem("Firewall Profile", "Switch firewall profile")
+	m.appsMenu = systray.AddMenuItem("Blocked Apps", "Applications whose network access is blocked")
+	m.noAppsItem = m.appsMenu.AddSubMenuItem("No apps blocked", "")
+	m.noAppsItem.Disable()
+
+	systray.AddSeparator()
+
+	// One click to cut the network off
+	m.lockdownItem = systray.AddMenuItem("Emergency Lockdown", "Block all network traffic until released")
 
 	systray.AddSeparator()
 
@@ -85,6 +118,7 @@ func (m *menu) setupHandlers() {
 	m.pause1HourItem.Click(func() { m.handlePause("1h") })
 	m.pauseUntilReboot.Click(func() { m.handlePause("reboot") })
 	m.firewallItem.Click(m.handleFirewallToggle)
+	m.lockdownItem.Click(m.handleLockdown)
 	m.openAppItem.Click(m.handleOpenApp)
 	m.settingsItem.Click(m.handleOpenSettings)
 	m.quitItem.Click(systray.Quit)
@@ -188,6 +222,159 @@ func (m *menu) syncStateWithDaemon() {
 		m.isPaused = false
 		m.pauseMenu.SetTitle("Pause Protection")
 	}
+
+	m.setLockedDown(status.State == "lockdown")
+	m.syncProfiles()
+	m.syncApps()
+}
+
+// syncProfiles fills the profile submenu and checks the active profile.
+func (m *menu) syncProfiles() {
+	list, err := m.tray.client.ListFirewallProfiles()
+	if err != nil {
+		slog.Debug("failed to list firewall profiles", "error", err)
+		return
+	}
+
+	for _, p := range list.Profiles {
+		if _, ok := m.profileItems[p.Name]; ok {
+			continue
+		}
+		name := p.Name
+		item := m.profileMenu.AddSubMenuItemCheckbox(profileTitle(name), p.Description, false)
+		item.Click(func() { m.handleProfileSelect(name) })
+		m.profileItems[name] = item
+	}
+	m.checkProfile(list.Active)
+}
+
+// checkProfile ticks the active profile and unticks the rest.
+func (m *menu) checkProfile(active string) {
+	for name, item := range m.profileItems {
+		if name == active {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+	}
+	if active != "" {
+		m.profileMenu.SetTitle("Firewall Profile: " + profileTitle(active))
+	}
+}
+
+// profileTitle formats a profile name for display ("home" -> "Home").
+func profileTitle(name string) string {
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// syncApps lists blocked apps in their submenu.
+func (m *menu) syncApps() {
+	list, err := m.tray.client.ListFirewallApps()
+	if err != nil {
+		slog.Debug("failed to list blocked apps", "error", err)
+		return
+	}
+
+	blocked := make(map[ipc.FirewallApp]bool, len(list.Apps))
+	for _, a := range list.Apps {
+		key := appKey(a.FirewallApp)
+		blocked[key] = true
+
+		ai, ok := m.appItems[key]
+		if !ok {
+			ai = &appItem{app: a.FirewallApp}
+			ai.item = m.appsMenu.AddSubMenuItemCheckbox(appTitle(a.FirewallApp), "", true)
+			ai.item.Click(func() { m.handleAppToggle(ai) })
+			m.appItems[key] = ai
+		}
+		ai.item.SetTooltip(appTooltip(a))
+	}
+	for key, ai := range m.appItems {
+		if blocked[key] {
+			ai.item.Check()
+		} else {
+			ai.item.Uncheck()
+		}
+	}
+
+	if len(m.appItems) == 0 {
+		m.noAppsItem.Show()
+	} else {
+		m.noAppsItem.Hide()
+	}
+	m.appsMenu.SetTitle(fmt.Sprintf("Blocked Apps (%d)", len(list.Apps)))
+}
+
+// appKey identifies an app block regardless of its comment, the way the
+// daemon matches them.
+func appKey(a ipc.FirewallApp) ipc.FirewallApp {
+	a.Comment = ""
+	return a
+}
+
+// appTitle names a blocked app for display: its comment if it has one,
+// else the executable's name or the last element of the cgroup.
+func appTitle(a ipc.FirewallApp) string {
+	switch {
+	case a.Comment != "":
+		return a.Comment
+	case a.Exe != "":
+		return path.Base(a.Exe)
+	}
+	return path.Base(a.Cgroup)
+}
+
+// appTooltip says what an app block currently covers.
+func appTooltip(a ipc.FirewallAppStatus) string {
+	what := a.Exe
+	if what == "" {
+		what = a.Cgroup
+	}
+	switch n := len(a.Cgroups); n {
+	case 0:
+		return what + " (not running)"
+	case 1:
+		return what + " (blocking 1 running instance)"
+	default:
+		return fmt.Sprintf("%s (blocking %d running instances)", what, n)
+	}
+}
+
+// handleAppToggle blocks or unblocks an app from the tray.
+func (m *menu) handleAppToggle(ai *appItem) {
+	block := !ai.item.Checked()
+	go func() {
+		var err error
+		if block {
+			err = m.tray.client.AddFirewallApp(ai.app)
+		} else {
+			err = m.tray.client.RemoveFirewallApp(ai.app)
+		}
+		if err != nil {
+			m.tray.showNotification(None, "Error", "Failed to change app block: "+err.Error())
+			return
+		}
+		m.syncApps()
+		if block {
+			m.tray.showNotification(NotificationStateChange, "App Blocked", appTitle(ai.app)+" can no longer reach the network")
+		} else {
+			m.tray.showNotification(NotificationStateChange, "App Unblocked", appTitle(ai.app)+" can reach the network again")
+		}
+	}()
+}
+
+func (m *menu) handleProfileSelect(name string) {
+	go func() {
+		if err := m.tray.client.SetFirewallProfile(name); err != nil {
+			m.tray.showNotification(None, "Error", "Failed to switch firewall profile: "+err.Error())
+			return
+		}
+		m.checkProfile(name)
+		m.tray.showNotification(NotificationStateChange, "Firewall Profile Changed", "Now using the "+profileTitle(name)+" profile")
+	}()
 }
 
 func (m *menu) handleFirewallToggle() {
@@ -211,6 +398,41 @@ func (m *menu) handleFirewallToggle() {
 	}
 }
 
+// handleLockdown starts or releases an emergency lockdown. The tray icon
+// follows from the daemon's state change.
+func (m *menu) handleLockdown() {
+	release := m.isLockedDown
+	go func() {
+		var err error
+		if release {
+			err = m.tray.client.ReleaseLockdown()
+		} else {
+			err = m.tray.client.Lockdown()
+		}
+		if err != nil {
+			m.tray.showNotification(None, "Error", "Failed to change lockdown: "+err.Error())
+			return
+		}
+		m.setLockedDown(!release)
+		if release {
+			m.tray.showNotification(NotificationStateChange, "Lockdown Released", "Network traffic is allowed again")
+		}
+	}()
+}
+
+// setLockedDown switches the lockdown item between starting and
+// releasing a lockdown.
+func (m *menu) setLockedDown(locked bool) {
+	m.isLockedDown = locked
+	if locked {
+		m.lockdownItem.SetTitle("Release Lockdown")
+		m.lockdownItem.SetTooltip("Allow network traffic again")
+	} else {
+		m.lockdownItem.SetTitle("Emergency Lockdown")
+		m.lockdownItem.SetTooltip("Block all network traffic until released")
+	}
+}
+
 func (m *menu) handleOpenApp() {
 	// TODO: Implement app open
 	slog.Debug("open app requested")
@@ -25,6 +25,9 @@ const (
 	NotificationScanComplete     NotificationType = "scan_complete"
 	NotificationThreatBlocked    NotificationType = "threat_blocked"
 	NotificationStateChange      NotificationType = "state_change"
+	NotificationFirewallReverted NotificationType = "firewall_reverted"
+	NotificationLockdown         NotificationType = "lockdown"
+	NotificationThreatAsk        NotificationType = "threat_ask"
 )
 
 // Tray embeds the system tray functionality
@@ -32,7 +35,9 @@ const (
 //go:embed icons/logo.png
 var logo []byte
 
-func (t *Tray) showNotification(notificationType NotificationType, title, message string) {
+// showNotification returns the notification's ID, or 0 if it couldn't
+// be shown.
+func (t *Tray) showNotification(notificationType NotificationType, title, message string) uint32 {
 	n := notify.Notification{
 		AppName:       "Oreon Defense",
 		Summary:       title,
@@ -70,6 +75,14 @@ func (t *Tray) showNotification(notificationType NotificationType, title, messag
 			{Key: "view_results", Label: "View Results"},
 			{Key: "dismiss", Label: "Dismiss"},
 		}
+	case NotificationThreatAsk:
+		// the daemon acts on its own if nobody answers, so don't rush them
+		n.ExpireTimeout = notify.ExpireTimeoutNever
+		n.Actions = []notify.Action{
+			{Key: "quarantine", Label: "Quarantine"},
+			{Key: "delete", Label: "Delete"},
+			{Key: "report", Label: "Leave It"},
+		}
 	case NotificationStateChange:
 		// No actions for state change notifications
 		n.ExpireTimeout = 5 * time.Second
@@ -83,12 +96,12 @@ func (t *Tray) showNotification(notificationType NotificationType, title, messag
 		id, err := t.notifier.SendNotification(n)
 		if err != nil {
 			slog.Error("failed to show notification", "error", err)
-			return
+			return 0
 		}
 		slog.Debug("notification sent", "id", id)
-		// Listen for actions
-
+		return id
 	}
+	return 0
 }
 
 // executeOrder66 runs a command with the given arguments
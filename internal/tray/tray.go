@@ -3,6 +3,7 @@ package tray
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"sync"
@@ -25,9 +26,11 @@ type Tray struct {
 	iconAlert     []byte
 	iconScanning  []byte
 	iconPaused    []byte
+	iconLockdown  []byte
 
 	mu           sync.Mutex
 	currentState string
+	asks         map[uint32]string // notification ID to the threat it asks about
 }
 
 // New creates a new Tray instance
@@ -62,6 +65,8 @@ func (t *Tray) onReady() {
 			t.executeOrder66("defense-ui", []string{"--show-threats"})
 		case "view_results":
 			t.executeOrder66("defense-ui", []string{"--show-scan-results"})
+		case "quarantine", "delete", "report":
+			t.resolveThreat(action.ID, action.ActionKey)
 		// case "dismiss", "remind":
 		// 	// Just close the notification
 		// 	t.notifier.CloseNotification(uint32(id))
@@ -124,6 +129,9 @@ func (t *Tray) setIcon(state string) {
 	case "paused":
 		systray.SetIcon(t.iconPaused)
 		systray.SetTooltip("Oreon Defense - Paused")
+	case "lockdown":
+		systray.SetIcon(t.iconLockdown)
+		systray.SetTooltip("Oreon Defense - Locked Down")
 	}
 	t.mu.Unlock()
 
@@ -135,6 +143,86 @@ func (t *Tray) setIcon(state string) {
 		t.showNotification(NotificationThreatBlocked, "Threat Blocked", "A potential threat has been blocked")
 	case "paused":
 		t.showNotification(NotificationFirewallDisabled, "Firewall Disabled", "Your firewall protection is currently disabled")
+	case "lockdown":
+		t.showNotification(NotificationLockdown, "Emergency Lockdown", "All network traffic is blocked until the lockdown is released")
+	}
+}
+
+// setScanProgress shows how the running scan is going in the tooltip,
+// as long as the icon still says we're scanning.
+func (t *Tray) setScanProgress(scan ipc.ScanStatusResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.currentState != "scanning" || scan.Status != "running" {
+		return
+	}
+	systray.SetTooltip(scanTooltip(scan, time.Now()))
+}
+
+// scanTooltip describes a running scan, e.g.
+// "Oreon Defense - Scanning... 42%, about 3m left".
+func scanTooltip(scan ipc.ScanStatusResponse, now time.Time) string {
+	if scan.Progress <= 0 {
+		return fmt.Sprintf("Oreon Defense - Scanning... %d files", scan.FilesScanned)
+	}
+	tip := fmt.Sprintf("Oreon Defense - Scanning... %d%%", int(scan.Progress*100))
+	if scan.ETA.IsZero() {
+		return tip
+	}
+	left := scan.ETA.Sub(now).Round(time.Minute)
+	switch {
+	case left < time.Minute:
+		tip += ", less than a minute left"
+	case left < time.Hour:
+		tip += fmt.Sprintf(", about %dm left", int(left.Minutes()))
+	default:
+		tip += fmt.Sprintf(", about %dh%02dm left", int(left.Hours()), int(left.Minutes())%60)
+	}
+	return tip
+}
+
+// askThreat asks what to do about a threat the daemon found, keeping
+// track of the notification so the answer goes back to the right one.
+func (t *Tray) askThreat(ask ipc.ThreatAsk) {
+	id := t.showNotification(NotificationThreatAsk, "Threat Found",
+		fmt.Sprintf("%s was found in %s. What should be done with it?", ask.Threat, ask.Path))
+	if id == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.asks == nil {
+		t.asks = make(map[uint32]string)
+	}
+	t.asks[id] = ask.ID
+}
+
+// foundMessage describes a threat real-time protection found, e.g.
+// "Threat Quarantined", "Eicar-Test-Signature was found in
+// /home/a/Downloads/eicar.com and quarantined".
+func foundMessage(found ipc.ThreatFound) (title, body string) {
+	body = fmt.Sprintf("%s was found in %s", found.Threat, found.Path)
+	switch found.Action {
+	case "quarantined":
+		return "Threat Quarantined", body + " and quarantined"
+	case "deleted":
+		return "Threat Deleted", body + " and deleted"
+	default:
+		return "Threat Found", body
+	}
+}
+
+// resolveThreat sends the choice made on a threat notification.
+func (t *Tray) resolveThreat(notification uint32, action string) {
+	t.mu.Lock()
+	id, ok := t.asks[notification]
+	delete(t.asks, notification)
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := t.client.ResolveThreat(id, action); err != nil {
+		slog.Error("failed to resolve threat", "id", id, "action", action, "error", err)
 	}
 }
 
@@ -146,6 +234,7 @@ func (t *Tray) loadIcons() {
 	t.iconAlert = loadIcon("alert")
 	t.iconScanning = loadIcon("scanning")
 	t.iconPaused = loadIcon("paused")
+	t.iconLockdown = loadIcon("lockdown")
 }
 
 // monitorStatus subscribes to state changes and updates the UI.
@@ -162,6 +251,31 @@ func (t *Tray) monitorStatus() {
 	slog.Info("subscribed to daemon state changes")
 
 	for event := range events {
+		if event.Reason == ipc.ReasonThreatAsk && event.Threat != nil {
+			t.askThreat(*event.Threat)
+			continue
+		}
+		if event.Reason == ipc.ReasonThreatFound && event.Found != nil {
+			title, body := foundMessage(*event.Found)
+			t.showNotification(NotificationThreatBlocked, title, body)
+			continue
+		}
+		if event.Reason == ipc.ReasonScanProgress && event.Scan != nil {
+			t.setIcon(event.NewState)
+			t.setScanProgress(*event.Scan)
+			continue
+		}
+		if event.Reason == ipc.ReasonFirewallReverted {
+			t.showNotification(NotificationFirewallReverted, "Firewall Change Reverted",
+				"The last firewall change wasn't confirmed in time and has been undone")
+			if t.menu != nil {
+				t.menu.syncStateWithDaemon()
+			}
+		}
+		// a lockdown may have been started or released elsewhere
+		if t.menu != nil && (event.NewState == "lockdown") != t.menu.isLockedDown {
+			t.menu.setLockedDown(event.NewState == "lockdown")
+		}
 		t.setIcon(event.NewState)
 	}
 
@@ -14,7 +14,9 @@ type mockClient struct {
 	statusState     string
 	statusErr       error
 	firewallEnabled bool
+	profile         string
 	events          chan ipc.StateChangeEvent
+	resolved        []string // "id action" for each ResolveThreat
 }
 
 func (m *mockClient) Status() (*ipc.StatusResponse, error) {
@@ -40,6 +42,48 @@ func (m *mockClient) IsFirewallEnabled() (bool, error) {
 	return m.firewallEnabled, nil
 }
 
+func (m *mockClient) ConfirmFirewall() error { return nil }
+
+func (m *mockClient) ListFirewallProfiles() (*ipc.FirewallProfileListResponse, error) {
+	return &ipc.FirewallProfileListResponse{Active: m.profile}, nil
+}
+
+func (m *mockClient) SetFirewallProfile(name string) error {
+	m.profile = name
+	return nil
+}
+
+func (m *mockClient) ListFirewallRules(profile string) (*ipc.FirewallRuleListResponse, error) {
+	return &ipc.FirewallRuleListResponse{Profile: m.profile}, nil
+}
+
+func (m *mockClient) AddFirewallRule(profile string, rule ipc.FirewallRule) error    { return nil }
+func (m *mockClient) RemoveFirewallRule(profile string, rule ipc.FirewallRule) error { return nil }
+
+func (m *mockClient) PreviewFirewall(params ipc.FirewallPreviewParams) (*ipc.FirewallPreviewResponse, error) {
+	return &ipc.FirewallPreviewResponse{Profile: m.profile}, nil
+}
+
+func (m *mockClient) FirewallLog(params ipc.FirewallLogParams) (*ipc.FirewallLogResponse, error) {
+	return &ipc.FirewallLogResponse{}, nil
+}
+
+func (m *mockClient) ReloadBlocklists() (*ipc.FirewallBlocklistReloadResponse, error) {
+	return &ipc.FirewallBlocklistReloadResponse{}, nil
+}
+
+func (m *mockClient) ListFirewallApps() (*ipc.FirewallAppListResponse, error) {
+	return &ipc.FirewallAppListResponse{}, nil
+}
+
+func (m *mockClient) AddFirewallApp(app ipc.FirewallApp) error {
+	return nil
+}
+
+func (m *mockClient) RemoveFirewallApp(app ipc.FirewallApp) error {
+	return nil
+}
+
 func (m *mockClient) StartQuickScan() (*ipc.ScanResponse, error) {
 	return &ipc.ScanResponse{JobID: "quick-test"}, nil
 }
@@ -48,6 +92,31 @@ func (m *mockClient) StartFullScan() (*ipc.ScanResponse, error) {
 	return &ipc.ScanResponse{JobID: "full-test"}, nil
 }
 
+func (m *mockClient) StartCustomScan(paths []string) (*ipc.ScanResponse, error) {
+	return &ipc.ScanResponse{JobID: "custom-test"}, nil
+}
+
+func (m *mockClient) ScanStatus(jobID string) (*ipc.ScanStatusResponse, error) {
+	return &ipc.ScanStatusResponse{JobID: "quick-test", Status: "running"}, nil
+}
+
+func (m *mockClient) CancelScan(jobID string) error { return nil }
+
+func (m *mockClient) ListQuarantine() (*ipc.QuarantineListResponse, error) {
+	return &ipc.QuarantineListResponse{}, nil
+}
+
+func (m *mockClient) RestoreQuarantine(id string) error { return nil }
+func (m *mockClient) DeleteQuarantine(id string) error  { return nil }
+
+func (m *mockClient) ResolveThreat(id, action string) error {
+	m.resolved = append(m.resolved, id+" "+action)
+	return nil
+}
+
+func (m *mockClient) Lockdown() error        { return nil }
+func (m *mockClient) ReleaseLockdown() error { return nil }
+
 func (m *mockClient) Pause() error  { return nil }
 func (m *mockClient) Resume() error { return nil }
 
@@ -81,6 +150,7 @@ func TestTray_setIcon(t *testing.T) {
 	tray.iconAlert = []byte{3}
 	tray.iconScanning = []byte{4}
 	tray.iconPaused = []byte{5}
+	tray.iconLockdown = []byte{6}
 
 	tests := []struct {
 		state string
@@ -91,6 +161,7 @@ func TestTray_setIcon(t *testing.T) {
 		{"alert", "alert"},
 		{"scanning", "scanning"},
 		{"paused", "paused"},
+		{"lockdown", "lockdown"},
 	}
 
 	for _, tt := range tests {
@@ -122,6 +193,52 @@ func TestTray_setIcon_NoChange(t *testing.T) {
 	}
 }
 
+func TestScanTooltip(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		scan ipc.ScanStatusResponse
+		want string
+	}{
+		{ipc.ScanStatusResponse{FilesScanned: 12}, "Oreon Defense - Scanning... 12 files"},
+		{ipc.ScanStatusResponse{Progress: 0.42}, "Oreon Defense - Scanning... 42%"},
+		{ipc.ScanStatusResponse{Progress: 0.9, ETA: now.Add(20 * time.Second)}, "Oreon Defense - Scanning... 90%, less than a minute left"},
+		{ipc.ScanStatusResponse{Progress: 0.5, ETA: now.Add(3 * time.Minute)}, "Oreon Defense - Scanning... 50%, about 3m left"},
+		{ipc.ScanStatusResponse{Progress: 0.1, ETA: now.Add(85 * time.Minute)}, "Oreon Defense - Scanning... 10%, about 1h25m left"},
+	}
+	for _, tt := range tests {
+		if got := scanTooltip(tt.scan, now); got != tt.want {
+			t.Errorf("scanTooltip(%+v) = %q, want %q", tt.scan, got, tt.want)
+		}
+	}
+}
+
+func TestFoundMessage(t *testing.T) {
+	found := ipc.ThreatFound{Path: "/home/a/Downloads/eicar.com", Threat: "Eicar-Test-Signature", Action: "quarantined"}
+	title, body := foundMessage(found)
+	if title != "Threat Quarantined" || body != "Eicar-Test-Signature was found in /home/a/Downloads/eicar.com and quarantined" {
+		t.Errorf("foundMessage() = %q, %q", title, body)
+	}
+	found.Action = "detected"
+	if title, _ := foundMessage(found); title != "Threat Found" {
+		t.Errorf("title for a threat left in place = %q", title)
+	}
+}
+
+func TestTray_resolveThreat(t *testing.T) {
+	client := &mockClient{}
+	tray := New(client)
+	tray.asks = map[uint32]string{7: "ask-1"}
+
+	tray.resolveThreat(7, "delete")
+	// answered already, and a notification that isn't an ask
+	tray.resolveThreat(7, "quarantine")
+	tray.resolveThreat(8, "report")
+
+	if len(client.resolved) != 1 || client.resolved[0] != "ask-1 delete" {
+		t.Errorf("resolved = %v, want [ask-1 delete]", client.resolved)
+	}
+}
+
 func TestTray_pollStatus(t *testing.T) {
 	client := &mockClient{statusState: "protected"}
 	tray := New(client)
@@ -168,3 +285,32 @@ func TestMockClient_Subscribe(t *testing.T) {
 		t.Fatal("timeout waiting for event")
 	}
 }
+
+func TestProfileTitle(t *testing.T) {
+	tests := map[string]string{
+		"home":   "Home",
+		"public": "Public",
+		"":       "",
+	}
+	for in, want := range tests {
+		if got := profileTitle(in); got != want {
+			t.Errorf("profileTitle(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAppTitle(t *testing.T) {
+	tests := []struct {
+		app  ipc.FirewallApp
+		want string
+	}{
+		{ipc.FirewallApp{Exe: "/opt/vendor/bin/agent", Comment: "Telemetry"}, "Telemetry"},
+		{ipc.FirewallApp{Exe: "/opt/vendor/bin/agent"}, "agent"},
+		{ipc.FirewallApp{Cgroup: "user.slice/user-*.slice/user@*.service/app.slice/app-foo-*.scope"}, "app-foo-*.scope"},
+	}
+	for _, tt := range tests {
+		if got := appTitle(tt.app); got != tt.want {
+			t.Errorf("appTitle(%+v) = %q, want %q", tt.app, got, tt.want)
+		}
+	}
+}
@@ -12,8 +12,10 @@ import (
 type Config struct {
 	General       General       `toml:"general"`
 	Firewall      Firewall      `toml:"firewall"`
+	Network       Network       `toml:"network"`
 	Notifications Notifications `toml:"notifications"`
 	Scanning      Scanning      `toml:"scanning"`
+	RealTime      RealTime      `toml:"realtime"`
 	ClamAV        ClamAV        `toml:"clamav"`
 	Events        Events        `toml:"events"`
 }
@@ -22,10 +24,112 @@ type General struct {
 	RealTimeProtection bool   `toml:"real_time_protection"`
 	LogLevel           string `toml:"log_level"`
 	SocketPath         string `toml:"socket_path"` // IPC socket path (default: /run/oreon/defense.sock)
+	// AdminGroup is a group whose members may change the firewall over
+	// IPC as well as root, e.g. "wheel". Empty means root only.
+	AdminGroup string `toml:"admin_group"`
 }
 
 type Firewall struct {
-	Enabled bool `toml:"enabled"`
+	Enabled  bool                       `toml:"enabled"`
+	Profile  string                     `toml:"profile"`  // name of the active profile
+	Profiles map[string]FirewallProfile `toml:"profiles"` // built-in profiles can be overridden by name
+
+	// ConfirmTimeout enables confirm-or-revert for changes made over IPC:
+	// unless firewall_confirm arrives within this long (e.g. "60s") the
+	// previous ruleset is restored. Empty disables it.
+	ConfirmTimeout string `toml:"confirm_timeout"`
+
+	LogDrops bool `toml:"log_drops"` // record dropped inbound packets in the event store
+
+	// Conflict is what to do when another firewall manager (firewalld,
+	// ufw, or nftables tables nothing else claims) is active: "coexist"
+	// loads our table alongside it, "defer" stands aside while firewalld
+	// or ufw runs, only reporting other tables, and "refuse" won't enable
+	// at all.
+	Conflict string `toml:"conflict"`
+	// Priority is the hook priority of our chains relative to filter (0);
+	// lower runs earlier. Mainly for ordering against another manager.
+	Priority int32 `toml:"priority"`
+
+	Blocklists []FirewallBlocklist `toml:"blocklists"`
+	Apps       []FirewallApp       `toml:"apps"`
+}
+
+// FirewallApp blocks outbound traffic from an application, whatever the
+// profile. Set exactly one of Cgroup and Exe.
+type FirewallApp struct {
+	// Cgroup is a cgroup v2 path below /sys/fs/cgroup; each element may
+	// use * and ? wildcards to cover every user's instance of an app scope.
+	Cgroup string `toml:"cgroup,omitempty"`
+	// Exe is an absolute executable path. The cgroups its running
+	// processes are in get blocked, so it should be started in a scope of
+	// its own (desktop launchers do this, as does systemd-run --scope).
+	Exe     string `toml:"exe,omitempty"`
+	Comment string `toml:"comment,omitempty"`
+}
+
+// FirewallBlocklist is a file of addresses and networks to block in both
+// directions, one per line or as the first column of a CSV file.
+// Reloaded with the firewall_blocklist_reload IPC command.
+type FirewallBlocklist struct {
+	Name string `toml:"name"` // letters, digits and underscores; used in nft set names
+	Path string `toml:"path"`
+}
+
+// FirewallProfile controls how much unsolicited inbound traffic is let in.
+type FirewallProfile struct {
+	Description string         `toml:"description"`
+	AllowPing   bool           `toml:"allow_ping"` // answer ICMP/ICMPv6 echo requests
+	AllowLAN    bool           `toml:"allow_lan"`  // accept anything from private and link-local ranges
+	Reject      bool           `toml:"reject"`     // reject unsolicited traffic instead of silently dropping it
+	Rules       []FirewallRule `toml:"rules"`
+}
+
+// FirewallRule opens a port or port range on top of a profile.
+type FirewallRule struct {
+	Proto     string `toml:"proto"`               // "tcp" or "udp"
+	Port      int    `toml:"port"`                // first port of the range
+	PortEnd   int    `toml:"port_end,omitempty"`  // last port of the range, 0 for a single port
+	Source    string `toml:"source,omitempty"`    // remote network (CIDR or address), empty for any
+	Direction string `toml:"direction,omitempty"` // "in" (default) or "out"
+	Comment   string `toml:"comment,omitempty"`
+}
+
+// DefaultFirewallProfiles returns the built-in home, public and strict profiles.
+func DefaultFirewallProfiles() map[string]FirewallProfile {
+	return map[string]FirewallProfile{
+		"home": {
+			Description: "Trusted network, local devices can connect",
+			AllowPing:   true,
+			AllowLAN:    true,
+			Reject:      true,
+		},
+		"public": {
+			Description: "Untrusted network, block incoming connections",
+			Reject:      true,
+		},
+		"strict": {
+			Description: "Hostile network, silently drop everything unsolicited",
+		},
+	}
+}
+
+// Network controls automatic profile switching when the active
+// NetworkManager connection changes.
+type Network struct {
+	AutoProfile      bool          `toml:"auto_profile"`      // switch firewall profile on network change
+	TrustedProfile   string        `toml:"trusted_profile"`   // profile for connections matching a trusted rule
+	UntrustedProfile string        `toml:"untrusted_profile"` // profile for everything else
+	Rules            []NetworkRule `toml:"rules"`             // checked in order, first match wins
+}
+
+// NetworkRule classifies a connection. Every non-empty field must match;
+// a rule with no fields set matches nothing.
+type NetworkRule struct {
+	UUID      string `toml:"uuid"`      // NetworkManager connection UUID
+	SSID      string `toml:"ssid"`      // wifi network name
+	Interface string `toml:"interface"` // e.g. "enp3s0"
+	Trusted   bool   `toml:"trusted"`
 }
 
 type Notifications struct {
@@ -33,12 +137,68 @@ type Notifications struct {
 }
 
 type Scanning struct {
+	// Exclusions are paths (skipped with everything under them), globs
+	// where ** spans directories ("*.iso" matches the base name), or
+	// regular expressions prefixed with "re:".
 	Exclusions     []string `toml:"exclusions"`
+	MaxFileSize    string   `toml:"max_file_size"` // skip larger files, e.g. "500M"; empty for no limit
+	SkipFSTypes    []string `toml:"skip_fs_types"` // mounts of these types are skipped; unset for pseudo-filesystems
 	QuickScanPaths []string `toml:"quick_scan_paths"`
+	FullScanPaths  []string `toml:"full_scan_paths"`
+	// CrossMounts are the kinds of mount scans go into, which they skip
+	// otherwise: "network", "fuse", "snapshot", and "overlay" for the
+	// lower layers of overlay mounts.
+	CrossMounts    []string `toml:"cross_mounts"`
+	Concurrency    int      `toml:"concurrency"`     // files scanned at once; 0 for half the CPUs
+	LowPriority    bool     `toml:"low_priority"`    // scan at nice 10 with idle IO priority
+	BatteryBackoff bool     `toml:"battery_backoff"` // scan one file at a time on battery
+	MaxLoad        float64  `toml:"max_load"`        // scan one file at a time above this load; 0 for the CPU count
+	PreCount       bool     `toml:"pre_count"`       // count what a scan covers alongside it, for progress and ETA
+	Quarantine     bool     `toml:"quarantine"`      // move infected files into the vault; off only reports them
+	Cache          bool     `toml:"cache"`           // skip files found clean before, until they or the signatures change
+	// Remediation decides what happens to a threat, first match wins.
+	// Threats no rule matches are quarantined, or only reported with
+	// Quarantine off.
+	Remediation []RemediationRule `toml:"remediation"`
+}
+
+// RemediationRule picks the action for threats found under Paths whose
+// names match Threats. An empty list matches anything.
+type RemediationRule struct {
+	Paths   []string `toml:"paths"`   // in the syntax of Exclusions
+	Threats []string `toml:"threats"` // globs on the ClamAV name, e.g. "PUA.*"
+	// Action is "report" (leave the file be), "quarantine", "delete", or
+	// "ask" to let the desktop user choose, quarantining if nobody does.
+	Action string `toml:"action"`
+}
+
+// RealTime configures on-access scanning, which
+// General.RealTimeProtection turns on.
+type RealTime struct {
+	// Paths are watched for files being written. fanotify watches whole
+	// mounts, so accesses elsewhere on the mounts they're on are ignored.
+	Paths     []string `toml:"paths"`
+	BlockExec bool     `toml:"block_exec"` // scan programs before they run and refuse infected ones
+	Debounce  string   `toml:"debounce"`   // scan this long after the last write to a file, e.g. "2s"
+
+	// Method is "fanotify", which needs CAP_SYS_ADMIN, "inotify", which
+	// only watches Folders, or "auto" for fanotify when it can be had and
+	// inotify otherwise.
+	Method string `toml:"method"`
+	// Folders are watched with inotify, with everything in them. "~/" is
+	// the home of each logged-in user, and globs are allowed.
+	Folders []string `toml:"folders"`
 }
 
 type ClamAV struct {
 	SocketPath string `toml:"socket_path"`
+	// Mode is how files reach clamd: "scan" sends the path for clamd to
+	// open, "instream" sends the contents, and "auto" sends the path when
+	// clamd's user can read the file and the contents otherwise.
+	Mode string `toml:"mode"`
+	// StreamMaxLength must match clamd.conf (e.g. "25M"); larger files
+	// can't be streamed. Empty reads it from clamd.conf.
+	StreamMaxLength string `toml:"stream_max_length"`
 }
 
 type Events struct {
@@ -54,7 +214,16 @@ func Default() *Config {
 			SocketPath:         SocketPath,
 		},
 		Firewall: Firewall{
-			Enabled: true,
+			Enabled:  true,
+			Profile:  "public",
+			Profiles: DefaultFirewallProfiles(),
+			Conflict: "coexist",
+		},
+		Network: Network{
+			AutoProfile:      false,
+			TrustedProfile:   "home",
+			UntrustedProfile: "public",
+			Rules:            []NetworkRule{},
 		},
 		Notifications: Notifications{
 			Level: "all",
@@ -65,9 +234,22 @@ func Default() *Config {
 				"/tmp",
 				"/var/tmp",
 			},
+			FullScanPaths:  []string{"/"},
+			LowPriority:    true,
+			BatteryBackoff: true,
+			PreCount:       true,
+			Quarantine:     true,
+			Cache:          true,
+		},
+		RealTime: RealTime{
+			Paths:    []string{"/home", "/tmp", "/var/tmp"},
+			Debounce: "2s",
+			Method:   "auto",
+			Folders:  []string{"~/Downloads", "~/Desktop", "/run/media/*"},
 		},
 		ClamAV: ClamAV{
 			SocketPath: "/var/run/clamav/clamd.sock",
+			Mode:       "auto",
 		},
 		Events: Events{
 			DatabasePath: "/var/lib/oreon/events.db",
@@ -20,9 +20,120 @@ func TestDefault(t *testing.T) {
 	if !cfg.Firewall.Enabled {
 		t.Error("expected firewall to be enabled by default")
 	}
+	if cfg.Firewall.Conflict != "coexist" {
+		t.Errorf("expected conflict 'coexist', got %q", cfg.Firewall.Conflict)
+	}
+	if !cfg.Scanning.LowPriority || !cfg.Scanning.BatteryBackoff {
+		t.Error("expected scans to run at low priority and back off on battery by default")
+	}
+	if len(cfg.Scanning.FullScanPaths) != 1 || cfg.Scanning.FullScanPaths[0] != "/" {
+		t.Errorf("expected full scans to start from /, got %v", cfg.Scanning.FullScanPaths)
+	}
+	if cfg.ClamAV.Mode != "auto" {
+		t.Errorf("expected clamav mode 'auto', got %q", cfg.ClamAV.Mode)
+	}
 	if cfg.Notifications.Level != "all" {
 		t.Errorf("expected notification level 'all', got %q", cfg.Notifications.Level)
 	}
+	if _, ok := cfg.Firewall.Profiles[cfg.Firewall.Profile]; !ok {
+		t.Errorf("default profile %q is not defined", cfg.Firewall.Profile)
+	}
+	for _, name := range []string{cfg.Network.TrustedProfile, cfg.Network.UntrustedProfile} {
+		if _, ok := cfg.Firewall.Profiles[name]; !ok {
+			t.Errorf("network profile %q is not defined", name)
+		}
+	}
+	for _, name := range []string{"home", "public", "strict"} {
+		if _, ok := cfg.Firewall.Profiles[name]; !ok {
+			t.Errorf("missing built-in profile %q", name)
+		}
+	}
+}
+
+func TestLoadFirewallProfiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.toml")
+	data := `
+[firewall]
+profile = "office"
+conflict = "defer"
+priority = -10
+
+[[firewall.blocklists]]
+name = "internal"
+path = "/etc/oreon/blocklists/internal.txt"
+
+[firewall.profiles.office]
+description = "Work network"
+allow_ping = true
+
+[[firewall.profiles.office.rules]]
+proto = "tcp"
+port = 22
+source = "10.0.0.0/8"
+comment = "ssh"
+
+[firewall.profiles.home]
+allow_ping = false
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	if cfg.Firewall.Profile != "office" {
+		t.Errorf("expected profile 'office', got %q", cfg.Firewall.Profile)
+	}
+	if cfg.Firewall.Conflict != "defer" || cfg.Firewall.Priority != -10 {
+		t.Errorf("conflict = %q, priority = %d, want defer at -10", cfg.Firewall.Conflict, cfg.Firewall.Priority)
+	}
+	if p := cfg.Firewall.Profiles["office"]; !p.AllowPing {
+		t.Error("expected office profile to allow ping")
+	}
+	want := FirewallRule{Proto: "tcp", Port: 22, Source: "10.0.0.0/8", Comment: "ssh"}
+	if rules := cfg.Firewall.Profiles["office"].Rules; len(rules) != 1 || rules[0] != want {
+		t.Errorf("expected office ssh rule, got %+v", rules)
+	}
+	wantList := FirewallBlocklist{Name: "internal", Path: "/etc/oreon/blocklists/internal.txt"}
+	if lists := cfg.Firewall.Blocklists; len(lists) != 1 || lists[0] != wantList {
+		t.Errorf("expected internal blocklist, got %+v", lists)
+	}
+	// built-ins not mentioned in the file are kept
+	if _, ok := cfg.Firewall.Profiles["strict"]; !ok {
+		t.Error("expected built-in strict profile to survive load")
+	}
+	// overriding a built-in replaces it entirely
+	if p := cfg.Firewall.Profiles["home"]; p.AllowPing || p.AllowLAN {
+		t.Errorf("expected overridden home profile, got %+v", p)
+	}
+}
+
+func TestLoadClamAV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.toml")
+	data := `
+[clamav]
+mode = "instream"
+stream_max_length = "100M"
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if cfg.ClamAV.Mode != "instream" || cfg.ClamAV.StreamMaxLength != "100M" {
+		t.Errorf("clamav = %+v, want instream with 100M", cfg.ClamAV)
+	}
+	// the socket keeps its default
+	if cfg.ClamAV.SocketPath != Default().ClamAV.SocketPath {
+		t.Errorf("socket_path = %q, want the default", cfg.ClamAV.SocketPath)
+	}
 }
 
 func TestLoadMissing(t *testing.T) {
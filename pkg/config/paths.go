@@ -8,12 +8,14 @@ import (
 )
 
 const (
-	SystemConfigPath = "/etc/oreon/defense.toml"
-	SocketPath       = "/run/oreon/defense.sock"
-	LogPath          = "/var/log/oreon/defense.log"
-	DataPath         = "/var/lib/oreon/defense"
-	QuarantinePath   = "/var/lib/oreon/defense/quarantine"
-	DatabasePath     = "/var/lib/oreon/defense/defense.db"
+	SystemConfigPath  = "/etc/oreon/defense.toml"
+	SocketPath        = "/run/oreon/defense.sock"
+	LogPath           = "/var/log/oreon/defense.log"
+	DataPath          = "/var/lib/oreon/defense"
+	FirewallStatePath = "/var/lib/oreon/defense/firewall-state.toml"
+	QuarantinePath    = "/var/lib/oreon/defense/quarantine"
+	DatabasePath      = "/var/lib/oreon/defense/defense.db"
+	ScanCachePath     = "/var/lib/oreon/defense/scan-cache.db"
 )
 
 func UserConfigPath() string {
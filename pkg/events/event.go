@@ -15,6 +15,9 @@ const (
 	EventTypeStateChange EventType = "state_change"
 	EventTypeThreat      EventType = "threat_detected"
 	EventTypeHealthCheck EventType = "health_check"
+	EventTypeFirewall    EventType = "firewall"
+	EventTypeNetwork     EventType = "network_change"
+	EventTypeDrop        EventType = "firewall_drop"
 )
 
 // Event represents a wide event / canonical log line.
@@ -49,6 +52,9 @@ const (
 	FieldPath          = "path"
 	FieldFilesScanned  = "files_scanned"
 	FieldThreatsFound  = "threats_found"
+	FieldFilesSkipped  = "files_skipped"
+	FieldCacheHits     = "cache_hits"
+	FieldCacheMisses   = "cache_misses"
 	FieldFileSizeBytes = "file_size_bytes"
 	FieldCommand       = "command"
 	FieldRequestID     = "request_id"
@@ -59,6 +65,24 @@ const (
 	FieldReason        = "reason"
 	FieldThreatName    = "threat_name"
 	FieldAction        = "action"
+	FieldQuarantineID  = "quarantine_id"
+	FieldAskID         = "ask_id"
 	FieldClamAvailable = "clamav_available"
 	FieldFWEnabled     = "firewall_enabled"
+	FieldFWManagers    = "firewall_managers"
+	FieldRealTime      = "realtime_active"
+	FieldFWAction      = "firewall_action"
+	FieldFWProfile     = "firewall_profile"
+	FieldRuleCount     = "rule_count"
+	FieldNetworkName   = "network_name"
+	FieldNetworkUUID   = "network_uuid"
+	FieldNetworkType   = "network_type"
+	FieldSSID          = "ssid"
+	FieldInterface     = "interface"
+	FieldTrusted       = "trusted"
+	FieldSrcAddr       = "src"
+	FieldDstAddr       = "dst"
+	FieldDstPort       = "dst_port"
+	FieldProto         = "proto"
+	FieldPacketCount   = "packet_count"
 )
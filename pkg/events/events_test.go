@@ -133,6 +133,7 @@ func TestTypedBuilders(t *testing.T) {
 		evt := StartScan("quick", "job-123").
 			FilesScanned(100).
 			ThreatsFound(2).
+			FilesSkipped(5).
 			Path("/home").
 			End()
 
@@ -151,6 +152,9 @@ func TestTypedBuilders(t *testing.T) {
 		if evt.Fields[FieldThreatsFound] != 2 {
 			t.Errorf("threats_found = %v, want 2", evt.Fields[FieldThreatsFound])
 		}
+		if evt.Fields[FieldFilesSkipped] != 5 {
+			t.Errorf("files_skipped = %v, want 5", evt.Fields[FieldFilesSkipped])
+		}
 	})
 
 	t.Run("IPCRequestBuilder", func(t *testing.T) {
@@ -210,4 +214,62 @@ func TestTypedBuilders(t *testing.T) {
 			t.Errorf("clamav_available = %v, want true", evt.Fields[FieldClamAvailable])
 		}
 	})
+
+	t.Run("FirewallBuilder", func(t *testing.T) {
+		evt := StartFirewall("enable").
+			Profile("home").
+			RuleCount(5).
+			End()
+
+		if evt.Type != EventTypeFirewall {
+			t.Errorf("Type = %v, want %v", evt.Type, EventTypeFirewall)
+		}
+		if evt.Fields[FieldFWAction] != "enable" {
+			t.Errorf("firewall_action = %v, want enable", evt.Fields[FieldFWAction])
+		}
+		if evt.Fields[FieldFWProfile] != "home" {
+			t.Errorf("firewall_profile = %v, want home", evt.Fields[FieldFWProfile])
+		}
+		if evt.Fields[FieldRuleCount] != 5 {
+			t.Errorf("rule_count = %v, want 5", evt.Fields[FieldRuleCount])
+		}
+	})
+
+	t.Run("NetworkBuilder", func(t *testing.T) {
+		evt := StartNetworkChange("Home", "uuid-1").
+			SSID("HomeWifi").
+			Interface("wlan0").
+			Trusted(true).
+			Profile("home").
+			End()
+
+		if evt.Type != EventTypeNetwork {
+			t.Errorf("Type = %v, want %v", evt.Type, EventTypeNetwork)
+		}
+		if evt.Fields[FieldNetworkUUID] != "uuid-1" {
+			t.Errorf("network_uuid = %v, want uuid-1", evt.Fields[FieldNetworkUUID])
+		}
+		if evt.Fields[FieldTrusted] != true {
+			t.Errorf("trusted = %v, want true", evt.Fields[FieldTrusted])
+		}
+	})
+
+	t.Run("DropBuilder", func(t *testing.T) {
+		evt := StartFirewallDrop("203.0.113.5", "192.168.1.10").
+			Proto("tcp").
+			Port(22).
+			Interface("wlan0").
+			Count(12).
+			End()
+
+		if evt.Type != EventTypeDrop {
+			t.Errorf("Type = %v, want %v", evt.Type, EventTypeDrop)
+		}
+		if evt.Component != "firewall" {
+			t.Errorf("Component = %v, want firewall", evt.Component)
+		}
+		if evt.Fields[FieldDstPort] != 22 || evt.Fields[FieldPacketCount] != 12 {
+			t.Errorf("fields = %v", evt.Fields)
+		}
+	})
 }
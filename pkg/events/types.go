@@ -27,6 +27,25 @@ func (b *ScanBuilder) ThreatsFound(count int) *ScanBuilder {
 	return b
 }
 
+// FilesSkipped sets the number of files and directories the exclusions
+// left out.
+func (b *ScanBuilder) FilesSkipped(count int) *ScanBuilder {
+	b.Set(FieldFilesSkipped, count)
+	return b
+}
+
+// CacheHits sets how many files the verdict cache said were still clean.
+func (b *ScanBuilder) CacheHits(count int) *ScanBuilder {
+	b.Set(FieldCacheHits, count)
+	return b
+}
+
+// CacheMisses sets how many files were scanned with the cache on.
+func (b *ScanBuilder) CacheMisses(count int) *ScanBuilder {
+	b.Set(FieldCacheMisses, count)
+	return b
+}
+
 // Path sets the path being scanned.
 func (b *ScanBuilder) Path(path string) *ScanBuilder {
 	b.Set(FieldPath, path)
@@ -102,6 +121,18 @@ func (b *ThreatBuilder) FileSize(bytes int64) *ThreatBuilder {
 	return b
 }
 
+// AskID sets the ID of the question put to the user about the threat.
+func (b *ThreatBuilder) AskID(id string) *ThreatBuilder {
+	b.Set(FieldAskID, id)
+	return b
+}
+
+// QuarantineID sets the ID the file was quarantined under.
+func (b *ThreatBuilder) QuarantineID(id string) *ThreatBuilder {
+	b.Set(FieldQuarantineID, id)
+	return b
+}
+
 // HealthCheckBuilder is a typed builder for health check events.
 type HealthCheckBuilder struct {
 	*Builder
@@ -124,3 +155,121 @@ func (b *HealthCheckBuilder) FirewallEnabled(enabled bool) *HealthCheckBuilder {
 	b.Set(FieldFWEnabled, enabled)
 	return b
 }
+
+// FirewallManagers sets how many other firewall managers are active.
+func (b *HealthCheckBuilder) FirewallManagers(count int) *HealthCheckBuilder {
+	b.Set(FieldFWManagers, count)
+	return b
+}
+
+// RealTimeActive sets whether on-access scanning is running.
+func (b *HealthCheckBuilder) RealTimeActive(active bool) *HealthCheckBuilder {
+	b.Set(FieldRealTime, active)
+	return b
+}
+
+// FirewallBuilder is a typed builder for firewall change events.
+type FirewallBuilder struct {
+	*Builder
+}
+
+// StartFirewall creates a new firewall event builder.
+// Action is what was attempted, e.g. "enable" or "disable".
+func StartFirewall(action string) *FirewallBuilder {
+	b := Start(EventTypeFirewall, "firewall")
+	b.Set(FieldFWAction, action)
+	return &FirewallBuilder{Builder: b}
+}
+
+// Profile sets the firewall profile involved in the change.
+func (b *FirewallBuilder) Profile(name string) *FirewallBuilder {
+	b.Set(FieldFWProfile, name)
+	return b
+}
+
+// RuleCount sets the number of rules loaded after the change.
+func (b *FirewallBuilder) RuleCount(count int) *FirewallBuilder {
+	b.Set(FieldRuleCount, count)
+	return b
+}
+
+// NetworkBuilder is a typed builder for network change events.
+type NetworkBuilder struct {
+	*Builder
+}
+
+// StartNetworkChange creates a new network change event builder.
+func StartNetworkChange(name, uuid string) *NetworkBuilder {
+	b := Start(EventTypeNetwork, "network")
+	b.Set(FieldNetworkName, name)
+	b.Set(FieldNetworkUUID, uuid)
+	return &NetworkBuilder{Builder: b}
+}
+
+// Type sets the NetworkManager connection type.
+func (b *NetworkBuilder) Type(connType string) *NetworkBuilder {
+	b.Set(FieldNetworkType, connType)
+	return b
+}
+
+// SSID sets the wifi network name.
+func (b *NetworkBuilder) SSID(ssid string) *NetworkBuilder {
+	b.Set(FieldSSID, ssid)
+	return b
+}
+
+// Interface sets the network interface name.
+func (b *NetworkBuilder) Interface(name string) *NetworkBuilder {
+	b.Set(FieldInterface, name)
+	return b
+}
+
+// Trusted sets whether the network was classified as trusted.
+func (b *NetworkBuilder) Trusted(trusted bool) *NetworkBuilder {
+	b.Set(FieldTrusted, trusted)
+	return b
+}
+
+// Profile sets the firewall profile selected for the network.
+func (b *NetworkBuilder) Profile(name string) *NetworkBuilder {
+	b.Set(FieldFWProfile, name)
+	return b
+}
+
+// DropBuilder is a typed builder for packets dropped by the firewall.
+// One event summarises every matching drop seen in a reporting window.
+type DropBuilder struct {
+	*Builder
+}
+
+// StartFirewallDrop creates a new dropped packet event builder.
+func StartFirewallDrop(src, dst string) *DropBuilder {
+	b := Start(EventTypeDrop, "firewall")
+	b.Set(FieldSrcAddr, src)
+	b.Set(FieldDstAddr, dst)
+	return &DropBuilder{Builder: b}
+}
+
+// Proto sets the transport protocol, e.g. "tcp".
+func (b *DropBuilder) Proto(proto string) *DropBuilder {
+	b.Set(FieldProto, proto)
+	return b
+}
+
+// Port sets the destination port.
+func (b *DropBuilder) Port(port int) *DropBuilder {
+	b.Set(FieldDstPort, port)
+	return b
+}
+
+// Interface sets the interface the packets arrived on.
+func (b *DropBuilder) Interface(name string) *DropBuilder {
+	b.Set(FieldInterface, name)
+	return b
+}
+
+// Count sets how many packets the event covers.
+func (b *DropBuilder) Count(n int) *DropBuilder {
+	b.Set(FieldPacketCount, n)
+	return b
+}
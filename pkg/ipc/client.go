@@ -18,8 +18,29 @@ type Client interface {
 	GetProtectionStatus() (bool, error)
 	SetFirewallEnabled(enabled bool) error
 	IsFirewallEnabled() (bool, error)
+	ConfirmFirewall() error
+	ListFirewallProfiles() (*FirewallProfileListResponse, error)
+	SetFirewallProfile(name string) error
+	ListFirewallRules(profile string) (*FirewallRuleListResponse, error)
+	AddFirewallRule(profile string, rule FirewallRule) error
+	RemoveFirewallRule(profile string, rule FirewallRule) error
+	PreviewFirewall(params FirewallPreviewParams) (*FirewallPreviewResponse, error)
+	FirewallLog(params FirewallLogParams) (*FirewallLogResponse, error)
+	ReloadBlocklists() (*FirewallBlocklistReloadResponse, error)
+	ListFirewallApps() (*FirewallAppListResponse, error)
+	AddFirewallApp(app FirewallApp) error
+	RemoveFirewallApp(app FirewallApp) error
+	Lockdown() error
+	ReleaseLockdown() error
 	StartQuickScan() (*ScanResponse, error)
 	StartFullScan() (*ScanResponse, error)
+	StartCustomScan(paths []string) (*ScanResponse, error)
+	ScanStatus(jobID string) (*ScanStatusResponse, error)
+	CancelScan(jobID string) error
+	ListQuarantine() (*QuarantineListResponse, error)
+	RestoreQuarantine(id string) error
+	DeleteQuarantine(id string) error
+	ResolveThreat(id, action string) error
 	Pause() error
 	Resume() error
 	Subscribe() (<-chan StateChangeEvent, error)
@@ -182,6 +203,124 @@ func (c *socketClient) IsFirewallEnabled() (bool, error) {
 	return status.FirewallEnabled, nil
 }
 
+func (c *socketClient) ConfirmFirewall() error {
+	_, err := c.call(CmdFirewallConfirm, nil)
+	return err
+}
+
+func (c *socketClient) ListFirewallProfiles() (*FirewallProfileListResponse, error) {
+	resp, err := c.call(CmdFirewallProfileList, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list FirewallProfileListResponse
+	if err := resp.UnmarshalData(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *socketClient) SetFirewallProfile(name string) error {
+	_, err := c.call(CmdFirewallProfileSet, FirewallProfileParams{Name: name})
+	return err
+}
+
+func (c *socketClient) ListFirewallRules(profile string) (*FirewallRuleListResponse, error) {
+	resp, err := c.call(CmdFirewallRuleList, FirewallRuleListParams{Profile: profile})
+	if err != nil {
+		return nil, err
+	}
+
+	var list FirewallRuleListResponse
+	if err := resp.UnmarshalData(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *socketClient) AddFirewallRule(profile string, rule FirewallRule) error {
+	_, err := c.call(CmdFirewallRuleAdd, FirewallRuleParams{Profile: profile, Rule: rule})
+	return err
+}
+
+func (c *socketClient) RemoveFirewallRule(profile string, rule FirewallRule) error {
+	_, err := c.call(CmdFirewallRuleRemove, FirewallRuleParams{Profile: profile, Rule: rule})
+	return err
+}
+
+func (c *socketClient) PreviewFirewall(params FirewallPreviewParams) (*FirewallPreviewResponse, error) {
+	resp, err := c.call(CmdFirewallPreview, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var preview FirewallPreviewResponse
+	if err := resp.UnmarshalData(&preview); err != nil {
+		return nil, err
+	}
+	return &preview, nil
+}
+
+func (c *socketClient) FirewallLog(params FirewallLogParams) (*FirewallLogResponse, error) {
+	resp, err := c.call(CmdFirewallLog, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var log FirewallLogResponse
+	if err := resp.UnmarshalData(&log); err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (c *socketClient) ReloadBlocklists() (*FirewallBlocklistReloadResponse, error) {
+	resp, err := c.call(CmdFirewallBlocklistReload, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var reload FirewallBlocklistReloadResponse
+	if err := resp.UnmarshalData(&reload); err != nil {
+		return nil, err
+	}
+	return &reload, nil
+}
+
+func (c *socketClient) ListFirewallApps() (*FirewallAppListResponse, error) {
+	resp, err := c.call(CmdFirewallAppList, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list FirewallAppListResponse
+	if err := resp.UnmarshalData(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *socketClient) AddFirewallApp(app FirewallApp) error {
+	_, err := c.call(CmdFirewallAppAdd, app)
+	return err
+}
+
+func (c *socketClient) RemoveFirewallApp(app FirewallApp) error {
+	_, err := c.call(CmdFirewallAppRemove, app)
+	return err
+}
+
+func (c *socketClient) Lockdown() error {
+	_, err := c.call(CmdLockdown, nil)
+	return err
+}
+
+func (c *socketClient) ReleaseLockdown() error {
+	_, err := c.call(CmdLockdownRelease, nil)
+	return err
+}
+
 func (c *socketClient) StartQuickScan() (*ScanResponse, error) {
 	resp, err := c.call(CmdScanQuick, nil)
 	if err != nil {
@@ -208,6 +347,65 @@ func (c *socketClient) StartFullScan() (*ScanResponse, error) {
 	return &scanResp, nil
 }
 
+func (c *socketClient) StartCustomScan(paths []string) (*ScanResponse, error) {
+	resp, err := c.call(CmdScanCustom, ScanCustomParams{Paths: paths})
+	if err != nil {
+		return nil, err
+	}
+
+	var scanResp ScanResponse
+	if err := resp.UnmarshalData(&scanResp); err != nil {
+		return nil, err
+	}
+	return &scanResp, nil
+}
+
+func (c *socketClient) ScanStatus(jobID string) (*ScanStatusResponse, error) {
+	resp, err := c.call(CmdScanStatus, ScanJobParams{JobID: jobID})
+	if err != nil {
+		return nil, err
+	}
+
+	var status ScanStatusResponse
+	if err := resp.UnmarshalData(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *socketClient) CancelScan(jobID string) error {
+	_, err := c.call(CmdScanCancel, ScanJobParams{JobID: jobID})
+	return err
+}
+
+func (c *socketClient) ListQuarantine() (*QuarantineListResponse, error) {
+	resp, err := c.call(CmdQuarantineList, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list QuarantineListResponse
+	if err := resp.UnmarshalData(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *socketClient) RestoreQuarantine(id string) error {
+	_, err := c.call(CmdQuarantineRestore, QuarantineParams{ID: id})
+	return err
+}
+
+func (c *socketClient) DeleteQuarantine(id string) error {
+	_, err := c.call(CmdQuarantineDelete, QuarantineParams{ID: id})
+	return err
+}
+
+func (c *socketClient) ResolveThreat(id, action string) error {
+	_, err := c.call(CmdThreatResolve, ThreatResolveParams{ID: id, Action: action})
+	return err
+}
+
 func (c *socketClient) Pause() error {
 	_, err := c.call(CmdPause, nil)
 	return err
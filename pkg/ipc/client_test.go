@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"net"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -138,6 +139,248 @@ func TestClient_SetFirewallEnabled(t *testing.T) {
 	if receivedCmd != CmdFirewallDisable {
 		t.Errorf("command = %v, want %v", receivedCmd, CmdFirewallDisable)
 	}
+
+	if err := client.ConfirmFirewall(); err != nil {
+		t.Fatalf("ConfirmFirewall() error = %v", err)
+	}
+	if receivedCmd != CmdFirewallConfirm {
+		t.Errorf("command = %v, want %v", receivedCmd, CmdFirewallConfirm)
+	}
+}
+
+func TestClient_FirewallProfiles(t *testing.T) {
+	var gotParams FirewallProfileParams
+
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		switch req.Command {
+		case CmdFirewallProfileList:
+			data, _ := json.Marshal(FirewallProfileListResponse{
+				Active:   "home",
+				Profiles: []FirewallProfile{{Name: "home"}, {Name: "public"}},
+			})
+			return &Response{ID: req.ID, Success: true, Data: data}
+		case CmdFirewallProfileSet:
+			json.Unmarshal(req.Params, &gotParams)
+			return &Response{ID: req.ID, Success: true}
+		}
+		t.Errorf("unexpected command: %s", req.Command)
+		return &Response{ID: req.ID, Success: false}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	list, err := client.ListFirewallProfiles()
+	if err != nil {
+		t.Fatalf("ListFirewallProfiles() error = %v", err)
+	}
+	if list.Active != "home" || len(list.Profiles) != 2 {
+		t.Errorf("list = %+v, want active home with 2 profiles", list)
+	}
+
+	if err := client.SetFirewallProfile("public"); err != nil {
+		t.Fatalf("SetFirewallProfile() error = %v", err)
+	}
+	if gotParams.Name != "public" {
+		t.Errorf("params name = %q, want public", gotParams.Name)
+	}
+}
+
+func TestClient_FirewallRules(t *testing.T) {
+	var commands []string
+	var gotParams FirewallRuleParams
+	ssh := FirewallRule{Proto: "tcp", Port: 22, Source: "10.0.0.0/8", Comment: "ssh"}
+
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		commands = append(commands, req.Command)
+		switch req.Command {
+		case CmdFirewallRuleList:
+			data, _ := json.Marshal(FirewallRuleListResponse{Profile: "home", Rules: []FirewallRule{ssh}})
+			return &Response{ID: req.ID, Success: true, Data: data}
+		case CmdFirewallRuleAdd, CmdFirewallRuleRemove:
+			json.Unmarshal(req.Params, &gotParams)
+			return &Response{ID: req.ID, Success: true}
+		}
+		t.Errorf("unexpected command: %s", req.Command)
+		return &Response{ID: req.ID, Success: false}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	list, err := client.ListFirewallRules("")
+	if err != nil {
+		t.Fatalf("ListFirewallRules() error = %v", err)
+	}
+	if list.Profile != "home" || len(list.Rules) != 1 || list.Rules[0] != ssh {
+		t.Errorf("list = %+v, want home with the ssh rule", list)
+	}
+
+	if err := client.AddFirewallRule("home", ssh); err != nil {
+		t.Fatalf("AddFirewallRule() error = %v", err)
+	}
+	if gotParams.Profile != "home" || gotParams.Rule != ssh {
+		t.Errorf("add params = %+v", gotParams)
+	}
+
+	if err := client.RemoveFirewallRule("", ssh); err != nil {
+		t.Fatalf("RemoveFirewallRule() error = %v", err)
+	}
+
+	want := []string{CmdFirewallRuleList, CmdFirewallRuleAdd, CmdFirewallRuleRemove}
+	if len(commands) != len(want) {
+		t.Fatalf("commands = %v, want %v", commands, want)
+	}
+	for i := range want {
+		if commands[i] != want[i] {
+			t.Errorf("commands[%d] = %s, want %s", i, commands[i], want[i])
+		}
+	}
+}
+
+func TestClient_PreviewFirewall(t *testing.T) {
+	var gotParams FirewallPreviewParams
+
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		if req.Command != CmdFirewallPreview {
+			t.Errorf("unexpected command: %s", req.Command)
+		}
+		json.Unmarshal(req.Params, &gotParams)
+		data, _ := json.Marshal(FirewallPreviewResponse{
+			Profile: "home",
+			Changed: true,
+			Diff:    []FirewallDiffLine{{Op: "+", Chain: "input", Text: "tcp dport 22 accept"}},
+		})
+		return &Response{ID: req.ID, Success: true, Data: data}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	pv, err := client.PreviewFirewall(FirewallPreviewParams{
+		Profile: "home",
+		Add:     []FirewallRule{{Proto: "tcp", Port: 22}},
+	})
+	if err != nil {
+		t.Fatalf("PreviewFirewall() error = %v", err)
+	}
+	if !pv.Changed || len(pv.Diff) != 1 || pv.Diff[0].Op != "+" {
+		t.Errorf("preview = %+v", pv)
+	}
+	if gotParams.Profile != "home" || len(gotParams.Add) != 1 {
+		t.Errorf("params = %+v", gotParams)
+	}
+}
+
+func TestClient_FirewallLog(t *testing.T) {
+	var gotParams FirewallLogParams
+
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		if req.Command != CmdFirewallLog {
+			t.Errorf("unexpected command: %s", req.Command)
+		}
+		json.Unmarshal(req.Params, &gotParams)
+		data, _ := json.Marshal(FirewallLogResponse{
+			Drops: []FirewallDrop{{Src: "203.0.113.5", Proto: "tcp", Port: 22, Count: 3}},
+		})
+		return &Response{ID: req.ID, Success: true, Data: data}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	log, err := client.FirewallLog(FirewallLogParams{Limit: 20})
+	if err != nil {
+		t.Fatalf("FirewallLog() error = %v", err)
+	}
+	if len(log.Drops) != 1 || log.Drops[0].Count != 3 {
+		t.Errorf("drops = %+v", log.Drops)
+	}
+	if gotParams.Limit != 20 {
+		t.Errorf("limit = %d, want 20", gotParams.Limit)
+	}
+}
+
+func TestClient_ReloadBlocklists(t *testing.T) {
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		if req.Command != CmdFirewallBlocklistReload {
+			t.Errorf("unexpected command: %s", req.Command)
+		}
+		data, _ := json.Marshal(FirewallBlocklistReloadResponse{
+			Blocklists: []FirewallBlocklist{{Name: "internal", Path: "/etc/oreon/internal.txt", Entries: 12}},
+		})
+		return &Response{ID: req.ID, Success: true, Data: data}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	reload, err := client.ReloadBlocklists()
+	if err != nil {
+		t.Fatalf("ReloadBlocklists() error = %v", err)
+	}
+	if len(reload.Blocklists) != 1 || reload.Blocklists[0].Entries != 12 {
+		t.Errorf("blocklists = %+v", reload.Blocklists)
+	}
+}
+
+func TestClient_FirewallApps(t *testing.T) {
+	var commands []string
+	var gotApp FirewallApp
+	agent := FirewallApp{Exe: "/opt/vendor/bin/agent", Comment: "telemetry"}
+
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		commands = append(commands, req.Command)
+		switch req.Command {
+		case CmdFirewallAppList:
+			data, _ := json.Marshal(FirewallAppListResponse{Apps: []FirewallAppStatus{
+				{FirewallApp: agent, Cgroups: []string{"system.slice/agent.service"}},
+			}})
+			return &Response{ID: req.ID, Success: true, Data: data}
+		case CmdFirewallAppAdd, CmdFirewallAppRemove:
+			json.Unmarshal(req.Params, &gotApp)
+			return &Response{ID: req.ID, Success: true}
+		}
+		t.Errorf("unexpected command: %s", req.Command)
+		return &Response{ID: req.ID, Success: false}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	list, err := client.ListFirewallApps()
+	if err != nil {
+		t.Fatalf("ListFirewallApps() error = %v", err)
+	}
+	if len(list.Apps) != 1 || list.Apps[0].FirewallApp != agent || len(list.Apps[0].Cgroups) != 1 {
+		t.Errorf("list = %+v, want the agent in one cgroup", list)
+	}
+
+	if err := client.AddFirewallApp(agent); err != nil {
+		t.Fatalf("AddFirewallApp() error = %v", err)
+	}
+	if gotApp != agent {
+		t.Errorf("add params = %+v", gotApp)
+	}
+	if err := client.RemoveFirewallApp(agent); err != nil {
+		t.Fatalf("RemoveFirewallApp() error = %v", err)
+	}
+
+	want := []string{CmdFirewallAppList, CmdFirewallAppAdd, CmdFirewallAppRemove}
+	if len(commands) != len(want) {
+		t.Fatalf("commands = %v, want %v", commands, want)
+	}
+	for i := range want {
+		if commands[i] != want[i] {
+			t.Errorf("commands[%d] = %s, want %s", i, commands[i], want[i])
+		}
+	}
 }
 
 func TestClient_StartQuickScan(t *testing.T) {
@@ -162,6 +405,91 @@ func TestClient_StartQuickScan(t *testing.T) {
 	}
 }
 
+func TestClient_ScanStatus(t *testing.T) {
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		var params ScanJobParams
+		json.Unmarshal(req.Params, &params)
+		if req.Command != CmdScanStatus || params.JobID != "quick-123" {
+			t.Errorf("unexpected request: %s %s", req.Command, req.Params)
+		}
+		data, _ := json.Marshal(ScanStatusResponse{JobID: "quick-123", Status: "running", FilesScanned: 7})
+		return &Response{ID: req.ID, Success: true, Data: data}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	status, err := client.ScanStatus("quick-123")
+	if err != nil {
+		t.Fatalf("ScanStatus() error = %v", err)
+	}
+	if status.Status != "running" || status.FilesScanned != 7 {
+		t.Errorf("ScanStatus() = %+v", status)
+	}
+}
+
+func TestClient_Quarantine(t *testing.T) {
+	var received []string
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		var params QuarantineParams
+		json.Unmarshal(req.Params, &params)
+		received = append(received, req.Command+" "+params.ID)
+		var data []byte
+		if req.Command == CmdQuarantineList {
+			data, _ = json.Marshal(QuarantineListResponse{Items: []QuarantineItem{
+				{ID: "abc", Path: "/tmp/eicar.com", Threat: "Eicar-Test-Signature"},
+			}})
+		}
+		return &Response{ID: req.ID, Success: true, Data: data}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	list, err := client.ListQuarantine()
+	if err != nil {
+		t.Fatalf("ListQuarantine() error = %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Path != "/tmp/eicar.com" {
+		t.Errorf("ListQuarantine() = %+v", list)
+	}
+	if err := client.RestoreQuarantine("abc"); err != nil {
+		t.Fatalf("RestoreQuarantine() error = %v", err)
+	}
+	if err := client.DeleteQuarantine("abc"); err != nil {
+		t.Fatalf("DeleteQuarantine() error = %v", err)
+	}
+
+	want := []string{CmdQuarantineList + " ", CmdQuarantineRestore + " abc", CmdQuarantineDelete + " abc"}
+	if strings.Join(received, ",") != strings.Join(want, ",") {
+		t.Errorf("sent %q, want %q", received, want)
+	}
+}
+
+func TestClient_ResolveThreat(t *testing.T) {
+	var received ThreatResolveParams
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		if req.Command != CmdThreatResolve {
+			return &Response{ID: req.ID, Success: false, Error: "unexpected " + req.Command}
+		}
+		json.Unmarshal(req.Params, &received)
+		return &Response{ID: req.ID, Success: true}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	if err := client.ResolveThreat("ask-1", "delete"); err != nil {
+		t.Fatalf("ResolveThreat() error = %v", err)
+	}
+	if received.ID != "ask-1" || received.Action != "delete" {
+		t.Errorf("params = %+v", received)
+	}
+}
+
 func TestClient_PauseResume(t *testing.T) {
 	var receivedCmd string
 
@@ -190,6 +518,33 @@ func TestClient_PauseResume(t *testing.T) {
 	}
 }
 
+func TestClient_Lockdown(t *testing.T) {
+	var receivedCmd string
+
+	sockPath, cleanup := mockIPCServer(t, func(req *Request) *Response {
+		receivedCmd = req.Command
+		return &Response{ID: req.ID, Success: true}
+	})
+	defer cleanup()
+
+	client := NewClient(sockPath)
+	defer client.Close()
+
+	if err := client.Lockdown(); err != nil {
+		t.Fatalf("Lockdown() error = %v", err)
+	}
+	if receivedCmd != CmdLockdown {
+		t.Errorf("command = %v, want %v", receivedCmd, CmdLockdown)
+	}
+
+	if err := client.ReleaseLockdown(); err != nil {
+		t.Fatalf("ReleaseLockdown() error = %v", err)
+	}
+	if receivedCmd != CmdLockdownRelease {
+		t.Errorf("command = %v, want %v", receivedCmd, CmdLockdownRelease)
+	}
+}
+
 func TestClient_Reconnect(t *testing.T) {
 	callCount := 0
 
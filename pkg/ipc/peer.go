@@ -0,0 +1,77 @@
+// oreon/defense · watchthelight <wtl>
+
+package ipc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerCred asks the kernel who is on the other end of a unix socket: the
+// user ID and groups, primary group first.
+func PeerCred(conn net.Conn) (uint32, []uint32, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, nil, fmt.Errorf("socket is not a unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, nil, err
+	}
+	if credErr != nil {
+		return 0, nil, fmt.Errorf("peer credentials: %w", credErr)
+	}
+
+	groups := []uint32{cred.Gid}
+	// supplementary groups aren't in the credentials; without them
+	// checks are just more cautious than they need to be
+	if more, err := procGroups(fmt.Sprintf("/proc/%d/status", cred.Pid)); err == nil {
+		for _, g := range more {
+			if !slices.Contains(groups, g) {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return cred.Uid, groups, nil
+}
+
+// procGroups reads the supplementary groups from /proc/PID/status.
+func procGroups(path string) ([]uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		rest, ok := strings.CutPrefix(sc.Text(), "Groups:")
+		if !ok {
+			continue
+		}
+		var groups []uint32
+		for _, field := range strings.Fields(rest) {
+			g, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(g))
+		}
+		return groups, nil
+	}
+	return nil, sc.Err()
+}
@@ -0,0 +1,48 @@
+// oreon/defense · watchthelight <wtl>
+
+package ipc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCred(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "peer.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	uid, groups, err := PeerCred(conn)
+	if err != nil {
+		t.Fatalf("PeerCred() error = %v", err)
+	}
+	if uid != uint32(os.Getuid()) || len(groups) == 0 || groups[0] != uint32(os.Getgid()) {
+		t.Errorf("PeerCred() = %d, %v, want uid %d with primary group %d", uid, groups, os.Getuid(), os.Getgid())
+	}
+}
+
+func TestProcGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status")
+	os.WriteFile(path, []byte("Name:\tfoo\nGroups:\t10 20 1000 \nNgid:\t0\n"), 0644)
+	groups, err := procGroups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 || groups[0] != 10 || groups[2] != 1000 {
+		t.Errorf("procGroups() = %v, want [10 20 1000]", groups)
+	}
+}
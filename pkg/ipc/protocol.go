@@ -50,18 +50,55 @@ const (
 	CmdResume   = "resume"   // resume protection
 	CmdFirewall = "firewall" // firewall control
 
+	// Emergency lockdown: drop everything but loopback until released
+	CmdLockdown        = "lockdown"
+	CmdLockdownRelease = "lockdown_release"
+
 	// Firewall commands (pan will implement these)
 	CmdFirewallStatus  = "firewall_status"
 	CmdFirewallEnable  = "firewall_enable"
 	CmdFirewallDisable = "firewall_disable"
+	CmdFirewallConfirm = "firewall_confirm" // keep a change made under confirm_timeout
+
+	// Firewall profiles
+	CmdFirewallProfileSet  = "firewall_profile_set"
+	CmdFirewallProfileList = "firewall_profile_list"
+
+	// Firewall port rules
+	CmdFirewallRuleAdd    = "firewall_rule_add"
+	CmdFirewallRuleRemove = "firewall_rule_remove"
+	CmdFirewallRuleList   = "firewall_rule_list"
+
+	// Dry run: render a profile and diff it against the live table
+	CmdFirewallPreview = "firewall_preview"
+
+	// Dropped packets recorded with log_drops
+	CmdFirewallLog = "firewall_log"
+
+	// Re-read the blocklist files named in the config
+	CmdFirewallBlocklistReload = "firewall_blocklist_reload"
+
+	// Per-application outbound blocks
+	CmdFirewallAppAdd    = "firewall_app_add"
+	CmdFirewallAppRemove = "firewall_app_remove"
+	CmdFirewallAppList   = "firewall_app_list"
 
 	// Scan commands
 	CmdScanQuick   = "scan_quick"
 	CmdScanFull    = "scan_full"
+	CmdScanCustom  = "scan_custom" // scan the paths given, as the calling user
 	CmdScanStatus  = "scan_status"
 	CmdScanCancel  = "scan_cancel"
 	CmdScanHistory = "scan_history"
 
+	// Quarantine commands
+	CmdQuarantineList    = "quarantine_list"
+	CmdQuarantineRestore = "quarantine_restore"
+	CmdQuarantineDelete  = "quarantine_delete"
+
+	// Threat remediation
+	CmdThreatResolve = "threat_resolve" // answer a ReasonThreatAsk
+
 	// Rule updates
 	CmdRulesStatus = "rules_status"
 	CmdRulesUpdate = "rules_update"
@@ -71,11 +108,30 @@ const (
 )
 
 // StateChangeEvent is pushed to subscribed clients when state changes.
+// Reason is set when the push isn't a plain state transition, e.g.
+// ReasonFirewallReverted.
 type StateChangeEvent struct {
 	OldState string `json:"old_state"`
 	NewState string `json:"new_state"`
+	Reason   string `json:"reason,omitempty"`
+
+	// Scan is set with ReasonScanProgress.
+	Scan *ScanStatusResponse `json:"scan,omitempty"`
+	// Threat is set with ReasonThreatAsk, which only root and the
+	// file's owner are sent.
+	Threat *ThreatAsk `json:"threat,omitempty"`
+	// Found is set with ReasonThreatFound, sent likewise.
+	Found *ThreatFound `json:"found,omitempty"`
 }
 
+// Reasons attached to StateChangeEvent.
+const (
+	ReasonFirewallReverted = "firewall_reverted" // an unconfirmed change was rolled back
+	ReasonScanProgress     = "scan_progress"     // periodic update on the running scan
+	ReasonThreatAsk        = "threat_ask"        // a threat waits for the user to choose what to do
+	ReasonThreatFound      = "threat_found"      // real-time protection found a threat
+)
+
 // StatusResponse is returned by CmdStatus.
 //
 // Example (josh will use this for tray icon):
@@ -84,10 +140,12 @@ type StateChangeEvent struct {
 //	status := resp.Data.(*StatusResponse)
 //	updateTrayIcon(status.State)
 type StatusResponse struct {
-	State           string    `json:"state"`            // "protected", "warning", etc
-	FirewallEnabled bool      `json:"firewall_enabled"` // pan's firewall integration
-	LastScan        time.Time `json:"last_scan"`
-	RulesUpdated    time.Time `json:"rules_updated"`
+	State              string    `json:"state"`                // "protected", "warning", etc
+	FirewallEnabled    bool      `json:"firewall_enabled"`     // pan's firewall integration
+	FirewallProfile    string    `json:"firewall_profile"`     // active profile name
+	RealTimeProtection bool      `json:"real_time_protection"` // on-access scanning is running
+	LastScan           time.Time `json:"last_scan"`
+	RulesUpdated       time.Time `json:"rules_updated"`
 }
 
 // ScanParams for CmdScan.
@@ -100,14 +158,86 @@ type ScanResponse struct {
 	JobID string `json:"job_id"`
 }
 
-// ScanStatusResponse is returned by CmdScanStatus.
+// ScanCustomParams for CmdScanCustom. Paths must be absolute, and the
+// daemon only scans what the calling user could read themselves.
+type ScanCustomParams struct {
+	Paths []string `json:"paths"`
+}
+
+// ScanJobParams for CmdScanStatus and CmdScanCancel. An empty JobID
+// means the running scan; scan_status falls back to the last one to
+// finish.
+type ScanJobParams struct {
+	JobID string `json:"job_id,omitempty"`
+}
+
+// ScanStatusResponse is returned by CmdScanStatus. Paths and CurrentPath
+// are left out unless the client is root, an admin or started the scan.
 type ScanStatusResponse struct {
 	JobID        string    `json:"job_id"`
-	Status       string    `json:"status"` // "running", "completed", "cancelled"
-	Progress     float64   `json:"progress"`
+	Type         string    `json:"type"`   // "quick", "full" or "custom"
+	Status       string    `json:"status"` // "queued", "running", "completed", "cancelled", "failed"
+	Error        string    `json:"error,omitempty"`
+	Paths        []string  `json:"paths,omitempty"`
+	Progress     float64   `json:"progress"` // 0 to 1, 0 when it can't be estimated yet
 	FilesScanned int       `json:"files_scanned"`
+	BytesScanned int64     `json:"bytes_scanned"`
 	ThreatsFound int       `json:"threats_found"`
+	TotalFiles   int       `json:"total_files,omitempty"` // from the pre-count, once it's done
+	TotalBytes   int64     `json:"total_bytes,omitempty"`
+	CurrentPath  string    `json:"current_path,omitempty"`
+	Queued       int       `json:"queued,omitempty"` // jobs ahead of this one
 	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	ETA          time.Time `json:"eta"` // zero when it can't be estimated
+}
+
+// QuarantineItem is a file held in quarantine.
+type QuarantineItem struct {
+	ID            string    `json:"id"`
+	Path          string    `json:"path"` // where it was found
+	Threat        string    `json:"threat"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	UID           uint32    `json:"uid"`
+	GID           uint32    `json:"gid"`
+	Mode          string    `json:"mode"` // e.g. "-rwxr-xr-x"
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// QuarantineListResponse is returned by CmdQuarantineList, newest first.
+// Only root sees everything; other users see their own files.
+type QuarantineListResponse struct {
+	Items []QuarantineItem `json:"items"`
+}
+
+// QuarantineParams for CmdQuarantineRestore and CmdQuarantineDelete.
+type QuarantineParams struct {
+	ID string `json:"id"`
+}
+
+// ThreatAsk is a threat the daemon is waiting on the user to decide
+// about. If nobody answers by Expires it is quarantined.
+type ThreatAsk struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Threat  string    `json:"threat"`
+	Size    int64     `json:"size"`
+	Expires time.Time `json:"expires"`
+}
+
+// ThreatFound is a threat real-time protection found, and what was done
+// with it.
+type ThreatFound struct {
+	Path   string `json:"path"`
+	Threat string `json:"threat"`
+	Action string `json:"action"` // "detected", "quarantined" or "deleted"
+}
+
+// ThreatResolveParams for CmdThreatResolve.
+type ThreatResolveParams struct {
+	ID     string `json:"id"`
+	Action string `json:"action"` // "report", "quarantine" or "delete"
 }
 
 // PauseParams for CmdPause.
@@ -122,4 +252,161 @@ type FirewallStatusResponse struct {
 	TableCount int  `json:"table_count"`
 	ChainCount int  `json:"chain_count"`
 	RuleCount  int  `json:"rule_count"`
+
+	// ConfirmDeadline is when an unconfirmed change will be reverted;
+	// zero if nothing is waiting for firewall_confirm.
+	ConfirmDeadline time.Time `json:"confirm_deadline"`
+
+	// Lockdown is set while the drop-all ruleset from CmdLockdown is
+	// loaded, whatever Enabled says.
+	Lockdown bool `json:"lockdown,omitempty"`
+
+	Blocklists []FirewallBlocklist `json:"blocklists,omitempty"`
+
+	// Managers are other firewall managers found on the system; Conflict
+	// is the configured strategy for them (coexist, defer or refuse).
+	Managers []FirewallManager `json:"managers,omitempty"`
+	Conflict string            `json:"conflict"`
+}
+
+// FirewallManager reports another firewall manager.
+type FirewallManager struct {
+	Name string   `json:"name"` // firewalld, ufw, or nftables for tables nothing claims
+	Via  []string `json:"via"`  // e.g. "unit firewalld.service", "table ip filter"
+}
+
+// FirewallBlocklist reports one configured blocklist.
+type FirewallBlocklist struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Entries int    `json:"entries"`           // addresses and networks loaded
+	Skipped int    `json:"skipped,omitempty"` // lines that didn't parse
+	Error   string `json:"error,omitempty"`   // the file couldn't be read on the last load
+}
+
+// FirewallProfileParams for CmdFirewallProfileSet.
+type FirewallProfileParams struct {
+	Name string `json:"name"`
+}
+
+// FirewallProfile describes one configured profile.
+type FirewallProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	AllowPing   bool   `json:"allow_ping"`
+	AllowLAN    bool   `json:"allow_lan"`
+	Reject      bool   `json:"reject"`
+}
+
+// FirewallProfileListResponse is returned by CmdFirewallProfileList.
+type FirewallProfileListResponse struct {
+	Active   string            `json:"active"`
+	Profiles []FirewallProfile `json:"profiles"` // sorted by name
+}
+
+// FirewallRule opens a port or port range while a profile is active.
+//
+// Example (allow ssh from the office network):
+//
+//	client.AddFirewallRule("", FirewallRule{Proto: "tcp", Port: 22, Source: "10.0.0.0/8"})
+type FirewallRule struct {
+	Proto     string `json:"proto"`               // "tcp" or "udp"
+	Port      int    `json:"port"`                // first port of the range
+	PortEnd   int    `json:"port_end,omitempty"`  // last port of the range, 0 for a single port
+	Source    string `json:"source,omitempty"`    // remote network (CIDR or address), empty for any
+	Direction string `json:"direction,omitempty"` // "in" (default) or "out"
+	Comment   string `json:"comment,omitempty"`
+}
+
+// FirewallRuleParams for CmdFirewallRuleAdd and CmdFirewallRuleRemove.
+// Remove matches on everything except the comment.
+type FirewallRuleParams struct {
+	Profile string       `json:"profile,omitempty"` // defaults to the active profile
+	Rule    FirewallRule `json:"rule"`
+}
+
+// FirewallRuleListParams for CmdFirewallRuleList.
+type FirewallRuleListParams struct {
+	Profile string `json:"profile,omitempty"` // defaults to the active profile
+}
+
+// FirewallRuleListResponse is returned by CmdFirewallRuleList.
+type FirewallRuleListResponse struct {
+	Profile string         `json:"profile"`
+	Rules   []FirewallRule `json:"rules"`
+}
+
+// FirewallPreviewParams for CmdFirewallPreview. The profile is rendered
+// with Remove and Add applied to its rules, as the matching
+// firewall_rule_* commands would.
+type FirewallPreviewParams struct {
+	Profile string         `json:"profile,omitempty"` // defaults to the active profile
+	Add     []FirewallRule `json:"add,omitempty"`
+	Remove  []FirewallRule `json:"remove,omitempty"`
+}
+
+// FirewallDiffLine is one line of a ruleset diff. Text is a rule, or the
+// chain declaration for the first line of each chain.
+type FirewallDiffLine struct {
+	Op    string `json:"op"` // "+" added, "-" removed, " " unchanged
+	Chain string `json:"chain"`
+	Text  string `json:"text"`
+}
+
+// FirewallPreviewResponse is returned by CmdFirewallPreview.
+type FirewallPreviewResponse struct {
+	Profile string             `json:"profile"`
+	Ruleset string             `json:"ruleset"` // what would be loaded, in nft syntax
+	Changed bool               `json:"changed"` // false if the live table already matches
+	Diff    []FirewallDiffLine `json:"diff"`
+}
+
+// FirewallLogParams for CmdFirewallLog.
+type FirewallLogParams struct {
+	Since time.Time `json:"since,omitempty"` // zero = no lower bound
+	Limit int       `json:"limit,omitempty"` // 0 = server default
+}
+
+// FirewallDrop summarises packets the firewall dropped from one source
+// to one destination port within a reporting window.
+type FirewallDrop struct {
+	Time      time.Time `json:"time"` // end of the window
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	Proto     string    `json:"proto"`
+	Port      int       `json:"port,omitempty"`
+	Interface string    `json:"interface,omitempty"`
+	Count     int       `json:"count"`
+}
+
+// FirewallLogResponse is returned by CmdFirewallLog, newest first.
+type FirewallLogResponse struct {
+	Drops []FirewallDrop `json:"drops"`
+}
+
+// FirewallBlocklistReloadResponse is returned by CmdFirewallBlocklistReload.
+type FirewallBlocklistReloadResponse struct {
+	Blocklists []FirewallBlocklist `json:"blocklists"`
+}
+
+// FirewallApp identifies an application whose outbound traffic is
+// blocked, by cgroup path (wildcards allowed) or by executable. Set
+// exactly one. Params for CmdFirewallAppAdd and CmdFirewallAppRemove;
+// remove ignores the comment.
+type FirewallApp struct {
+	Cgroup  string `json:"cgroup,omitempty"`
+	Exe     string `json:"exe,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// FirewallAppStatus is a blocked app and the cgroups its block currently
+// covers. An app that isn't running covers none.
+type FirewallAppStatus struct {
+	FirewallApp
+	Cgroups []string `json:"cgroups"`
+}
+
+// FirewallAppListResponse is returned by CmdFirewallAppList.
+type FirewallAppListResponse struct {
+	Apps []FirewallAppStatus `json:"apps"`
 }
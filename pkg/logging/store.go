@@ -90,6 +90,7 @@ func (s *LogStore) Insert(entry LogEntry) error {
 type QueryOptions struct {
 	Level     string    // filter by level (empty = all)
 	Component string    // filter by component (empty = all)
+	Message   string    // filter by exact message (empty = all)
 	After     time.Time // only logs after this time (zero = no filter)
 	Before    time.Time // only logs before this time (zero = no filter)
 	Limit     int       // max results (0 = no limit)
@@ -109,6 +110,10 @@ func (s *LogStore) Query(opts QueryOptions) ([]LogEntry, error) {
 		query += ` AND component = ?`
 		args = append(args, opts.Component)
 	}
+	if opts.Message != "" {
+		query += ` AND message = ?`
+		args = append(args, opts.Message)
+	}
 	if !opts.After.IsZero() {
 		query += ` AND timestamp > ?`
 		args = append(args, opts.After)
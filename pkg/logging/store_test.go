@@ -98,6 +98,29 @@ func TestQueryFilterComponent(t *testing.T) {
 	}
 }
 
+func TestQueryFilterMessage(t *testing.T) {
+	store, err := NewLogStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewLogStore: %v", err)
+	}
+	defer store.Close()
+
+	store.Insert(LogEntry{Timestamp: time.Now(), Level: "info", Component: "firewall", Message: "firewall"})
+	store.Insert(LogEntry{Timestamp: time.Now(), Level: "info", Component: "firewall", Message: "firewall_drop"})
+
+	results, err := store.Query(QueryOptions{Component: "firewall", Message: "firewall_drop"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if results[0].Message != "firewall_drop" {
+		t.Errorf("message = %q, want %q", results[0].Message, "firewall_drop")
+	}
+}
+
 func TestQueryLimit(t *testing.T) {
 	store, err := NewLogStore(":memory:")
 	if err != nil {